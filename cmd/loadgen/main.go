@@ -0,0 +1,159 @@
+// loadgen sends synthetic user behavior events to the kinesis data stream or writes them as NDJSON,
+//
+//	go run ./cmd/loadgen -rate 50 -duration 10m -warning 0.05 -burst-every 5m -burst-for 1m -burst-factor 10 -burst-action pay
+//	go run ./cmd/loadgen -count 10000 -seed 42 -out events.ndjson
+//
+// the stream name is the -stream flag or the EventStreamName output of -stack
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"user-behavior-analytics-cdk/loadgen"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+)
+
+var (
+	stream  = flag.String("stream", "", "kinesis data stream name, default is the EventStreamName output of -stack")
+	stack   = flag.String("stack", "KdsSqlKdaLambdaDynamoDBStackForUserBehaviorEvent", "cloudformation stack which outputs EventStreamName")
+	region  = flag.String("region", "", "aws region, default is the sdk default region")
+	out     = flag.String("out", "", "write NDJSON to the file instead of kinesis, - is stdout")
+	retries = flag.Int("retries", 3, "max retries of the throttled records")
+
+	rate     = flag.Float64("rate", 10, "events per second out of a burst")
+	count    = flag.Int("count", 0, "stop after count events, 0 is no limit")
+	duration = flag.Duration("duration", 0, "stop after duration, 0 is no limit")
+	seed     = flag.Int64("seed", 0, "random seed, 0 is a time seed which is logged to repeat the run")
+
+	users   = flag.Int("users", 1000, "user id cardinality")
+	objects = flag.Int("objects", 10000, "object id cardinality")
+	bizs    = flag.Int("bizs", 10, "biz id cardinality")
+	actions = flag.String("actions", strings.Join(loadgen.DefaultActions, ","), "comma separated actions")
+
+	panicFrac   = flag.Float64("panic", 0.001, "fraction of [panic] events")
+	errorFrac   = flag.Float64("error", 0.01, "fraction of [error] events")
+	warningFrac = flag.Float64("warning", 0.02, "fraction of [warning] events")
+
+	burstEvery   = flag.Duration("burst-every", 0, "burst period, 0 is no burst")
+	burstFor     = flag.Duration("burst-for", 10*time.Second, "burst duration at the end of every period")
+	burstFactor  = flag.Float64("burst-factor", 5, "rate multiplier in a burst")
+	burstAction  = flag.String("burst-action", "", "all burst events use this action, e.g. to hit the warn count threshold")
+	burstPanic   = flag.Float64("burst-panic", -1, "fraction of [panic] events in a burst, -1 keeps -panic")
+	burstError   = flag.Float64("burst-error", -1, "fraction of [error] events in a burst, -1 keeps -error")
+	burstWarning = flag.Float64("burst-warning", -1, "fraction of [warning] events in a burst, -1 keeps -warning")
+)
+
+func main() {
+	flag.Parse()
+	// NDJSON on stdout, logs on stderr
+	log.SetOutput(os.Stderr)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	log.Printf("[INFO] seed %d\n", *seed)
+
+	gen, err := loadgen.NewGenerator(generatorConfig(), time.Now())
+	if err != nil {
+		log.Fatalf("[ERROR] %s\n", err.Error())
+	}
+	sink, closer, err := newSink(ctx)
+	if err != nil {
+		log.Fatalf("[ERROR] %s\n", err.Error())
+	}
+	defer closer.Close()
+
+	stats, err := loadgen.Run(ctx, gen, sink, loadgen.RunConfig{Rate: *rate, Count: *count, Duration: *duration})
+	log.Printf("[INFO] generated %d sent %d events, %d bursts\n", stats.Generated, stats.Sent, stats.Bursts)
+	if err != nil {
+		log.Fatalf("[ERROR] %s\n", err.Error())
+	}
+}
+
+func generatorConfig() loadgen.Config {
+	mix := loadgen.Mix{Panic: *panicFrac, Error: *errorFrac, Warning: *warningFrac}
+	cfg := loadgen.Config{
+		Seed:    *seed,
+		Users:   *users,
+		Objects: *objects,
+		Bizs:    *bizs,
+		Actions: strings.Split(*actions, ","),
+		Mix:     mix,
+		Burst: loadgen.Burst{
+			Every:    *burstEvery,
+			Duration: *burstFor,
+			Factor:   *burstFactor,
+			Action:   *burstAction,
+		},
+	}
+	if *burstPanic >= 0 || *burstError >= 0 || *burstWarning >= 0 {
+		burstMix := mix
+		if *burstPanic >= 0 {
+			burstMix.Panic = *burstPanic
+		}
+		if *burstError >= 0 {
+			burstMix.Error = *burstError
+		}
+		if *burstWarning >= 0 {
+			burstMix.Warning = *burstWarning
+		}
+		cfg.Burst.Mix = &burstMix
+	}
+	return cfg
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+func newSink(ctx context.Context) (loadgen.Sink, io.Closer, error) {
+	switch *out {
+	case "-":
+		return &loadgen.NDJSONSink{Writer: os.Stdout}, nopCloser{}, nil
+	case "":
+	default:
+		f, err := os.Create(*out)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &loadgen.NDJSONSink{Writer: f}, f, nil
+	}
+
+	opts := []func(*config.LoadOptions) error{}
+	if len(*region) > 0 {
+		opts = append(opts, config.WithRegion(*region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	streamName := *stream
+	if len(streamName) == 0 {
+		streamName, err = loadgen.StackOutput(ctx, cloudformation.NewFromConfig(cfg), *stack, "EventStreamName")
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w, use -stream", err)
+		}
+	}
+	log.Printf("[INFO] put events into stream %s\n", streamName)
+
+	return &loadgen.KinesisSink{
+		KinesisClient: kinesis.NewFromConfig(cfg),
+		StreamName:    streamName,
+		MaxRetries:    *retries,
+		Backoff:       100 * time.Millisecond,
+	}, nopCloser{}, nil
+}
@@ -0,0 +1,150 @@
+// replay puts the events archived by firehose under raw/ back into the kinesis data stream,
+//
+//	go run ./cmd/replay -bucket <raw data bucket> -prefix raw/2022/11/11/ -from "2022-11-11 08:00:00" -to "2022-11-11 09:00:00" -action pay -rate 200
+//	go run ./cmd/replay -dir ./raw -biz b1 -dry-run > /tmp/events.ndjson, then the TestSimulateEvents of src/lambda/save-alert-from-kda with -events /tmp/events.ndjson
+//
+// the objects are GZIP, Snappy or UNCOMPRESSED, the stream name is the -stream flag or the EventStreamName output of -stack
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"user-behavior-analytics-cdk/loadgen"
+	"user-behavior-analytics-cdk/replay"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// -from/-to layouts, the createdAt layout of the producers and RFC3339
+var timeLayouts = []string{"2006-01-02 15:04:05", "2006-01-02", time.RFC3339}
+
+var (
+	bucket = flag.String("bucket", "", "firehose destination bucket")
+	prefix = flag.String("prefix", "raw/", "object key prefix, e.g. raw/2022/11/11/ for the objects delivered that day(UTC)")
+	dir    = flag.String("dir", "", "read a local copy of the archive instead of -bucket, an explicit -prefix is relative to it")
+
+	stream  = flag.String("stream", "", "target kinesis data stream name, default is the EventStreamName output of -stack")
+	stack   = flag.String("stack", "KdsSqlKdaLambdaDynamoDBStackForUserBehaviorEvent", "cloudformation stack which outputs EventStreamName")
+	region  = flag.String("region", "", "aws region, default is the sdk default region")
+	rate    = flag.Float64("rate", 100, "max events per second, 0 is no limit")
+	retries = flag.Int("retries", 3, "max retries of the throttled records")
+	dryRun  = flag.Bool("dry-run", false, "write the selected events to stdout as NDJSON instead of the stream")
+
+	from    = flag.String("from", "", "select createdAt >= from, e.g. 2022-11-11 08:00:00, UTC")
+	to      = flag.String("to", "", "select createdAt < to")
+	actions = flag.String("action", "", "comma separated actions to select, empty is all")
+	bizIds  = flag.String("biz", "", "comma separated bizIds to select, empty is all")
+)
+
+func main() {
+	flag.Parse()
+	log.SetOutput(os.Stderr)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	filter, err := newFilter()
+	if err != nil {
+		log.Fatalf("[ERROR] %s\n", err.Error())
+	}
+	replayer := &replay.Replayer{Filter: filter, Rate: *rate}
+
+	var cfg aws.Config
+	if len(*dir) == 0 || !*dryRun {
+		opts := []func(*config.LoadOptions) error{}
+		if len(*region) > 0 {
+			opts = append(opts, config.WithRegion(*region))
+		}
+		if cfg, err = config.LoadDefaultConfig(ctx, opts...); err != nil {
+			log.Fatalf("[ERROR] %s\n", err.Error())
+		}
+	}
+
+	switch {
+	case len(*dir) > 0:
+		source := &replay.DirSource{Root: *dir}
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "prefix" {
+				source.Prefix = *prefix
+			}
+		})
+		replayer.Source = source
+	case len(*bucket) > 0:
+		replayer.Source = &replay.S3Source{S3Client: s3.NewFromConfig(cfg), Bucket: *bucket, Prefix: *prefix}
+	default:
+		log.Fatalf("[ERROR] -bucket or -dir is required\n")
+	}
+
+	if *dryRun {
+		replayer.Sink = &loadgen.NDJSONSink{Writer: os.Stdout}
+		replayer.Rate = 0
+	} else {
+		streamName := *stream
+		if len(streamName) == 0 {
+			if streamName, err = loadgen.StackOutput(ctx, cloudformation.NewFromConfig(cfg), *stack, "EventStreamName"); err != nil {
+				log.Fatalf("[ERROR] %s, use -stream\n", err.Error())
+			}
+		}
+		log.Printf("[INFO] replay into stream %s\n", streamName)
+		replayer.Sink = &loadgen.KinesisSink{
+			KinesisClient: kinesis.NewFromConfig(cfg),
+			StreamName:    streamName,
+			MaxRetries:    *retries,
+			Backoff:       100 * time.Millisecond,
+		}
+	}
+
+	stats, err := replayer.Run(ctx)
+	log.Printf("[INFO] %d objects, read %d matched %d sent %d events\n", stats.Objects, stats.Read, stats.Matched, stats.Sent)
+	if err != nil {
+		log.Fatalf("[ERROR] %s\n", err.Error())
+	}
+}
+
+func newFilter() (replay.Filter, error) {
+	filter := replay.Filter{Actions: set(*actions), BizIds: set(*bizIds)}
+	for _, t := range []struct {
+		value string
+		out   *time.Time
+	}{{*from, &filter.From}, {*to, &filter.To}} {
+		if len(t.value) == 0 {
+			continue
+		}
+		parsed, err := parseTime(t.value)
+		if err != nil {
+			return filter, err
+		}
+		*t.out = parsed
+	}
+	return filter, nil
+}
+
+func parseTime(value string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("time %s isn't one of the layouts %v", value, timeLayouts)
+}
+
+func set(csv string) map[string]bool {
+	m := map[string]bool{}
+	for _, v := range strings.Split(csv, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			m[v] = true
+		}
+	}
+	return m
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"strconv"
 	"time"
 	"user-behavior-analytics-cdk/infra"
+	"user-behavior-analytics-cdk/infra/lib"
 
 	"github.com/aws/aws-cdk-go/awscdk/v2"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awskinesis"
@@ -20,7 +24,34 @@ func main() {
 
 	//RedshiftQuickSightStack(app)
 
+	// the anomaly model pipeline of the raw/ archive
+	if sagemaker, _ := app.Node().TryGetContext(jsii.String("sagemaker")).(bool); sagemaker {
+		SageMakerStack(app, kdsKdfS3)
+	}
+
+	// the pyflink window app of the event stream
+	if pyflinkApp, _ := app.Node().TryGetContext(jsii.String("pyflinkApp")).(bool); pyflinkApp {
+		KdsPyFlinkS3Stack(app, kdsKdfS3)
+	}
+
+	// the business db of the order and user tables, the CDC source
+	rdsMysql, _ := app.Node().TryGetContext(jsii.String("rdsMysql")).(bool)
+	dmsCdc, _ := app.Node().TryGetContext(jsii.String("dmsCdc")).(bool)
+	// the flink cdc app jar
+	flinkCdcOpenSearch, _ := app.Node().TryGetContext(jsii.String("flinkCdcOpenSearch")).(string)
+	if rdsMysql || dmsCdc || len(flinkCdcOpenSearch) > 0 {
+		rdsMysqlStack := RdsMysqlStack(app)
+		var dmsKdsStack infra.DmsKdsStack
+		if dmsCdc {
+			dmsKdsStack = DmsKdsStack(app, rdsMysqlStack, kdsKdfS3)
+		}
+		if len(flinkCdcOpenSearch) > 0 {
+			FlinkCdcOpenSearchStack(app, rdsMysqlStack, kdsKdfS3, dmsKdsStack, flinkCdcOpenSearch)
+		}
+	}
+
 	awscdk.Tags_Of(app).Add(jsii.String("version"), jsii.String("1.0"), nil)
+	awscdk.Tags_Of(app).Add(jsii.String("stage"), jsii.String(string(lib.StageProfileOf(app).Stage)), nil)
 	awscdk.Tags_Of(app).Add(jsii.String("project"), jsii.String("user-behavior-analytics"), nil)
 	awscdk.Tags_Of(app).Add(jsii.String("role"), jsii.String("user behavior analytics streamimg and stroage"), nil)
 	awscdk.Tags_Of(app).Add(jsii.String("synthTime"), jsii.String(time.Now().Format("2006-01-02 15:04:05.999")), nil)
@@ -32,9 +63,10 @@ func main() {
 func WorkshopStack(app awscdk.App, eventStream awskinesis.Stream) {
 	infra.NewCdkWsStack(app, "CDK-Workshop-Lambda-KDS-stack", &infra.CdkWsStackProps{
 		StackProps: awscdk.StackProps{
-			Env:         env(),
-			StackName:   jsii.String("CDK-Workshop-lambda-KDS-stack"),
-			Description: jsii.String("some cdk workshop demo constructs to test,then to use it"),
+			Env:                   env(app),
+			TerminationProtection: terminationProtection(app),
+			StackName:             jsii.String("CDK-Workshop-lambda-KDS-stack"),
+			Description:           jsii.String("some cdk workshop demo constructs to test,then to use it"),
 		},
 		EventStream: eventStream,
 	})
@@ -43,9 +75,10 @@ func WorkshopStack(app awscdk.App, eventStream awskinesis.Stream) {
 func WorkshopCICDPipelineStack(app awscdk.App) {
 	infra.NewPipelineStack(app, "WorkshopCICDPipelineCdkStack", &infra.PipelineStackProps{
 		StackProps: awscdk.StackProps{
-			Env:         env(),
-			StackName:   jsii.String("WorkshopCICDPipelineCdkStack"),
-			Description: jsii.String("some cdk workshop pipleline demo"),
+			Env:                   env(app),
+			TerminationProtection: terminationProtection(app),
+			StackName:             jsii.String("WorkshopCICDPipelineCdkStack"),
+			Description:           jsii.String("some cdk workshop pipleline demo"),
 		},
 	})
 }
@@ -53,37 +86,182 @@ func WorkshopCICDPipelineStack(app awscdk.App) {
 func RedshiftQuickSightStack(app awscdk.App) {
 	infra.NewRedshiftQuicksightCdkStack(app, "RedshiftQuickSightStack", &infra.RedshiftQuicksightCdkStackProps{
 		StackProps: awscdk.StackProps{
-			Env:         env(),
-			StackName:   jsii.String("RedshiftQuickSightStack"),
-			Description: jsii.String("deploy Redshift and QuickSight"),
+			Env:                   env(app),
+			TerminationProtection: terminationProtection(app),
+			StackName:             jsii.String("RedshiftQuickSightStack"),
+			Description:           jsii.String("deploy Redshift and QuickSight"),
+		},
+	})
+}
+
+// rdsVpcId context imports the vpc of the business db, env(app) gives it the account and region to look it up
+func RdsMysqlStack(app awscdk.App) infra.RdsMysqlStack {
+	vpcId, _ := app.Node().TryGetContext(jsii.String("rdsVpcId")).(string)
+	return infra.NewRdsMysqlStack(app, "RDS-Mysql-stack", &infra.RdsMysqlStackProps{
+		StackProps: awscdk.StackProps{
+			Env:                   env(app),
+			TerminationProtection: terminationProtection(app),
+			StackName:             jsii.String("RdsMysqlStackForUserBehavior"),
+			Description:           jsii.String("rds mysql business db with ROW binlog as the CDC source"),
+		},
+		VpcId: vpcId,
+	})
+}
+
+// the CDC records go to a dedicated CDC stream, the user behavior event consumers don't read the CDC envelope
+func DmsKdsStack(app awscdk.App, source infra.RdsMysqlStack, kdsKdfS3 infra.KdsKdfS3Stack) infra.DmsKdsStack {
+	props := &infra.DmsKdsStackProps{
+		StackProps: awscdk.StackProps{
+			Env:                   env(app),
+			TerminationProtection: terminationProtection(app),
+			StackName:             jsii.String("DmsKdsStackForUserBehavior"),
+			Description:           jsii.String("dms CDC of the rds mysql business db to aws kinesis data stream"),
+		},
+		Source:        source,
+		EncryptionKey: kdsKdfS3.EncryptionKey(),
+	}
+	return infra.NewDmsKdsStack(app, "DMS-KDS-stack", props)
+}
+
+// searchRoleArns context are the IAM roles of the support teams which search the domain
+// dmsKdsStack is nil without DMS, with it the app uses the vpc endpoints of the DMS stack
+func FlinkCdcOpenSearchStack(app awscdk.App, source infra.RdsMysqlStack, kdsKdfS3 infra.KdsKdfS3Stack, dmsKdsStack infra.DmsKdsStack, codePath string) infra.FlinkCdcOpenSearchStack {
+	searchRoleArns := []string{}
+	if arns, _ := app.Node().TryGetContext(jsii.String("searchRoleArns")).([]interface{}); len(arns) > 0 {
+		for _, arn := range arns {
+			searchRoleArns = append(searchRoleArns, arn.(string))
+		}
+	}
+	stack := infra.NewFlinkCdcOpenSearchStack(app, "FlinkCDC-OpenSearch-stack", &infra.FlinkCdcOpenSearchStackProps{
+		StackProps: awscdk.StackProps{
+			Env:                   env(app),
+			TerminationProtection: terminationProtection(app),
+			StackName:             jsii.String("FlinkCdcOpenSearchStackForUserBehavior"),
+			Description:           jsii.String("managed flink indexes the user behavior events and the mysql CDC into opensearch"),
 		},
+		Source:           source,
+		EventStream:      kdsKdfS3.Stream(),
+		CodePath:         codePath,
+		EncryptionKey:    kdsKdfS3.EncryptionKey(),
+		SearchRoleArns:   searchRoleArns,
+		SkipVpcEndpoints: dmsKdsStack != nil,
 	})
+	if dmsKdsStack != nil {
+		// the jsii stack, not the go struct embedding it
+		stack.AddDependency(awscdk.Stack_Of(dmsKdsStack.ReplicationTask()), jsii.String("vpc endpoints"))
+	}
+	return stack
+}
+
+// pyflinkJarFile context is the kinesis connector jar in src/kinesis-analytics-pyflink, default lib/flink-sql-connector-kinesis_2.12-1.13.2.jar
+func KdsPyFlinkS3Stack(app awscdk.App, kdsKdfS3 infra.KdsKdfS3Stack) infra.KdsPyFlinkS3Stack {
+	jarFile, _ := app.Node().TryGetContext(jsii.String("pyflinkJarFile")).(string)
+	return infra.NewKdsPyFlinkS3Stack(app, "KDS-PyFlink-S3-stack", &infra.KdsPyFlinkS3StackProps{
+		StackProps: awscdk.StackProps{
+			Env:                   env(app),
+			TerminationProtection: terminationProtection(app),
+			StackName:             jsii.String("KdsPyFlinkS3StackForUserBehavior"),
+			Description:           jsii.String("managed flink runs the pyflink window app of the kinesis data stream into s3"),
+		},
+		InputStream:   kdsKdfS3.Stream(),
+		JarFile:       jarFile,
+		EncryptionKey: kdsKdfS3.EncryptionKey(),
+	})
+}
+
+// anomalyEndpointModelPackageArn context is an approved model package version of the sagemaker pipeline, it creates the endpoint
+func SageMakerStack(app awscdk.App, kdsKdfS3 infra.KdsKdfS3Stack) infra.SageMakerStack {
+	modelPackageArn, _ := app.Node().TryGetContext(jsii.String("anomalyEndpointModelPackageArn")).(string)
+	return infra.NewSageMakerStack(app, "SageMaker-stack", &infra.SageMakerStackProps{
+		StackProps: awscdk.StackProps{
+			Env:                   env(app),
+			TerminationProtection: terminationProtection(app),
+			StackName:             jsii.String("SageMakerStackForUserBehavior"),
+			Description:           jsii.String("sagemaker studio, the anomaly model pipeline of the raw event archive and the scoring endpoint"),
+		},
+		RawBucket:               kdsKdfS3.Bucket(),
+		EndpointModelPackageArn: modelPackageArn,
+	})
+}
+
+// with the sagemaker and anomalyEndpointModelPackageArn contexts the alert lambda scores the events by the endpoint,
+// the endpoint name is known before the sagemaker stack, a missing endpoint only logs
+func anomalyEndpointName(app awscdk.App) string {
+	sagemaker, _ := app.Node().TryGetContext(jsii.String("sagemaker")).(bool)
+	modelPackageArn, _ := app.Node().TryGetContext(jsii.String("anomalyEndpointModelPackageArn")).(string)
+	if sagemaker && len(modelPackageArn) > 0 {
+		return infra.AnomalyEndpointName
+	}
+	return ""
+}
+
+// anomalyScoreThreshold context pages the events the endpoint scores at least it, e.g. -c anomalyScoreThreshold=3,
+// none only saves and alerts the score
+func anomalyScoreThreshold(app awscdk.App) float64 {
+	switch threshold := app.Node().TryGetContext(jsii.String("anomalyScoreThreshold")).(type) {
+	case float64:
+		return threshold
+	case string:
+		value, err := strconv.ParseFloat(threshold, 64)
+		if err != nil {
+			panic(fmt.Sprintf("anomalyScoreThreshold context %q is not a number", threshold))
+		}
+		return value
+	}
+	return 0
 }
 
 func KDSStack(app awscdk.App) (infra.KdsKdfS3Stack, awscdk.Stack) {
 	kdsFirehoseS3Stack := infra.NewKdsKdfS3StackForUserBehaviorEvent(app, "KDS-KDF-S3-stack", &infra.KdsKdfS3StackProps{
 		StackProps: awscdk.StackProps{
-			Env:         env(),
-			StackName:   jsii.String("KdsKdfS3StackForUserBehaviorEvent"),
-			Description: jsii.String("aws kinesis data stream for firehose to s3"),
+			Env:                   env(app),
+			TerminationProtection: terminationProtection(app),
+			StackName:             jsii.String("KdsKdfS3StackForUserBehaviorEvent"),
+			Description:           jsii.String("aws kinesis data stream for firehose to s3"),
 		},
 	})
 
 	stack := infra.NewKdsSqlKdaLambdaDynamoDBStack(app, "KDS-KDA-sql-Lambda-DynamoDB-stack", &infra.KdsSqlKdaLambdaDynamoDBStackProps{
 		StackProps: awscdk.StackProps{
-			Env:         env(),
-			StackName:   jsii.String("KdsSqlKdaLambdaDynamoDBStackForUserBehaviorEvent"),
-			Description: jsii.String("use aws kinesis data stream to analytics by sql"),
+			Env:                   env(app),
+			TerminationProtection: terminationProtection(app),
+			StackName:             jsii.String("KdsSqlKdaLambdaDynamoDBStackForUserBehaviorEvent"),
+			Description:           jsii.String("use aws kinesis data stream to analytics by sql"),
 		},
 		UseStream: kdsFirehoseS3Stack.Stream(),
+		// one key of the user data at rest, nil without the kmsEncryption context
+		EncryptionKey:       kdsFirehoseS3Stack.EncryptionKey(),
+		AlertSuppressWindow: awscdk.Duration_Minutes(jsii.Number(5)),
+		// panics get their own window, an error alert of the same action doesn't suppress a page
+		AlertGroupKeys:        []string{"action", "bizId", "severity"},
+		AnomalyEndpointName:   anomalyEndpointName(app),
+		AnomalyScoreThreshold: anomalyScoreThreshold(app),
 	})
 
 	return kdsFirehoseS3Stack, stack
 }
 
+// terminationProtection protects the prod stacks from cdk destroy, the stage is from the stage context e.g. -c stage=prod
+func terminationProtection(app awscdk.App) *bool {
+	return jsii.Bool(lib.StageProfileOf(app).DeletionProtection)
+}
+
 // env determines the AWS environment (account+region) in which our stack is to
 // be deployed. For more information see: https://docs.aws.amazon.com/cdk/latest/guide/environments.html
-func env() *awscdk.Environment {
+// the rdsVpcId context looks up the vpc, so all the stacks get the cli account and region,
+// the stacks which share the rds and the stream must be in one environment
+func env(app awscdk.App) *awscdk.Environment {
+	if vpcId, _ := app.Node().TryGetContext(jsii.String("rdsVpcId")).(string); len(vpcId) > 0 {
+		account, region := os.Getenv("CDK_DEFAULT_ACCOUNT"), os.Getenv("CDK_DEFAULT_REGION")
+		if len(account) == 0 || len(region) == 0 {
+			panic(fmt.Sprintf("rdsVpcId context %s looks up the vpc, it needs CDK_DEFAULT_ACCOUNT and CDK_DEFAULT_REGION of the cdk cli profile", vpcId))
+		}
+		return &awscdk.Environment{
+			Account: jsii.String(account),
+			Region:  jsii.String(region),
+		}
+	}
+
 	// If unspecified, this stack will be "environment-agnostic".
 	// Account/Region-dependent features and context lookups will not work, but a
 	// single synthesized template can be deployed anywhere.
@@ -1,5 +1,223 @@
 package infra
 
+import (
+	"encoding/json"
+	"fmt"
+
+	"user-behavior-analytics-cdk/infra/lib"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsdms"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsec2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskinesis"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskms"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
 /*
 infra: db(RDS-Mysql) --- CDC ---> DMS ---> KDS(kinesis data streams)
+the records are the schema.CdcRecord json envelope, see schema/cdc-envelope.schema.json
 */
+
+type DmsKdsStackProps struct {
+	awscdk.StackProps
+	Source RdsMysqlStack
+	// UseStream is an existing cdc stream, its consumers must read the schema.CdcRecord envelope,
+	// not the user behavior event stream whose kda apps, firehose and glue table read every record as an event.
+	// nil creates the dedicated cdc stream StreamName
+	UseStream  awskinesis.Stream
+	StreamName string
+	// EncryptionKey of the dedicated cdc stream, nil is unencrypted
+	EncryptionKey awskms.IKey
+	// TableRules select the replicated tables, default all tables of the source database
+	TableRules []lib.DmsTableRule
+	// MigrationType full-load-and-cdc (default), full-load or cdc
+	MigrationType string
+	// ReplicationInstanceClass default dms.t3.micro
+	ReplicationInstanceClass string
+	// VpcSubnets of the replication instance, default the subnets of the source db
+	VpcSubnets *awsec2.SubnetSelection
+	// SkipVpcEndpoints doesn't create the kinesis and secrets manager endpoints of an isolated vpc, e.g. the vpc has them
+	SkipVpcEndpoints bool
+	// CreateDmsVpcRole creates dms-vpc-role which DMS needs once per account
+	CreateDmsVpcRole bool
+}
+
+type dmsKdsStack struct {
+	awscdk.Stack
+	stream              awskinesis.Stream
+	replicationInstance awsdms.CfnReplicationInstance
+	replicationTask     awsdms.CfnReplicationTask
+}
+
+func (m *dmsKdsStack) Stream() awskinesis.Stream {
+	return m.stream
+}
+func (m *dmsKdsStack) ReplicationInstance() awsdms.CfnReplicationInstance {
+	return m.replicationInstance
+}
+func (m *dmsKdsStack) ReplicationTask() awsdms.CfnReplicationTask {
+	return m.replicationTask
+}
+
+type DmsKdsStack interface {
+	awscdk.Stack
+	// Stream is the target of the cdc records
+	Stream() awskinesis.Stream
+	ReplicationInstance() awsdms.CfnReplicationInstance
+	ReplicationTask() awsdms.CfnReplicationTask
+}
+
+func NewDmsKdsStack(scope constructs.Construct, id string, props *DmsKdsStackProps) DmsKdsStack {
+	if props == nil || props.Source == nil {
+		panic("DmsKdsStack needs the Source mysql stack")
+	}
+	stack := awscdk.NewStack(scope, &id, &props.StackProps)
+	profile := lib.StageProfileOf(stack)
+	source := props.Source
+	vpc := source.Vpc()
+
+	stream := props.UseStream
+	if stream == nil {
+		streamName := props.StreamName
+		if len(streamName) == 0 {
+			streamName = "UserBehaviorCdcStream"
+		}
+		streamProps := &awskinesis.StreamProps{}
+		if props.EncryptionKey != nil {
+			streamProps.Encryption = awskinesis.StreamEncryption_KMS
+			streamProps.EncryptionKey = props.EncryptionKey
+		}
+		stream = awskinesis.NewStream(stack, jsii.String(streamName), streamProps)
+		stream.ApplyRemovalPolicy(profile.RemovalPolicy)
+	}
+
+	if props.CreateDmsVpcRole {
+		awsiam.NewRole(stack, jsii.String("DmsVpcRole"), &awsiam.RoleProps{
+			RoleName:  jsii.String("dms-vpc-role"),
+			AssumedBy: awsiam.NewServicePrincipal(jsii.String("dms.amazonaws.com"), nil),
+			ManagedPolicies: &[]awsiam.IManagedPolicy{
+				awsiam.ManagedPolicy_FromAwsManagedPolicyName(jsii.String("service-role/AmazonDMSVPCManagementRole")),
+			},
+		})
+	}
+
+	// the replication instance is in the subnets of the source db
+	vpcSubnets := props.VpcSubnets
+	if vpcSubnets == nil {
+		vpcSubnets = source.VpcSubnets()
+	}
+	subnets := vpc.SelectSubnets(vpcSubnets)
+	subnetGroup := awsdms.NewCfnReplicationSubnetGroup(stack, jsii.String("DmsSubnetGroup"), &awsdms.CfnReplicationSubnetGroupProps{
+		ReplicationSubnetGroupDescription: jsii.String("subnets of the mysql cdc replication instance"),
+		SubnetIds:                         subnets.SubnetIds,
+	})
+	securityGroup := awsec2.NewSecurityGroup(stack, jsii.String("DmsSecurityGroup"), &awsec2.SecurityGroupProps{
+		Vpc:         vpc,
+		Description: jsii.String("mysql cdc replication instance"),
+	})
+	if !props.SkipVpcEndpoints {
+		// no nat in the db subnets, the instance puts records and reads the db secret through the endpoints
+		for name, service := range map[string]awsec2.InterfaceVpcEndpointAwsService{
+			"KinesisEndpoint":        awsec2.InterfaceVpcEndpointAwsService_KINESIS_STREAMS(),
+			"SecretsManagerEndpoint": awsec2.InterfaceVpcEndpointAwsService_SECRETS_MANAGER(),
+		} {
+			awsec2.NewInterfaceVpcEndpoint(stack, jsii.String(name), &awsec2.InterfaceVpcEndpointProps{
+				Vpc:     vpc,
+				Service: service,
+				Subnets: &awsec2.SubnetSelection{Subnets: subnets.Subnets},
+			})
+		}
+	}
+
+	replicationInstanceClass := props.ReplicationInstanceClass
+	if len(replicationInstanceClass) == 0 {
+		replicationInstanceClass = "dms.t3.micro"
+	}
+	replicationInstance := awsdms.NewCfnReplicationInstance(stack, jsii.String("DmsReplicationInstance"), &awsdms.CfnReplicationInstanceProps{
+		ReplicationInstanceClass:         jsii.String(replicationInstanceClass),
+		AllocatedStorage:                 jsii.Number(50),
+		ReplicationSubnetGroupIdentifier: subnetGroup.Ref(),
+		VpcSecurityGroupIds:              &[]*string{securityGroup.SecurityGroupId()},
+		PubliclyAccessible:               jsii.Bool(false),
+		MultiAz:                          jsii.Bool(profile.Stage == lib.StageProd),
+	})
+
+	// the regional dms principal reads the secret, https://docs.aws.amazon.com/dms/latest/userguide/security_iam_secretsmanager.html
+	secretAccessRole := awsiam.NewRole(stack, jsii.String("DmsSecretAccessRole"), &awsiam.RoleProps{
+		AssumedBy: awsiam.NewServicePrincipal(jsii.String(fmt.Sprintf("dms.%s.amazonaws.com", *stack.Region())), nil),
+	})
+	source.Secret().GrantRead(secretAccessRole, nil)
+	sourceEndpoint := awsdms.NewCfnEndpoint(stack, jsii.String("MysqlSourceEndpoint"), &awsdms.CfnEndpointProps{
+		EndpointType: jsii.String("source"),
+		EngineName:   jsii.String("mysql"),
+		MySqlSettings: &awsdms.CfnEndpoint_MySqlSettingsProperty{
+			SecretsManagerSecretId:      source.Secret().SecretArn(),
+			SecretsManagerAccessRoleArn: secretAccessRole.RoleArn(),
+		},
+	})
+
+	streamAccessRole := awsiam.NewRole(stack, jsii.String("DmsStreamAccessRole"), &awsiam.RoleProps{
+		AssumedBy: awsiam.NewServicePrincipal(jsii.String("dms.amazonaws.com"), nil),
+	})
+	stream.GrantWrite(streamAccessRole)
+	stream.Grant(streamAccessRole, jsii.String("kinesis:DescribeStream"))
+	targetEndpoint := awsdms.NewCfnEndpoint(stack, jsii.String("KinesisTargetEndpoint"), &awsdms.CfnEndpointProps{
+		EndpointType: jsii.String("target"),
+		EngineName:   jsii.String("kinesis"),
+		KinesisSettings: &awsdms.CfnEndpoint_KinesisSettingsProperty{
+			StreamArn:            stream.StreamArn(),
+			ServiceAccessRoleArn: streamAccessRole.RoleArn(),
+			// the schema.CdcRecord envelope, one json record per row change
+			MessageFormat:               jsii.String("json-unformatted"),
+			IncludeTransactionDetails:   jsii.Bool(true),
+			IncludePartitionValue:       jsii.Bool(true),
+			PartitionIncludeSchemaTable: jsii.Bool(true),
+			IncludeTableAlterOperations: jsii.Bool(true),
+			IncludeControlDetails:       jsii.Bool(true),
+			IncludeNullAndEmpty:         jsii.Bool(true),
+		},
+	})
+
+	tableRules := props.TableRules
+	if len(tableRules) == 0 {
+		tableRules = []lib.DmsTableRule{{Schema: source.DatabaseName(), Table: "%"}}
+	}
+	migrationType := props.MigrationType
+	if len(migrationType) == 0 {
+		migrationType = "full-load-and-cdc"
+	}
+	taskSettings, err := json.Marshal(map[string]interface{}{
+		"Logging": map[string]interface{}{"EnableLogging": true},
+		// before-image of the updates
+		"BeforeImageSettings": map[string]interface{}{"EnableBeforeImage": true, "FieldName": "before-image", "ColumnFilter": "all"},
+	})
+	if err != nil {
+		panic(err.Error())
+	}
+	replicationTask := awsdms.NewCfnReplicationTask(stack, jsii.String("MysqlCdcTask"), &awsdms.CfnReplicationTaskProps{
+		MigrationType:           jsii.String(migrationType),
+		ReplicationInstanceArn:  replicationInstance.Ref(),
+		SourceEndpointArn:       sourceEndpoint.Ref(),
+		TargetEndpointArn:       targetEndpoint.Ref(),
+		TableMappings:           jsii.String(lib.DmsTableMappings(tableRules)),
+		ReplicationTaskSettings: jsii.String(string(taskSettings)),
+	})
+
+	awscdk.NewCfnOutput(stack, jsii.String("CdcStreamName"), &awscdk.CfnOutputProps{
+		Value: stream.StreamName(),
+	})
+	awscdk.NewCfnOutput(stack, jsii.String("CdcReplicationTaskArn"), &awscdk.CfnOutputProps{
+		Value:       replicationTask.Ref(),
+		Description: jsii.String("aws dms start-replication-task --start-replication-task-type start-replication --replication-task-arn <arn>"),
+	})
+
+	return &dmsKdsStack{
+		Stack:               stack,
+		stream:              stream,
+		replicationInstance: replicationInstance,
+		replicationTask:     replicationTask,
+	}
+}
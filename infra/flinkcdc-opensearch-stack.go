@@ -1 +1,310 @@
 package infra
+
+import (
+	"encoding/json"
+
+	"user-behavior-analytics-cdk/infra/lib"
+	"user-behavior-analytics-cdk/schema"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsec2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskinesis"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskms"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsopensearchservice"
+	"github.com/aws/aws-cdk-go/awscdk/v2/customresources"
+	awscdklambdago "github.com/aws/aws-cdk-go/awscdklambdagoalpha/v2"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+/*
+infra: db(RDS-Mysql) --- Flink CDC ---|
+                                      |---> Managed Flink ---> OpenSearch
+KDS(user behavior event stream) ------|
+the events are indexed into user-behavior-event, the row changes into cdc-<table> as the schema.CdcRecord envelope
+*/
+
+const (
+	EventIndex     = "user-behavior-event"
+	CdcIndexPrefix = "cdc-"
+)
+
+type FlinkCdcOpenSearchStackProps struct {
+	awscdk.StackProps
+	// Source is the CDC mysql, the app and the domain are in its vpc
+	Source RdsMysqlStack
+	// EventStream is the user behavior event stream, e.g. KdsKdfS3Stack.Stream()
+	EventStream awskinesis.IStream
+	// CodePath is the flink cdc app jar relative to the cdk app dir, it isn't in this repo, it reads the property groups
+	// EventSource, MySqlCdcSource and OpenSearchSink, see src/flink-cdc-opensearch/readme.md
+	CodePath string
+	// CdcTables is the flink cdc table-list regex, default <db>.*
+	CdcTables string
+	// VpcSubnets of the app and the domain, default the subnets of the source db, one per az
+	VpcSubnets *awsec2.SubnetSelection
+	// SkipVpcEndpoints doesn't create the kinesis and secrets manager endpoints, e.g. the DmsKdsStack created them
+	SkipVpcEndpoints bool
+	// DataNodeInstanceType default m6g.large.search, DataNodes default 2 in 2 azs, VolumeSize GiB default 20
+	DataNodeInstanceType string
+	DataNodes            int
+	VolumeSize           int
+	// EncryptionKey of the domain at rest, nil is the aws managed key
+	EncryptionKey awskms.IKey
+	// SearchRoleArns are the IAM roles of the support teams, mapped to the read only user_behavior_reader role
+	SearchRoleArns []string
+	// CreateServiceLinkedRole creates the opensearch service linked role a vpc domain needs once per account
+	CreateServiceLinkedRole bool
+}
+
+type flinkCdcOpenSearchStack struct {
+	awscdk.Stack
+	domain   awsopensearchservice.Domain
+	flinkApp lib.IFlinkAppConstruct
+}
+
+func (m *flinkCdcOpenSearchStack) Domain() awsopensearchservice.Domain {
+	return m.domain
+}
+func (m *flinkCdcOpenSearchStack) FlinkApp() lib.IFlinkAppConstruct {
+	return m.flinkApp
+}
+
+type FlinkCdcOpenSearchStack interface {
+	awscdk.Stack
+	Domain() awsopensearchservice.Domain
+	FlinkApp() lib.IFlinkAppConstruct
+}
+
+// jsonString marshals a document of the setup custom resource, the tokens in it are resolved by cdk
+func jsonString(doc interface{}) string {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		panic(err.Error())
+	}
+	return string(data)
+}
+
+func NewFlinkCdcOpenSearchStack(scope constructs.Construct, id string, props *FlinkCdcOpenSearchStackProps) FlinkCdcOpenSearchStack {
+	if props == nil || props.Source == nil || props.EventStream == nil {
+		panic("FlinkCdcOpenSearchStack needs the Source mysql stack and the EventStream")
+	}
+	stack := awscdk.NewStack(scope, &id, &props.StackProps)
+	profile := lib.StageProfileOf(stack)
+	source := props.Source
+	vpc := source.Vpc()
+
+	vpcSubnets := props.VpcSubnets
+	if vpcSubnets == nil {
+		dbSubnets := *source.VpcSubnets()
+		dbSubnets.OnePerAz = jsii.Bool(true)
+		vpcSubnets = &dbSubnets
+	}
+	subnets := vpc.SelectSubnets(vpcSubnets)
+	if !props.SkipVpcEndpoints {
+		// no nat in the db subnets, the app reads the events and the db secret through the endpoints
+		for name, service := range map[string]awsec2.InterfaceVpcEndpointAwsService{
+			"KinesisEndpoint":        awsec2.InterfaceVpcEndpointAwsService_KINESIS_STREAMS(),
+			"SecretsManagerEndpoint": awsec2.InterfaceVpcEndpointAwsService_SECRETS_MANAGER(),
+		} {
+			awsec2.NewInterfaceVpcEndpoint(stack, jsii.String(name), &awsec2.InterfaceVpcEndpointProps{
+				Vpc:     vpc,
+				Service: service,
+				Subnets: &awsec2.SubnetSelection{Subnets: subnets.Subnets},
+			})
+		}
+	}
+
+	// the setup function is the domain master user, it puts the index templates and the security roles
+	setupLambda := awscdklambdago.NewGoFunction(stack, jsii.String("UserBehaviorAnalytics-SetupOpenSearchFunc"), &awscdklambdago.GoFunctionProps{
+		Description: jsii.String("puts the index templates and the fine-grained access control roles into the user behavior search domain"),
+		Entry:       jsii.String("src/lambda/setup-opensearch"),
+		Timeout:     awscdk.Duration_Minutes(jsii.Number(2)),
+		Vpc:         vpc,
+		VpcSubnets:  &awsec2.SubnetSelection{Subnets: subnets.Subnets},
+		Environment: &map[string]*string{
+			"REGION": stack.Region(),
+		},
+	})
+
+	domainSecurityGroup := awsec2.NewSecurityGroup(stack, jsii.String("SearchDomainSecurityGroup"), &awsec2.SecurityGroupProps{
+		Vpc:         vpc,
+		Description: jsii.String("user behavior search domain from the vpc"),
+	})
+	domainSecurityGroup.AddIngressRule(awsec2.Peer_Ipv4(vpc.VpcCidrBlock()), awsec2.Port_Tcp(jsii.Number(443)), jsii.String("Allow https from the vpc"), nil)
+
+	dataNodeInstanceType := props.DataNodeInstanceType
+	if len(dataNodeInstanceType) == 0 {
+		dataNodeInstanceType = "m6g.large.search"
+	}
+	dataNodes := props.DataNodes
+	if dataNodes <= 0 {
+		dataNodes = 2
+	}
+	volumeSize := props.VolumeSize
+	if volumeSize <= 0 {
+		volumeSize = 20
+	}
+	domain := awsopensearchservice.NewDomain(stack, jsii.String("SearchDomain"), &awsopensearchservice.DomainProps{
+		Version:        awsopensearchservice.EngineVersion_OPENSEARCH_1_3(),
+		Vpc:            vpc,
+		VpcSubnets:     &[]*awsec2.SubnetSelection{{Subnets: subnets.Subnets}},
+		SecurityGroups: &[]awsec2.ISecurityGroup{domainSecurityGroup},
+		Capacity: &awsopensearchservice.CapacityConfig{
+			DataNodes:            jsii.Number(float64(dataNodes)),
+			DataNodeInstanceType: jsii.String(dataNodeInstanceType),
+		},
+		Ebs: &awsopensearchservice.EbsOptions{
+			VolumeSize: jsii.Number(float64(volumeSize)),
+			VolumeType: awsec2.EbsDeviceVolumeType_GP3,
+		},
+		ZoneAwareness: &awsopensearchservice.ZoneAwarenessConfig{
+			Enabled:               jsii.Bool(len(*subnets.SubnetIds) > 1),
+			AvailabilityZoneCount: jsii.Number(float64(len(*subnets.SubnetIds))),
+		},
+		EnforceHttps:         jsii.Bool(true),
+		TlsSecurityPolicy:    awsopensearchservice.TLSSecurityPolicy_TLS_1_2,
+		NodeToNodeEncryption: jsii.Bool(true),
+		EncryptionAtRest: &awsopensearchservice.EncryptionAtRestOptions{
+			Enabled: jsii.Bool(true),
+			KmsKey:  props.EncryptionKey,
+		},
+		FineGrainedAccessControl: &awsopensearchservice.AdvancedSecurityOptions{
+			MasterUserArn: setupLambda.Role().RoleArn(),
+		},
+		RemovalPolicy: profile.RemovalPolicy,
+	})
+	if props.CreateServiceLinkedRole {
+		serviceLinkedRole := awsiam.NewCfnServiceLinkedRole(stack, jsii.String("OpenSearchServiceLinkedRole"), &awsiam.CfnServiceLinkedRoleProps{
+			AwsServiceName: jsii.String("opensearchservice.amazonaws.com"),
+		})
+		domain.Node().AddDependency(serviceLinkedRole)
+	}
+
+	cdcTables := props.CdcTables
+	if len(cdcTables) == 0 {
+		cdcTables = source.DatabaseName() + ".*"
+	}
+	flinkApp := lib.NewFlinkAppConstruct(stack, "FlinkCdcOpenSearchApp", &lib.FlinkAppProps{
+		ApplicationName: "UserBehaviorFlinkCdcOpenSearch",
+		Description:     "indexes the user behavior events and the mysql row changes into opensearch",
+		CodePath:        props.CodePath,
+		PropertyGroups: map[string]map[string]string{
+			"EventSource": {
+				"stream.name":          *props.EventStream.StreamName(),
+				"aws.region":           *stack.Region(),
+				"flink.stream.initpos": "LATEST",
+			},
+			// username and password are in the secret
+			"MySqlCdcSource": {
+				"hostname":      *source.Instance().DbInstanceEndpointAddress(),
+				"port":          *source.Instance().DbInstanceEndpointPort(),
+				"database.name": source.DatabaseName(),
+				"table.list":    cdcTables,
+				"secret.arn":    *source.Secret().SecretArn(),
+			},
+			"OpenSearchSink": {
+				"endpoint":         "https://" + *domain.DomainEndpoint(),
+				"aws.region":       *stack.Region(),
+				"event.index":      EventIndex,
+				"cdc.index.prefix": CdcIndexPrefix,
+			},
+		},
+		Vpc:        vpc,
+		VpcSubnets: &awsec2.SubnetSelection{Subnets: subnets.Subnets},
+		Profile:    profile,
+	})
+
+	// IAM lets the principals in, the fine-grained access control roles scope the indices
+	writers := []awsiam.IPrincipal{setupLambda.Role(), flinkApp.Role()}
+	domain.AddAccessPolicies(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Principals: &writers,
+		Actions:    &[]*string{jsii.String("es:ESHttp*")},
+		Resources:  &[]*string{jsii.String(*domain.DomainArn() + "/*")},
+	}))
+	indexPatterns := []string{EventIndex + "*", CdcIndexPrefix + "*"}
+	roles := map[string]string{
+		"user_behavior_writer": jsonString(map[string]interface{}{
+			"cluster_permissions": []string{"cluster_monitor", "cluster_composite_ops"},
+			"index_permissions": []interface{}{map[string]interface{}{
+				"index_patterns":  indexPatterns,
+				"allowed_actions": []string{"crud", "create_index", "indices:admin/mapping/put"},
+			}},
+		}),
+		"user_behavior_reader": jsonString(map[string]interface{}{
+			"cluster_permissions": []string{"cluster_composite_ops_ro"},
+			"index_permissions": []interface{}{map[string]interface{}{
+				"index_patterns":  indexPatterns,
+				"allowed_actions": []string{"read"},
+			}},
+		}),
+	}
+	rolesMapping := map[string]string{
+		"user_behavior_writer": jsonString(map[string]interface{}{"backend_roles": []string{*flinkApp.Role().RoleArn()}}),
+	}
+	if len(props.SearchRoleArns) > 0 {
+		readers := make([]awsiam.IPrincipal, len(props.SearchRoleArns))
+		for i, arn := range props.SearchRoleArns {
+			readers[i] = awsiam.NewArnPrincipal(jsii.String(arn))
+		}
+		domain.AddAccessPolicies(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+			Principals: &readers,
+			Actions:    &[]*string{jsii.String("es:ESHttpGet"), jsii.String("es:ESHttpHead"), jsii.String("es:ESHttpPost")},
+			Resources:  &[]*string{jsii.String(*domain.DomainArn() + "/*")},
+		}))
+		rolesMapping["user_behavior_reader"] = jsonString(map[string]interface{}{"backend_roles": props.SearchRoleArns})
+	}
+
+	eventTemplate, err := schema.UserBehaviorEventSchema.OpenSearchIndexTemplate(EventIndex + "*")
+	if err != nil {
+		panic(err.Error())
+	}
+	cdcTemplate, err := schema.CdcOpenSearchIndexTemplate(CdcIndexPrefix + "*")
+	if err != nil {
+		panic(err.Error())
+	}
+	// the provider framework function is out of the vpc, it answers cloudformation for the setup function
+	setupProvider := customresources.NewProvider(stack, jsii.String("SetupOpenSearchProvider"), &customresources.ProviderProps{
+		OnEventHandler: setupLambda,
+	})
+	setup := awscdk.NewCustomResource(stack, jsii.String("SetupOpenSearch"), &awscdk.CustomResourceProps{
+		ServiceToken: setupProvider.ServiceToken(),
+		Properties: &map[string]interface{}{
+			"Endpoint": "https://" + *domain.DomainEndpoint(),
+			"IndexTemplates": map[string]string{
+				EventIndex: string(eventTemplate),
+				"cdc":      string(cdcTemplate),
+			},
+			"Roles":        roles,
+			"RolesMapping": rolesMapping,
+		},
+	})
+	// the access policies are applied after the domain
+	setup.Node().AddDependency(domain)
+
+	// the app role reads the sources, writes are granted by the user_behavior_writer mapping
+	props.EventStream.GrantRead(flinkApp.Role())
+	props.EventStream.Grant(flinkApp.Role(), jsii.String("kinesis:DescribeStream"))
+	source.Secret().GrantRead(flinkApp.Role(), nil)
+	cfnApplication := flinkApp.Application()
+	// the app writes after its role is mapped
+	cfnApplication.Node().AddDependency(setup)
+
+	awscdk.NewCfnOutput(stack, jsii.String("SearchDomainEndpoint"), &awscdk.CfnOutputProps{
+		Value: domain.DomainEndpoint(),
+	})
+	awscdk.NewCfnOutput(stack, jsii.String("SearchDashboardsUrl"), &awscdk.CfnOutputProps{
+		Value:       jsii.String("https://" + *domain.DomainEndpoint() + "/_dashboards"),
+		Description: jsii.String("in the vpc only, no dashboards sign-in is configured, the SearchRoleArns query the domain api with SigV4 signed requests"),
+	})
+	awscdk.NewCfnOutput(stack, jsii.String("FlinkApplicationName"), &awscdk.CfnOutputProps{
+		Value:       cfnApplication.Ref(),
+		Description: jsii.String("aws kinesisanalyticsv2 start-application --application-name <name> --run-configuration '{}'"),
+	})
+
+	return &flinkCdcOpenSearchStack{
+		Stack:    stack,
+		domain:   domain,
+		flinkApp: flinkApp,
+	}
+}
@@ -2,9 +2,11 @@ package infra
 
 import (
 	"user-behavior-analytics-cdk/infra/lib"
+	"user-behavior-analytics-cdk/schema"
 
 	"github.com/aws/aws-cdk-go/awscdk/v2"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awskinesis"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskms"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
 	"github.com/aws/constructs-go/constructs/v10"
 	"github.com/aws/jsii-runtime-go"
@@ -17,6 +19,7 @@ type kdsKdfS3Stack struct {
 	awscdk.Stack
 	stream awskinesis.Stream
 	bucket awss3.Bucket
+	key    awskms.IKey
 }
 
 func (m *kdsKdfS3Stack) Stream() awskinesis.Stream {
@@ -25,11 +28,16 @@ func (m *kdsKdfS3Stack) Stream() awskinesis.Stream {
 func (m *kdsKdfS3Stack) Bucket() awss3.Bucket {
 	return m.bucket
 }
+func (m *kdsKdfS3Stack) EncryptionKey() awskms.IKey {
+	return m.key
+}
 
 type KdsKdfS3Stack interface {
 	awscdk.Stack
 	Stream() awskinesis.Stream
 	Bucket() awss3.Bucket
+	// EncryptionKey of the stream and bucket, nil without kmsEncryption
+	EncryptionKey() awskms.IKey
 }
 
 func NewKdsKdfS3StackForUserBehaviorEvent(scope constructs.Construct, id string, props *KdsKdfS3StackProps) KdsKdfS3Stack {
@@ -41,11 +49,30 @@ func NewKdsKdfS3StackForUserBehaviorEvent(scope constructs.Construct, id string,
 	stack := awscdk.NewStack(scope, &id, &sprops)
 	streamName := stack.Node().TryGetContext(jsii.String("kinesisDataStreamName")).(string)
 	compressionFormat := stack.Node().TryGetContext(jsii.String("s3CompressionFormat")).(string)
+	// optional, dt=/hour=/bizId= partitions and PARQUET or ORC files for athena
+	dynamicPartitioning, _ := stack.Node().TryGetContext(jsii.String("firehoseDynamicPartitioning")).(bool)
+	recordFormat, _ := stack.Node().TryGetContext(jsii.String("firehoseRecordFormat")).(string)
+	// optional, a KMS CMK for the user data at rest
+	encrypt, _ := stack.Node().TryGetContext(jsii.String("kmsEncryption")).(bool)
+	profile := lib.StageProfileOf(stack)
 
 	kdsFirehoseS3Construct := lib.NewKdsFirehoseS3Construct(stack, "KdsFirehoseS3Construct", &lib.KdsFirehoseS3Props{
-		StreamName:        streamName,
-		CompressionFormat: compressionFormat,
+		StreamName:          streamName,
+		CompressionFormat:   compressionFormat,
+		DynamicPartitioning: dynamicPartitioning,
+		RecordFormat:        recordFormat,
+		Columns:             glueColumnsOf(schema.UserBehaviorEventSchema),
+		Encrypt:             encrypt,
+		Profile:             profile,
 	})
+	// athena can't split the concatenated raw json records of the default archive
+	if dynamicPartitioning || len(recordFormat) > 0 {
+		lib.NewGlueAthenaConstruct(stack, "GlueAthenaConstruct", &lib.GlueAthenaProps{
+			Firehose: kdsFirehoseS3Construct,
+			Columns:  glueColumnsOf(schema.UserBehaviorEventSchema),
+			Profile:  profile,
+		})
+	}
 
-	return &kdsKdfS3Stack{stream: kdsFirehoseS3Construct.Stream(), bucket: kdsFirehoseS3Construct.Bucket()}
+	return &kdsKdfS3Stack{stream: kdsFirehoseS3Construct.Stream(), bucket: kdsFirehoseS3Construct.Bucket(), key: kdsFirehoseS3Construct.EncryptionKey()}
 }
@@ -0,0 +1,106 @@
+package infra
+
+import (
+	"user-behavior-analytics-cdk/infra/lib"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskinesis"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskms"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+/*
+infra: KDS ---> Managed Flink(pyflink tumbling window) ---> S3(csv)
+*/
+
+type KdsPyFlinkS3StackProps struct {
+	awscdk.StackProps
+	// InputStream is read by the app, e.g. KdsKdfS3Stack.Stream()
+	InputStream awskinesis.IStream
+	// CodePath is the dir of the script and its lib/ connector jars, default src/kinesis-analytics-pyflink
+	CodePath string
+	// JarFile is the connector jar in CodePath, default lib/flink-sql-connector-kinesis_2.12-1.13.2.jar
+	JarFile string
+	// EncryptionKey of the output bucket, nil is S3 managed
+	EncryptionKey awskms.IKey
+	// Parallelism default 1, AutoScaling scales it by the cpu
+	Parallelism int
+	AutoScaling bool
+}
+
+type kdsPyFlinkS3Stack struct {
+	awscdk.Stack
+	flinkApp     lib.IFlinkAppConstruct
+	outputBucket awss3.Bucket
+}
+
+func (m *kdsPyFlinkS3Stack) FlinkApp() lib.IFlinkAppConstruct {
+	return m.flinkApp
+}
+func (m *kdsPyFlinkS3Stack) OutputBucket() awss3.Bucket {
+	return m.outputBucket
+}
+
+type KdsPyFlinkS3Stack interface {
+	awscdk.Stack
+	FlinkApp() lib.IFlinkAppConstruct
+	OutputBucket() awss3.Bucket
+}
+
+func NewKdsPyFlinkS3Stack(scope constructs.Construct, id string, props *KdsPyFlinkS3StackProps) KdsPyFlinkS3Stack {
+	if props == nil || props.InputStream == nil {
+		panic("KdsPyFlinkS3Stack needs the InputStream")
+	}
+	stack := awscdk.NewStack(scope, &id, &props.StackProps)
+	profile := lib.StageProfileOf(stack)
+
+	codePath := props.CodePath
+	if len(codePath) == 0 {
+		codePath = "src/kinesis-analytics-pyflink"
+	}
+	jarFile := props.JarFile
+	if len(jarFile) == 0 {
+		jarFile = "lib/flink-sql-connector-kinesis_2.12-1.13.2.jar"
+	}
+
+	outputBucketProps := &awss3.BucketProps{
+		BlockPublicAccess: awss3.BlockPublicAccess_BLOCK_ALL(),
+		Encryption:        awss3.BucketEncryption_S3_MANAGED,
+		EnforceSSL:        jsii.Bool(true),
+	}
+	if props.EncryptionKey != nil {
+		outputBucketProps.Encryption = awss3.BucketEncryption_KMS
+		outputBucketProps.EncryptionKey = props.EncryptionKey
+	}
+	profile.ApplyBucketProps(outputBucketProps, false)
+	outputBucket := awss3.NewBucket(stack, jsii.String("OutputBucket"), outputBucketProps)
+
+	flinkApp := lib.NewPyFlinkAppConstruct(stack, "PyFlinkApp", &lib.PyFlinkAppProps{
+		ApplicationName:    "UserBehaviorPyFlinkWindow",
+		Description:        "pyflink tumbling window of the kinesis data stream into s3",
+		CodePath:           codePath,
+		JarFile:            jarFile,
+		InputStream:        props.InputStream,
+		OutputBucket:       outputBucket,
+		Parallelism:        props.Parallelism,
+		AutoScaling:        props.AutoScaling,
+		CheckpointInterval: awscdk.Duration_Minutes(jsii.Number(1)),
+		Profile:            profile,
+	})
+
+	awscdk.NewCfnOutput(stack, jsii.String("PyFlinkApplicationName"), &awscdk.CfnOutputProps{
+		Value:       flinkApp.Application().Ref(),
+		Description: jsii.String("aws kinesisanalyticsv2 start-application --application-name <name> --run-configuration '{}'"),
+	})
+	awscdk.NewCfnOutput(stack, jsii.String("PyFlinkOutputBucketName"), &awscdk.CfnOutputProps{
+		Value: outputBucket.BucketName(),
+	})
+
+	return &kdsPyFlinkS3Stack{
+		Stack:        stack,
+		flinkApp:     flinkApp,
+		outputBucket: outputBucket,
+	}
+}
@@ -1,13 +1,21 @@
 package infra
 
 import (
-	"os"
+	"user-behavior-analytics-cdk/infra/lib"
+	"user-behavior-analytics-cdk/schema"
+
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/aws/aws-cdk-go/awscdk/v2"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsdynamodb"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsevents"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awseventstargets"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awskinesis"
-	"github.com/aws/aws-cdk-go/awscdk/v2/awskinesisanalytics"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskms"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awssns"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awssnssubscriptions"
 
@@ -21,6 +29,23 @@ type KdsSqlKdaLambdaDynamoDBStackProps struct {
 	awscdk.StackProps
 	StreamName string
 	UseStream  awskinesis.Stream
+	// AlertSuppressWindow sends the first alert of a group immediately and rolls up the others
+	// in the window into a digest sent every window, nil sends every alert. it's whole minutes, at least 1 minute.
+	AlertSuppressWindow awscdk.Duration
+	// AlertGroupKeys are the event json field names to group alerts, default action, bizId and severity
+	AlertGroupKeys []string
+	// WarnCountThreshold alerts an action which has at least WarnCountThreshold warnings in one 60 seconds window, default 10
+	WarnCountThreshold int
+	// EncryptionKey is the KMS CMK of the stream it creates and the abnormal event table,
+	// nil with Encrypt creates a key with rotation, UseStream keeps its own encryption
+	EncryptionKey awskms.IKey
+	Encrypt       bool
+	// AnomalyEndpointName is the sagemaker endpoint which scores the abnormal events before they are saved and alerted,
+	// e.g. AnomalyEndpointName of the SageMakerStack, empty doesn't score
+	AnomalyEndpointName string
+	// AnomalyScoreThreshold raises the severity of an event scored at least it to panic so it pages,
+	// 0 only saves and alerts the score
+	AnomalyScoreThreshold float64
 }
 
 func NewKdsSqlKdaLambdaDynamoDBStack(scope constructs.Construct, id string, props *KdsSqlKdaLambdaDynamoDBStackProps) awscdk.Stack {
@@ -28,17 +53,39 @@ func NewKdsSqlKdaLambdaDynamoDBStack(scope constructs.Construct, id string, prop
 	if props != nil {
 		sprops = props.StackProps
 	}
+	// the digest schedule is a rate of whole minutes
+	if props != nil && props.AlertSuppressWindow != nil {
+		seconds := *props.AlertSuppressWindow.ToSeconds(&awscdk.TimeConversionOptions{Integral: jsii.Bool(false)})
+		if seconds < 60 || seconds != float64(int(seconds)/60*60) {
+			panic(fmt.Sprintf("AlertSuppressWindow %vs must be a whole number of minutes, at least 1 minute", seconds))
+		}
+	}
 	stack := awscdk.NewStack(scope, &id, &sprops)
+	// removal policy, point in time recovery and deletion protection of the tables by the stage context
+	profile := lib.StageProfileOf(stack)
+
+	encryptionKey := props.EncryptionKey
+	if encryptionKey == nil && props.Encrypt {
+		encryptionKey = lib.NewEncryptionKey(stack, "EncryptionKey", "user behavior event stream and abnormal event table", profile)
+	}
 
 	var eventStream awskinesis.Stream
 	if props.UseStream != nil {
 		eventStream = props.UseStream
+	} else if encryptionKey != nil {
+		eventStream = awskinesis.NewStream(stack, jsii.String(props.StreamName), &awskinesis.StreamProps{
+			Encryption:    awskinesis.StreamEncryption_KMS,
+			EncryptionKey: encryptionKey,
+		})
 	} else {
 		eventStream = awskinesis.NewStream(stack, jsii.String(props.StreamName), nil)
 	}
+	if props.UseStream == nil {
+		eventStream.ApplyRemovalPolicy(profile.RemovalPolicy)
+	}
 
 	// The DynamoDB table that stores user behavior abnormal event result by kinesis analytic app through lambda function to write
-	userBeHaviorAbnormalTable := awsdynamodb.NewTable(stack, jsii.String("UserBehaviorAbnormalEventTable"), &awsdynamodb.TableProps{
+	abnormalTableProps := &awsdynamodb.TableProps{
 		PartitionKey: &awsdynamodb.Attribute{
 			Name: jsii.String("eventId"),
 			Type: awsdynamodb.AttributeType_STRING,
@@ -47,9 +94,14 @@ func NewKdsSqlKdaLambdaDynamoDBStack(scope constructs.Construct, id string, prop
 			Name: jsii.String("createdAt"),
 			Type: awsdynamodb.AttributeType_STRING,
 		},
-		RemovalPolicy: awscdk.RemovalPolicy_DESTROY,
-		TableName:     jsii.String("UserBeHaviorAbnormalEvent"), //biz define table name
-	})
+		TableName: jsii.String("UserBeHaviorAbnormalEvent"), //biz define table name
+	}
+	if encryptionKey != nil {
+		// the table grants to the lambdas and the table viewer include the key grants
+		abnormalTableProps.Encryption = awsdynamodb.TableEncryption_CUSTOMER_MANAGED
+		abnormalTableProps.EncryptionKey = encryptionKey
+	}
+	userBeHaviorAbnormalTable := profile.NewTable(stack, "UserBehaviorAbnormalEventTable", abnormalTableProps)
 
 	//table viewer is demo construct of a web app for dynamodb table display, use aws api gateway and serverless lambda function
 	dynamotableviewer.NewTableViewer(stack, jsii.String("UserBehaviorAbnormalView"), &dynamotableviewer.TableViewerProps{
@@ -63,13 +115,47 @@ func NewKdsSqlKdaLambdaDynamoDBStack(scope constructs.Construct, id string, prop
 	})
 
 	// new email subscription to alert
-	// u can new lambda subscription to send feishu or dingTalk alert
 	snsSendEmail := stack.Node().TryGetContext(jsii.String("snsSendEmail")).(string)
 	abnormalEventNoticationTopic.AddSubscription(awssnssubscriptions.NewEmailSubscription(
 		jsii.String(snsSendEmail), // biz define alert email, u can change.
 		nil,
 	))
 
+	// panic events page on call through the high priority topic, the other severities only go to the alert topic
+	highPriorityNoticationTopic := awssns.NewTopic(stack, jsii.String("AbnormalEventHighPriorityNotication"), &awssns.TopicProps{
+		DisplayName: jsii.String("AbnormalEventPageNotication"),
+	})
+	// page email default is snsSendEmail, snsPageSms is an optional on call phone number e.g. +8613800000000
+	snsPageEmail, _ := stack.Node().TryGetContext(jsii.String("snsPageEmail")).(string)
+	if len(snsPageEmail) == 0 {
+		snsPageEmail = snsSendEmail
+	}
+	highPriorityNoticationTopic.AddSubscription(awssnssubscriptions.NewEmailSubscription(jsii.String(snsPageEmail), nil))
+	if snsPageSms, _ := stack.Node().TryGetContext(jsii.String("snsPageSms")).(string); len(snsPageSms) > 0 {
+		highPriorityNoticationTopic.AddSubscription(awssnssubscriptions.NewSmsSubscription(jsii.String(snsPageSms), nil))
+	}
+
+	// new lambda subscription to send feishu/dingTalk/slack/webhook alert
+	// webhooks are from context alertWebhooks, e.g. [{"type":"dingtalk","url":"https://oapi.dingtalk.com/robot/send?access_token=xxx","secret":"SECxxx"}]
+	alertWebhooks, _ := stack.Node().TryGetContext(jsii.String("alertWebhooks")).([]interface{})
+	if len(alertWebhooks) > 0 {
+		webhooksJson, err := json.Marshal(alertWebhooks)
+		if err != nil {
+			panic(err.Error())
+		}
+		sendAlertWebhookLambda := awscdklambdago.NewGoFunction(stack, jsii.String("UserBehaviorAnalytics-SendAlertWebhookFunc"), &awscdklambdago.GoFunctionProps{
+			FunctionName: jsii.String("UserBehaviorAnalytics-SendAlertWebhookFunc"),
+			Description:  jsii.String("reads abnormal event alert from sns topic and send to feishu/dingTalk/slack/webhook"),
+			Entry:        jsii.String("src/lambda/send-alert-to-webhook"),
+			Environment: &map[string]*string{
+				"WEBHOOKS": jsii.String(string(webhooksJson)),
+			},
+		})
+		abnormalEventNoticationTopic.AddSubscription(awssnssubscriptions.NewLambdaSubscription(sendAlertWebhookLambda, nil))
+		// the channel sees the panics too
+		highPriorityNoticationTopic.AddSubscription(awssnssubscriptions.NewLambdaSubscription(sendAlertWebhookLambda, nil))
+	}
+
 	// Lambda function that reads output from our kinesis analytic app and save to DynamoDB table
 	// and alert abnormal events
 	saveAlertLambda := awscdklambdago.NewGoFunction(stack, jsii.String("UserBehaviorAnalytics-SaveAlertFunc"), &awscdklambdago.GoFunctionProps{
@@ -79,6 +165,9 @@ func NewKdsSqlKdaLambdaDynamoDBStack(scope constructs.Construct, id string, prop
 		Environment: &map[string]*string{
 			"TABLE_NAME": userBeHaviorAbnormalTable.TableName(),
 			"TOPIC_ARN":  abnormalEventNoticationTopic.TopicArn(),
+			// table and topic live in the stack region, AWS_REGION is reserved by lambda runtime
+			"REGION":                  stack.Region(),
+			"HIGH_PRIORITY_TOPIC_ARN": highPriorityNoticationTopic.TopicArn(),
 		},
 	})
 
@@ -94,114 +183,142 @@ func NewKdsSqlKdaLambdaDynamoDBStack(scope constructs.Construct, id string, prop
 		})
 	*/
 	abnormalEventNoticationTopic.GrantPublish(saveAlertLambda)
+	highPriorityNoticationTopic.GrantPublish(saveAlertLambda)
 	userBeHaviorAbnormalTable.GrantReadWriteData(saveAlertLambda)
 
-	// create stream analytics role for kinesis analytics app
-	streamToAnalyticsRole := awsiam.NewRole(stack, jsii.String("streamToAnalyticsRole"), &awsiam.RoleProps{
-		AssumedBy: awsiam.NewServicePrincipal(jsii.String("kinesisanalytics.amazonaws.com"), nil),
-	})
-	streamToAnalyticsRole.AddToPolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
-		Actions:   &[]*string{jsii.String("kinesis:*"), jsii.String("lambda:*")},
-		Resources: &[]*string{eventStream.StreamArn(), saveAlertLambda.FunctionArn()},
-	}))
+	if len(props.AnomalyEndpointName) > 0 {
+		saveAlertLambda.AddEnvironment(jsii.String("ANOMALY_ENDPOINT_NAME"), jsii.String(props.AnomalyEndpointName), nil)
+		if props.AnomalyScoreThreshold > 0 {
+			saveAlertLambda.AddEnvironment(jsii.String("ANOMALY_SCORE_THRESHOLD"), jsii.String(strconv.FormatFloat(props.AnomalyScoreThreshold, 'f', -1, 64)), nil)
+		}
+		saveAlertLambda.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+			Actions: &[]*string{jsii.String("sagemaker:InvokeEndpoint")},
+			Resources: &[]*string{stack.FormatArn(&awscdk.ArnComponents{
+				Service:      jsii.String("sagemaker"),
+				Resource:     jsii.String("endpoint"),
+				ResourceName: jsii.String(props.AnomalyEndpointName),
+			})},
+		}))
+	}
 
-	// create kinesis analytics app use sql(old version) from kinesis data stream
-	// for abnormality event alert
-	dir, _ := os.Getwd()
-	sqlCode, err := os.ReadFile(dir + "/src/kinesis-analytics-sql/filter-abnormality-event.sql")
-	if err != nil {
-		panic(err.Error())
+	// severity rules are from context alertSeverityRules, e.g. [{"severity":"panic","pattern":"(?i)\\[panic\\]|fatal"}]
+	// none uses the lambda default rules: [panic] [error] [warning] tags in errorMsg
+	if alertSeverityRules, _ := stack.Node().TryGetContext(jsii.String("alertSeverityRules")).([]interface{}); len(alertSeverityRules) > 0 {
+		severityRulesJson, err := json.Marshal(alertSeverityRules)
+		if err != nil {
+			panic(err.Error())
+		}
+		saveAlertLambda.AddEnvironment(jsii.String("SEVERITY_RULES"), jsii.String(string(severityRulesJson)), nil)
 	}
-	kinesisAnalyticsAppForAbnormalityEvent := awskinesisanalytics.NewCfnApplication(stack, jsii.String("KinesisAnalyticsApplication"), &awskinesisanalytics.CfnApplicationProps{
-		ApplicationName:        jsii.String("abnormality-event-detector"),
-		ApplicationDescription: jsii.String("use kinesis sql to analytics filter abnormality event"),
-		ApplicationCode:        jsii.String(string(sqlCode)),
-		// https://docs.aws.amazon.com/zh_cn/kinesisanalytics/latest/dev/how-it-works-input.html
-		Inputs: []awskinesisanalytics.CfnApplication_InputProperty{
-			{
-				NamePrefix: jsii.String("SOURCE_SQL_STREAM"),
-				KinesisStreamsInput: &awskinesisanalytics.CfnApplicationOutput_KinesisStreamsOutputProperty{
-					ResourceArn: eventStream.StreamArn(),
-					RoleArn:     streamToAnalyticsRole.RoleArn(),
-				},
-				InputParallelism: &awskinesisanalytics.CfnApplication_InputParallelismProperty{
-					Count: jsii.Number(1),
-				},
-				// https://docs.aws.amazon.com/zh_cn/kinesisanalytics/latest/dev/about-json-path.html
-				InputSchema: &awskinesisanalytics.CfnApplication_InputSchemaProperty{
-					RecordFormat: &awskinesisanalytics.CfnApplication_RecordFormatProperty{
-						RecordFormatType: jsii.String("JSON"),
-						MappingParameters: &awskinesisanalytics.CfnApplication_MappingParametersProperty{
-							JsonMappingParameters: &awskinesisanalytics.CfnApplication_JSONMappingParametersProperty{
-								RecordRowPath: jsii.String("$"),
-							},
-						},
-					},
-					RecordEncoding: jsii.String("UTF-8"),
-					// https://docs.aws.amazon.com/zh_cn/kinesisanalytics/latest/dev/sch-mapping.html
-					RecordColumns: []awskinesisanalytics.CfnApplication_RecordColumnProperty{
-						{
-							Name:    jsii.String("eventId"),
-							SqlType: jsii.String("VARCHAR(64)"),
-							Mapping: jsii.String("$.eventId"),
-						},
-						{
-							Name:    jsii.String("action"),
-							SqlType: jsii.String("VARCHAR(256)"),
-							Mapping: jsii.String("$.action"),
-						},
-						{
-							Name:    jsii.String("userId"),
-							SqlType: jsii.String("VARCHAR(64)"),
-							Mapping: jsii.String("$.userId"),
-						},
-						{
-							Name:    jsii.String("objectId"),
-							SqlType: jsii.String("VARCHAR(64)"),
-							Mapping: jsii.String("$.objectId"),
-						},
-						{
-							Name:    jsii.String("bizId"),
-							SqlType: jsii.String("VARCHAR(64)"),
-							Mapping: jsii.String("$.bizId"),
-						},
-						{
-							Name:    jsii.String("errorMsg"),
-							SqlType: jsii.String("VARCHAR(1024)"),
-							Mapping: jsii.String("$.errorMsg"),
-						},
-						{
-							Name:    jsii.String("createdAt"),
-							SqlType: jsii.String("VARCHAR(32)"),
-							Mapping: jsii.String("$.createdAt"),
-						},
-					},
-				},
+
+	// alert suppression window per group(action+bizId), the digest function sends the suppressed counts every window
+	if props.AlertSuppressWindow != nil {
+		alertSuppressTable := profile.NewTable(stack, "UserBehaviorAlertSuppressTable", &awsdynamodb.TableProps{
+			PartitionKey: &awsdynamodb.Attribute{
+				Name: jsii.String("groupKey"),
+				Type: awsdynamodb.AttributeType_STRING,
 			},
+			TimeToLiveAttribute: jsii.String("expiresAt"),
+			TableName:           jsii.String("UserBeHaviorAlertSuppress"),
+		})
+		suppressEnv := map[string]*string{
+			"SUPPRESS_TABLE_NAME":     alertSuppressTable.TableName(),
+			"SUPPRESS_WINDOW_SECONDS": jsii.String(fmt.Sprintf("%d", int(*props.AlertSuppressWindow.ToSeconds(nil)))),
+			"SUPPRESS_GROUP_KEYS":     jsii.String(strings.Join(props.AlertGroupKeys, ",")),
+		}
+		for k, v := range suppressEnv {
+			saveAlertLambda.AddEnvironment(jsii.String(k), v, nil)
+		}
+		alertSuppressTable.GrantReadWriteData(saveAlertLambda)
+
+		// the digests are routed by severity like the alerts
+		digestEnv := map[string]*string{
+			"TABLE_NAME":              userBeHaviorAbnormalTable.TableName(),
+			"TOPIC_ARN":               abnormalEventNoticationTopic.TopicArn(),
+			"REGION":                  stack.Region(),
+			"HIGH_PRIORITY_TOPIC_ARN": highPriorityNoticationTopic.TopicArn(),
+			"HANDLER":                 jsii.String("digest"),
+		}
+		for k, v := range suppressEnv {
+			digestEnv[k] = v
+		}
+		sendAlertDigestLambda := awscdklambdago.NewGoFunction(stack, jsii.String("UserBehaviorAnalytics-SendAlertDigestFunc"), &awscdklambdago.GoFunctionProps{
+			FunctionName: jsii.String("UserBehaviorAnalytics-SendAlertDigestFunc"),
+			Description:  jsii.String("send the digest of suppressed abnormal event alerts to sns every suppression window"),
+			Entry:        jsii.String("src/lambda/save-alert-from-kda"),
+			Environment:  &digestEnv,
+		})
+		abnormalEventNoticationTopic.GrantPublish(sendAlertDigestLambda)
+		highPriorityNoticationTopic.GrantPublish(sendAlertDigestLambda)
+		alertSuppressTable.GrantReadWriteData(sendAlertDigestLambda)
+		awsevents.NewRule(stack, jsii.String("SendAlertDigestSchedule"), &awsevents.RuleProps{
+			Schedule: awsevents.Schedule_Rate(props.AlertSuppressWindow),
+			Targets:  &[]awsevents.IRuleTarget{awseventstargets.NewLambdaFunction(sendAlertDigestLambda, nil)},
+		})
+	}
+
+	// The DynamoDB table that stores the per action warning count of every window, a time series by windowStart
+	actionWarnCountTable := profile.NewTable(stack, "UserBehaviorActionWarnCountTable", &awsdynamodb.TableProps{
+		PartitionKey: &awsdynamodb.Attribute{
+			Name: jsii.String("action"),
+			Type: awsdynamodb.AttributeType_STRING,
+		},
+		SortKey: &awsdynamodb.Attribute{
+			Name: jsii.String("windowStart"),
+			Type: awsdynamodb.AttributeType_STRING,
 		},
+		TimeToLiveAttribute: jsii.String("expiresAt"),
+		TableName:           jsii.String("UserBeHaviorActionWarnCount"),
 	})
-	kinesisAnalyticsAppForAbnormalityEvent.Node().AddDependency(streamToAnalyticsRole)
-	kinesisAnalyticsAppOutput := awskinesisanalytics.NewCfnApplicationOutput(stack, jsii.String("KinesisAnalyticsApplicationOutPut"), &awskinesisanalytics.CfnApplicationOutputProps{
-		ApplicationName: jsii.String("abnormality-event-detector"),
-		Output: &awskinesisanalytics.CfnApplicationOutput_OutputProperty{
-			Name: jsii.String("DESTINATION_SQL_STREAM"),
-			DestinationSchema: &awskinesisanalytics.CfnApplicationOutput_DestinationSchemaProperty{
-				RecordFormatType: jsii.String("JSON"),
-			},
-			LambdaOutput: &awskinesisanalytics.CfnApplicationOutput_LambdaOutputProperty{
-				ResourceArn: saveAlertLambda.FunctionArn(),
-				RoleArn:     streamToAnalyticsRole.RoleArn(),
-			},
-			//KinesisFirehoseOutput: nil,
-			//KinesisStreamsOutput:  nil,
+
+	// Lambda function that reads the windowed warning counts from kinesis analytic app and save to DynamoDB table
+	// and alert the counts over threshold
+	warnCountThreshold := props.WarnCountThreshold
+	if warnCountThreshold <= 0 {
+		warnCountThreshold = 10
+	}
+	saveWarnCountLambda := awscdklambdago.NewGoFunction(stack, jsii.String("UserBehaviorAnalytics-SaveWarnCountFunc"), &awscdklambdago.GoFunctionProps{
+		FunctionName: jsii.String("UserBehaviorAnalytics-SaveWarnCountFunc"),
+		Description:  jsii.String("reads windowed warning counts from our kinesis analytic app and save to DynamoDB table and alert counts over threshold"),
+		Entry:        jsii.String("src/lambda/save-warn-count-from-kda"),
+		Environment: &map[string]*string{
+			"TABLE_NAME":           actionWarnCountTable.TableName(),
+			"TOPIC_ARN":            abnormalEventNoticationTopic.TopicArn(),
+			"REGION":               stack.Region(),
+			"WARN_COUNT_THRESHOLD": jsii.String(fmt.Sprintf("%d", warnCountThreshold)),
 		},
 	})
-	kinesisAnalyticsAppOutput.Node().AddDependency(kinesisAnalyticsAppForAbnormalityEvent)
+	abnormalEventNoticationTopic.GrantPublish(saveWarnCountLambda)
+	actionWarnCountTable.GrantReadWriteData(saveWarnCountLambda)
+
+	// create kinesis analytics app use sql(old version) from kinesis data stream
+	// for abnormality event alert
+	lib.NewKdaSqlAppConstruct(stack, "AbnormalityEventDetector", &lib.KdaSqlAppProps{
+		ApplicationName: "abnormality-event-detector",
+		Description:     "use kinesis sql to analytics filter abnormality event",
+		SqlFile:         "src/kinesis-analytics-sql/filter-abnormality-event.sql",
+		InputStream:     eventStream,
+		Schema:          kdaSqlSchemaOf(schema.UserBehaviorEventSchema),
+		Outputs:         []lib.KdaSqlOutput{{Lambda: saveAlertLambda}},
+	})
+
+	// for per action warning count of 60 seconds tumbling window
+	lib.NewKdaSqlAppConstruct(stack, "AbnormalityWarnCountDetector", &lib.KdaSqlAppProps{
+		ApplicationName: "abnormality-warn-count-detector",
+		Description:     "use kinesis sql tumbling window to count warning event per action",
+		SqlFile:         "src/kinesis-analytics-sql/filter-abnormality-window-event.sql",
+		InputStream:     eventStream,
+		Schema:          kdaSqlSchemaOf(schema.UserBehaviorEventSchema),
+		Outputs:         []lib.KdaSqlOutput{{Lambda: saveWarnCountLambda}},
+	})
 
 	// outPut the stream name so can connect our script to this stream
 	awscdk.NewCfnOutput(stack, jsii.String("EventStreamName"), &awscdk.CfnOutputProps{
 		Value: eventStream.StreamName(),
 	})
+	awscdk.NewCfnOutput(stack, jsii.String("HighPriorityTopicArn"), &awscdk.CfnOutputProps{
+		Value: highPriorityNoticationTopic.TopicArn(),
+	})
 
 	return stack
 }
@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// DmsTableRule selects the source tables of a DMS task, Schema and Table support the % wildcard,
+// https://docs.aws.amazon.com/dms/latest/userguide/CHAP_Tasks.CustomizingTasks.TableMapping.SelectionTransformation.Selections.html
+type DmsTableRule struct {
+	Schema string
+	Table  string
+	// Exclude drops the matched tables of the include rules before it
+	Exclude bool
+}
+
+type dmsObjectLocator struct {
+	SchemaName string `json:"schema-name"`
+	TableName  string `json:"table-name"`
+}
+
+type dmsSelectionRule struct {
+	RuleType      string           `json:"rule-type"`
+	RuleId        string           `json:"rule-id"`
+	RuleName      string           `json:"rule-name"`
+	ObjectLocator dmsObjectLocator `json:"object-locator"`
+	RuleAction    string           `json:"rule-action"`
+}
+
+// DmsTableMappings is the TableMappings json of the rules, it panics without a rule
+func DmsTableMappings(rules []DmsTableRule) string {
+	if len(rules) == 0 {
+		panic("DmsTableMappings needs a rule")
+	}
+	selections := make([]dmsSelectionRule, len(rules))
+	for i, rule := range rules {
+		if len(rule.Schema) == 0 || len(rule.Table) == 0 {
+			panic(fmt.Sprintf("DmsTableRule %d needs Schema and Table", i))
+		}
+		action := "include"
+		if rule.Exclude {
+			action = "exclude"
+		}
+		id := fmt.Sprintf("%d", i+1)
+		selections[i] = dmsSelectionRule{
+			RuleType:      "selection",
+			RuleId:        id,
+			RuleName:      id,
+			ObjectLocator: dmsObjectLocator{SchemaName: rule.Schema, TableName: rule.Table},
+			RuleAction:    action,
+		}
+	}
+	data, err := json.Marshal(map[string]interface{}{"rules": selections})
+	if err != nil {
+		panic(err.Error())
+	}
+	return string(data)
+}
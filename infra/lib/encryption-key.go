@@ -0,0 +1,19 @@
+package lib
+
+import (
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskms"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// NewEncryptionKey creates a KMS CMK with yearly rotation for the user data at rest,
+// the key policy trusts the account, the resource grants add the role policies
+func NewEncryptionKey(scope constructs.Construct, id string, description string, profile *StageProfile) awskms.Key {
+	profile = profile.orDev()
+	return awskms.NewKey(scope, jsii.String(id), &awskms.KeyProps{
+		Description:       jsii.String(description),
+		EnableKeyRotation: jsii.Bool(true),
+		PendingWindow:     profile.KeyPendingWindow,
+		RemovalPolicy:     profile.RemovalPolicy,
+	})
+}
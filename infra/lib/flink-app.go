@@ -0,0 +1,243 @@
+package lib
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsec2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskinesisanalytics"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslogs"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awss3assets"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+type FlinkAppProps struct {
+	ApplicationName string
+	Description     string
+	// Runtime default FLINK-1_15
+	Runtime string
+	// CodePath is the jar, or the dir zipped as the code e.g. a pyflink script with its lib/ jars, relative to the cdk app dir
+	CodePath string
+	// PropertyGroups are the runtime properties by group id,
+	// the app reads them by KinesisAnalyticsRuntime.getApplicationProperties() or /etc/flink/application_properties.json
+	PropertyGroups map[string]map[string]string
+	// Parallelism default 1, ParallelismPerKpu default 1
+	Parallelism       int
+	ParallelismPerKpu int
+	AutoScaling       bool
+	// CheckpointInterval nil is the service default, checkpoints every 60 seconds
+	CheckpointInterval awscdk.Duration
+	// LogLevel INFO (default), WARN, ERROR or DEBUG
+	LogLevel string
+	// Vpc runs the app in the subnets, the app reaches the aws services through the vpc endpoints or a nat
+	Vpc        awsec2.IVpc
+	VpcSubnets *awsec2.SubnetSelection
+	// Profile is the removal policy of the log group
+	Profile *StageProfile
+}
+
+type flinkAppConstruct struct {
+	constructs.Construct
+	application   awskinesisanalytics.CfnApplicationV2
+	role          awsiam.Role
+	logGroup      awslogs.LogGroup
+	securityGroup awsec2.SecurityGroup
+}
+
+func (m *flinkAppConstruct) Application() awskinesisanalytics.CfnApplicationV2 {
+	return m.application
+}
+func (m *flinkAppConstruct) Role() awsiam.Role {
+	return m.role
+}
+func (m *flinkAppConstruct) LogGroup() awslogs.LogGroup {
+	return m.logGroup
+}
+func (m *flinkAppConstruct) SecurityGroup() awsec2.SecurityGroup {
+	return m.securityGroup
+}
+
+type IFlinkAppConstruct interface {
+	constructs.Construct
+	Application() awskinesisanalytics.CfnApplicationV2
+	// Role is the app service role, grant it the sources and sinks
+	Role() awsiam.Role
+	LogGroup() awslogs.LogGroup
+	// SecurityGroup of the app in the Vpc, nil without Vpc
+	SecurityGroup() awsec2.SecurityGroup
+}
+
+// NewFlinkAppConstruct creates the managed flink(kinesis analytics v2) app of the code asset with snapshots and cloudwatch logging,
+// the sources and sinks are granted to Role by the caller
+func NewFlinkAppConstruct(scope constructs.Construct, id string, props *FlinkAppProps) IFlinkAppConstruct {
+	if len(strings.Trim(props.ApplicationName, " ")) == 0 {
+		panic("ApplicationName is empty")
+	}
+	if len(props.CodePath) == 0 {
+		panic("CodePath is empty")
+	}
+	runtime := props.Runtime
+	if len(runtime) == 0 {
+		runtime = "FLINK-1_15"
+	}
+	parallelism := props.Parallelism
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+	parallelismPerKpu := props.ParallelismPerKpu
+	if parallelismPerKpu <= 0 {
+		parallelismPerKpu = 1
+	}
+	logLevel := props.LogLevel
+	if len(logLevel) == 0 {
+		logLevel = "INFO"
+	}
+	profile := props.Profile.orDev()
+
+	this := constructs.NewConstruct(scope, &id)
+	stack := awscdk.Stack_Of(this)
+
+	role := awsiam.NewRole(this, jsii.String("FlinkAppRole"), &awsiam.RoleProps{
+		AssumedBy: awsiam.NewServicePrincipal(jsii.String("kinesisanalytics.amazonaws.com"), nil),
+	})
+	code := awss3assets.NewAsset(this, jsii.String("Code"), &awss3assets.AssetProps{
+		Path: jsii.String(props.CodePath),
+	})
+	code.GrantRead(role)
+
+	logGroup := awslogs.NewLogGroup(this, jsii.String("LogGroup"), &awslogs.LogGroupProps{
+		Retention:     awslogs.RetentionDays_ONE_MONTH,
+		RemovalPolicy: profile.RemovalPolicy,
+	})
+	logStream := awslogs.NewLogStream(this, jsii.String("LogStream"), &awslogs.LogStreamProps{
+		LogGroup:      logGroup,
+		RemovalPolicy: profile.RemovalPolicy,
+	})
+	role.AddToPolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Actions:   &[]*string{jsii.String("logs:DescribeLogGroups")},
+		Resources: &[]*string{jsii.String("*")},
+	}))
+	logGroup.Grant(role, jsii.String("logs:DescribeLogStreams"), jsii.String("logs:PutLogEvents"))
+
+	propertyGroups := make([]awskinesisanalytics.CfnApplicationV2_PropertyGroupProperty, 0, len(props.PropertyGroups))
+	groupIds := make([]string, 0, len(props.PropertyGroups))
+	for groupId := range props.PropertyGroups {
+		groupIds = append(groupIds, groupId)
+	}
+	sort.Strings(groupIds)
+	for _, groupId := range groupIds {
+		propertyMap := map[string]*string{}
+		for k, v := range props.PropertyGroups[groupId] {
+			propertyMap[k] = jsii.String(v)
+		}
+		propertyGroups = append(propertyGroups, awskinesisanalytics.CfnApplicationV2_PropertyGroupProperty{
+			PropertyGroupId: jsii.String(groupId),
+			PropertyMap:     &propertyMap,
+		})
+	}
+
+	checkpointConfiguration := &awskinesisanalytics.CfnApplicationV2_CheckpointConfigurationProperty{
+		ConfigurationType: jsii.String("DEFAULT"),
+	}
+	if props.CheckpointInterval != nil {
+		checkpointConfiguration = &awskinesisanalytics.CfnApplicationV2_CheckpointConfigurationProperty{
+			ConfigurationType:    jsii.String("CUSTOM"),
+			CheckpointingEnabled: jsii.Bool(true),
+			CheckpointInterval:   props.CheckpointInterval.ToMilliseconds(nil),
+		}
+	}
+	applicationConfiguration := &awskinesisanalytics.CfnApplicationV2_ApplicationConfigurationProperty{
+		ApplicationCodeConfiguration: &awskinesisanalytics.CfnApplicationV2_ApplicationCodeConfigurationProperty{
+			// a jar is a zip file too
+			CodeContentType: jsii.String("ZIPFILE"),
+			CodeContent: &awskinesisanalytics.CfnApplicationV2_CodeContentProperty{
+				S3ContentLocation: &awskinesisanalytics.CfnApplicationV2_S3ContentLocationProperty{
+					BucketArn: code.Bucket().BucketArn(),
+					FileKey:   code.S3ObjectKey(),
+				},
+			},
+		},
+		ApplicationSnapshotConfiguration: &awskinesisanalytics.CfnApplicationV2_ApplicationSnapshotConfigurationProperty{
+			SnapshotsEnabled: jsii.Bool(true),
+		},
+		EnvironmentProperties: &awskinesisanalytics.CfnApplicationV2_EnvironmentPropertiesProperty{
+			PropertyGroups: &propertyGroups,
+		},
+		FlinkApplicationConfiguration: &awskinesisanalytics.CfnApplicationV2_FlinkApplicationConfigurationProperty{
+			CheckpointConfiguration: checkpointConfiguration,
+			ParallelismConfiguration: &awskinesisanalytics.CfnApplicationV2_ParallelismConfigurationProperty{
+				ConfigurationType:  jsii.String("CUSTOM"),
+				Parallelism:        jsii.Number(float64(parallelism)),
+				ParallelismPerKpu:  jsii.Number(float64(parallelismPerKpu)),
+				AutoScalingEnabled: jsii.Bool(props.AutoScaling),
+			},
+			MonitoringConfiguration: &awskinesisanalytics.CfnApplicationV2_MonitoringConfigurationProperty{
+				ConfigurationType: jsii.String("CUSTOM"),
+				LogLevel:          jsii.String(logLevel),
+				MetricsLevel:      jsii.String("APPLICATION"),
+			},
+		},
+	}
+
+	var securityGroup awsec2.SecurityGroup
+	if props.Vpc != nil {
+		securityGroup = awsec2.NewSecurityGroup(this, jsii.String("SecurityGroup"), &awsec2.SecurityGroupProps{
+			Vpc:         props.Vpc,
+			Description: jsii.String(props.ApplicationName + " flink app"),
+		})
+		// https://docs.aws.amazon.com/managed-flink/latest/java/vpc-permissions.html
+		role.AddToPolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+			Actions: &[]*string{
+				jsii.String("ec2:DescribeVpcs"),
+				jsii.String("ec2:DescribeSubnets"),
+				jsii.String("ec2:DescribeSecurityGroups"),
+				jsii.String("ec2:DescribeDhcpOptions"),
+				jsii.String("ec2:CreateNetworkInterface"),
+				jsii.String("ec2:CreateNetworkInterfacePermission"),
+				jsii.String("ec2:DescribeNetworkInterfaces"),
+				jsii.String("ec2:DeleteNetworkInterface"),
+			},
+			Resources: &[]*string{jsii.String("*")},
+		}))
+		subnets := props.Vpc.SelectSubnets(props.VpcSubnets)
+		applicationConfiguration.VpcConfigurations = &[]*awskinesisanalytics.CfnApplicationV2_VpcConfigurationProperty{
+			{
+				SubnetIds:        subnets.SubnetIds,
+				SecurityGroupIds: &[]*string{securityGroup.SecurityGroupId()},
+			},
+		}
+	}
+
+	application := awskinesisanalytics.NewCfnApplicationV2(this, jsii.String("Application"), &awskinesisanalytics.CfnApplicationV2Props{
+		ApplicationName:          jsii.String(props.ApplicationName),
+		ApplicationDescription:   jsii.String(props.Description),
+		RuntimeEnvironment:       jsii.String(runtime),
+		ServiceExecutionRole:     role.RoleArn(),
+		ApplicationConfiguration: applicationConfiguration,
+	})
+	// the role policy must be attached before kinesis analytics validates the code and the vpc
+	application.Node().AddDependency(role)
+
+	awskinesisanalytics.NewCfnApplicationCloudWatchLoggingOptionV2(this, jsii.String("Logging"), &awskinesisanalytics.CfnApplicationCloudWatchLoggingOptionV2Props{
+		ApplicationName: application.Ref(),
+		CloudWatchLoggingOption: &awskinesisanalytics.CfnApplicationCloudWatchLoggingOptionV2_CloudWatchLoggingOptionProperty{
+			LogStreamArn: stack.FormatArn(&awscdk.ArnComponents{
+				Service:      jsii.String("logs"),
+				Resource:     jsii.String("log-group"),
+				ResourceName: jsii.String(*logGroup.LogGroupName() + ":log-stream:" + *logStream.LogStreamName()),
+				ArnFormat:    awscdk.ArnFormat_COLON_RESOURCE_NAME,
+			}),
+		},
+	})
+
+	return &flinkAppConstruct{
+		Construct:     this,
+		application:   application,
+		role:          role,
+		logGroup:      logGroup,
+		securityGroup: securityGroup,
+	}
+}
@@ -0,0 +1,352 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsathena"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsglue"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+type GlueAthenaProps struct {
+	// Firehose is the event archive, its records must be newline delimited json (DynamicPartitioning) or PARQUET/ORC,
+	// firehose concatenates the raw json records which athena reads as one record per object
+	Firehose IKdsFirehoseS3Construct
+	// Columns of the json table, the PARQUET/ORC table of Firehose is used as is
+	Columns []GlueColumn
+	// DatabaseName default user_behavior_analytics, the database of Firehose is used if it has one
+	DatabaseName string
+	// TableName of the json table, default user_behavior_event
+	TableName string
+	// WorkGroupName default user_behavior_analytics
+	WorkGroupName string
+	// ProjectionStart is the first dt partition, default 2022-01-01
+	ProjectionStart time.Time
+	// PartitionValues are the enum values of a partition key, e.g. bizId: [b1 b2 unknown],
+	// a key without values is injected, its queries need an equality predicate on it
+	PartitionValues map[string][]string
+	// BytesScannedCutoffPerQuery cancels a query of the workgroup which scans more bytes, 0 is no limit, min 10MB
+	BytesScannedCutoffPerQuery int
+	// ResultExpiration expires the query results, default 30 days
+	ResultExpiration awscdk.Duration
+	// Profile sets the removal policy of the result bucket, nil is dev
+	Profile *StageProfile
+}
+
+type glueAthenaConstruct struct {
+	constructs.Construct
+	databaseName *string
+	tableName    *string
+	table        awsglue.CfnTable
+	workGroup    awsathena.CfnWorkGroup
+	resultBucket awss3.Bucket
+	namedQueries []awsathena.CfnNamedQuery
+}
+
+func (m *glueAthenaConstruct) DatabaseName() *string {
+	return m.databaseName
+}
+func (m *glueAthenaConstruct) TableName() *string {
+	return m.tableName
+}
+func (m *glueAthenaConstruct) Table() awsglue.CfnTable {
+	return m.table
+}
+func (m *glueAthenaConstruct) WorkGroup() awsathena.CfnWorkGroup {
+	return m.workGroup
+}
+func (m *glueAthenaConstruct) ResultBucket() awss3.Bucket {
+	return m.resultBucket
+}
+func (m *glueAthenaConstruct) NamedQueries() []awsathena.CfnNamedQuery {
+	return m.namedQueries
+}
+
+type IGlueAthenaConstruct interface {
+	constructs.Construct
+	DatabaseName() *string
+	TableName() *string
+	// Table is the partition projected table over the firehose prefix
+	Table() awsglue.CfnTable
+	WorkGroup() awsathena.CfnWorkGroup
+	ResultBucket() awss3.Bucket
+	NamedQueries() []awsathena.CfnNamedQuery
+}
+
+// partition projection of the firehose layouts, https://docs.aws.amazon.com/athena/latest/ug/partition-projection.html
+type projection struct {
+	partitionKeys []string
+	parameters    map[string]string
+	// where is the partition predicate of the last day
+	where string
+}
+
+func newProjection(firehose IKdsFirehoseS3Construct, bucket awss3.Bucket, props *GlueAthenaProps) *projection {
+	start := props.ProjectionStart
+	if start.IsZero() {
+		start = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	location := fmt.Sprintf("s3://%s/%s", *bucket.BucketName(), firehose.Prefix())
+	p := &projection{parameters: map[string]string{"projection.enabled": "true"}}
+
+	if len(firehose.PartitionKeys()) == 0 {
+		// firehose default yyyy/MM/dd/HH/ layout of the UTC delivery time
+		p.partitionKeys = []string{"dt"}
+		p.parameters["projection.dt.type"] = "date"
+		p.parameters["projection.dt.format"] = "yyyy/MM/dd/HH"
+		p.parameters["projection.dt.range"] = start.UTC().Format("2006/01/02/15") + ",NOW"
+		p.parameters["projection.dt.interval"] = "1"
+		p.parameters["projection.dt.interval.unit"] = "HOURS"
+		p.parameters["storage.location.template"] = location + "${dt}/"
+		p.where = "dt >= date_format(current_timestamp - interval '1' day, '%Y/%m/%d/%H')"
+		return p
+	}
+
+	// dynamic partitioning dt=yyyy-MM-dd/hour=HH/bizId=<bizId>/ layout of the event createdAt
+	hours := make([]string, 24)
+	for i := range hours {
+		hours[i] = fmt.Sprintf("%02d", i)
+	}
+	template := location
+	where := []string{"dt >= date_format(current_date - interval '1' day, '%Y-%m-%d')"}
+	for _, key := range firehose.PartitionKeys() {
+		// glue column names are lower case, the s3 keys keep the json field name
+		column := strings.ToLower(key)
+		p.partitionKeys = append(p.partitionKeys, column)
+		template += fmt.Sprintf("%s=${%s}/", key, column)
+		switch {
+		case key == "dt":
+			p.parameters["projection.dt.type"] = "date"
+			p.parameters["projection.dt.format"] = "yyyy-MM-dd"
+			p.parameters["projection.dt.range"] = start.UTC().Format("2006-01-02") + ",NOW"
+			p.parameters["projection.dt.interval"] = "1"
+			p.parameters["projection.dt.interval.unit"] = "DAYS"
+		case key == "hour":
+			p.parameters["projection.hour.type"] = "enum"
+			p.parameters["projection.hour.values"] = strings.Join(hours, ",")
+		case len(props.PartitionValues[key]) > 0:
+			p.parameters["projection."+column+".type"] = "enum"
+			p.parameters["projection."+column+".values"] = strings.Join(props.PartitionValues[key], ",")
+		default:
+			// a parameterized named query, athena asks for the value
+			p.parameters["projection."+column+".type"] = "injected"
+			where = append(where, column+" = ?")
+		}
+	}
+	p.parameters["storage.location.template"] = template
+	p.where = strings.Join(where, " AND ")
+	return p
+}
+
+func (m *projection) columns() []awsglue.CfnTable_ColumnProperty {
+	columns := make([]awsglue.CfnTable_ColumnProperty, len(m.partitionKeys))
+	for i, key := range m.partitionKeys {
+		columns[i] = awsglue.CfnTable_ColumnProperty{Name: jsii.String(key), Type: jsii.String("string")}
+	}
+	return columns
+}
+
+// namedQueries are the common analyses of the last day, errorMsg starts with a level tag e.g. [panic] [error] [warning]
+var namedQueries = []struct {
+	name, description, sql string
+}{
+	{
+		"error-count-by-action",
+		"abnormal event count by action of the last day",
+		`SELECT action, count(*) AS errors, count(DISTINCT userid) AS users
+FROM "%[1]s"."%[2]s"
+WHERE %[3]s AND errormsg <> ''
+GROUP BY action
+ORDER BY errors DESC`,
+	},
+	{
+		"error-count-by-level",
+		"abnormal event count by errorMsg level tag of the last day",
+		`SELECT lower(regexp_extract(errormsg, '^\[(\w+)\]', 1)) AS level, count(*) AS events
+FROM "%[1]s"."%[2]s"
+WHERE %[3]s AND errormsg <> ''
+GROUP BY 1
+ORDER BY events DESC`,
+	},
+	{
+		"event-count-by-hour",
+		"event count by createdAt hour and action of the last day",
+		`SELECT substr(createdat, 1, 13) AS created_hour, action, count(*) AS events
+FROM "%[1]s"."%[2]s"
+WHERE %[3]s
+GROUP BY 1, 2
+ORDER BY 1, 2`,
+	},
+	{
+		"top-users",
+		"top 100 users by event count of the last day",
+		`SELECT userid, count(*) AS events, count(DISTINCT action) AS actions
+FROM "%[1]s"."%[2]s"
+WHERE %[3]s
+GROUP BY userid
+ORDER BY events DESC
+LIMIT 100`,
+	},
+}
+
+func NewGlueAthenaConstruct(scope constructs.Construct, id string, props *GlueAthenaProps) IGlueAthenaConstruct {
+	if props.Firehose == nil {
+		panic("Firehose is nil")
+	}
+	firehose := props.Firehose
+	if len(firehose.RecordFormat()) == 0 && len(firehose.PartitionKeys()) == 0 {
+		panic("the firehose raw json records aren't newline delimited, enable DynamicPartitioning or RecordFormat")
+	}
+	if len(firehose.RecordFormat()) == 0 && len(props.Columns) == 0 {
+		panic("Columns is empty")
+	}
+
+	this := constructs.NewConstruct(scope, &id)
+	m := &glueAthenaConstruct{Construct: this}
+	p := newProjection(firehose, firehose.Bucket(), props)
+
+	if firehose.GlueTable() != nil {
+		// the table of the record format conversion, firehose only reads its columns
+		m.databaseName = firehose.GlueDatabase().Ref()
+		m.table = firehose.GlueTable()
+		p.parameters["classification"] = strings.ToLower(firehose.RecordFormat())
+		m.table.AddPropertyOverride(jsii.String("TableInput.Parameters"), p.parameters)
+		// overrides are raw cloudformation, not the jsii property structs
+		partitionKeys := make([]map[string]string, len(p.partitionKeys))
+		for i, key := range p.partitionKeys {
+			partitionKeys[i] = map[string]string{"Name": key, "Type": "string"}
+		}
+		m.table.AddPropertyOverride(jsii.String("TableInput.PartitionKeys"), partitionKeys)
+	} else {
+		databaseName := props.DatabaseName
+		if len(databaseName) == 0 {
+			databaseName = "user_behavior_analytics"
+		}
+		tableName := props.TableName
+		if len(tableName) == 0 {
+			tableName = "user_behavior_event"
+		}
+		database := awsglue.NewCfnDatabase(this, jsii.String("GlueDatabase"), &awsglue.CfnDatabaseProps{
+			CatalogId: awscdk.Aws_ACCOUNT_ID(),
+			DatabaseInput: &awsglue.CfnDatabase_DatabaseInputProperty{
+				Name: jsii.String(databaseName),
+			},
+		})
+		m.databaseName = database.Ref()
+
+		partitioned := map[string]bool{}
+		for _, key := range p.partitionKeys {
+			partitioned[key] = true
+		}
+		columns := []awsglue.CfnTable_ColumnProperty{}
+		for _, column := range props.Columns {
+			name := strings.ToLower(column.Name)
+			if partitioned[name] {
+				continue
+			}
+			col := awsglue.CfnTable_ColumnProperty{Name: jsii.String(name), Type: jsii.String(column.Type)}
+			if len(column.Comment) > 0 {
+				col.Comment = jsii.String(column.Comment)
+			}
+			columns = append(columns, col)
+		}
+		p.parameters["classification"] = "json"
+		m.table = awsglue.NewCfnTable(this, jsii.String("GlueTable"), &awsglue.CfnTableProps{
+			CatalogId:    awscdk.Aws_ACCOUNT_ID(),
+			DatabaseName: database.Ref(),
+			TableInput: &awsglue.CfnTable_TableInputProperty{
+				Name:          jsii.String(tableName),
+				TableType:     jsii.String("EXTERNAL_TABLE"),
+				Parameters:    p.parameters,
+				PartitionKeys: p.columns(),
+				StorageDescriptor: &awsglue.CfnTable_StorageDescriptorProperty{
+					Columns:      columns,
+					Location:     jsii.String(fmt.Sprintf("s3://%s/%s", *firehose.Bucket().BucketName(), firehose.Prefix())),
+					InputFormat:  jsii.String("org.apache.hadoop.mapred.TextInputFormat"),
+					OutputFormat: jsii.String("org.apache.hadoop.hive.ql.io.HiveIgnoreKeyTextOutputFormat"),
+					SerdeInfo: &awsglue.CfnTable_SerdeInfoProperty{
+						// gzip/snappy objects are read by the extension of the firehose keys
+						SerializationLibrary: jsii.String("org.openx.data.jsonserde.JsonSerDe"),
+						Parameters:           map[string]string{"ignore.malformed.json": "true"},
+					},
+				},
+			},
+		})
+	}
+	m.tableName = m.table.Ref()
+
+	resultExpiration := props.ResultExpiration
+	if resultExpiration == nil {
+		resultExpiration = awscdk.Duration_Days(jsii.Number(30))
+	}
+	resultBucketProps := &awss3.BucketProps{
+		BlockPublicAccess: awss3.BlockPublicAccess_BLOCK_ALL(),
+		Encryption:        awss3.BucketEncryption_S3_MANAGED,
+		LifecycleRules: &[]*awss3.LifecycleRule{
+			{Expiration: resultExpiration},
+		},
+	}
+	props.Profile.orDev().ApplyBucketProps(resultBucketProps, false)
+	// the query results are user data too, encrypted by the key of the archive
+	resultEncryption := &awsathena.CfnWorkGroup_EncryptionConfigurationProperty{
+		EncryptionOption: jsii.String("SSE_S3"),
+	}
+	if encryptionKey := firehose.EncryptionKey(); encryptionKey != nil {
+		resultBucketProps.Encryption = awss3.BucketEncryption_KMS
+		resultBucketProps.EncryptionKey = encryptionKey
+		resultBucketProps.BucketKeyEnabled = jsii.Bool(true)
+		resultEncryption = &awsathena.CfnWorkGroup_EncryptionConfigurationProperty{
+			EncryptionOption: jsii.String("SSE_KMS"),
+			KmsKey:           encryptionKey.KeyArn(),
+		}
+	}
+	m.resultBucket = awss3.NewBucket(this, jsii.String("QueryResultBucket"), resultBucketProps)
+
+	workGroupName := props.WorkGroupName
+	if len(workGroupName) == 0 {
+		workGroupName = "user_behavior_analytics"
+	}
+	workGroupConfiguration := &awsathena.CfnWorkGroup_WorkGroupConfigurationProperty{
+		EnforceWorkGroupConfiguration:   jsii.Bool(true),
+		PublishCloudWatchMetricsEnabled: jsii.Bool(true),
+		ResultConfiguration: &awsathena.CfnWorkGroup_ResultConfigurationProperty{
+			OutputLocation:          jsii.String(fmt.Sprintf("s3://%s/results/", *m.resultBucket.BucketName())),
+			EncryptionConfiguration: resultEncryption,
+		},
+	}
+	if props.BytesScannedCutoffPerQuery > 0 {
+		workGroupConfiguration.BytesScannedCutoffPerQuery = jsii.Number(float64(props.BytesScannedCutoffPerQuery))
+	}
+	m.workGroup = awsathena.NewCfnWorkGroup(this, jsii.String("WorkGroup"), &awsathena.CfnWorkGroupProps{
+		Name:                   jsii.String(workGroupName),
+		Description:            jsii.String("user behavior event analytics"),
+		RecursiveDeleteOption:  jsii.Bool(true),
+		WorkGroupConfiguration: workGroupConfiguration,
+	})
+
+	for _, q := range namedQueries {
+		namedQuery := awsathena.NewCfnNamedQuery(this, jsii.String(q.name), &awsathena.CfnNamedQueryProps{
+			Name:        jsii.String(q.name),
+			Description: jsii.String(q.description),
+			Database:    m.databaseName,
+			WorkGroup:   m.workGroup.Ref(),
+			QueryString: jsii.String(fmt.Sprintf(q.sql, *m.databaseName, *m.tableName, p.where)),
+		})
+		namedQuery.AddDependsOn(m.workGroup)
+		m.namedQueries = append(m.namedQueries, namedQuery)
+	}
+
+	awscdk.NewCfnOutput(this, jsii.String("AthenaWorkGroup"), &awscdk.CfnOutputProps{
+		Value: m.workGroup.Ref(),
+	})
+	awscdk.NewCfnOutput(this, jsii.String("GlueTableName"), &awscdk.CfnOutputProps{
+		Value: jsii.String(*m.databaseName + "." + *m.tableName),
+	})
+
+	return m
+}
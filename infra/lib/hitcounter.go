@@ -1,10 +1,10 @@
 package lib
 
 import (
-	"github.com/aws/aws-cdk-go/awscdk/v2"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsdynamodb"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awskinesis"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	awscdklambdago "github.com/aws/aws-cdk-go/awscdklambdagoalpha/v2"
 	"github.com/aws/constructs-go/constructs/v10"
 	"github.com/aws/jsii-runtime-go"
 )
@@ -13,6 +13,11 @@ type HitCounterProps struct {
 	Downstream   awslambda.IFunction
 	ReadCapacity float64
 	EventStream  awskinesis.Stream
+	// UseGoCollector replaces the node hitcounter handler with the go event collector src/lambda/collect-event-to-kds,
+	// it validates POST /event single and batch payloads by the event schema and puts them with PutRecords
+	UseGoCollector bool
+	// Profile sets the removal policy, point in time recovery and deletion protection of the hits table, nil is dev
+	Profile *StageProfile
 }
 
 type hitCounter struct {
@@ -37,23 +42,32 @@ func NewHitCounter(scope constructs.Construct, id string, props *HitCounterProps
 
 	this := constructs.NewConstruct(scope, &id)
 
-	table := awsdynamodb.NewTable(this, jsii.String("Hits"), &awsdynamodb.TableProps{
-		PartitionKey:  &awsdynamodb.Attribute{Name: jsii.String("path"), Type: awsdynamodb.AttributeType_STRING},
-		RemovalPolicy: awscdk.RemovalPolicy_DESTROY,
-		Encryption:    awsdynamodb.TableEncryption_AWS_MANAGED,
-		ReadCapacity:  &props.ReadCapacity,
+	table := props.Profile.orDev().NewTable(this, "Hits", &awsdynamodb.TableProps{
+		PartitionKey: &awsdynamodb.Attribute{Name: jsii.String("path"), Type: awsdynamodb.AttributeType_STRING},
+		Encryption:   awsdynamodb.TableEncryption_AWS_MANAGED,
+		ReadCapacity: &props.ReadCapacity,
 	})
 
-	handler := awslambda.NewFunction(this, jsii.String("HitCounterHandler"), &awslambda.FunctionProps{
-		Runtime: awslambda.Runtime_NODEJS_16_X(),
-		Handler: jsii.String("hitcounter.handler"),
-		Code:    awslambda.Code_FromAsset(jsii.String("src/lambda/js-func/hitcounter"), nil),
-		Environment: &map[string]*string{
-			"DOWNSTREAM_FUNCTION_NAME": props.Downstream.FunctionName(),
-			"HITS_TABLE_NAME":          table.TableName(),
-			"HITS_STREAM_NAME":         props.EventStream.StreamName(),
-		},
-	})
+	environment := &map[string]*string{
+		"DOWNSTREAM_FUNCTION_NAME": props.Downstream.FunctionName(),
+		"HITS_TABLE_NAME":          table.TableName(),
+		"HITS_STREAM_NAME":         props.EventStream.StreamName(),
+	}
+	var handler awslambda.IFunction
+	if props.UseGoCollector {
+		handler = awscdklambdago.NewGoFunction(this, jsii.String("CollectEventHandler"), &awscdklambdago.GoFunctionProps{
+			Description: jsii.String("count hits, collect user behavior events into kinesis data stream and call downstream function"),
+			Entry:       jsii.String("src/lambda/collect-event-to-kds"),
+			Environment: environment,
+		})
+	} else {
+		handler = awslambda.NewFunction(this, jsii.String("HitCounterHandler"), &awslambda.FunctionProps{
+			Runtime:     awslambda.Runtime_NODEJS_16_X(),
+			Handler:     jsii.String("hitcounter.handler"),
+			Code:        awslambda.Code_FromAsset(jsii.String("src/lambda/js-func/hitcounter"), nil),
+			Environment: environment,
+		})
+	}
 
 	table.GrantReadWriteData(handler)
 	props.Downstream.GrantInvoke(handler)
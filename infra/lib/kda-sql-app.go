@@ -0,0 +1,205 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskinesis"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskinesisanalytics"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskinesisfirehose"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// KdaSqlColumn maps one json field of the input record to an in-application stream column
+// https://docs.aws.amazon.com/zh_cn/kinesisanalytics/latest/dev/sch-mapping.html
+type KdaSqlColumn struct {
+	Name string
+	// SqlType e.g. VARCHAR(64), INTEGER, TIMESTAMP
+	SqlType string
+	// Mapping is the json path of the field, default $.Name
+	Mapping string
+}
+
+// KdaSqlSchema is the json input record schema of the in-application source stream
+type KdaSqlSchema struct {
+	Columns []KdaSqlColumn
+	// RecordRowPath default $, https://docs.aws.amazon.com/zh_cn/kinesisanalytics/latest/dev/about-json-path.html
+	RecordRowPath string
+}
+
+// KdaSqlOutput delivers an in-application stream to one of Lambda, Firehose or Kinesis stream
+type KdaSqlOutput struct {
+	// Name is the in-application stream name, default DESTINATION_SQL_STREAM
+	Name     string
+	Lambda   awslambda.IFunction
+	Firehose awskinesisfirehose.CfnDeliveryStream
+	Stream   awskinesis.IStream
+	// RecordFormatType JSON or CSV, default JSON
+	RecordFormatType string
+}
+
+type KdaSqlAppProps struct {
+	ApplicationName string
+	Description     string
+	// SqlFile is the application code path relative to the cdk app dir, e.g. src/kinesis-analytics-sql/filter-abnormality-event.sql
+	SqlFile     string
+	InputStream awskinesis.IStream
+	// InputNamePrefix default SOURCE_SQL_STREAM, the first in-application input stream is SOURCE_SQL_STREAM_001
+	InputNamePrefix string
+	Schema          *KdaSqlSchema
+	Outputs         []KdaSqlOutput
+}
+
+type kdaSqlAppConstruct struct {
+	constructs.Construct
+	application awskinesisanalytics.CfnApplication
+	role        awsiam.Role
+}
+
+func (m *kdaSqlAppConstruct) Application() awskinesisanalytics.CfnApplication {
+	return m.application
+}
+func (m *kdaSqlAppConstruct) Role() awsiam.Role {
+	return m.role
+}
+
+type IKdaSqlAppConstruct interface {
+	constructs.Construct
+	Application() awskinesisanalytics.CfnApplication
+	Role() awsiam.Role
+}
+
+// NewKdaSqlAppConstruct creates the kinesis analytics sql(old version) app which reads the input stream with the schema,
+// the app role which can read the input and write every output, and the app outputs
+func NewKdaSqlAppConstruct(scope constructs.Construct, id string, props *KdaSqlAppProps) IKdaSqlAppConstruct {
+	if len(strings.Trim(props.ApplicationName, " ")) == 0 {
+		panic("ApplicationName is empty")
+	}
+	if props.Schema == nil || len(props.Schema.Columns) == 0 {
+		panic("Schema has no columns")
+	}
+	sqlCode, err := os.ReadFile(props.SqlFile)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	this := constructs.NewConstruct(scope, &id)
+
+	// create stream analytics role for kinesis analytics app
+	role := awsiam.NewRole(this, jsii.String("streamToAnalyticsRole"), &awsiam.RoleProps{
+		AssumedBy: awsiam.NewServicePrincipal(jsii.String("kinesisanalytics.amazonaws.com"), nil),
+	})
+	props.InputStream.GrantRead(role)
+	props.InputStream.Grant(role, jsii.String("kinesis:DescribeStream"))
+
+	inputNamePrefix := props.InputNamePrefix
+	if len(inputNamePrefix) == 0 {
+		inputNamePrefix = "SOURCE_SQL_STREAM"
+	}
+	recordRowPath := props.Schema.RecordRowPath
+	if len(recordRowPath) == 0 {
+		recordRowPath = "$"
+	}
+	recordColumns := make([]awskinesisanalytics.CfnApplication_RecordColumnProperty, len(props.Schema.Columns))
+	for i, column := range props.Schema.Columns {
+		mapping := column.Mapping
+		if len(mapping) == 0 {
+			mapping = "$." + column.Name
+		}
+		recordColumns[i] = awskinesisanalytics.CfnApplication_RecordColumnProperty{
+			Name:    jsii.String(column.Name),
+			SqlType: jsii.String(column.SqlType),
+			Mapping: jsii.String(mapping),
+		}
+	}
+
+	application := awskinesisanalytics.NewCfnApplication(this, jsii.String("Application"), &awskinesisanalytics.CfnApplicationProps{
+		ApplicationName:        jsii.String(props.ApplicationName),
+		ApplicationDescription: jsii.String(props.Description),
+		ApplicationCode:        jsii.String(string(sqlCode)),
+		// https://docs.aws.amazon.com/zh_cn/kinesisanalytics/latest/dev/how-it-works-input.html
+		Inputs: []awskinesisanalytics.CfnApplication_InputProperty{
+			{
+				NamePrefix: jsii.String(inputNamePrefix),
+				KinesisStreamsInput: &awskinesisanalytics.CfnApplication_KinesisStreamsInputProperty{
+					ResourceArn: props.InputStream.StreamArn(),
+					RoleArn:     role.RoleArn(),
+				},
+				InputParallelism: &awskinesisanalytics.CfnApplication_InputParallelismProperty{
+					Count: jsii.Number(1),
+				},
+				InputSchema: &awskinesisanalytics.CfnApplication_InputSchemaProperty{
+					RecordFormat: &awskinesisanalytics.CfnApplication_RecordFormatProperty{
+						RecordFormatType: jsii.String("JSON"),
+						MappingParameters: &awskinesisanalytics.CfnApplication_MappingParametersProperty{
+							JsonMappingParameters: &awskinesisanalytics.CfnApplication_JSONMappingParametersProperty{
+								RecordRowPath: jsii.String(recordRowPath),
+							},
+						},
+					},
+					RecordEncoding: jsii.String("UTF-8"),
+					RecordColumns:  recordColumns,
+				},
+			},
+		},
+	})
+	// the role policy must be attached before kinesis analytics validates the input
+	application.Node().AddDependency(role)
+
+	for i, output := range props.Outputs {
+		if len(output.Name) == 0 {
+			output.Name = "DESTINATION_SQL_STREAM"
+		}
+		if len(output.RecordFormatType) == 0 {
+			output.RecordFormatType = "JSON"
+		}
+		outputProperty := &awskinesisanalytics.CfnApplicationOutput_OutputProperty{
+			Name: jsii.String(output.Name),
+			DestinationSchema: &awskinesisanalytics.CfnApplicationOutput_DestinationSchemaProperty{
+				RecordFormatType: jsii.String(output.RecordFormatType),
+			},
+		}
+		switch {
+		case output.Lambda != nil:
+			output.Lambda.GrantInvoke(role)
+			role.AddToPolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+				Actions:   &[]*string{jsii.String("lambda:GetFunctionConfiguration")},
+				Resources: &[]*string{output.Lambda.FunctionArn()},
+			}))
+			outputProperty.LambdaOutput = &awskinesisanalytics.CfnApplicationOutput_LambdaOutputProperty{
+				ResourceArn: output.Lambda.FunctionArn(),
+				RoleArn:     role.RoleArn(),
+			}
+		case output.Firehose != nil:
+			role.AddToPolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+				Actions:   &[]*string{jsii.String("firehose:DescribeDeliveryStream"), jsii.String("firehose:PutRecord"), jsii.String("firehose:PutRecordBatch")},
+				Resources: &[]*string{output.Firehose.AttrArn()},
+			}))
+			outputProperty.KinesisFirehoseOutput = &awskinesisanalytics.CfnApplicationOutput_KinesisFirehoseOutputProperty{
+				ResourceArn: output.Firehose.AttrArn(),
+				RoleArn:     role.RoleArn(),
+			}
+		case output.Stream != nil:
+			output.Stream.GrantWrite(role)
+			output.Stream.Grant(role, jsii.String("kinesis:DescribeStream"))
+			outputProperty.KinesisStreamsOutput = &awskinesisanalytics.CfnApplicationOutput_KinesisStreamsOutputProperty{
+				ResourceArn: output.Stream.StreamArn(),
+				RoleArn:     role.RoleArn(),
+			}
+		default:
+			panic(fmt.Sprintf("output %d has no Lambda, Firehose or Stream", i))
+		}
+
+		applicationOutput := awskinesisanalytics.NewCfnApplicationOutput(this, jsii.String(fmt.Sprintf("ApplicationOutput%d", i)), &awskinesisanalytics.CfnApplicationOutputProps{
+			ApplicationName: application.Ref(),
+			Output:          outputProperty,
+		})
+		applicationOutput.Node().AddDependency(application, role)
+	}
+
+	return &kdaSqlAppConstruct{Construct: this, application: application, role: role}
+}
@@ -1,28 +1,93 @@
 package lib
 
 import (
+	"fmt"
 	"strings"
 
 	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsglue"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awskinesis"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awskinesisfirehose"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskms"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
 	"github.com/aws/constructs-go/constructs/v10"
 	"github.com/aws/jsii-runtime-go"
 )
 
+// GlueColumn is one column of the glue table, Type is a hive type e.g. string, bigint
+type GlueColumn struct {
+	Name    string
+	Type    string
+	Comment string
+}
+
+// record format conversion serdes, https://docs.aws.amazon.com/firehose/latest/dev/record-format-conversion.html
+var recordFormatSerdes = map[string]struct {
+	serializationLibrary, inputFormat, outputFormat string
+}{
+	"PARQUET": {
+		"org.apache.hadoop.hive.ql.io.parquet.serde.ParquetHiveSerDe",
+		"org.apache.hadoop.hive.ql.io.parquet.MapredParquetInputFormat",
+		"org.apache.hadoop.hive.ql.io.parquet.MapredParquetOutputFormat",
+	},
+	"ORC": {
+		"org.apache.hadoop.hive.ql.io.orc.OrcSerde",
+		"org.apache.hadoop.hive.ql.io.orc.OrcInputFormat",
+		"org.apache.hadoop.hive.ql.io.orc.OrcOutputFormat",
+	},
+}
+
 type KdsFirehoseS3Props struct {
 	StreamName string
 	// For valid values, see the `CompressionFormat` content for the [S3DestinationConfiguration](https://docs.aws.amazon.com/firehose/latest/APIReference/API_S3DestinationConfiguration.html) data type in the *Amazon Kinesis Data Firehose API Reference* .
+	// it's UNCOMPRESSED with RecordFormat, the parquet/orc files are snappy compressed
 	CompressionFormat string
 	UseStream         awskinesis.Stream
+
+	// Prefix of the delivered objects, default raw/, or parquet/ orc/ with RecordFormat
+	Prefix string
+	// ErrorOutputPrefix of the records firehose fails to partition, convert or deliver,
+	// default errors/!{firehose:error-output-type}/!{timestamp:yyyy/MM/dd}/
+	ErrorOutputPrefix string
+
+	// DynamicPartitioning delivers the events to <Prefix>dt=yyyy-MM-dd/hour=HH/<PartitionKeys>=<value>/,
+	// dt and hour are from the event createdAt, the keys are extracted by a JQ query
+	// https://docs.aws.amazon.com/firehose/latest/dev/dynamic-partitioning.html
+	DynamicPartitioning bool
+	// PartitionKeys are json fields of the event after dt and hour, default bizId, an empty value is unknown
+	PartitionKeys []string
+
+	// RecordFormat PARQUET or ORC converts the json events by the glue table the construct creates,
+	// empty delivers the events as newline delimited json with DynamicPartitioning, as is without it
+	RecordFormat string
+	// Columns of the glue table, required with RecordFormat
+	Columns []GlueColumn
+	// GlueDatabaseName default user_behavior_analytics
+	GlueDatabaseName string
+	// GlueTableName default user_behavior_event
+	GlueTableName string
+
+	// EncryptionKey is the KMS CMK of the stream it creates, the bucket and the firehose destination,
+	// nil with Encrypt creates a key with rotation, UseStream keeps its own encryption
+	EncryptionKey awskms.IKey
+	Encrypt       bool
+
+	// Profile sets the removal policy, versioning and lifecycle of the bucket, nil is dev
+	Profile *StageProfile
 }
 
 type kdsFirehoseS3Construct struct {
 	constructs.Construct
-	stream awskinesis.Stream
-	bucket awss3.Bucket
+	stream         awskinesis.Stream
+	bucket         awss3.Bucket
+	deliveryStream awskinesisfirehose.CfnDeliveryStream
+	prefix         string
+	partitionKeys  []string
+	recordFormat   string
+	glueDatabase   awsglue.CfnDatabase
+	glueTable      awsglue.CfnTable
+	encryptionKey  awskms.IKey
 }
 
 func (m *kdsFirehoseS3Construct) Stream() awskinesis.Stream {
@@ -31,26 +96,82 @@ func (m *kdsFirehoseS3Construct) Stream() awskinesis.Stream {
 func (m *kdsFirehoseS3Construct) Bucket() awss3.Bucket {
 	return m.bucket
 }
+func (m *kdsFirehoseS3Construct) DeliveryStream() awskinesisfirehose.CfnDeliveryStream {
+	return m.deliveryStream
+}
+func (m *kdsFirehoseS3Construct) Prefix() string {
+	return m.prefix
+}
+func (m *kdsFirehoseS3Construct) PartitionKeys() []string {
+	return m.partitionKeys
+}
+func (m *kdsFirehoseS3Construct) RecordFormat() string {
+	return m.recordFormat
+}
+func (m *kdsFirehoseS3Construct) GlueDatabase() awsglue.CfnDatabase {
+	return m.glueDatabase
+}
+func (m *kdsFirehoseS3Construct) GlueTable() awsglue.CfnTable {
+	return m.glueTable
+}
+func (m *kdsFirehoseS3Construct) EncryptionKey() awskms.IKey {
+	return m.encryptionKey
+}
 
 type IKdsFirehoseS3Construct interface {
 	constructs.Construct
 	Stream() awskinesis.Stream
 	Bucket() awss3.Bucket
+	DeliveryStream() awskinesisfirehose.CfnDeliveryStream
+	// Prefix is the static key prefix of the delivered objects, e.g. raw/
+	Prefix() string
+	// PartitionKeys are the hive partitions under Prefix, e.g. dt hour bizId, nil without DynamicPartitioning
+	PartitionKeys() []string
+	// RecordFormat PARQUET, ORC or empty for json
+	RecordFormat() string
+	// GlueDatabase and GlueTable of the record format conversion, nil without RecordFormat
+	GlueDatabase() awsglue.CfnDatabase
+	GlueTable() awsglue.CfnTable
+	// EncryptionKey of the bucket and the firehose destination, nil without encryption
+	EncryptionKey() awskms.IKey
 }
 
 func NewKdsFirehoseS3Construct(scope constructs.Construct, id string, props *KdsFirehoseS3Props) IKdsFirehoseS3Construct {
 	if len(strings.Trim(props.StreamName, " ")) == 0 {
 		panic("StreamName is empty")
 	}
+	recordFormat := strings.ToUpper(props.RecordFormat)
+	if len(recordFormat) > 0 {
+		if _, ok := recordFormatSerdes[recordFormat]; !ok {
+			panic(fmt.Sprintf("RecordFormat %s isn't PARQUET or ORC", props.RecordFormat))
+		}
+		if len(props.Columns) == 0 {
+			panic("RecordFormat needs the glue table Columns")
+		}
+	}
 
 	this := constructs.NewConstruct(scope, &id)
+	profile := props.Profile.orDev()
+	encryptionKey := props.EncryptionKey
+	if encryptionKey == nil && props.Encrypt {
+		encryptionKey = NewEncryptionKey(this, "EncryptionKey", "user behavior event stream and raw data bucket", profile)
+	}
+
 	var dataStream awskinesis.Stream
 	if props.UseStream != nil {
 		dataStream = props.UseStream
+	} else if encryptionKey != nil {
+		dataStream = awskinesis.NewStream(this, jsii.String(props.StreamName), &awskinesis.StreamProps{
+			Encryption:    awskinesis.StreamEncryption_KMS,
+			EncryptionKey: encryptionKey,
+		})
 	} else {
 		// new kinesis data stream
 		dataStream = awskinesis.NewStream(this, jsii.String(props.StreamName), nil)
 	}
+	if props.UseStream == nil {
+		dataStream.ApplyRemovalPolicy(profile.RemovalPolicy)
+	}
 
 	// outPut the stream name so can connect our script to this stream
 	awscdk.NewCfnOutput(this, jsii.String("DataStreamName"), &awscdk.CfnOutputProps{
@@ -58,10 +179,16 @@ func NewKdsFirehoseS3Construct(scope constructs.Construct, id string, props *Kds
 	})
 
 	// S3 bucket that serve as the desc
-	rawDataBucket := awss3.NewBucket(this, jsii.String("RawDataBucket"), &awss3.BucketProps{
-		RemovalPolicy:     awscdk.RemovalPolicy_DESTROY, // REMOVE FOR PRODUCTION
-		AutoDeleteObjects: jsii.Bool(true),              // REMOVE FOR PROUCTION
-	})
+	bucketProps := &awss3.BucketProps{}
+	profile.ApplyBucketProps(bucketProps, true)
+	if encryptionKey != nil {
+		bucketProps.Encryption = awss3.BucketEncryption_KMS
+		bucketProps.EncryptionKey = encryptionKey
+		// fewer kms requests of the many small firehose objects
+		bucketProps.BucketKeyEnabled = jsii.Bool(true)
+		bucketProps.EnforceSSL = jsii.Bool(true)
+	}
+	rawDataBucket := awss3.NewBucket(this, jsii.String("RawDataBucket"), bucketProps)
 
 	firehoseRole := awsiam.NewRole(this, jsii.String("firehoseRole"), &awsiam.RoleProps{
 		AssumedBy: awsiam.NewServicePrincipal(jsii.String("firehose.amazonaws.com"), nil),
@@ -71,31 +198,226 @@ func NewKdsFirehoseS3Construct(scope constructs.Construct, id string, props *Kds
 	dataStream.Grant(firehoseRole, jsii.String("kinesis:DescribeStream"))
 	rawDataBucket.GrantWrite(firehoseRole, nil)
 
-	firehoseDeliveryStreamToS3 := awskinesisfirehose.NewCfnDeliveryStream(this, jsii.String("FirehoseDeliveryStreamToS3"), &awskinesisfirehose.CfnDeliveryStreamProps{
-		//DeliveryStreamName: jsii.String("RawDataStreamToS3"),
-		DeliveryStreamType: jsii.String("KinesisStreamAsSource"),
-		KinesisStreamSourceConfiguration: &awskinesisfirehose.CfnDeliveryStream_KinesisStreamSourceConfigurationProperty{
-			KinesisStreamArn: dataStream.StreamArn(),
-			RoleArn:          firehoseRole.RoleArn(),
-		},
-		S3DestinationConfiguration: &awskinesisfirehose.CfnDeliveryStream_S3DestinationConfigurationProperty{
-			BucketArn: rawDataBucket.BucketArn(),
-			RoleArn:   firehoseRole.RoleArn(),
-			BufferingHints: &awskinesisfirehose.CfnDeliveryStream_BufferingHintsProperty{
-				IntervalInSeconds: jsii.Number(60),
-				SizeInMBs:         jsii.Number(64),
+	prefix := props.Prefix
+	if len(prefix) == 0 {
+		prefix = "raw/"
+		if len(recordFormat) > 0 {
+			prefix = strings.ToLower(recordFormat) + "/"
+		}
+	}
+	errorOutputPrefix := props.ErrorOutputPrefix
+	if len(errorOutputPrefix) == 0 {
+		errorOutputPrefix = "errors/!{firehose:error-output-type}/!{timestamp:yyyy/MM/dd}/"
+	}
+
+	m := &kdsFirehoseS3Construct{Construct: this, stream: dataStream, bucket: rawDataBucket, prefix: prefix, recordFormat: recordFormat, encryptionKey: encryptionKey}
+	sourceConfiguration := &awskinesisfirehose.CfnDeliveryStream_KinesisStreamSourceConfigurationProperty{
+		KinesisStreamArn: dataStream.StreamArn(),
+		RoleArn:          firehoseRole.RoleArn(),
+	}
+	bufferingHints := &awskinesisfirehose.CfnDeliveryStream_BufferingHintsProperty{
+		IntervalInSeconds: jsii.Number(60),
+		// dynamic partitioning needs at least 64MB
+		SizeInMBs: jsii.Number(64),
+	}
+	encryptionConfiguration := &awskinesisfirehose.CfnDeliveryStream_EncryptionConfigurationProperty{
+		NoEncryptionConfig: jsii.String("NoEncryption"),
+	}
+	if encryptionKey != nil {
+		encryptionConfiguration = &awskinesisfirehose.CfnDeliveryStream_EncryptionConfigurationProperty{
+			KmsEncryptionConfig: &awskinesisfirehose.CfnDeliveryStream_KMSEncryptionConfigProperty{
+				AwskmsKeyArn: encryptionKey.KeyArn(),
 			},
-			CompressionFormat: jsii.String(props.CompressionFormat),
-			//CompressionFormat: jsii.String("UNCOMPRESSED"),
-			EncryptionConfiguration: &awskinesisfirehose.CfnDeliveryStream_EncryptionConfigurationProperty{
-				NoEncryptionConfig: jsii.String("NoEncryption"),
+		}
+		encryptionKey.GrantEncryptDecrypt(firehoseRole)
+	}
+
+	var firehoseDeliveryStreamToS3 awskinesisfirehose.CfnDeliveryStream
+	if !props.DynamicPartitioning && len(recordFormat) == 0 {
+		firehoseDeliveryStreamToS3 = awskinesisfirehose.NewCfnDeliveryStream(this, jsii.String("FirehoseDeliveryStreamToS3"), &awskinesisfirehose.CfnDeliveryStreamProps{
+			//DeliveryStreamName: jsii.String("RawDataStreamToS3"),
+			DeliveryStreamType:               jsii.String("KinesisStreamAsSource"),
+			KinesisStreamSourceConfiguration: sourceConfiguration,
+			S3DestinationConfiguration: &awskinesisfirehose.CfnDeliveryStream_S3DestinationConfigurationProperty{
+				BucketArn:         rawDataBucket.BucketArn(),
+				RoleArn:           firehoseRole.RoleArn(),
+				BufferingHints:    bufferingHints,
+				CompressionFormat: jsii.String(props.CompressionFormat),
+				//CompressionFormat: jsii.String("UNCOMPRESSED"),
+				EncryptionConfiguration: encryptionConfiguration,
+				Prefix:                  jsii.String(prefix),
+				ErrorOutputPrefix:       jsii.String(errorOutputPrefix),
 			},
-			Prefix: jsii.String("raw/"),
-		},
-	})
+		})
+	} else {
+		destination := &awskinesisfirehose.CfnDeliveryStream_ExtendedS3DestinationConfigurationProperty{
+			BucketArn:               rawDataBucket.BucketArn(),
+			RoleArn:                 firehoseRole.RoleArn(),
+			BufferingHints:          bufferingHints,
+			CompressionFormat:       jsii.String(props.CompressionFormat),
+			EncryptionConfiguration: encryptionConfiguration,
+			Prefix:                  jsii.String(prefix),
+			ErrorOutputPrefix:       jsii.String(errorOutputPrefix),
+		}
+
+		processors := []awskinesisfirehose.CfnDeliveryStream_ProcessorProperty{}
+		if props.DynamicPartitioning {
+			partitionKeys := props.PartitionKeys
+			if len(partitionKeys) == 0 {
+				partitionKeys = []string{"bizId"}
+			}
+			m.partitionKeys = append([]string{"dt", "hour"}, partitionKeys...)
+
+			// createdAt is 2022-11-11 11:11:11.000000 or the js 2022-11-11T11:11:11.000Z
+			queries := []string{"dt: .createdAt[0:10]", "hour: .createdAt[11:13]"}
+			partitionPrefix := prefix + "dt=!{partitionKeyFromQuery:dt}/hour=!{partitionKeyFromQuery:hour}/"
+			for _, key := range partitionKeys {
+				queries = append(queries, fmt.Sprintf(`%s: (if (.%s // "") == "" then "unknown" else .%s end)`, key, key, key))
+				partitionPrefix += fmt.Sprintf("%s=!{partitionKeyFromQuery:%s}/", key, key)
+			}
+			destination.Prefix = jsii.String(partitionPrefix)
+			destination.DynamicPartitioningConfiguration = &awskinesisfirehose.CfnDeliveryStream_DynamicPartitioningConfigurationProperty{
+				Enabled: jsii.Bool(true),
+				RetryOptions: &awskinesisfirehose.CfnDeliveryStream_RetryOptionsProperty{
+					DurationInSeconds: jsii.Number(300),
+				},
+			}
+			processors = append(processors, awskinesisfirehose.CfnDeliveryStream_ProcessorProperty{
+				Type: jsii.String("MetadataExtraction"),
+				Parameters: []awskinesisfirehose.CfnDeliveryStream_ProcessorParameterProperty{
+					{ParameterName: jsii.String("MetadataExtractionQuery"), ParameterValue: jsii.String("{" + strings.Join(queries, ", ") + "}")},
+					{ParameterName: jsii.String("JsonParsingEngine"), ParameterValue: jsii.String("JQ-1.6")},
+				},
+			})
+			if len(recordFormat) == 0 {
+				// newline delimited json for athena
+				processors = append(processors, awskinesisfirehose.CfnDeliveryStream_ProcessorProperty{
+					Type: jsii.String("AppendDelimiterToRecord"),
+					Parameters: []awskinesisfirehose.CfnDeliveryStream_ProcessorParameterProperty{
+						{ParameterName: jsii.String("Delimiter"), ParameterValue: jsii.String("\\n")},
+					},
+				})
+			}
+		}
+		if len(processors) > 0 {
+			destination.ProcessingConfiguration = &awskinesisfirehose.CfnDeliveryStream_ProcessingConfigurationProperty{
+				Enabled:    jsii.Bool(true),
+				Processors: processors,
+			}
+		}
+
+		if len(recordFormat) > 0 {
+			m.glueDatabase, m.glueTable = newRecordFormatTable(this, props, recordFormat, rawDataBucket, prefix, m.partitionKeys)
+			firehoseRole.AddToPolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+				Actions: &[]*string{jsii.String("glue:GetTable"), jsii.String("glue:GetTableVersion"), jsii.String("glue:GetTableVersions")},
+				Resources: &[]*string{
+					awscdk.Stack_Of(this).FormatArn(&awscdk.ArnComponents{Service: jsii.String("glue"), Resource: jsii.String("catalog")}),
+					awscdk.Stack_Of(this).FormatArn(&awscdk.ArnComponents{Service: jsii.String("glue"), Resource: jsii.String("database"), ResourceName: m.glueDatabase.Ref()}),
+					awscdk.Stack_Of(this).FormatArn(&awscdk.ArnComponents{Service: jsii.String("glue"), Resource: jsii.String("table"), ResourceName: jsii.String(*m.glueDatabase.Ref() + "/" + *m.glueTable.Ref())}),
+				},
+			}))
+
+			serializer := &awskinesisfirehose.CfnDeliveryStream_SerializerProperty{}
+			if recordFormat == "PARQUET" {
+				serializer.ParquetSerDe = &awskinesisfirehose.CfnDeliveryStream_ParquetSerDeProperty{Compression: jsii.String("SNAPPY")}
+			} else {
+				serializer.OrcSerDe = &awskinesisfirehose.CfnDeliveryStream_OrcSerDeProperty{Compression: jsii.String("SNAPPY")}
+			}
+			// the files are compressed by the serializer
+			destination.CompressionFormat = jsii.String("UNCOMPRESSED")
+			destination.DataFormatConversionConfiguration = &awskinesisfirehose.CfnDeliveryStream_DataFormatConversionConfigurationProperty{
+				Enabled: jsii.Bool(true),
+				InputFormatConfiguration: &awskinesisfirehose.CfnDeliveryStream_InputFormatConfigurationProperty{
+					Deserializer: &awskinesisfirehose.CfnDeliveryStream_DeserializerProperty{
+						OpenXJsonSerDe: &awskinesisfirehose.CfnDeliveryStream_OpenXJsonSerDeProperty{},
+					},
+				},
+				OutputFormatConfiguration: &awskinesisfirehose.CfnDeliveryStream_OutputFormatConfigurationProperty{
+					Serializer: serializer,
+				},
+				SchemaConfiguration: &awskinesisfirehose.CfnDeliveryStream_SchemaConfigurationProperty{
+					CatalogId:    awscdk.Aws_ACCOUNT_ID(),
+					DatabaseName: m.glueDatabase.Ref(),
+					TableName:    m.glueTable.Ref(),
+					Region:       awscdk.Aws_REGION(),
+					RoleArn:      firehoseRole.RoleArn(),
+					VersionId:    jsii.String("LATEST"),
+				},
+			}
+		}
+
+		firehoseDeliveryStreamToS3 = awskinesisfirehose.NewCfnDeliveryStream(this, jsii.String("FirehoseDeliveryStreamToS3"), &awskinesisfirehose.CfnDeliveryStreamProps{
+			DeliveryStreamType:                 jsii.String("KinesisStreamAsSource"),
+			KinesisStreamSourceConfiguration:   sourceConfiguration,
+			ExtendedS3DestinationConfiguration: destination,
+		})
+	}
 
 	// Ensures firehose role is created before create a Kinesis Firehose
 	firehoseDeliveryStreamToS3.Node().AddDependency(firehoseRole)
+	m.deliveryStream = firehoseDeliveryStreamToS3
+
+	return m
+}
+
+// newRecordFormatTable creates the glue table the firehose record format conversion reads the schema from,
+// the partition keys are table partitions, they aren't stored in the files again
+func newRecordFormatTable(scope constructs.Construct, props *KdsFirehoseS3Props, recordFormat string, bucket awss3.Bucket, prefix string, partitionKeys []string) (awsglue.CfnDatabase, awsglue.CfnTable) {
+	databaseName := props.GlueDatabaseName
+	if len(databaseName) == 0 {
+		databaseName = "user_behavior_analytics"
+	}
+	tableName := props.GlueTableName
+	if len(tableName) == 0 {
+		tableName = "user_behavior_event"
+	}
+
+	database := awsglue.NewCfnDatabase(scope, jsii.String("GlueDatabase"), &awsglue.CfnDatabaseProps{
+		CatalogId: awscdk.Aws_ACCOUNT_ID(),
+		DatabaseInput: &awsglue.CfnDatabase_DatabaseInputProperty{
+			Name: jsii.String(databaseName),
+		},
+	})
+
+	partitioned := map[string]bool{}
+	partitionColumns := []awsglue.CfnTable_ColumnProperty{}
+	for _, key := range partitionKeys {
+		partitioned[key] = true
+		partitionColumns = append(partitionColumns, awsglue.CfnTable_ColumnProperty{Name: jsii.String(strings.ToLower(key)), Type: jsii.String("string")})
+	}
+	columns := []awsglue.CfnTable_ColumnProperty{}
+	for _, column := range props.Columns {
+		if partitioned[column.Name] {
+			continue
+		}
+		// glue column names are lower case, the openx json serde matches json keys case insensitively
+		col := awsglue.CfnTable_ColumnProperty{Name: jsii.String(strings.ToLower(column.Name)), Type: jsii.String(column.Type)}
+		if len(column.Comment) > 0 {
+			col.Comment = jsii.String(column.Comment)
+		}
+		columns = append(columns, col)
+	}
+
+	serde := recordFormatSerdes[recordFormat]
+	table := awsglue.NewCfnTable(scope, jsii.String("GlueTable"), &awsglue.CfnTableProps{
+		CatalogId:    awscdk.Aws_ACCOUNT_ID(),
+		DatabaseName: database.Ref(),
+		TableInput: &awsglue.CfnTable_TableInputProperty{
+			Name:          jsii.String(tableName),
+			TableType:     jsii.String("EXTERNAL_TABLE"),
+			Parameters:    map[string]string{"classification": strings.ToLower(recordFormat)},
+			PartitionKeys: partitionColumns,
+			StorageDescriptor: &awsglue.CfnTable_StorageDescriptorProperty{
+				Columns:      columns,
+				Location:     jsii.String(fmt.Sprintf("s3://%s/%s", *bucket.BucketName(), prefix)),
+				InputFormat:  jsii.String(serde.inputFormat),
+				OutputFormat: jsii.String(serde.outputFormat),
+				SerdeInfo: &awsglue.CfnTable_SerdeInfoProperty{
+					SerializationLibrary: jsii.String(serde.serializationLibrary),
+				},
+			},
+		},
+	})
 
-	return &kdsFirehoseS3Construct{stream: dataStream, bucket: rawDataBucket}
+	return database, table
 }
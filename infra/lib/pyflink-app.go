@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskinesis"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
+	"github.com/aws/constructs-go/constructs/v10"
+)
+
+// the property group ids of src/kinesis-analytics-pyflink/kda-pyflink-demo.py,
+// https://docs.aws.amazon.com/managed-flink/latest/java/how-python-creating.html
+const (
+	PyFlinkRunOptionsGroup = "kinesis.analytics.flink.run.options"
+	PyFlinkConsumerGroup   = "consumer.config.0"
+	PyFlinkSinkGroup       = "sink.config.0"
+)
+
+type PyFlinkAppProps struct {
+	ApplicationName string
+	Description     string
+	// Runtime default FLINK-1_13, the blink planner of the demo script is gone since 1.14
+	Runtime string
+	// CodePath is the dir zipped as the code, the python script with its connector jars, relative to the cdk app dir
+	CodePath string
+	// MainFile is the python script in CodePath, default kda-pyflink-demo.py
+	MainFile string
+	// JarFile is the connector jar in CodePath, e.g. lib/flink-sql-connector-kinesis_2.12-1.13.2.jar, empty without connector jar
+	JarFile string
+	// InputStream is read from the InitialPosition, LATEST (default), TRIM_HORIZON or AT_TIMESTAMP
+	InputStream     awskinesis.IStream
+	InitialPosition string
+	// OutputBucket is written by the filesystem sink
+	OutputBucket awss3.IBucket
+	// PropertyGroups are more runtime properties by group id, the script reads them from /etc/flink/application_properties.json
+	PropertyGroups map[string]map[string]string
+	// Parallelism, ParallelismPerKpu, AutoScaling, CheckpointInterval and LogLevel are the same as FlinkAppProps
+	Parallelism        int
+	ParallelismPerKpu  int
+	AutoScaling        bool
+	CheckpointInterval awscdk.Duration
+	LogLevel           string
+	Profile            *StageProfile
+}
+
+// NewPyFlinkAppConstruct creates the managed flink app of the pyflink script which reads InputStream and writes OutputBucket,
+// the run options, consumer and sink property groups are set from the props,
+// it panics at synth when MainFile or JarFile isn't in CodePath, e.g. the connector jar isn't downloaded
+func NewPyFlinkAppConstruct(scope constructs.Construct, id string, props *PyFlinkAppProps) IFlinkAppConstruct {
+	if props.InputStream == nil || props.OutputBucket == nil {
+		panic("PyFlinkApp needs the InputStream and the OutputBucket")
+	}
+	runtime := props.Runtime
+	if len(runtime) == 0 {
+		runtime = "FLINK-1_13"
+	}
+	mainFile := props.MainFile
+	if len(mainFile) == 0 {
+		mainFile = "kda-pyflink-demo.py"
+	}
+	for _, file := range []string{mainFile, props.JarFile} {
+		if len(file) == 0 {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(props.CodePath, file)); err != nil {
+			panic(fmt.Sprintf("PyFlinkApp file %s isn't in CodePath %s: %v", file, props.CodePath, err))
+		}
+	}
+	initialPosition := props.InitialPosition
+	if len(initialPosition) == 0 {
+		initialPosition = "LATEST"
+	}
+
+	runOptions := map[string]string{"python": mainFile}
+	if len(props.JarFile) > 0 {
+		runOptions["jarfile"] = props.JarFile
+	}
+	propertyGroups := map[string]map[string]string{
+		PyFlinkRunOptionsGroup: runOptions,
+		PyFlinkConsumerGroup: {
+			"input.stream.name":    *props.InputStream.StreamName(),
+			"aws.region":           *awscdk.Stack_Of(scope).Region(),
+			"flink.stream.initpos": initialPosition,
+		},
+		PyFlinkSinkGroup: {
+			"output.bucket.name": *props.OutputBucket.BucketName(),
+		},
+	}
+	for groupId, properties := range props.PropertyGroups {
+		if groupId == PyFlinkRunOptionsGroup {
+			panic(PyFlinkRunOptionsGroup + " is set by MainFile and JarFile")
+		}
+		if _, ok := propertyGroups[groupId]; !ok {
+			propertyGroups[groupId] = map[string]string{}
+		}
+		for k, v := range properties {
+			propertyGroups[groupId][k] = v
+		}
+	}
+
+	app := NewFlinkAppConstruct(scope, id, &FlinkAppProps{
+		ApplicationName:    props.ApplicationName,
+		Description:        props.Description,
+		Runtime:            runtime,
+		CodePath:           props.CodePath,
+		PropertyGroups:     propertyGroups,
+		Parallelism:        props.Parallelism,
+		ParallelismPerKpu:  props.ParallelismPerKpu,
+		AutoScaling:        props.AutoScaling,
+		CheckpointInterval: props.CheckpointInterval,
+		LogLevel:           props.LogLevel,
+		Profile:            props.Profile,
+	})
+	props.InputStream.GrantRead(app.Role())
+	props.OutputBucket.GrantReadWrite(app.Role(), nil)
+
+	return app
+}
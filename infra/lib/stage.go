@@ -0,0 +1,148 @@
+package lib
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsdynamodb"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// Stage is the deployment stage selected by the stage context, e.g. cdk deploy -c stage=prod
+type Stage string
+
+const (
+	StageDev     Stage = "dev"
+	StageStaging Stage = "staging"
+	StageProd    Stage = "prod"
+)
+
+// StageProfile is the retention and protection of the user data resources of a stage
+type StageProfile struct {
+	Stage Stage
+	// RemovalPolicy of the buckets, tables, keys and secrets when they leave the stack
+	RemovalPolicy awscdk.RemovalPolicy
+	// AutoDeleteObjects empties the buckets when the stack is deleted, only with RemovalPolicy_DESTROY
+	AutoDeleteObjects bool
+	// DeletionProtection protects the tables and the stacks from deletion
+	DeletionProtection  bool
+	PointInTimeRecovery bool
+	// Versioned keeps the overwritten and deleted archive objects for NoncurrentVersionExpiration
+	Versioned                   bool
+	NoncurrentVersionExpiration awscdk.Duration
+	// the archive moves to infrequent access and glacier instant retrieval, which athena and replay still read directly, nil keeps it in standard
+	InfrequentAccessAfter awscdk.Duration
+	GlacierAfter          awscdk.Duration
+	// ArchiveExpiration deletes the archive objects, nil keeps them
+	ArchiveExpiration awscdk.Duration
+	// KeyPendingWindow of a deleted KMS key, 7-30 days
+	KeyPendingWindow awscdk.Duration
+	// BackupRetention of the automated database backups, at least 1 day keeps the mysql binlog
+	BackupRetention awscdk.Duration
+}
+
+// NewStageProfile returns the profile of dev, staging or prod, it panics on another stage
+func NewStageProfile(stage Stage) *StageProfile {
+	switch stage {
+	case StageDev:
+		return &StageProfile{
+			Stage:             stage,
+			RemovalPolicy:     awscdk.RemovalPolicy_DESTROY,
+			AutoDeleteObjects: true,
+			ArchiveExpiration: awscdk.Duration_Days(jsii.Number(30)),
+			KeyPendingWindow:  awscdk.Duration_Days(jsii.Number(7)),
+			BackupRetention:   awscdk.Duration_Days(jsii.Number(1)),
+		}
+	case StageStaging:
+		return &StageProfile{
+			Stage:                       stage,
+			RemovalPolicy:               awscdk.RemovalPolicy_RETAIN,
+			PointInTimeRecovery:         true,
+			Versioned:                   true,
+			NoncurrentVersionExpiration: awscdk.Duration_Days(jsii.Number(7)),
+			InfrequentAccessAfter:       awscdk.Duration_Days(jsii.Number(30)),
+			ArchiveExpiration:           awscdk.Duration_Days(jsii.Number(90)),
+			KeyPendingWindow:            awscdk.Duration_Days(jsii.Number(30)),
+			BackupRetention:             awscdk.Duration_Days(jsii.Number(7)),
+		}
+	case StageProd:
+		return &StageProfile{
+			Stage:                       stage,
+			RemovalPolicy:               awscdk.RemovalPolicy_RETAIN,
+			DeletionProtection:          true,
+			PointInTimeRecovery:         true,
+			Versioned:                   true,
+			NoncurrentVersionExpiration: awscdk.Duration_Days(jsii.Number(30)),
+			InfrequentAccessAfter:       awscdk.Duration_Days(jsii.Number(30)),
+			GlacierAfter:                awscdk.Duration_Days(jsii.Number(90)),
+			KeyPendingWindow:            awscdk.Duration_Days(jsii.Number(30)),
+			BackupRetention:             awscdk.Duration_Days(jsii.Number(14)),
+		}
+	}
+	panic(fmt.Sprintf("stage %s isn't dev, staging or prod", stage))
+}
+
+// StageProfileOf returns the profile of the stage context of scope, default dev
+func StageProfileOf(scope constructs.Construct) *StageProfile {
+	stage, _ := scope.Node().TryGetContext(jsii.String("stage")).(string)
+	if len(stage) == 0 {
+		stage = string(StageDev)
+	}
+	return NewStageProfile(Stage(stage))
+}
+
+// orDev is the profile of a construct without one, dev keeps the demo behavior
+func (m *StageProfile) orDev() *StageProfile {
+	if m == nil {
+		return NewStageProfile(StageDev)
+	}
+	return m
+}
+
+// ApplyBucketProps sets the removal policy of the bucket, an archive bucket is also versioned with the lifecycle rules of the stage
+func (m *StageProfile) ApplyBucketProps(props *awss3.BucketProps, archive bool) {
+	props.RemovalPolicy = m.RemovalPolicy
+	props.AutoDeleteObjects = jsii.Bool(m.AutoDeleteObjects)
+	if !archive {
+		return
+	}
+
+	props.Versioned = jsii.Bool(m.Versioned)
+	rule := &awss3.LifecycleRule{
+		Id:                                  jsii.String(string(m.Stage) + "-archive"),
+		AbortIncompleteMultipartUploadAfter: awscdk.Duration_Days(jsii.Number(7)),
+		Expiration:                          m.ArchiveExpiration,
+	}
+	if m.Versioned {
+		rule.NoncurrentVersionExpiration = m.NoncurrentVersionExpiration
+	}
+	transitions := []*awss3.Transition{}
+	if m.InfrequentAccessAfter != nil {
+		transitions = append(transitions, &awss3.Transition{StorageClass: awss3.StorageClass_INFREQUENT_ACCESS(), TransitionAfter: m.InfrequentAccessAfter})
+	}
+	if m.GlacierAfter != nil {
+		transitions = append(transitions, &awss3.Transition{StorageClass: awss3.StorageClass_GLACIER_INSTANT_RETRIEVAL(), TransitionAfter: m.GlacierAfter})
+	}
+	if len(transitions) > 0 {
+		rule.Transitions = &transitions
+	}
+	rules := []*awss3.LifecycleRule{rule}
+	if props.LifecycleRules != nil {
+		rules = append(*props.LifecycleRules, rule)
+	}
+	props.LifecycleRules = &rules
+}
+
+// NewTable creates the table with the removal policy, point in time recovery and deletion protection of the stage
+func (m *StageProfile) NewTable(scope constructs.Construct, id string, props *awsdynamodb.TableProps) awsdynamodb.Table {
+	props.RemovalPolicy = m.RemovalPolicy
+	props.PointInTimeRecovery = jsii.Bool(m.PointInTimeRecovery)
+	table := awsdynamodb.NewTable(scope, jsii.String(id), props)
+	if m.DeletionProtection {
+		// TableProps has no deletion protection yet
+		table.Node().DefaultChild().(awsdynamodb.CfnTable).AddPropertyOverride(jsii.String("DeletionProtectionEnabled"), true)
+	}
+	return table
+}
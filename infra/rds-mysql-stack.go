@@ -1 +1,204 @@
 package infra
+
+import (
+	"fmt"
+	"user-behavior-analytics-cdk/infra/lib"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsec2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskms"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsrds"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssecretsmanager"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+/*
+infra: business db(RDS-Mysql) with ROW binlog, the CDC source of the order and user tables
+*/
+
+type RdsMysqlStackProps struct {
+	awscdk.StackProps
+	// Vpc is an existing vpc, VpcId looks one up (needs the stack env), none creates a vpc with public and isolated db subnets
+	Vpc   awsec2.IVpc
+	VpcId string
+	// VpcSubnets of the instance, default the isolated subnets of a created vpc, the private subnets of an existing one
+	VpcSubnets *awsec2.SubnetSelection
+	// DatabaseName default user_behavior
+	DatabaseName string
+	// InstanceType default t3.micro
+	InstanceType awsec2.InstanceType
+	// AllocatedStorage GiB default 20, the storage autoscales to 5 times
+	AllocatedStorage float64
+	// StorageEncryptionKey is a KMS CMK of the storage, nil is the aws managed key
+	StorageEncryptionKey awskms.IKey
+}
+
+type rdsMysqlStack struct {
+	awscdk.Stack
+	vpc           awsec2.IVpc
+	instance      awsrds.DatabaseInstance
+	secret        awssecretsmanager.ISecret
+	securityGroup awsec2.SecurityGroup
+	databaseName  string
+	vpcSubnets    *awsec2.SubnetSelection
+}
+
+func (m *rdsMysqlStack) Vpc() awsec2.IVpc {
+	return m.vpc
+}
+func (m *rdsMysqlStack) VpcSubnets() *awsec2.SubnetSelection {
+	return m.vpcSubnets
+}
+func (m *rdsMysqlStack) Instance() awsrds.DatabaseInstance {
+	return m.instance
+}
+func (m *rdsMysqlStack) Secret() awssecretsmanager.ISecret {
+	return m.secret
+}
+func (m *rdsMysqlStack) SecurityGroup() awsec2.SecurityGroup {
+	return m.securityGroup
+}
+func (m *rdsMysqlStack) DatabaseName() string {
+	return m.databaseName
+}
+
+// RdsMysqlStack is the CDC source, the CDC stacks connect with Secret (username, password, host, port) in the same Vpc
+type RdsMysqlStack interface {
+	awscdk.Stack
+	Vpc() awsec2.IVpc
+	// VpcSubnets of the instance, the default subnets of the CDC stacks in the Vpc
+	VpcSubnets() *awsec2.SubnetSelection
+	Instance() awsrds.DatabaseInstance
+	Secret() awssecretsmanager.ISecret
+	// SecurityGroup of the instance, it allows mysql from the vpc cidr
+	SecurityGroup() awsec2.SecurityGroup
+	DatabaseName() string
+}
+
+func NewRdsMysqlStack(scope constructs.Construct, id string, props *RdsMysqlStackProps) RdsMysqlStack {
+	var sprops awscdk.StackProps
+	if props != nil {
+		sprops = props.StackProps
+	}
+	stack := awscdk.NewStack(scope, &id, &sprops)
+	profile := lib.StageProfileOf(stack)
+
+	vpc := props.Vpc
+	vpcSubnets := props.VpcSubnets
+	if vpc == nil && len(props.VpcId) > 0 {
+		// an env-agnostic stack can't look up the vpc
+		if *awscdk.Token_IsUnresolved(stack.Account()) || *awscdk.Token_IsUnresolved(stack.Region()) {
+			panic(fmt.Sprintf("RdsMysqlStack VpcId %s needs the stack env account and region to look it up", props.VpcId))
+		}
+		vpc = awsec2.Vpc_FromLookup(stack, jsii.String("MysqlVpc"), &awsec2.VpcLookupOptions{VpcId: jsii.String(props.VpcId)})
+	}
+	if vpc == nil {
+		// no nat, the cdc tasks are in the vpc
+		vpc = awsec2.NewVpc(stack, jsii.String("MysqlVpc"), &awsec2.VpcProps{
+			IpAddresses:        awsec2.IpAddresses_Cidr(jsii.String("10.20.0.0/16")),
+			EnableDnsHostnames: jsii.Bool(true),
+			EnableDnsSupport:   jsii.Bool(true),
+			MaxAzs:             jsii.Number(2),
+			NatGateways:        jsii.Number(0),
+			SubnetConfiguration: &[]*awsec2.SubnetConfiguration{
+				{Name: jsii.String("public"), SubnetType: awsec2.SubnetType_PUBLIC, CidrMask: jsii.Number(24)},
+				{Name: jsii.String("db"), SubnetType: awsec2.SubnetType_PRIVATE_ISOLATED, CidrMask: jsii.Number(24)},
+			},
+		})
+		if vpcSubnets == nil {
+			vpcSubnets = &awsec2.SubnetSelection{SubnetType: awsec2.SubnetType_PRIVATE_ISOLATED}
+		}
+	}
+	if vpcSubnets == nil {
+		// the rds default of an existing vpc
+		vpcSubnets = &awsec2.SubnetSelection{SubnetType: awsec2.SubnetType_PRIVATE_WITH_EGRESS}
+	}
+
+	databaseName := props.DatabaseName
+	if len(databaseName) == 0 {
+		databaseName = "user_behavior"
+	}
+	instanceType := props.InstanceType
+	if instanceType == nil {
+		instanceType = awsec2.InstanceType_Of(awsec2.InstanceClass_BURSTABLE3, awsec2.InstanceSize_MICRO)
+	}
+	allocatedStorage := props.AllocatedStorage
+	if allocatedStorage <= 0 {
+		allocatedStorage = 20
+	}
+
+	engine := awsrds.DatabaseInstanceEngine_Mysql(&awsrds.MySqlInstanceEngineProps{
+		Version: awsrds.MysqlEngineVersion_VER_8_0(),
+	})
+	// binlog for CDC, https://docs.aws.amazon.com/dms/latest/userguide/CHAP_Source.MySQL.html
+	// the binlog retention hours are set after deploy: call mysql.rds_set_configuration('binlog retention hours', 24);
+	parameterGroup := awsrds.NewParameterGroup(stack, jsii.String("MysqlBinlogParameterGroup"), &awsrds.ParameterGroupProps{
+		Engine:      engine,
+		Description: jsii.String("mysql ROW binlog for CDC"),
+		Parameters: &map[string]*string{
+			"binlog_format":    jsii.String("ROW"),
+			"binlog_row_image": jsii.String("FULL"),
+			"binlog_checksum":  jsii.String("NONE"),
+		},
+	})
+
+	securityGroup := awsec2.NewSecurityGroup(stack, jsii.String("MysqlSecurityGroup"), &awsec2.SecurityGroupProps{
+		Vpc:         vpc,
+		Description: jsii.String("mysql from the cdc tasks in the vpc"),
+	})
+	securityGroup.AddIngressRule(awsec2.Peer_Ipv4(vpc.VpcCidrBlock()), awsec2.Port_Tcp(jsii.Number(3306)), jsii.String("Allow mysql from the vpc"), nil)
+
+	// the rds managed snapshot is the retained copy of a database
+	removalPolicy := awscdk.RemovalPolicy_SNAPSHOT
+	if profile.RemovalPolicy == awscdk.RemovalPolicy_DESTROY {
+		removalPolicy = awscdk.RemovalPolicy_DESTROY
+	}
+	instance := awsrds.NewDatabaseInstance(stack, jsii.String("MysqlInstance"), &awsrds.DatabaseInstanceProps{
+		Engine:       engine,
+		InstanceType: instanceType,
+		Vpc:          vpc,
+		VpcSubnets:   vpcSubnets,
+		// username, password, host, port, dbname
+		Credentials: awsrds.Credentials_FromGeneratedSecret(jsii.String("admin"), &awsrds.CredentialsBaseOptions{
+			SecretName: jsii.String("UserBehaviorMysqlSecret"),
+		}),
+		DatabaseName:          jsii.String(databaseName),
+		ParameterGroup:        parameterGroup,
+		SecurityGroups:        &[]awsec2.ISecurityGroup{securityGroup},
+		AllocatedStorage:      jsii.Number(allocatedStorage),
+		MaxAllocatedStorage:   jsii.Number(allocatedStorage * 5),
+		StorageEncrypted:      jsii.Bool(true),
+		StorageEncryptionKey:  props.StorageEncryptionKey,
+		PubliclyAccessible:    jsii.Bool(false),
+		CloudwatchLogsExports: &[]*string{jsii.String("error"), jsii.String("slowquery")},
+		// automated backups keep the binlog
+		BackupRetention:    profile.BackupRetention,
+		DeletionProtection: jsii.Bool(profile.DeletionProtection),
+		RemovalPolicy:      removalPolicy,
+	})
+
+	awscdk.NewCfnOutput(stack, jsii.String("MysqlEndpoint"), &awscdk.CfnOutputProps{
+		Value: instance.DbInstanceEndpointAddress(),
+	})
+	awscdk.NewCfnOutput(stack, jsii.String("MysqlPort"), &awscdk.CfnOutputProps{
+		Value: instance.DbInstanceEndpointPort(),
+	})
+	awscdk.NewCfnOutput(stack, jsii.String("MysqlSecretArn"), &awscdk.CfnOutputProps{
+		Value:       instance.Secret().SecretArn(),
+		Description: jsii.String("username, password, host, port and dbname of the mysql admin"),
+	})
+	awscdk.NewCfnOutput(stack, jsii.String("MysqlVpcId"), &awscdk.CfnOutputProps{
+		Value: vpc.VpcId(),
+	})
+
+	return &rdsMysqlStack{
+		Stack:         stack,
+		vpc:           vpc,
+		instance:      instance,
+		secret:        instance.Secret(),
+		securityGroup: securityGroup,
+		databaseName:  databaseName,
+		vpcSubnets:    vpcSubnets,
+	}
+}
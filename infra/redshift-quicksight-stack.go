@@ -1,6 +1,8 @@
 package infra
 
 import (
+	"user-behavior-analytics-cdk/infra/lib"
+
 	"github.com/aws/aws-cdk-go/awscdk/v2"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsec2"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
@@ -69,7 +71,7 @@ func NewRedshiftQuicksightCdkStack(scope constructs.Construct, id string, props
 	// create cluster password
 	secret := awssecretsmanager.NewSecret(stack, jsii.String("SetRedShiftClusterSecret"), &awssecretsmanager.SecretProps{
 		Description:   jsii.String("Redshift cluster secret"),
-		RemovalPolicy: awscdk.RemovalPolicy_DESTROY,
+		RemovalPolicy: lib.StageProfileOf(stack).RemovalPolicy,
 		SecretName:    jsii.String("RedshiftClusterSecret"),
 		GenerateSecretString: &awssecretsmanager.SecretStringGenerator{
 			ExcludePunctuation:   jsii.Bool(true),
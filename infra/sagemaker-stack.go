@@ -1 +1,367 @@
 package infra
+
+import (
+	"fmt"
+	"path"
+
+	"user-behavior-analytics-cdk/infra/lib"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsec2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awss3assets"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssagemaker"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+/*
+infra: S3(firehose raw/) ---> SageMaker Pipeline(Features ---> Train ---> Register) ---> Model Registry
+                                                                                            |(approved version)
+KDA ---> Lambda(save alert) --- InvokeEndpoint ---> SageMaker Endpoint(random cut forest) <-|
+the alert lambda scores the events by the feature row of src/sagemaker-studio/pipeline/features.py
+*/
+
+const (
+	AnomalyModelPackageGroupName = "user-behavior-anomaly"
+	AnomalyPipelineName          = "UserBehaviorAnomalyPipeline"
+	AnomalyEndpointName          = "user-behavior-anomaly"
+	// AnomalyFeatureDim is the length of the feature row: hour, action bucket, bizId bucket, errorMsg length, level
+	AnomalyFeatureDim = 5
+)
+
+// the ecr accounts of the builtin random cut forest and the scikit-learn processing images by region,
+// https://docs.aws.amazon.com/sagemaker/latest/dg/ecr-paths/sagemaker-algo-docker-registry-paths.html
+var sageMakerImageAccounts = map[string]map[string]string{
+	"us-east-1":      {"randomcutforest": "382416733822", "sklearn": "683313688378"},
+	"us-east-2":      {"randomcutforest": "404615174143", "sklearn": "257758044811"},
+	"us-west-2":      {"randomcutforest": "174872318107", "sklearn": "246618743249"},
+	"eu-west-1":      {"randomcutforest": "438346466558", "sklearn": "141502667606"},
+	"ap-northeast-1": {"randomcutforest": "351501993468", "sklearn": "354813040037"},
+	"cn-north-1":     {"randomcutforest": "390948362332", "sklearn": "450853457545"},
+	"cn-northwest-1": {"randomcutforest": "387376663083", "sklearn": "451049120500"},
+}
+
+type SageMakerStackProps struct {
+	awscdk.StackProps
+	// RawBucket is the firehose archive, e.g. KdsKdfS3Stack.Bucket()
+	RawBucket awss3.IBucket
+	// RawPrefix of the json events, default raw/
+	RawPrefix string
+	// Vpc of the studio domain, default a vpc of public subnets without nat
+	Vpc awsec2.IVpc
+	// TrainingImage and ProcessingImage override the images of the region mapping,
+	// default the builtin random cut forest and scikit-learn 0.23-1
+	TrainingImage   string
+	ProcessingImage string
+	// InstanceType of the pipeline jobs and the endpoint, default ml.m5.large
+	InstanceType string
+	// EndpointModelPackageArn is an approved model package version of the group, it creates the real-time endpoint,
+	// empty only registers the models of the pipeline executions
+	EndpointModelPackageArn string
+}
+
+type sageMakerStack struct {
+	awscdk.Stack
+	domain            awssagemaker.CfnDomain
+	pipeline          awssagemaker.CfnPipeline
+	modelPackageGroup awssagemaker.CfnModelPackageGroup
+	endpoint          awssagemaker.CfnEndpoint
+	role              awsiam.Role
+}
+
+func (m *sageMakerStack) Domain() awssagemaker.CfnDomain {
+	return m.domain
+}
+func (m *sageMakerStack) Pipeline() awssagemaker.CfnPipeline {
+	return m.pipeline
+}
+func (m *sageMakerStack) ModelPackageGroup() awssagemaker.CfnModelPackageGroup {
+	return m.modelPackageGroup
+}
+func (m *sageMakerStack) Endpoint() awssagemaker.CfnEndpoint {
+	return m.endpoint
+}
+func (m *sageMakerStack) Role() awsiam.Role {
+	return m.role
+}
+
+type SageMakerStack interface {
+	awscdk.Stack
+	Domain() awssagemaker.CfnDomain
+	Pipeline() awssagemaker.CfnPipeline
+	ModelPackageGroup() awssagemaker.CfnModelPackageGroup
+	// Endpoint is AnomalyEndpointName, nil without EndpointModelPackageArn
+	Endpoint() awssagemaker.CfnEndpoint
+	// Role is the execution role of the studio users, the pipeline jobs and the model
+	Role() awsiam.Role
+}
+
+func NewSageMakerStack(scope constructs.Construct, id string, props *SageMakerStackProps) SageMakerStack {
+	if props == nil || props.RawBucket == nil {
+		panic("SageMakerStack needs the firehose RawBucket")
+	}
+	stack := awscdk.NewStack(scope, &id, &props.StackProps)
+	profile := lib.StageProfileOf(stack)
+
+	rawPrefix := props.RawPrefix
+	if len(rawPrefix) == 0 {
+		rawPrefix = "raw/"
+	}
+	instanceType := props.InstanceType
+	if len(instanceType) == 0 {
+		instanceType = "ml.m5.large"
+	}
+	mapping := map[string]*map[string]interface{}{}
+	for region, accounts := range sageMakerImageAccounts {
+		regionAccounts := map[string]interface{}{}
+		for repository, account := range accounts {
+			regionAccounts[repository] = account
+		}
+		mapping[region] = &regionAccounts
+	}
+	images := awscdk.NewCfnMapping(stack, jsii.String("ImageAccounts"), &awscdk.CfnMappingProps{
+		Mapping: &mapping,
+	})
+	image := func(override, account, repository string) *string {
+		if len(override) > 0 {
+			return jsii.String(override)
+		}
+		return awscdk.Fn_Join(jsii.String(""), &[]*string{
+			images.FindInMap(awscdk.Aws_REGION(), jsii.String(account)),
+			jsii.String(".dkr.ecr."), awscdk.Aws_REGION(), jsii.String("."), awscdk.Aws_URL_SUFFIX(),
+			jsii.String("/" + repository),
+		})
+	}
+	trainingImage := image(props.TrainingImage, "randomcutforest", "randomcutforest:1")
+	processingImage := image(props.ProcessingImage, "sklearn", "sagemaker-scikit-learn:0.23-1-cpu-py3")
+
+	role := awsiam.NewRole(stack, jsii.String("ExecutionRole"), &awsiam.RoleProps{
+		AssumedBy:       awsiam.NewServicePrincipal(jsii.String("sagemaker.amazonaws.com"), nil),
+		ManagedPolicies: &[]awsiam.IManagedPolicy{awsiam.ManagedPolicy_FromAwsManagedPolicyName(jsii.String("AmazonSageMakerFullAccess"))},
+	})
+	props.RawBucket.GrantRead(role, jsii.String(rawPrefix+"*"))
+
+	// the features, the models and the studio shares of the pipeline executions
+	artifactBucketProps := &awss3.BucketProps{
+		BlockPublicAccess: awss3.BlockPublicAccess_BLOCK_ALL(),
+		Encryption:        awss3.BucketEncryption_S3_MANAGED,
+		EnforceSSL:        jsii.Bool(true),
+	}
+	profile.ApplyBucketProps(artifactBucketProps, false)
+	artifactBucket := awss3.NewBucket(stack, jsii.String("ArtifactBucket"), artifactBucketProps)
+	artifactBucket.GrantReadWrite(role, nil)
+	artifactUri := "s3://" + *artifactBucket.BucketName()
+
+	vpc := props.Vpc
+	if vpc == nil {
+		vpc = awsec2.NewVpc(stack, jsii.String("StudioVpc"), &awsec2.VpcProps{
+			IpAddresses: awsec2.IpAddresses_Cidr(jsii.String("10.30.0.0/16")),
+			MaxAzs:      jsii.Number(2),
+			NatGateways: jsii.Number(0),
+			SubnetConfiguration: &[]*awsec2.SubnetConfiguration{
+				{Name: jsii.String("studio"), SubnetType: awsec2.SubnetType_PUBLIC, CidrMask: jsii.Number(24)},
+			},
+		})
+	}
+	domain := awssagemaker.NewCfnDomain(stack, jsii.String("Domain"), &awssagemaker.CfnDomainProps{
+		DomainName: jsii.String("user-behavior-analytics"),
+		AuthMode:   jsii.String("IAM"),
+		VpcId:      vpc.VpcId(),
+		SubnetIds:  vpc.SelectSubnets(&awsec2.SubnetSelection{SubnetType: awsec2.SubnetType_PUBLIC}).SubnetIds,
+		// VpcOnly needs the sagemaker api, runtime and studio vpc endpoints
+		AppNetworkAccessType: jsii.String("PublicInternetOnly"),
+		DefaultUserSettings: &awssagemaker.CfnDomain_UserSettingsProperty{
+			ExecutionRole: role.RoleArn(),
+			SharingSettings: &awssagemaker.CfnDomain_SharingSettingsProperty{
+				NotebookOutputOption: jsii.String("Allowed"),
+				S3OutputPath:         jsii.String(artifactUri + "/studio"),
+			},
+		},
+	})
+	domain.ApplyRemovalPolicy(profile.RemovalPolicy, nil)
+	userProfile := awssagemaker.NewCfnUserProfile(stack, jsii.String("UserProfile"), &awssagemaker.CfnUserProfileProps{
+		DomainId:        domain.AttrDomainId(),
+		UserProfileName: jsii.String("user-behavior-analyst"),
+	})
+	userProfile.ApplyRemovalPolicy(profile.RemovalPolicy, nil)
+
+	modelPackageGroup := awssagemaker.NewCfnModelPackageGroup(stack, jsii.String("ModelPackageGroup"), &awssagemaker.CfnModelPackageGroupProps{
+		ModelPackageGroupName:        jsii.String(AnomalyModelPackageGroupName),
+		ModelPackageGroupDescription: jsii.String("random cut forest anomaly models of the user behavior events"),
+	})
+
+	featuresScript := awss3assets.NewAsset(stack, jsii.String("FeaturesScript"), &awss3assets.AssetProps{
+		Path: jsii.String("src/sagemaker-studio/pipeline/features.py"),
+	})
+	featuresScript.GrantRead(role)
+
+	// https://aws-sagemaker-mlops.github.io/sagemaker-model-building-pipeline-definition-JSON-schema/
+	executionUri := func(name string) map[string]interface{} {
+		return map[string]interface{}{"Std:Join": map[string]interface{}{
+			"On":     "/",
+			"Values": []interface{}{artifactUri, name, map[string]interface{}{"Get": "Execution.PipelineExecutionId"}},
+		}}
+	}
+	instance := map[string]interface{}{"Get": "Parameters.InstanceType"}
+	definition := map[string]interface{}{
+		"Version": "2020-12-01",
+		"Parameters": []interface{}{
+			map[string]interface{}{"Name": "RawDataUri", "Type": "String", "DefaultValue": "s3://" + *props.RawBucket.BucketName() + "/" + rawPrefix},
+			map[string]interface{}{"Name": "InstanceType", "Type": "String", "DefaultValue": instanceType},
+			map[string]interface{}{"Name": "MaxEvents", "Type": "String", "DefaultValue": "1000000"},
+			map[string]interface{}{"Name": "ModelApprovalStatus", "Type": "String", "DefaultValue": "PendingManualApproval"},
+		},
+		"Steps": []interface{}{
+			map[string]interface{}{
+				"Name": "Features",
+				"Type": "Processing",
+				"Arguments": map[string]interface{}{
+					"RoleArn": role.RoleArn(),
+					"ProcessingResources": map[string]interface{}{
+						"ClusterConfig": map[string]interface{}{"InstanceType": instance, "InstanceCount": 1, "VolumeSizeInGB": 30},
+					},
+					"AppSpecification": map[string]interface{}{
+						"ImageUri":            processingImage,
+						"ContainerEntrypoint": []interface{}{"python3", "/opt/ml/processing/input/code/" + path.Base(*featuresScript.S3ObjectKey())},
+						"ContainerArguments":  []interface{}{"--max-events", map[string]interface{}{"Get": "Parameters.MaxEvents"}},
+					},
+					"ProcessingInputs": []interface{}{
+						map[string]interface{}{"InputName": "raw", "S3Input": map[string]interface{}{
+							"S3Uri": map[string]interface{}{"Get": "Parameters.RawDataUri"}, "LocalPath": "/opt/ml/processing/raw",
+							"S3DataType": "S3Prefix", "S3InputMode": "File", "S3DataDistributionType": "FullyReplicated",
+						}},
+						map[string]interface{}{"InputName": "code", "S3Input": map[string]interface{}{
+							"S3Uri": featuresScript.S3ObjectUrl(), "LocalPath": "/opt/ml/processing/input/code",
+							"S3DataType": "S3Prefix", "S3InputMode": "File", "S3DataDistributionType": "FullyReplicated",
+						}},
+					},
+					"ProcessingOutputConfig": map[string]interface{}{
+						"Outputs": []interface{}{
+							map[string]interface{}{"OutputName": "train", "S3Output": map[string]interface{}{
+								"S3Uri": executionUri("features"), "LocalPath": "/opt/ml/processing/train", "S3UploadMode": "EndOfJob",
+							}},
+						},
+					},
+					"StoppingCondition": map[string]interface{}{"MaxRuntimeInSeconds": 3600},
+				},
+			},
+			map[string]interface{}{
+				"Name": "Train",
+				"Type": "Training",
+				"Arguments": map[string]interface{}{
+					"RoleArn":                role.RoleArn(),
+					"AlgorithmSpecification": map[string]interface{}{"TrainingImage": trainingImage, "TrainingInputMode": "File"},
+					"HyperParameters": map[string]interface{}{
+						"feature_dim":          fmt.Sprintf("%d", AnomalyFeatureDim),
+						"num_trees":            "100",
+						"num_samples_per_tree": "256",
+					},
+					"InputDataConfig": []interface{}{
+						map[string]interface{}{
+							"ChannelName": "train",
+							"ContentType": "text/csv;label_size=0",
+							"DataSource": map[string]interface{}{"S3DataSource": map[string]interface{}{
+								"S3DataType": "S3Prefix", "S3DataDistributionType": "ShardedByS3Key",
+								"S3Uri": map[string]interface{}{"Get": "Steps.Features.ProcessingOutputConfig.Outputs['train'].S3Output.S3Uri"},
+							}},
+						},
+					},
+					"OutputDataConfig":  map[string]interface{}{"S3OutputPath": executionUri("models")},
+					"ResourceConfig":    map[string]interface{}{"InstanceType": instance, "InstanceCount": 1, "VolumeSizeInGB": 30},
+					"StoppingCondition": map[string]interface{}{"MaxRuntimeInSeconds": 3600},
+				},
+			},
+			map[string]interface{}{
+				"Name": "Register",
+				"Type": "RegisterModel",
+				"Arguments": map[string]interface{}{
+					"ModelPackageGroupName": AnomalyModelPackageGroupName,
+					"ModelApprovalStatus":   map[string]interface{}{"Get": "Parameters.ModelApprovalStatus"},
+					"InferenceSpecification": map[string]interface{}{
+						"Containers": []interface{}{
+							map[string]interface{}{
+								"Image":        trainingImage,
+								"ModelDataUrl": map[string]interface{}{"Get": "Steps.Train.ModelArtifacts.S3ModelArtifacts"},
+							},
+						},
+						"SupportedContentTypes":                   []interface{}{"text/csv"},
+						"SupportedResponseMIMETypes":              []interface{}{"application/json"},
+						"SupportedRealtimeInferenceInstanceTypes": []interface{}{instanceType},
+						"SupportedTransformInstanceTypes":         []interface{}{instanceType},
+					},
+				},
+			},
+		},
+	}
+	pipeline := awssagemaker.NewCfnPipeline(stack, jsii.String("Pipeline"), &awssagemaker.CfnPipelineProps{
+		PipelineName:        jsii.String(AnomalyPipelineName),
+		PipelineDescription: jsii.String("trains the random cut forest anomaly model of the archived user behavior events"),
+		RoleArn:             role.RoleArn(),
+		PipelineDefinition:  map[string]interface{}{"PipelineDefinitionBody": jsonString(definition)},
+	})
+	pipeline.AddDependsOn(modelPackageGroup)
+	pipeline.Node().AddDependency(role)
+
+	var endpoint awssagemaker.CfnEndpoint
+	if len(props.EndpointModelPackageArn) > 0 {
+		model := awssagemaker.NewCfnModel(stack, jsii.String("Model"), &awssagemaker.CfnModelProps{
+			ExecutionRoleArn: role.RoleArn(),
+			Containers: &[]*awssagemaker.CfnModel_ContainerDefinitionProperty{
+				{ModelPackageName: jsii.String(props.EndpointModelPackageArn)},
+			},
+		})
+		model.Node().AddDependency(role)
+		endpointConfig := awssagemaker.NewCfnEndpointConfig(stack, jsii.String("EndpointConfig"), &awssagemaker.CfnEndpointConfigProps{
+			ProductionVariants: &[]*awssagemaker.CfnEndpointConfig_ProductionVariantProperty{
+				{
+					ModelName:            model.AttrModelName(),
+					VariantName:          jsii.String("AllTraffic"),
+					InitialInstanceCount: jsii.Number(1),
+					InstanceType:         jsii.String(instanceType),
+					InitialVariantWeight: jsii.Number(1),
+				},
+			},
+		})
+		endpoint = awssagemaker.NewCfnEndpoint(stack, jsii.String("Endpoint"), &awssagemaker.CfnEndpointProps{
+			EndpointName:       jsii.String(AnomalyEndpointName),
+			EndpointConfigName: endpointConfig.AttrEndpointConfigName(),
+		})
+
+		invokePolicy := awsiam.NewManagedPolicy(stack, jsii.String("InvokeEndpointPolicy"), &awsiam.ManagedPolicyProps{
+			Description: jsii.String("invokes the user behavior anomaly endpoint"),
+			Statements: &[]awsiam.PolicyStatement{
+				awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+					Actions:   &[]*string{jsii.String("sagemaker:InvokeEndpoint")},
+					Resources: &[]*string{endpoint.Ref()},
+				}),
+			},
+		})
+		awscdk.NewCfnOutput(stack, jsii.String("AnomalyEndpointName"), &awscdk.CfnOutputProps{
+			Value: endpoint.AttrEndpointName(),
+		})
+		awscdk.NewCfnOutput(stack, jsii.String("InvokeAnomalyEndpointPolicyArn"), &awscdk.CfnOutputProps{
+			Value: invokePolicy.ManagedPolicyArn(),
+		})
+	}
+
+	awscdk.NewCfnOutput(stack, jsii.String("StudioDomainId"), &awscdk.CfnOutputProps{
+		Value: domain.AttrDomainId(),
+	})
+	awscdk.NewCfnOutput(stack, jsii.String("AnomalyPipelineName"), &awscdk.CfnOutputProps{
+		Value: pipeline.PipelineName(),
+	})
+	awscdk.NewCfnOutput(stack, jsii.String("AnomalyModelPackageGroupName"), &awscdk.CfnOutputProps{
+		Value: modelPackageGroup.ModelPackageGroupName(),
+	})
+
+	return &sageMakerStack{
+		Stack:             stack,
+		domain:            domain,
+		pipeline:          pipeline,
+		modelPackageGroup: modelPackageGroup,
+		endpoint:          endpoint,
+		role:              role,
+	}
+}
@@ -0,0 +1,24 @@
+package infra
+
+import (
+	"user-behavior-analytics-cdk/infra/lib"
+	"user-behavior-analytics-cdk/schema"
+)
+
+// kdaSqlSchemaOf is the KDA input record schema of the event, one column per field mapped from its json path
+func kdaSqlSchemaOf(s *schema.Schema) *lib.KdaSqlSchema {
+	columns := make([]lib.KdaSqlColumn, len(s.Fields))
+	for i, field := range s.Fields {
+		columns[i] = lib.KdaSqlColumn{Name: field.Name, SqlType: field.SqlType(), Mapping: field.JsonPath()}
+	}
+	return &lib.KdaSqlSchema{Columns: columns}
+}
+
+// glueColumnsOf are the glue table columns of the firehose record format conversion and athena
+func glueColumnsOf(s *schema.Schema) []lib.GlueColumn {
+	columns := make([]lib.GlueColumn, len(s.Fields))
+	for i, field := range s.Fields {
+		columns[i] = lib.GlueColumn{Name: field.Name, Type: field.GlueType(), Comment: field.Description}
+	}
+	return columns
+}
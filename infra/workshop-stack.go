@@ -46,6 +46,9 @@ func NewCdkWsStack(scope constructs.Construct, id string, props *CdkWsStackProps
 		Downstream:   helloHandler,
 		ReadCapacity: 7,
 		EventStream:  props.EventStream,
+		// POST /event is validated and put into the stream by the go collector
+		UseGoCollector: true,
+		Profile:        lib.StageProfileOf(stack),
 	})
 
 	gateway := awsapigateway.NewLambdaRestApi(stack, jsii.String("Endpoint"), &awsapigateway.LambdaRestApiProps{
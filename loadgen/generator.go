@@ -0,0 +1,185 @@
+// Package loadgen generates synthetic user behavior events for load tests,
+// the events are sent to the kinesis data stream or written as NDJSON.
+package loadgen
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"user-behavior-analytics-cdk/schema"
+)
+
+// CreatedAtLayout same as the python producers str(datetime.now())
+const CreatedAtLayout = "2006-01-02 15:04:05.000000"
+
+// DefaultActions are the user actions when Config.Actions is empty
+var DefaultActions = []string{"view", "click", "search", "cart", "pay", "share", "login"}
+
+// level tagged errorMsg, the tags are matched by the KDA sql filters and the severity rules
+var levelMessages = map[string][]string{
+	"panic": {
+		"[panic] runtime error: invalid memory address or nil pointer dereference",
+		"[panic] runtime error: index out of range",
+	},
+	"error": {
+		"[error] order service timeout",
+		"[error] inventory service unavailable",
+		"[error] payment declined",
+	},
+	"warning": {
+		"[warning] slow response over 1000ms",
+		"[warning] retry 3 times",
+		"[warning] cache miss",
+	},
+}
+
+// Mix is the fraction of panic, error and warning events, the rest have no errorMsg
+type Mix struct {
+	Panic   float64
+	Error   float64
+	Warning float64
+}
+
+func (m Mix) validate() error {
+	if m.Panic < 0 || m.Error < 0 || m.Warning < 0 || m.Panic+m.Error+m.Warning > 1 {
+		return fmt.Errorf("mix %+v must be non negative and sum up to at most 1", m)
+	}
+	return nil
+}
+
+// Burst multiplies the rate for Duration at the end of every Every period
+type Burst struct {
+	// Every is the burst period, 0 is no burst
+	Every    time.Duration
+	Duration time.Duration
+	// Factor is the rate multiplier in a burst
+	Factor float64
+	// Action concentrates the burst events on one action, e.g. to hit the warn count threshold
+	Action string
+	// Mix overrides Config.Mix in a burst, nil keeps it
+	Mix *Mix
+}
+
+// Config of the generator, the same Seed and Start generates the same events
+type Config struct {
+	// Seed of the random source
+	Seed int64
+	// Users, Objects and Bizs are the id cardinalities, user and object ids are zipf distributed
+	Users   int
+	Objects int
+	Bizs    int
+	// Actions default DefaultActions
+	Actions []string
+	Mix     Mix
+	Burst   Burst
+}
+
+// Generator generates events, it isn't safe for concurrent use
+type Generator struct {
+	cfg     Config
+	start   time.Time
+	rnd     *rand.Rand
+	users   *rand.Zipf
+	objects *rand.Zipf
+}
+
+// NewGenerator returns the generator of cfg, bursts are timed from start
+func NewGenerator(cfg Config, start time.Time) (*Generator, error) {
+	if cfg.Users <= 0 || cfg.Objects <= 0 || cfg.Bizs <= 0 {
+		return nil, fmt.Errorf("users %d, objects %d and bizs %d must be positive", cfg.Users, cfg.Objects, cfg.Bizs)
+	}
+	if len(cfg.Actions) == 0 {
+		cfg.Actions = DefaultActions
+	}
+	if err := cfg.Mix.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Burst.Every > 0 {
+		if cfg.Burst.Duration <= 0 || cfg.Burst.Duration > cfg.Burst.Every {
+			return nil, fmt.Errorf("burst duration %s must be in (0, %s]", cfg.Burst.Duration, cfg.Burst.Every)
+		}
+		if cfg.Burst.Factor <= 0 {
+			return nil, fmt.Errorf("burst factor %v must be positive", cfg.Burst.Factor)
+		}
+		if cfg.Burst.Mix != nil {
+			if err := cfg.Burst.Mix.validate(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	rnd := rand.New(rand.NewSource(cfg.Seed))
+	return &Generator{
+		cfg:     cfg,
+		start:   start,
+		rnd:     rnd,
+		users:   rand.NewZipf(rnd, 1.1, 1, uint64(cfg.Users-1)),
+		objects: rand.NewZipf(rnd, 1.1, 1, uint64(cfg.Objects-1)),
+	}, nil
+}
+
+// InBurst reports whether now is in a burst
+func (m *Generator) InBurst(now time.Time) bool {
+	if m.cfg.Burst.Every <= 0 || now.Before(m.start) {
+		return false
+	}
+	return now.Sub(m.start)%m.cfg.Burst.Every >= m.cfg.Burst.Every-m.cfg.Burst.Duration
+}
+
+// RateFactor is the rate multiplier at now
+func (m *Generator) RateFactor(now time.Time) float64 {
+	if m.InBurst(now) {
+		return m.cfg.Burst.Factor
+	}
+	return 1
+}
+
+// Next generates the event created at now
+func (m *Generator) Next(now time.Time) schema.UserBehaviorEvent {
+	mix := m.cfg.Mix
+	action := m.cfg.Actions[m.rnd.Intn(len(m.cfg.Actions))]
+	if m.InBurst(now) {
+		if m.cfg.Burst.Mix != nil {
+			mix = *m.cfg.Burst.Mix
+		}
+		if len(m.cfg.Burst.Action) > 0 {
+			action = m.cfg.Burst.Action
+		}
+	}
+
+	return schema.UserBehaviorEvent{
+		EventId:   m.uuid(),
+		Action:    action,
+		UserId:    fmt.Sprintf("user-%06d", m.users.Uint64()),
+		ObjectId:  fmt.Sprintf("obj-%06d", m.objects.Uint64()),
+		BizId:     fmt.Sprintf("biz-%03d", m.rnd.Intn(m.cfg.Bizs)),
+		ErrorMsg:  m.errorMsg(mix),
+		CreatedAt: now.Format(CreatedAtLayout),
+	}
+}
+
+func (m *Generator) errorMsg(mix Mix) string {
+	level := ""
+	switch p := m.rnd.Float64(); {
+	case p < mix.Panic:
+		level = "panic"
+	case p < mix.Panic+mix.Error:
+		level = "error"
+	case p < mix.Panic+mix.Error+mix.Warning:
+		level = "warning"
+	default:
+		return ""
+	}
+	msgs := levelMessages[level]
+	return msgs[m.rnd.Intn(len(msgs))]
+}
+
+// uuid v4 from the seeded source, so a seed repeats the event ids
+func (m *Generator) uuid() string {
+	b := make([]byte, 16)
+	m.rnd.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,149 @@
+package loadgen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"user-behavior-analytics-cdk/schema"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var testStart = time.Date(2022, 11, 11, 11, 11, 11, 0, time.UTC)
+
+func testConfig() Config {
+	return Config{Seed: 1, Users: 100, Objects: 1000, Bizs: 3, Mix: Mix{Panic: 0.01, Error: 0.05, Warning: 0.2}}
+}
+
+func TestGeneratorRepeatable(t *testing.T) {
+	gen1, err := NewGenerator(testConfig(), testStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen2, _ := NewGenerator(testConfig(), testStart)
+	for i := 0; i < 100; i++ {
+		now := testStart.Add(time.Duration(i) * time.Millisecond)
+		e1, e2 := gen1.Next(now), gen2.Next(now)
+		if diff := cmp.Diff(e1, e2); diff != "" {
+			t.Fatalf("event %d of the same seed (-1 +2):\n%s", i, diff)
+		}
+		if err := e1.Validate(); err != nil {
+			t.Fatalf("event %d %+v: %s", i, e1, err)
+		}
+	}
+	if e := gen1.Next(testStart); e.CreatedAt != "2022-11-11 11:11:11.000000" {
+		t.Errorf("createdAt %s", e.CreatedAt)
+	}
+}
+
+func TestGeneratorMix(t *testing.T) {
+	gen, _ := NewGenerator(testConfig(), testStart)
+	total := 20000
+	levels := map[string]int{}
+	users := map[string]bool{}
+	for i := 0; i < total; i++ {
+		e := gen.Next(testStart)
+		users[e.UserId] = true
+		level := ""
+		for _, tag := range []string{"panic", "error", "warning"} {
+			if strings.HasPrefix(e.ErrorMsg, "["+tag+"]") {
+				level = tag
+			}
+		}
+		levels[level]++
+	}
+
+	for level, want := range map[string]float64{"panic": 0.01, "error": 0.05, "warning": 0.2, "": 0.74} {
+		if got := float64(levels[level]) / float64(total); math.Abs(got-want) > 0.01 {
+			t.Errorf("level %q fraction %v, want %v", level, got, want)
+		}
+	}
+	if len(users) > 100 {
+		t.Errorf("%d users over the cardinality 100", len(users))
+	}
+}
+
+func TestGeneratorBurst(t *testing.T) {
+	cfg := testConfig()
+	cfg.Burst = Burst{Every: time.Minute, Duration: 10 * time.Second, Factor: 5, Action: "pay", Mix: &Mix{Warning: 1}}
+	gen, err := NewGenerator(cfg, testStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		offset    time.Duration
+		wantBurst bool
+	}{
+		{0, false},
+		{49 * time.Second, false},
+		{50 * time.Second, true},
+		{59 * time.Second, true},
+		{60 * time.Second, false},
+		{110 * time.Second, true},
+	}
+	for _, tt := range tests {
+		now := testStart.Add(tt.offset)
+		if got := gen.InBurst(now); got != tt.wantBurst {
+			t.Errorf("InBurst(+%s) %v, want %v", tt.offset, got, tt.wantBurst)
+		}
+		if !tt.wantBurst {
+			continue
+		}
+		if f := gen.RateFactor(now); f != 5 {
+			t.Errorf("RateFactor(+%s) %v", tt.offset, f)
+		}
+		if e := gen.Next(now); e.Action != "pay" || !strings.HasPrefix(e.ErrorMsg, "[warning]") {
+			t.Errorf("burst event %+v", e)
+		}
+	}
+
+	cfg.Burst.Duration = 2 * time.Minute
+	if _, err := NewGenerator(cfg, testStart); err == nil {
+		t.Error("burst longer than its period")
+	}
+	cfg = testConfig()
+	cfg.Mix = Mix{Error: 0.6, Warning: 0.6}
+	if _, err := NewGenerator(cfg, testStart); err == nil {
+		t.Error("mix over 1")
+	}
+}
+
+func TestRun(t *testing.T) {
+	gen, _ := NewGenerator(testConfig(), time.Now())
+	out := &bytes.Buffer{}
+	stats, err := Run(context.Background(), gen, &NDJSONSink{Writer: out}, RunConfig{Rate: 10000, Count: 250, Tick: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Generated != 250 || stats.Sent != 250 {
+		t.Errorf("stats %+v", stats)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 250 {
+		t.Fatalf("%d lines", len(lines))
+	}
+	for _, line := range lines {
+		e := schema.UserBehaviorEvent{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err = Run(context.Background(), gen, &NDJSONSink{Writer: &bytes.Buffer{}}, RunConfig{Rate: 100, Duration: 50 * time.Millisecond, Tick: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Generated > 5 {
+		t.Errorf("%d events in 50ms at 100/s", stats.Generated)
+	}
+}
@@ -0,0 +1,87 @@
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"user-behavior-analytics-cdk/schema"
+)
+
+// RunConfig is when and how fast the events are sent
+type RunConfig struct {
+	// Rate is the events per second out of a burst
+	Rate float64
+	// Count stops the run after Count events, 0 is no limit
+	Count int
+	// Duration stops the run after Duration, 0 is no limit
+	Duration time.Duration
+	// Tick is the send interval, the events of a tick are sent in one batch, default 100ms
+	Tick time.Duration
+}
+
+// Stats of a run, Generated = Sent + dropped
+type Stats struct {
+	Generated int
+	Sent      int
+	Bursts    int
+}
+
+// Run sends the generated events to sink at the configured rate until Count, Duration or ctx is done
+func Run(ctx context.Context, gen *Generator, sink Sink, cfg RunConfig) (Stats, error) {
+	stats := Stats{}
+	if cfg.Rate <= 0 {
+		return stats, fmt.Errorf("rate %v must be positive", cfg.Rate)
+	}
+	tick := cfg.Tick
+	if tick <= 0 {
+		tick = 100 * time.Millisecond
+	}
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	due, inBurst := 0.0, false
+	for cfg.Count <= 0 || stats.Generated < cfg.Count {
+		select {
+		case <-ctx.Done():
+			return stats, nil
+		case now := <-ticker.C:
+			if burst := gen.InBurst(now); burst != inBurst {
+				if burst {
+					stats.Bursts++
+				}
+				inBurst = burst
+			}
+
+			due += cfg.Rate * gen.RateFactor(now) * tick.Seconds()
+			n := int(due)
+			due -= float64(n)
+			if cfg.Count > 0 && stats.Generated+n > cfg.Count {
+				n = cfg.Count - stats.Generated
+			}
+			if n == 0 {
+				continue
+			}
+
+			events := make([]schema.UserBehaviorEvent, n)
+			for i := range events {
+				events[i] = gen.Next(now)
+			}
+			stats.Generated += n
+			sent, err := sink.Send(ctx, events)
+			stats.Sent += sent
+			if err != nil {
+				if ctx.Err() != nil {
+					return stats, nil
+				}
+				return stats, err
+			}
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,118 @@
+package loadgen
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"user-behavior-analytics-cdk/schema"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// PutRecords accepts at most 500 records per call
+const maxBatchSize = 500
+
+// Sink receives the generated events
+type Sink interface {
+	// Send returns the number of events sent, the others are dropped
+	Send(ctx context.Context, events []schema.UserBehaviorEvent) (int, error)
+}
+
+// KinesisPutRecordsAPI is the Kinesis client api used to put events, *kinesis.Client implements it
+type KinesisPutRecordsAPI interface {
+	PutRecords(ctx context.Context, params *kinesis.PutRecordsInput, optFns ...func(*kinesis.Options)) (*kinesis.PutRecordsOutput, error)
+}
+
+// KinesisSink puts events into the stream with PutRecords, the partition key is eventId like the producers
+type KinesisSink struct {
+	KinesisClient KinesisPutRecordsAPI
+	StreamName    string
+	// MaxRetries of the failed(e.g. throttled) records, the records still failed are dropped
+	MaxRetries int
+	// Backoff before the first retry, doubled every retry
+	Backoff time.Duration
+}
+
+func (m *KinesisSink) Send(ctx context.Context, events []schema.UserBehaviorEvent) (int, error) {
+	sent := 0
+	for len(events) > 0 {
+		n := len(events)
+		if n > maxBatchSize {
+			n = maxBatchSize
+		}
+		records := make([]types.PutRecordsRequestEntry, n)
+		for i := range events[:n] {
+			data, err := json.Marshal(&events[i])
+			if err != nil {
+				return sent, err
+			}
+			records[i] = types.PutRecordsRequestEntry{Data: data, PartitionKey: aws.String(events[i].EventId)}
+		}
+		ok, err := m.put(ctx, records)
+		sent += ok
+		if err != nil {
+			return sent, err
+		}
+		events = events[n:]
+	}
+	return sent, nil
+}
+
+// put retries the failed records of one PutRecords batch
+func (m *KinesisSink) put(ctx context.Context, records []types.PutRecordsRequestEntry) (int, error) {
+	sent := 0
+	backoff := m.Backoff
+	for retry := 0; ; retry++ {
+		output, err := m.KinesisClient.PutRecords(ctx, &kinesis.PutRecordsInput{
+			Records:    records,
+			StreamName: aws.String(m.StreamName),
+		})
+		if err != nil {
+			return sent, err
+		}
+		failed, lastErr := records[:0], ""
+		for i, record := range output.Records {
+			if record.ErrorCode != nil {
+				failed, lastErr = append(failed, records[i]), aws.ToString(record.ErrorCode)
+				continue
+			}
+			sent++
+		}
+		if len(failed) == 0 {
+			return sent, nil
+		}
+		if retry >= m.MaxRetries {
+			log.Printf("[WARN] drop %d records after %d retries, last error %s\n", len(failed), retry, lastErr)
+			return sent, nil
+		}
+		records = failed
+
+		select {
+		case <-ctx.Done():
+			return sent, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// NDJSONSink writes one event json per line
+type NDJSONSink struct {
+	Writer io.Writer
+}
+
+func (m *NDJSONSink) Send(ctx context.Context, events []schema.UserBehaviorEvent) (int, error) {
+	enc := json.NewEncoder(m.Writer)
+	for i := range events {
+		if err := enc.Encode(&events[i]); err != nil {
+			return i, fmt.Errorf("write event %s: %w", events[i].EventId, err)
+		}
+	}
+	return len(events), nil
+}
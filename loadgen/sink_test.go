@@ -0,0 +1,95 @@
+package loadgen
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"user-behavior-analytics-cdk/schema"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// fakeKinesis throttles the first throttles records, then puts every record
+type fakeKinesis struct {
+	calls     []int
+	events    []schema.UserBehaviorEvent
+	throttles int
+	err       error
+}
+
+func (f *fakeKinesis) PutRecords(ctx context.Context, params *kinesis.PutRecordsInput, optFns ...func(*kinesis.Options)) (*kinesis.PutRecordsOutput, error) {
+	f.calls = append(f.calls, len(params.Records))
+	if f.err != nil {
+		return nil, f.err
+	}
+	output := &kinesis.PutRecordsOutput{}
+	for _, record := range params.Records {
+		if f.throttles > 0 {
+			f.throttles--
+			output.Records = append(output.Records, types.PutRecordsResultEntry{ErrorCode: aws.String("ProvisionedThroughputExceededException")})
+			continue
+		}
+		e := schema.UserBehaviorEvent{}
+		json.Unmarshal(record.Data, &e)
+		f.events = append(f.events, e)
+		output.Records = append(output.Records, types.PutRecordsResultEntry{SequenceNumber: aws.String("1")})
+	}
+	return output, nil
+}
+
+func testEvents(t *testing.T, n int) []schema.UserBehaviorEvent {
+	gen, err := NewGenerator(testConfig(), testStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make([]schema.UserBehaviorEvent, n)
+	for i := range events {
+		events[i] = gen.Next(testStart)
+	}
+	return events
+}
+
+func TestKinesisSinkSend(t *testing.T) {
+	tests := []struct {
+		name       string
+		events     int
+		throttles  int
+		maxRetries int
+		err        error
+		wantSent   int
+		wantCalls  []int
+		wantErr    bool
+	}{
+		{name: "batches of 500", events: 1200, wantSent: 1200, wantCalls: []int{500, 500, 200}},
+		{name: "retry throttled", events: 10, throttles: 3, maxRetries: 2, wantSent: 10, wantCalls: []int{10, 3}},
+		{name: "drop after retries", events: 10, throttles: 13, maxRetries: 1, wantSent: 7, wantCalls: []int{10, 10}},
+		{name: "put error", events: 10, err: errors.New("ResourceNotFoundException"), wantCalls: []int{10}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeKds := &fakeKinesis{throttles: tt.throttles, err: tt.err}
+			sink := &KinesisSink{KinesisClient: fakeKds, StreamName: "test", MaxRetries: tt.maxRetries, Backoff: time.Millisecond}
+			events := testEvents(t, tt.events)
+			sent, err := sink.Send(context.Background(), events)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err %v, wantErr %v", err, tt.wantErr)
+			}
+			if sent != tt.wantSent || len(fakeKds.events) != tt.wantSent {
+				t.Errorf("sent %d, put %d, want %d", sent, len(fakeKds.events), tt.wantSent)
+			}
+			if len(fakeKds.calls) != len(tt.wantCalls) {
+				t.Fatalf("calls %v, want %v", fakeKds.calls, tt.wantCalls)
+			}
+			for i := range tt.wantCalls {
+				if fakeKds.calls[i] != tt.wantCalls[i] {
+					t.Errorf("calls %v, want %v", fakeKds.calls, tt.wantCalls)
+				}
+			}
+		})
+	}
+}
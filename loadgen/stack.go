@@ -0,0 +1,30 @@
+package loadgen
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+)
+
+// CloudFormationDescribeStacksAPI is the CloudFormation client api used to read stack outputs, *cloudformation.Client implements it
+type CloudFormationDescribeStacksAPI interface {
+	DescribeStacks(ctx context.Context, params *cloudformation.DescribeStacksInput, optFns ...func(*cloudformation.Options)) (*cloudformation.DescribeStacksOutput, error)
+}
+
+// StackOutput is the output value of the deployed stack, e.g. EventStreamName
+func StackOutput(ctx context.Context, client CloudFormationDescribeStacksAPI, stackName, key string) (string, error) {
+	res, err := client.DescribeStacks(ctx, &cloudformation.DescribeStacksInput{StackName: aws.String(stackName)})
+	if err != nil {
+		return "", err
+	}
+	for _, s := range res.Stacks {
+		for _, output := range s.Outputs {
+			if aws.ToString(output.OutputKey) == key {
+				return aws.ToString(output.OutputValue), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("stack %s has no output %s", stackName, key)
+}
@@ -0,0 +1,170 @@
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"time"
+
+	"user-behavior-analytics-cdk/loadgen"
+	"user-behavior-analytics-cdk/schema"
+)
+
+// createdAt layouts of the producers, python str(datetime.now()) and js toISOString()
+var createdAtLayouts = []string{"2006-01-02 15:04:05.999999999", time.RFC3339Nano}
+
+// PutRecords accepts at most 500 records per call
+const defaultBatchSize = 500
+
+// Filter selects the events to replay, zero value selects all
+type Filter struct {
+	// From and To bound createdAt [From, To), createdAt without a zone is read as UTC,
+	// an event without a valid createdAt isn't selected by a time range
+	From time.Time
+	To   time.Time
+	// Actions and BizIds select the events of any of them, empty selects all
+	Actions map[string]bool
+	BizIds  map[string]bool
+}
+
+// Match reports whether the event is selected
+func (m *Filter) Match(event *schema.UserBehaviorEvent) bool {
+	if len(m.Actions) > 0 && !m.Actions[event.Action] {
+		return false
+	}
+	if len(m.BizIds) > 0 && !m.BizIds[event.BizId] {
+		return false
+	}
+	if m.From.IsZero() && m.To.IsZero() {
+		return true
+	}
+	createdAt, ok := parseCreatedAt(event.CreatedAt)
+	if !ok {
+		return false
+	}
+	if !m.From.IsZero() && createdAt.Before(m.From) {
+		return false
+	}
+	if !m.To.IsZero() && !createdAt.Before(m.To) {
+		return false
+	}
+	return true
+}
+
+func parseCreatedAt(createdAt string) (time.Time, bool) {
+	for _, layout := range createdAtLayouts {
+		if t, err := time.Parse(layout, createdAt); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Stats of a replay, Read = Matched + filtered out, Matched = Sent + dropped
+type Stats struct {
+	Objects int
+	Read    int
+	Matched int
+	Sent    int
+}
+
+// Replayer puts the selected archived events into Sink, a loadgen.NDJSONSink is a dry run
+type Replayer struct {
+	Source Source
+	Filter Filter
+	Sink   loadgen.Sink
+	// Rate is the max events per second, 0 is no limit
+	Rate float64
+	// BatchSize is the events of one Sink.Send, default 500
+	BatchSize int
+}
+
+// Run replays the objects in key order, the events of an object are in firehose delivery order
+func (m *Replayer) Run(ctx context.Context) (Stats, error) {
+	stats := Stats{}
+	batchSize := m.BatchSize
+	if batchSize <= 0 || batchSize > defaultBatchSize {
+		batchSize = defaultBatchSize
+	}
+	// about one batch per second when throttled
+	if m.Rate > 0 && m.Rate < float64(batchSize) {
+		batchSize = int(math.Ceil(m.Rate))
+	}
+	keys, err := m.Source.List(ctx)
+	if err != nil {
+		return stats, err
+	}
+
+	start := time.Now()
+	batch := make([]schema.UserBehaviorEvent, 0, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		// throttle: the sent events can't be ahead of Rate since start
+		if m.Rate > 0 {
+			due := start.Add(time.Duration(float64(stats.Matched-len(batch)) / m.Rate * float64(time.Second)))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Until(due)):
+			}
+		}
+		sent, err := m.Sink.Send(ctx, batch)
+		stats.Sent += sent
+		batch = batch[:0]
+		return err
+	}
+
+	for _, key := range keys {
+		stats.Objects++
+		err := m.readObject(ctx, key, func(event *schema.UserBehaviorEvent) error {
+			stats.Read++
+			if !m.Filter.Match(event) {
+				return nil
+			}
+			stats.Matched++
+			batch = append(batch, *event)
+			if len(batch) >= batchSize {
+				return flush()
+			}
+			return nil
+		})
+		if err != nil {
+			return stats, err
+		}
+		log.Printf("[INFO] replayed %s, read %d matched %d sent %d\n", key, stats.Read, stats.Matched, stats.Sent)
+	}
+	return stats, flush()
+}
+
+// readObject decodes the newline delimited or concatenated json records of one firehose output object
+func (m *Replayer) readObject(ctx context.Context, key string, fn func(event *schema.UserBehaviorEvent) error) error {
+	body, err := m.Source.Open(ctx, key)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", key, err)
+	}
+	defer body.Close()
+	r, err := Decompress(body)
+	if err != nil {
+		return fmt.Errorf("decompress %s: %w", key, err)
+	}
+
+	dec := json.NewDecoder(r)
+	for {
+		event := &schema.UserBehaviorEvent{}
+		err := dec.Decode(event)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("decode %s at offset %d: %w", key, dec.InputOffset(), err)
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+}
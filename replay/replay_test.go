@@ -0,0 +1,213 @@
+package replay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"user-behavior-analytics-cdk/loadgen"
+	"user-behavior-analytics-cdk/schema"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/golang/snappy"
+)
+
+func event(id, action, bizId, createdAt string) string {
+	data, _ := json.Marshal(&schema.UserBehaviorEvent{EventId: id, Action: action, UserId: "u1", BizId: bizId, CreatedAt: createdAt})
+	return string(data)
+}
+
+func gzipData(t *testing.T, s string) []byte {
+	buf := bytes.Buffer{}
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(s))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func snappyData(t *testing.T, s string) []byte {
+	buf := bytes.Buffer{}
+	w := snappy.NewBufferedWriter(&buf)
+	w.Write([]byte(s))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testArchive is a firehose raw/ layout, one object per compression format,
+// firehose concatenates the records without a delimiter
+func testArchive(t *testing.T) map[string][]byte {
+	return map[string][]byte{
+		"2022/11/11/08/stream-1-2022-11-11-08-00-00-a.gz": gzipData(t,
+			event("e1", "pay", "b1", "2022-11-11 08:00:01.000000")+event("e2", "click", "b1", "2022-11-11 08:00:02.000000")),
+		"2022/11/11/08/stream-1-2022-11-11-08-30-00-b.snappy": snappyData(t,
+			event("e3", "pay", "b2", "2022-11-11 08:30:00.000000")+"\n"+event("e4", "pay", "b1", "2022-11-11T08:59:59.999Z")+"\n"),
+		"2022/11/11/09/stream-1-2022-11-11-09-00-00-c": []byte(
+			event("e5", "pay", "b1", "2022-11-11 09:00:00.000000") + event("e6", "pay", "b1", "not a time")),
+	}
+}
+
+func testDir(t *testing.T) string {
+	root := t.TempDir()
+	for key, data := range testArchive(t) {
+		path := filepath.Join(root, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func eventIds(t *testing.T, ndjson string) []string {
+	ids := []string{}
+	dec := json.NewDecoder(strings.NewReader(ndjson))
+	for dec.More() {
+		e := schema.UserBehaviorEvent{}
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, e.EventId)
+	}
+	return ids
+}
+
+func TestReplayerRun(t *testing.T) {
+	root := testDir(t)
+	tests := []struct {
+		name   string
+		prefix string
+		filter Filter
+		want   []string
+	}{
+		{name: "all", want: []string{"e1", "e2", "e3", "e4", "e5", "e6"}},
+		{name: "prefix", prefix: "2022/11/11/09/", want: []string{"e5", "e6"}},
+		{name: "action", filter: Filter{Actions: map[string]bool{"pay": true}}, want: []string{"e1", "e3", "e4", "e5", "e6"}},
+		{name: "action and biz", filter: Filter{Actions: map[string]bool{"pay": true}, BizIds: map[string]bool{"b1": true}}, want: []string{"e1", "e4", "e5", "e6"}},
+		{
+			name:   "time range",
+			filter: Filter{From: time.Date(2022, 11, 11, 8, 0, 2, 0, time.UTC), To: time.Date(2022, 11, 11, 9, 0, 0, 0, time.UTC)},
+			want:   []string{"e2", "e3", "e4"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			replayer := &Replayer{Source: &DirSource{Root: root, Prefix: tt.prefix}, Filter: tt.filter, Sink: &loadgen.NDJSONSink{Writer: out}, BatchSize: 2}
+			stats, err := replayer.Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := eventIds(t, out.String()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("replayed %v, want %v", got, tt.want)
+			}
+			if stats.Matched != len(tt.want) || stats.Sent != len(tt.want) {
+				t.Errorf("stats %+v", stats)
+			}
+		})
+	}
+}
+
+func TestReplayerRate(t *testing.T) {
+	out := &bytes.Buffer{}
+	replayer := &Replayer{Source: &DirSource{Root: testDir(t)}, Sink: &loadgen.NDJSONSink{Writer: out}, Rate: 40}
+	stats, err := replayer.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one batch of 6 events, it isn't ahead of the rate
+	if stats.Sent != 6 {
+		t.Errorf("stats %+v", stats)
+	}
+	replayer.BatchSize = 2
+	start := time.Now()
+	if _, err := replayer.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// the third batch is due after 4 events at 40/s
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("6 events in %s at 40/s", elapsed)
+	}
+}
+
+func TestReplayerDecodeError(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "bad"), []byte(`{"eventId":"e1"}{"eventId":`), 0644)
+	replayer := &Replayer{Source: &DirSource{Root: root}, Sink: &loadgen.NDJSONSink{Writer: io.Discard}}
+	if _, err := replayer.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "decode bad") {
+		t.Errorf("err %v", err)
+	}
+}
+
+// fakeS3 pages the archive one object per page
+type fakeS3 struct {
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.ToString(params.Prefix)) && key > aws.ToString(params.ContinuationToken) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return &s3.ListObjectsV2Output{}, nil
+	}
+	min := keys[0]
+	for _, key := range keys {
+		if key < min {
+			min = key
+		}
+	}
+	output := &s3.ListObjectsV2Output{Contents: []types.Object{{Key: aws.String(min)}}}
+	if len(keys) > 1 {
+		output.IsTruncated = aws.Bool(true)
+		output.NextContinuationToken = aws.String(min)
+	}
+	return output, nil
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(f.objects[aws.ToString(params.Key)]))}, nil
+}
+
+func TestS3Source(t *testing.T) {
+	objects := map[string][]byte{"raw/": nil}
+	for key, data := range testArchive(t) {
+		objects["raw/"+key] = data
+	}
+	source := &S3Source{S3Client: &fakeS3{objects: objects}, Bucket: "test", Prefix: "raw/2022/11/11/08/"}
+	keys, err := source.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"raw/2022/11/11/08/stream-1-2022-11-11-08-00-00-a.gz", "raw/2022/11/11/08/stream-1-2022-11-11-08-30-00-b.snappy"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys %v, want %v", keys, want)
+	}
+
+	out := &bytes.Buffer{}
+	source.Prefix = "raw/"
+	if _, err := (&Replayer{Source: source, Sink: &loadgen.NDJSONSink{Writer: out}}).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := eventIds(t, out.String()); len(got) != 6 {
+		t.Errorf("replayed %v", got)
+	}
+}
@@ -0,0 +1,125 @@
+// Package replay reads the user behavior events archived by firehose under the raw/ prefix
+// and puts them back into the kinesis data stream.
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/golang/snappy"
+)
+
+// firehose output file magic numbers, https://github.com/google/snappy/blob/main/framing_format.txt
+var (
+	gzipMagic   = []byte{0x1f, 0x8b}
+	snappyMagic = []byte("\xff\x06\x00\x00sNaPpY")
+)
+
+// Source lists and opens the firehose output objects
+type Source interface {
+	// List returns the object keys in key order, firehose keys are in delivery time order
+	List(ctx context.Context) ([]string, error)
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// S3API is the S3 client api used to read the archive, *s3.Client implements it
+type S3API interface {
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// S3Source is the archive bucket, Prefix e.g. raw/2022/11/11/ narrows the replay to the hours delivered then
+type S3Source struct {
+	S3Client S3API
+	Bucket   string
+	Prefix   string
+}
+
+func (m *S3Source) List(ctx context.Context) ([]string, error) {
+	keys := []string{}
+	paginator := s3.NewListObjectsV2Paginator(m.S3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(m.Bucket),
+		Prefix: aws.String(m.Prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			if key := aws.ToString(object.Key); !strings.HasSuffix(key, "/") {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *S3Source) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	res, err := m.S3Client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(m.Bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// DirSource is a local copy of the archive, e.g. aws s3 sync s3://bucket/raw/ ./raw/,
+// keys are the slash separated paths relative to Root
+type DirSource struct {
+	Root string
+	// Prefix of the relative paths, e.g. 2022/11/11/
+	Prefix string
+}
+
+func (m *DirSource) List(ctx context.Context) ([]string, error) {
+	keys := []string{}
+	err := filepath.WalkDir(m.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(m.Root, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, m.Prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *DirSource) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(m.Root, filepath.FromSlash(key)))
+}
+
+// Decompress detects the firehose CompressionFormat GZIP, Snappy or UNCOMPRESSED by the magic number
+func Decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(snappyMagic))
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(head, snappyMagic):
+		return snappy.NewReader(br), nil
+	}
+	return br, nil
+}
@@ -0,0 +1,106 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// CDC operations of the DMS kinesis target, load is a full load row
+const (
+	CdcOperationLoad   = "load"
+	CdcOperationInsert = "insert"
+	CdcOperationUpdate = "update"
+	CdcOperationDelete = "delete"
+)
+
+// CdcRecord is the envelope of a mysql row change put into the kinesis data stream by DMS with MessageFormat json-unformatted,
+// https://docs.aws.amazon.com/dms/latest/userguide/CHAP_Target.Kinesis.html#CHAP_Target.Kinesis.Messages
+//
+//	{"data":{"id":1,"status":"paid"},"before-image":{"id":1,"status":"created"},
+//	 "metadata":{"timestamp":"2022-11-11T11:11:11.111111Z","record-type":"data","operation":"update",
+//	 "partition-key-type":"primary-key","schema-name":"user_behavior","table-name":"order","transaction-id":8589934593}}
+type CdcRecord struct {
+	// Data is the row after the change, the deleted row of a delete
+	Data json.RawMessage `json:"data"`
+	// BeforeImage is the row before an update
+	BeforeImage json.RawMessage `json:"before-image,omitempty"`
+	Metadata    CdcMetadata     `json:"metadata"`
+}
+
+// CdcMetadata is the DMS metadata of a CdcRecord
+type CdcMetadata struct {
+	Timestamp string `json:"timestamp"`
+	// RecordType is data, or control of a table alter
+	RecordType string `json:"record-type"`
+	// Operation is load, insert, update, delete, or a control operation e.g. create-table
+	Operation        string      `json:"operation"`
+	PartitionKeyType string      `json:"partition-key-type,omitempty"`
+	SchemaName       string      `json:"schema-name"`
+	TableName        string      `json:"table-name"`
+	TransactionId    json.Number `json:"transaction-id,omitempty"`
+}
+
+// IsCdcRecord reports whether a record of a shared stream is a CdcRecord, a user behavior event has no metadata
+func IsCdcRecord(data []byte) bool {
+	probe := struct {
+		Metadata *struct {
+			RecordType string `json:"record-type"`
+		} `json:"metadata"`
+	}{}
+	return json.Unmarshal(data, &probe) == nil && probe.Metadata != nil && len(probe.Metadata.RecordType) > 0
+}
+
+// DecodeCdcRecord decodes and checks the envelope of a DMS kinesis record
+func DecodeCdcRecord(data []byte) (*CdcRecord, error) {
+	record := &CdcRecord{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, err
+	}
+	metadata := record.Metadata
+	switch {
+	case len(metadata.RecordType) == 0:
+		return nil, fmt.Errorf("metadata.record-type is required")
+	case len(metadata.Operation) == 0:
+		return nil, fmt.Errorf("metadata.operation is required")
+	case len(metadata.SchemaName) == 0 || len(metadata.TableName) == 0:
+		return nil, fmt.Errorf("metadata.schema-name and metadata.table-name are required")
+	case metadata.RecordType == "data" && len(record.Data) == 0:
+		return nil, fmt.Errorf("data is required of a %s record", metadata.Operation)
+	}
+	return record, nil
+}
+
+// CdcEnvelopeJSONSchema is the draft-07 JSON Schema document of CdcRecord
+func CdcEnvelopeJSONSchema() ([]byte, error) {
+	str := func(description string) map[string]interface{} {
+		return map[string]interface{}{"type": "string", "description": description}
+	}
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"title":       "CdcRecord",
+		"description": "mysql row change put into the kinesis data stream by DMS with MessageFormat json-unformatted",
+		"type":        "object",
+		"properties": map[string]interface{}{
+			"data":         map[string]interface{}{"type": "object", "description": "the row after the change, the deleted row of a delete"},
+			"before-image": map[string]interface{}{"type": "object", "description": "the row before an update"},
+			"metadata": map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"timestamp":          str("DMS time of the change, e.g. 2022-11-11T11:11:11.111111Z"),
+					"record-type":        map[string]interface{}{"type": "string", "enum": []string{"data", "control"}},
+					"operation":          str("load, insert, update, delete, or a control operation e.g. create-table"),
+					"partition-key-type": str("primary-key or schema-table"),
+					"schema-name":        str("source database"),
+					"table-name":         str("source table"),
+					"transaction-id":     map[string]interface{}{"type": "integer", "description": "source transaction id"},
+				},
+				"required": []string{"timestamp", "record-type", "operation", "schema-name", "table-name"},
+			},
+		},
+		"required": []string{"metadata"},
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
@@ -0,0 +1,61 @@
+// Code generated by go test ./schema -update; DO NOT EDIT.
+
+package schema
+
+import "fmt"
+
+// UserBehaviorEvent is the user behavior event put into the kinesis data stream
+type UserBehaviorEvent struct {
+	// unique event id, uuid
+	EventId string `json:"eventId"`
+	// user action, e.g. click, pay
+	Action string `json:"action"`
+	// user id
+	UserId string `json:"userId"`
+	// object id of the action
+	ObjectId string `json:"objectId"`
+	// business id
+	BizId string `json:"bizId"`
+	// error message with a level tag, e.g. [panic] [error] [warning]
+	ErrorMsg string `json:"errorMsg"`
+	// event time, e.g. 2022-11-11 11:11:11.000000
+	CreatedAt string `json:"createdAt"`
+}
+
+// Validate checks the required fields and the varchar lengths of the schema
+func (m *UserBehaviorEvent) Validate() error {
+	if len(m.EventId) == 0 {
+		return fmt.Errorf("eventId is required")
+	}
+	if len(m.EventId) > 64 {
+		return fmt.Errorf("eventId is longer than 64")
+	}
+	if len(m.Action) == 0 {
+		return fmt.Errorf("action is required")
+	}
+	if len(m.Action) > 256 {
+		return fmt.Errorf("action is longer than 256")
+	}
+	if len(m.UserId) == 0 {
+		return fmt.Errorf("userId is required")
+	}
+	if len(m.UserId) > 64 {
+		return fmt.Errorf("userId is longer than 64")
+	}
+	if len(m.ObjectId) > 64 {
+		return fmt.Errorf("objectId is longer than 64")
+	}
+	if len(m.BizId) > 64 {
+		return fmt.Errorf("bizId is longer than 64")
+	}
+	if len(m.ErrorMsg) > 1024 {
+		return fmt.Errorf("errorMsg is longer than 1024")
+	}
+	if len(m.CreatedAt) == 0 {
+		return fmt.Errorf("createdAt is required")
+	}
+	if len(m.CreatedAt) > 32 {
+		return fmt.Errorf("createdAt is longer than 32")
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"strings"
+	"text/template"
+)
+
+// SqlType is the KDA/Redshift column type of the field
+func (m *Field) SqlType() string {
+	switch m.Type {
+	case TypeInt:
+		return "BIGINT"
+	}
+	return fmt.Sprintf("VARCHAR(%d)", m.MaxLength)
+}
+
+// JsonPath is the KDA input record mapping of the field, the same name at the top level
+func (m *Field) JsonPath() string {
+	return "$." + m.Name
+}
+
+// GlueType is the glue/hive column type of the field
+func (m *Field) GlueType() string {
+	switch m.Type {
+	case TypeInt:
+		return "bigint"
+	}
+	return "string"
+}
+
+// RedshiftDDL is the CREATE TABLE of the ods table, see src/redshift-sql/ods/ods-raw-events.sql
+func (m *Schema) RedshiftDDL() string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "CREATE TABLE IF NOT EXISTS %s(\n", m.RedshiftTable)
+	for _, field := range m.Fields {
+		fmt.Fprintf(&b, "  %s %s not null", field.Name, strings.ToLower(field.SqlType()))
+		if field.Name == m.RedshiftDistKey {
+			b.WriteString(" distkey")
+		}
+		if field.Name == m.RedshiftSortKey {
+			b.WriteString(" sortkey")
+		}
+		b.WriteString(",\n")
+	}
+	fmt.Fprintf(&b, "  primary key(%s)\n);\n", m.PrimaryKey)
+	return b.String()
+}
+
+// JSONSchema is the draft-07 JSON Schema document of the event
+func (m *Schema) JSONSchema() ([]byte, error) {
+	type property struct {
+		Type        string `json:"type"`
+		MaxLength   int    `json:"maxLength,omitempty"`
+		MinLength   int    `json:"minLength,omitempty"`
+		Description string `json:"description,omitempty"`
+	}
+	properties := map[string]property{}
+	required := []string{}
+	for _, field := range m.Fields {
+		p := property{Type: "string", MaxLength: field.MaxLength, Description: field.Description}
+		if field.Type == TypeInt {
+			p = property{Type: "integer", Description: field.Description}
+		}
+		if field.Required {
+			required = append(required, field.Name)
+			if field.Type == TypeString {
+				p.MinLength = 1
+			}
+		}
+		properties[field.Name] = p
+	}
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"title":       m.Name,
+		"description": m.Description,
+		"type":        "object",
+		"properties":  properties,
+		"required":    required,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+var goStructTemplate = template.Must(template.New("struct").Parse(`// Code generated by go test ./schema -update; DO NOT EDIT.
+
+package {{.Package}}
+
+import "fmt"
+
+// {{.Schema.Name}} is the {{.Schema.Description}}
+type {{.Schema.Name}} struct {
+{{- range .Schema.Fields}}
+	// {{.Description}}
+	{{.GoName}} {{if eq .Type "int"}}int64{{else}}string{{end}} ` + "`{{call $.Tags .Name}}`" + `
+{{- end}}
+}
+
+// Validate checks the required fields and the varchar lengths of the schema
+func (m *{{.Schema.Name}}) Validate() error {
+{{- range .Schema.Fields}}{{if eq .Type "string"}}
+{{- if .Required}}
+	if len(m.{{.GoName}}) == 0 {
+		return fmt.Errorf("{{.Name}} is required")
+	}
+{{- end}}
+	if len(m.{{.GoName}}) > {{.MaxLength}} {
+		return fmt.Errorf("{{.Name}} is longer than {{.MaxLength}}")
+	}
+{{- end}}{{end}}
+	return nil
+}
+`))
+
+// GoStruct generates the gofmt-ed Go struct with a Validate method, every field has the tags, e.g. json dynamodbav
+func (m *Schema) GoStruct(pkg string, tags ...string) ([]byte, error) {
+	if len(tags) == 0 {
+		tags = []string{"json"}
+	}
+	buf := bytes.Buffer{}
+	err := goStructTemplate.Execute(&buf, struct {
+		Package string
+		Schema  *Schema
+		Tags    func(name string) string
+	}{
+		Package: pkg,
+		Schema:  m,
+		Tags: func(name string) string {
+			parts := make([]string, len(tags))
+			for i, tag := range tags {
+				parts[i] = fmt.Sprintf(`%s:"%s"`, tag, name)
+			}
+			return strings.Join(parts, " ")
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
@@ -0,0 +1,86 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// OpenSearchDateFormat parses the producer createdAt 2022-11-11 11:11:11.000000, the js 2022-11-11T11:11:11.000Z and the DMS timestamp
+const OpenSearchDateFormat = "yyyy-MM-dd HH:mm:ss.SSSSSS||strict_date_optional_time||epoch_millis"
+
+// OpenSearchMapping is the opensearch field mapping of the field
+func (m *Field) OpenSearchMapping(timeField bool) map[string]interface{} {
+	switch {
+	case timeField:
+		// a malformed time doesn't drop the event
+		return map[string]interface{}{"type": "date", "format": OpenSearchDateFormat, "ignore_malformed": true}
+	case m.Type == TypeInt:
+		return map[string]interface{}{"type": "long"}
+	case m.FullText:
+		return map[string]interface{}{
+			"type":   "text",
+			"fields": map[string]interface{}{"keyword": map[string]interface{}{"type": "keyword", "ignore_above": m.MaxLength}},
+		}
+	}
+	return map[string]interface{}{"type": "keyword", "ignore_above": m.MaxLength}
+}
+
+// OpenSearchIndexTemplate is the composable index template of the event indices matched by the patterns,
+// the fields out of the schema aren't indexed
+func (m *Schema) OpenSearchIndexTemplate(patterns ...string) ([]byte, error) {
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("index template of %s needs an index pattern", m.Name)
+	}
+	properties := map[string]interface{}{}
+	for _, field := range m.Fields {
+		properties[field.Name] = field.OpenSearchMapping(field.Name == m.TimeField)
+	}
+	return json.Marshal(map[string]interface{}{
+		"index_patterns": patterns,
+		"template": map[string]interface{}{
+			"mappings": map[string]interface{}{"dynamic": false, "properties": properties},
+		},
+	})
+}
+
+// CdcOpenSearchIndexTemplate is the composable index template of the CdcRecord indices matched by the patterns,
+// the columns of data and before-image are mapped dynamically, a string column is searched by words and by the exact keyword
+func CdcOpenSearchIndexTemplate(patterns ...string) ([]byte, error) {
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("index template of CdcRecord needs an index pattern")
+	}
+	keyword := map[string]interface{}{"type": "keyword"}
+	return json.Marshal(map[string]interface{}{
+		"index_patterns": patterns,
+		"template": map[string]interface{}{
+			"mappings": map[string]interface{}{
+				"dynamic_templates": []interface{}{
+					map[string]interface{}{
+						"row_strings": map[string]interface{}{
+							"match_mapping_type": "string",
+							"mapping": map[string]interface{}{
+								"type":   "text",
+								"fields": map[string]interface{}{"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 256}},
+							},
+						},
+					},
+				},
+				"properties": map[string]interface{}{
+					"data":         map[string]interface{}{"type": "object"},
+					"before-image": map[string]interface{}{"type": "object"},
+					"metadata": map[string]interface{}{
+						"properties": map[string]interface{}{
+							"timestamp":          map[string]interface{}{"type": "date", "format": OpenSearchDateFormat, "ignore_malformed": true},
+							"record-type":        keyword,
+							"operation":          keyword,
+							"partition-key-type": keyword,
+							"schema-name":        keyword,
+							"table-name":         keyword,
+							"transaction-id":     map[string]interface{}{"type": "long"},
+						},
+					},
+				},
+			},
+		},
+	})
+}
@@ -0,0 +1,71 @@
+// Package schema is the single source of truth of the user behavior event,
+// the KDA column mappings, Redshift DDL, JSON Schema document and Go struct are generated from it.
+// go test ./schema fails when a checked-in copy drifts, go test ./schema -update rewrites the generated files.
+package schema
+
+// FieldType is the event field value type
+type FieldType string
+
+const (
+	TypeString FieldType = "string"
+	TypeInt    FieldType = "int"
+)
+
+// Field is one json field of the event, the json name is also the KDA and Redshift column name
+type Field struct {
+	Name string
+	// GoName is the exported Go struct field name
+	GoName string
+	Type   FieldType
+	// MaxLength is the varchar length of a string field
+	MaxLength   int
+	Required    bool
+	Description string
+	// FullText is a string searched by words in opensearch, the others are exact keywords
+	FullText bool
+}
+
+// Schema is an event schema
+type Schema struct {
+	// Name is the Go type name
+	Name        string
+	Description string
+	Fields      []Field
+	// RedshiftTable is the ods table, keys are column names
+	RedshiftTable   string
+	RedshiftDistKey string
+	RedshiftSortKey string
+	PrimaryKey      string
+	// TimeField is the event time field, a date of the opensearch index
+	TimeField string
+}
+
+// UserBehaviorEventSchema is the event put into the kinesis data stream by the producers,
+// createdAt is the local time string of the producer, e.g. 2022-11-11 11:11:11.000000
+var UserBehaviorEventSchema = &Schema{
+	Name:        "UserBehaviorEvent",
+	Description: "user behavior event put into the kinesis data stream",
+	Fields: []Field{
+		{Name: "eventId", GoName: "EventId", Type: TypeString, MaxLength: 64, Required: true, Description: "unique event id, uuid"},
+		{Name: "action", GoName: "Action", Type: TypeString, MaxLength: 256, Required: true, Description: "user action, e.g. click, pay", FullText: true},
+		{Name: "userId", GoName: "UserId", Type: TypeString, MaxLength: 64, Required: true, Description: "user id"},
+		{Name: "objectId", GoName: "ObjectId", Type: TypeString, MaxLength: 64, Description: "object id of the action"},
+		{Name: "bizId", GoName: "BizId", Type: TypeString, MaxLength: 64, Description: "business id"},
+		{Name: "errorMsg", GoName: "ErrorMsg", Type: TypeString, MaxLength: 1024, Description: "error message with a level tag, e.g. [panic] [error] [warning]", FullText: true},
+		{Name: "createdAt", GoName: "CreatedAt", Type: TypeString, MaxLength: 32, Required: true, Description: "event time, e.g. 2022-11-11 11:11:11.000000"},
+	},
+	RedshiftTable:   "ods_raw_event",
+	RedshiftDistKey: "eventId",
+	RedshiftSortKey: "createdAt",
+	PrimaryKey:      "eventId",
+	TimeField:       "createdAt",
+}
+
+// FieldNames returns the json field names in schema order
+func (m *Schema) FieldNames() []string {
+	names := make([]string, len(m.Fields))
+	for i, field := range m.Fields {
+		names[i] = field.Name
+	}
+	return names
+}
@@ -0,0 +1,323 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the generated files")
+
+// generated files checked in, path is relative to the schema dir
+var generated = map[string]func() ([]byte, error){
+	"event_gen.go": func() ([]byte, error) {
+		return UserBehaviorEventSchema.GoStruct("schema", "json")
+	},
+	"user-behavior-event.schema.json": UserBehaviorEventSchema.JSONSchema,
+	"cdc-envelope.schema.json":        CdcEnvelopeJSONSchema,
+	"../src/lambda/collect-event-to-kds/event_gen.go": func() ([]byte, error) {
+		return UserBehaviorEventSchema.GoStruct("main", "json")
+	},
+}
+
+func TestGeneratedFiles(t *testing.T) {
+	for file, generate := range generated {
+		want, err := generate()
+		if err != nil {
+			t.Fatalf("generate %s error = %v", file, err)
+		}
+		if *update {
+			if err := os.WriteFile(file, want, 0o644); err != nil {
+				t.Fatalf("write %s error = %v", file, err)
+			}
+			continue
+		}
+		got, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("read %s error = %v", file, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s drifts from the schema, run go test ./schema -update", file)
+		}
+	}
+}
+
+type column struct {
+	name    string
+	sqlType string
+}
+
+var columnRe = regexp.MustCompile(`(?m)^\s*"?(\w+)"?\s+(\w+(?:\(\d+\))?)`)
+
+// columns parses the column list of the first "CREATE ..." statement which contains marker
+func columns(t *testing.T, sql, marker string) []column {
+	t.Helper()
+	start := strings.Index(sql, marker)
+	if start < 0 {
+		t.Fatalf("%s not found", marker)
+	}
+	body := sql[start:]
+	body = body[strings.Index(body, "(")+1 : strings.Index(body, ";")]
+	cols := []column{}
+	for _, m := range columnRe.FindAllStringSubmatch(body, -1) {
+		if strings.EqualFold(m[1], "primary") {
+			continue
+		}
+		cols = append(cols, column{name: m[1], sqlType: strings.ToUpper(m[2])})
+	}
+	return cols
+}
+
+func schemaColumns() []column {
+	cols := []column{}
+	for _, field := range UserBehaviorEventSchema.Fields {
+		cols = append(cols, column{name: field.Name, sqlType: field.SqlType()})
+	}
+	return cols
+}
+
+func readFile(t *testing.T, file string) string {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("read %s error = %v", file, err)
+	}
+	return string(data)
+}
+
+func TestRedshiftDDL(t *testing.T) {
+	if got := columns(t, UserBehaviorEventSchema.RedshiftDDL(), "CREATE TABLE"); !reflect.DeepEqual(got, schemaColumns()) {
+		t.Errorf("RedshiftDDL() columns = %v, want %v", got, schemaColumns())
+	}
+
+	sql := readFile(t, "../src/redshift-sql/ods/ods-raw-events.sql")
+	if got := columns(t, sql, "CREATE TABLE IF NOT EXISTS "+UserBehaviorEventSchema.RedshiftTable); !reflect.DeepEqual(got, schemaColumns()) {
+		t.Errorf("ods-raw-events.sql columns = %v, want %v", got, schemaColumns())
+	}
+}
+
+func TestKdaSql(t *testing.T) {
+	for _, field := range UserBehaviorEventSchema.Fields {
+		if got := field.JsonPath(); got != "$."+field.Name {
+			t.Errorf("JsonPath() of %s = %s", field.Name, got)
+		}
+	}
+
+	// the abnormal event output stream keeps the event columns
+	sql := readFile(t, "../src/kinesis-analytics-sql/filter-abnormality-event.sql")
+	if got := columns(t, sql, `STREAM "DESTINATION_SQL_STREAM"`); !reflect.DeepEqual(got, schemaColumns()) {
+		t.Errorf("filter-abnormality-event.sql columns = %v, want %v", got, schemaColumns())
+	}
+
+	// every source column selected by the apps is an event field
+	fields := map[string]bool{}
+	for _, name := range UserBehaviorEventSchema.FieldNames() {
+		fields[name] = true
+	}
+	sourceColumnRe := regexp.MustCompile(`"(\w+)"`)
+	for _, file := range []string{"filter-abnormality-event.sql", "filter-abnormality-window-event.sql"} {
+		sql := readFile(t, "../src/kinesis-analytics-sql/"+file)
+		declared := map[string]bool{}
+		for _, col := range columns(t, sql, `STREAM "DESTINATION_SQL_STREAM"`) {
+			declared[col.name] = true
+		}
+		pump := sql[strings.Index(sql, "CREATE OR REPLACE PUMP"):]
+		for _, m := range sourceColumnRe.FindAllStringSubmatch(pump, -1) {
+			name := m[1]
+			if fields[name] || declared[name] || strings.ToUpper(name) == name {
+				continue
+			}
+			t.Errorf("%s column %s isn't an event field", file, name)
+		}
+	}
+}
+
+// jsonTags returns the json tag names of the struct in the go file
+func jsonTags(t *testing.T, file, structName string) map[string]bool {
+	t.Helper()
+	f, err := parser.ParseFile(token.NewFileSet(), file, nil, 0)
+	if err != nil {
+		t.Fatalf("parse %s error = %v", file, err)
+	}
+	tags := map[string]bool{}
+	tagRe := regexp.MustCompile(`json:"(\w+)`)
+	ast.Inspect(f, func(n ast.Node) bool {
+		spec, ok := n.(*ast.TypeSpec)
+		if !ok || spec.Name.Name != structName {
+			return true
+		}
+		for _, field := range spec.Type.(*ast.StructType).Fields.List {
+			if field.Tag != nil {
+				if m := tagRe.FindStringSubmatch(field.Tag.Value); m != nil {
+					tags[m[1]] = true
+				}
+			}
+		}
+		return false
+	})
+	return tags
+}
+
+func TestEventConsumers(t *testing.T) {
+	for _, consumer := range []struct{ file, structName string }{
+		{"../src/lambda/save-alert-from-kda/main.go", "EventItem"},
+		{"../src/lambda/send-alert-to-webhook/main.go", "EventItem"},
+	} {
+		tags := jsonTags(t, consumer.file, consumer.structName)
+		for _, name := range UserBehaviorEventSchema.FieldNames() {
+			if !tags[name] {
+				t.Errorf("%s %s has no field %s", consumer.file, consumer.structName, name)
+			}
+		}
+	}
+}
+
+func TestEventProducers(t *testing.T) {
+	keyRe := regexp.MustCompile(`(?m)^\s*"?(\w+)"?\s*:`)
+	for _, producer := range []struct{ file, start, end string }{
+		{"../src/lambda/js-func/hitcounter/hitcounter.js", "var recordData = {", "};"},
+		{"../src/scripts/producer-kds-test.py", "payload = {", "}"},
+	} {
+		src := readFile(t, producer.file)
+		start := strings.Index(src, producer.start)
+		if start < 0 {
+			t.Fatalf("%s has no %s", producer.file, producer.start)
+		}
+		body := src[start+len(producer.start):]
+		body = body[:strings.Index(body, producer.end)]
+		keys := []string{}
+		for _, m := range keyRe.FindAllStringSubmatch(body, -1) {
+			keys = append(keys, m[1])
+		}
+		if !reflect.DeepEqual(keys, UserBehaviorEventSchema.FieldNames()) {
+			t.Errorf("%s event fields = %v, want %v", producer.file, keys, UserBehaviorEventSchema.FieldNames())
+		}
+	}
+}
+
+// the js producer fills a missing createdAt with formatCreatedAt, it runs with node when it's installed
+func TestEventProducerCreatedAt(t *testing.T) {
+	src := readFile(t, "../src/lambda/js-func/hitcounter/hitcounter.js")
+	if !strings.Contains(src, "createdAt: bodyObj.createdAt?bodyObj.createdAt:formatCreatedAt(new Date())") {
+		t.Fatal("hitcounter.js createdAt fallback isn't formatCreatedAt(new Date())")
+	}
+	start := strings.Index(src, "function formatCreatedAt(")
+	if start < 0 {
+		t.Fatal("hitcounter.js has no formatCreatedAt")
+	}
+	fn := src[start:]
+	fn = fn[:strings.Index(fn, "\n}\n")+2]
+
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node isn't installed")
+	}
+	cmd := exec.Command(node, "-e", fn+"\nconsole.log(formatCreatedAt(new Date(2022, 10, 1, 8, 5, 9, 7)))")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("node formatCreatedAt error = %v", err)
+	}
+	createdAt := strings.TrimSpace(string(out))
+	if createdAt != "2022-11-01 08:05:09.007000" {
+		t.Errorf("formatCreatedAt() = %s, want 2022-11-01 08:05:09.007000", createdAt)
+	}
+	if _, err := time.Parse("2006-01-02 15:04:05.000000", createdAt); err != nil {
+		t.Errorf("formatCreatedAt() = %s isn't the createdAt layout: %v", createdAt, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	event := &UserBehaviorEvent{EventId: "e1", Action: "pay", UserId: "u1", CreatedAt: "2022-11-11 11:11:11.000000"}
+	if err := event.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+	event.ErrorMsg = strings.Repeat("x", 1025)
+	if err := event.Validate(); err == nil || err.Error() != "errorMsg is longer than 1024" {
+		t.Errorf("Validate() error = %v, want errorMsg too long", err)
+	}
+	event = &UserBehaviorEvent{EventId: "e1", UserId: "u1", CreatedAt: "2022-11-11 11:11:11.000000"}
+	if err := event.Validate(); err == nil || err.Error() != "action is required" {
+		t.Errorf("Validate() error = %v, want action is required", err)
+	}
+}
+
+func TestDecodeCdcRecord(t *testing.T) {
+	update := []byte(`{"data":{"id":1,"status":"paid"},"before-image":{"id":1,"status":"created"},` +
+		`"metadata":{"timestamp":"2022-11-11T11:11:11.111111Z","record-type":"data","operation":"update",` +
+		`"partition-key-type":"primary-key","schema-name":"user_behavior","table-name":"order","transaction-id":8589934593}}`)
+	record, err := DecodeCdcRecord(update)
+	if err != nil {
+		t.Fatalf("DecodeCdcRecord() error = %v", err)
+	}
+	if record.Metadata.Operation != CdcOperationUpdate || record.Metadata.TableName != "order" || record.Metadata.TransactionId != "8589934593" {
+		t.Errorf("DecodeCdcRecord() metadata = %+v", record.Metadata)
+	}
+	if string(record.BeforeImage) != `{"id":1,"status":"created"}` {
+		t.Errorf("DecodeCdcRecord() before-image = %s", record.BeforeImage)
+	}
+	if !IsCdcRecord(update) {
+		t.Error("IsCdcRecord() = false of a cdc record")
+	}
+	if IsCdcRecord([]byte(`{"eventId":"e1","action":"pay","userId":"u1","createdAt":"2022-11-11 11:11:11.000000"}`)) {
+		t.Error("IsCdcRecord() = true of an event")
+	}
+
+	for _, bad := range []string{
+		`{"data":{"id":1}}`,
+		`{"data":{"id":1},"metadata":{"record-type":"data","operation":"insert","table-name":"order"}}`,
+		`{"metadata":{"record-type":"data","operation":"insert","schema-name":"user_behavior","table-name":"order"}}`,
+	} {
+		if _, err := DecodeCdcRecord([]byte(bad)); err == nil {
+			t.Errorf("DecodeCdcRecord(%s) error = nil", bad)
+		}
+	}
+}
+
+func TestOpenSearchIndexTemplate(t *testing.T) {
+	data, err := UserBehaviorEventSchema.OpenSearchIndexTemplate("user-behavior-event*")
+	if err != nil {
+		t.Fatalf("OpenSearchIndexTemplate() error = %v", err)
+	}
+	template := struct {
+		IndexPatterns []string `json:"index_patterns"`
+		Template      struct {
+			Mappings struct {
+				Properties map[string]struct {
+					Type string `json:"type"`
+				} `json:"properties"`
+			} `json:"mappings"`
+		} `json:"template"`
+	}{}
+	if err := json.Unmarshal(data, &template); err != nil {
+		t.Fatalf("OpenSearchIndexTemplate() json error = %v", err)
+	}
+	if !reflect.DeepEqual(template.IndexPatterns, []string{"user-behavior-event*"}) {
+		t.Errorf("index_patterns = %v", template.IndexPatterns)
+	}
+	properties := template.Template.Mappings.Properties
+	if len(properties) != len(UserBehaviorEventSchema.Fields) {
+		t.Errorf("properties = %v, want the schema fields", properties)
+	}
+	for name, want := range map[string]string{"eventId": "keyword", "errorMsg": "text", "createdAt": "date"} {
+		if got := properties[name].Type; got != want {
+			t.Errorf("%s type = %s, want %s", name, got, want)
+		}
+	}
+
+	if _, err := CdcOpenSearchIndexTemplate(); err == nil {
+		t.Error("CdcOpenSearchIndexTemplate() without a pattern error = nil")
+	}
+	if data, err := CdcOpenSearchIndexTemplate("cdc-*"); err != nil || !json.Valid(data) {
+		t.Errorf("CdcOpenSearchIndexTemplate() = %s, %v", data, err)
+	}
+}
@@ -6,12 +6,11 @@ kda-pyflink-demo.py
 1. 创建 Table Environment
 2. 创建源 Kinesis Data Stream
 3. 创建目标 S3 Bucket
-4. 执行窗口函数查询
-5. 将结果写入目标
+4. 执行窗口函数查询, 用户行为事件按 createdAt 一分钟滚动窗口统计每个 action, bizId 的事件数和异常事件数
+5. 将结果写入目标, 按 action 分区的 csv: window_end, bizId, event_count, abnormal_count
 """
 
 from pyflink.table import EnvironmentSettings, StreamTableEnvironment
-from pyflink.table.window import Tumble
 import os
 import json
 
@@ -44,21 +43,26 @@ def property_map(props, property_group_id):
 
 
 def create_source_table(table_name, stream_name, region, stream_initpos):
+    # 用户行为事件, 见 schema/user-behavior-event.schema.json,
+    # createdAt 是 2022-11-11 11:11:11.000000 或 2022-11-11T11:11:11.000Z, 取到秒作为事件时间
     return """ CREATE TABLE {0} (
-                ticker VARCHAR(6),
-                price DOUBLE,
-                event_time TIMESTAMP(3),
-                WATERMARK FOR event_time AS event_time - INTERVAL '5' SECOND
-
+                `eventId` STRING,
+                `action` STRING,
+                `userId` STRING,
+                `objectId` STRING,
+                `bizId` STRING,
+                `errorMsg` STRING,
+                `createdAt` STRING,
+                `event_time` AS TO_TIMESTAMP(SUBSTR(REPLACE(`createdAt`, 'T', ' '), 1, 19)),
+                WATERMARK FOR `event_time` AS `event_time` - INTERVAL '5' SECOND
               )
-              PARTITIONED BY (ticker)
               WITH (
                 'connector' = 'kinesis',
                 'stream' = '{1}',
                 'aws.region' = '{2}',
                 'scan.stream.initpos' = '{3}',
                 'format' = 'json',
-                'json.timestamp-format.standard' = 'ISO-8601'
+                'json.ignore-parse-errors' = 'true'
               ) """.format(
         table_name, stream_name, region, stream_initpos
     )
@@ -66,13 +70,13 @@ def create_source_table(table_name, stream_name, region, stream_initpos):
 
 def create_sink_table(table_name, bucket_name):
     return """ CREATE TABLE {0} (
-                ticker VARCHAR(6),
-                price DOUBLE,
-                event_time TIMESTAMP(3),
-                WATERMARK FOR event_time AS event_time - INTERVAL '5' SECOND
-
+                `window_end` TIMESTAMP(3),
+                `bizId` STRING,
+                `event_count` BIGINT,
+                `abnormal_count` BIGINT,
+                `action` STRING
               )
-              PARTITIONED BY (ticker)
+              PARTITIONED BY (`action`)
               WITH (
                   'connector'='filesystem',
                   'path'='s3a://{1}/',
@@ -83,19 +87,19 @@ def create_sink_table(table_name, bucket_name):
         table_name, bucket_name)
 
 
-def count_by_word(input_table_name):
-    # 使用 Table API
-    input_table = table_env.from_path(input_table_name)
-
-    tumbling_window_table = (
-        input_table.window(
-            Tumble.over("1.minute").on("event_time").alias("one_minute_window")
-        )
-        .group_by("ticker, one_minute_window")
-        .select("ticker, price.avg as price, one_minute_window.end as event_time")
-    )
-
-    return tumbling_window_table
+def count_by_action(input_table_name, output_table_name):
+    # 每分钟每个 action, bizId 的事件数和异常([error]/[panic])事件数
+    return """ INSERT INTO {1}
+              SELECT
+                TUMBLE_END(`event_time`, INTERVAL '1' MINUTE) AS `window_end`,
+                `bizId`,
+                COUNT(*) AS `event_count`,
+                SUM(CASE WHEN LOWER(`errorMsg`) LIKE '%[error]%' OR LOWER(`errorMsg`) LIKE '%[panic]%' THEN 1 ELSE 0 END) AS `abnormal_count`,
+                `action`
+              FROM {0}
+              WHERE `event_time` IS NOT NULL
+              GROUP BY TUMBLE(`event_time`, INTERVAL '1' MINUTE), `action`, `bizId` """.format(
+        input_table_name, output_table_name)
 
 
 def main():
@@ -139,11 +143,8 @@ def main():
     table_env.execute_sql(create_sink)
 
     # 4. 执行窗口函数查询
-    tumbling_window_table = count_by_word(input_table_name)
-
     # 5. 将结果写入目标
-    tumbling_window_table.execute_insert(output_table_name).wait()
-
+    statement_set.add_insert_sql(count_by_action(input_table_name, output_table_name))
     statement_set.execute()
 
 
@@ -13,36 +13,27 @@
 -- https://docs.aws.amazon.com/zh_cn/kinesisanalytics/latest/dev/streaming-sql-concepts.html
 -- https://docs.aws.amazon.com/zh_cn/kinesisanalytics/latest/sqlref/kinesis-analytics-sqlref.pdf
 
--- abnormality event stream
+-- per action warning count stream
+-- KDA requires every non aggregated column in GROUP BY, so only action and the window are kept
 CREATE OR REPLACE STREAM "DESTINATION_SQL_STREAM" 
 (
-    "eventId"       varchar(64),
     "action"        varchar(256),
-    "userId"        varchar(64),
-    "objectId"      varchar(64),
-    "bizId"         varchar(64),
-    "errorMsg"      varchar(1024),
-    "createAt"      varchar(32),
-    "INGREST_ROW_TIME"      varchar(32),
-    "APPROXIMATE_ARRIVAL_TIME"      varchar(32)
+    "windowStart"   TIMESTAMP,
+    "warnCount"     INTEGER
 );
 
 -- Filter errorMsg like warning pump
 -- Aggregation with time window(u can use stagger windows,tumbling windows, sliding windows)
--- use tumbling windows for this case
+-- use tumbling windows for this case, one row per action every 60 seconds,
+-- the alert threshold is checked by the output lambda so every window count is stored
 CREATE OR REPLACE PUMP "STREAM_PUMP" AS
     INSERT INTO "DESTINATION_SQL_STREAM"
-    SELECT STREAM "eventId", "userId", "objectId", "bizId", "createAt"
-        "errorMsg","action",
-        STEP("SOURCE_SQL_STREAM_001".ROWTIME BY INTERVAL '60' SECOND) AS "INGREST_ROW_TIME",
-        STEP("SOURCE_SQL_STREAM_001".APPROXIMATE_ARRIVAL_TIME BY INTERVAL '60' SECOND) AS "APPROXIMATE_ARRIVAL_TIME",
-        -- STEP("SOURCE_SQL_STREAM_001".EVENT_TIME BY INTERVAL '60' SECOND) AS "EVENT_TIME",
-        COUNT(*) AS "action_warn_count"
+    SELECT STREAM "action",
+        STEP("SOURCE_SQL_STREAM_001".ROWTIME BY INTERVAL '60' SECOND) AS "windowStart",
+        COUNT(*) AS "warnCount"
     FROM "SOURCE_SQL_STREAM_001"
-    WHERE "errorMsg" LIKE "% WARNNING %" or "errorMsg" LIKE "% warnning %"
+    WHERE LOWER("errorMsg") LIKE '%[warn]%'
+        or LOWER("errorMsg") LIKE '%[warning]%'
+        or LOWER("errorMsg") LIKE '%[warnning]%'
     GROUP BY "action",
-        STEP("SOURCE_SQL_STREAM_001".ROWTIME BY INTERVAL '60' SECOND),
-        STEP("SOURCE_SQL_STREAM_001".APPROXIMATE_ARRIVAL_TIME BY INTERVAL '60' SECOND)
-        -- STEP("SOURCE_SQL_STREAM_001".EVENT_TIME BY INTERVAL '60' SECOND) 
-    Having "action_warn_count" >= 10;
-    
\ No newline at end of file
+        STEP("SOURCE_SQL_STREAM_001".ROWTIME BY INTERVAL '60' SECOND);
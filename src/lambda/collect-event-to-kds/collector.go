@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// PutRecords accepts at most 500 records per call
+const maxBatchSize = 500
+
+// createdAt layout, same as the python producers str(datetime.now())
+const createdAtLayout = "2006-01-02 15:04:05.000000"
+
+// ErrBadRequest means the body is neither an event json object nor an array of them
+var ErrBadRequest = errors.New("bad request")
+
+// KinesisPutRecordsAPI is the Kinesis client api used to put events, *kinesis.Client implements it
+type KinesisPutRecordsAPI interface {
+	PutRecords(ctx context.Context, params *kinesis.PutRecordsInput, optFns ...func(*kinesis.Options)) (*kinesis.PutRecordsOutput, error)
+}
+
+// Rejection is an event which isn't put into the stream, Index is the position in the request
+type Rejection struct {
+	Index   int    `json:"index"`
+	EventId string `json:"eventId,omitempty"`
+	Error   string `json:"error"`
+	// Retryable is a kinesis failure(e.g. throttled) of a valid event, the client can send it again
+	Retryable bool `json:"retryable,omitempty"`
+}
+
+// CollectResult is the response body of POST /event
+type CollectResult struct {
+	Accepted int `json:"accepted"`
+	// EventIds of the accepted events
+	EventIds []string    `json:"eventIds"`
+	Rejected []Rejection `json:"rejected"`
+}
+
+// Collector validates the events by the event schema, fills eventId/createdAt and puts them into the kinesis data stream
+type Collector struct {
+	KinesisClient KinesisPutRecordsAPI
+	StreamName    string
+
+	now func() time.Time
+}
+
+func NewCollector(client KinesisPutRecordsAPI, streamName string) *Collector {
+	return &Collector{KinesisClient: client, StreamName: streamName, now: time.Now}
+}
+
+// Collect puts the valid events of body with one PutRecords call, body is one event or an array of events.
+// a request error(ErrBadRequest or the PutRecords error) rejects all events, otherwise every invalid or failed event is rejected alone.
+func (m *Collector) Collect(ctx context.Context, body []byte) (*CollectResult, error) {
+	raws, err := splitEvents(body)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &CollectResult{EventIds: []string{}, Rejected: []Rejection{}}
+	records := make([]types.PutRecordsRequestEntry, 0, len(raws))
+	recordIdxs := make([]int, 0, len(raws))
+	eventIds := make([]string, 0, len(raws))
+	for i, raw := range raws {
+		event := &UserBehaviorEvent{}
+		if err := json.Unmarshal(raw, event); err != nil {
+			result.Rejected = append(result.Rejected, Rejection{Index: i, Error: err.Error()})
+			continue
+		}
+		// filled server side when the client doesn't send them, a rejection only reports the client eventId
+		clientEventId := event.EventId
+		if len(event.EventId) == 0 {
+			event.EventId = newEventId()
+		}
+		if len(event.CreatedAt) == 0 {
+			event.CreatedAt = m.now().Format(createdAtLayout)
+		}
+		if err := event.Validate(); err != nil {
+			result.Rejected = append(result.Rejected, Rejection{Index: i, EventId: clientEventId, Error: err.Error()})
+			continue
+		}
+
+		data, err := json.Marshal(event)
+		if err != nil {
+			result.Rejected = append(result.Rejected, Rejection{Index: i, EventId: clientEventId, Error: err.Error()})
+			continue
+		}
+		records = append(records, types.PutRecordsRequestEntry{Data: data, PartitionKey: aws.String(event.EventId)})
+		recordIdxs = append(recordIdxs, i)
+		eventIds = append(eventIds, event.EventId)
+	}
+	if len(records) == 0 {
+		return result, nil
+	}
+
+	output, err := m.KinesisClient.PutRecords(ctx, &kinesis.PutRecordsInput{
+		Records:    records,
+		StreamName: aws.String(m.StreamName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for j, record := range output.Records {
+		if record.ErrorCode != nil {
+			result.Rejected = append(result.Rejected, Rejection{
+				Index:     recordIdxs[j],
+				EventId:   eventIds[j],
+				Error:     fmt.Sprintf("%s: %s", aws.ToString(record.ErrorCode), aws.ToString(record.ErrorMessage)),
+				Retryable: true,
+			})
+			continue
+		}
+		result.Accepted++
+		result.EventIds = append(result.EventIds, eventIds[j])
+	}
+
+	return result, nil
+}
+
+// splitEvents returns the raw json of every event in body
+func splitEvents(body []byte) ([]json.RawMessage, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, fmt.Errorf("%w: empty body", ErrBadRequest)
+	}
+	if body[0] != '[' {
+		if body[0] != '{' || !json.Valid(body) {
+			return nil, fmt.Errorf("%w: body isn't an event json object or array", ErrBadRequest)
+		}
+		return []json.RawMessage{body}, nil
+	}
+
+	raws := []json.RawMessage{}
+	if err := json.Unmarshal(body, &raws); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadRequest, err.Error())
+	}
+	if len(raws) == 0 || len(raws) > maxBatchSize {
+		return nil, fmt.Errorf("%w: batch size %d isn't in [1, %d]", ErrBadRequest, len(raws), maxBatchSize)
+	}
+	return raws, nil
+}
+
+// newEventId is a random uuid v4
+func newEventId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
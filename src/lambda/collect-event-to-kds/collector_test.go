@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// fakeKinesis records put events, events of an action in throttle fail with ProvisionedThroughputExceededException
+type fakeKinesis struct {
+	events   []*UserBehaviorEvent
+	throttle map[string]bool
+	err      error
+}
+
+func (f *fakeKinesis) PutRecords(ctx context.Context, params *kinesis.PutRecordsInput, optFns ...func(*kinesis.Options)) (*kinesis.PutRecordsOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	output := &kinesis.PutRecordsOutput{}
+	for _, record := range params.Records {
+		event := &UserBehaviorEvent{}
+		json.Unmarshal(record.Data, event)
+		if aws.ToString(record.PartitionKey) != event.EventId {
+			return nil, fmt.Errorf("partition key %s isn't eventId %s", aws.ToString(record.PartitionKey), event.EventId)
+		}
+		if f.throttle[event.Action] {
+			output.FailedRecordCount = aws.Int32(aws.ToInt32(output.FailedRecordCount) + 1)
+			output.Records = append(output.Records, types.PutRecordsResultEntry{
+				ErrorCode:    aws.String("ProvisionedThroughputExceededException"),
+				ErrorMessage: aws.String("Rate exceeded"),
+			})
+			continue
+		}
+		f.events = append(f.events, event)
+		output.Records = append(output.Records, types.PutRecordsResultEntry{SequenceNumber: aws.String("1"), ShardId: aws.String("shardId-000000000000")})
+	}
+	return output, nil
+}
+
+func newTestCollector(fakeKds *fakeKinesis) *Collector {
+	c := NewCollector(fakeKds, "test")
+	c.now = func() time.Time { return time.Date(2022, 11, 11, 11, 11, 11, 123456000, time.UTC) }
+	return c
+}
+
+func TestCollectorCollect(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		throttle     []string
+		wantErr      error
+		wantAccepted int
+		wantRejected []int
+	}{
+		{
+			name:         "single event",
+			body:         `{"eventId":"e1","action":"pay","userId":"u1","createdAt":"2022-11-11 11:11:11"}`,
+			wantAccepted: 1,
+		},
+		{
+			name:         "batch with invalid events",
+			body:         `[{"action":"pay","userId":"u1"}, {"action":"pay"}, "not an event", {"action":"login","userId":"u2","bizId":"` + strings.Repeat("b", 65) + `"}]`,
+			wantAccepted: 1,
+			wantRejected: []int{1, 2, 3},
+		},
+		{
+			name:         "throttled events are rejected alone",
+			body:         `[{"action":"pay","userId":"u1"}, {"action":"login","userId":"u1"}]`,
+			throttle:     []string{"pay"},
+			wantAccepted: 1,
+			wantRejected: []int{0},
+		},
+		{name: "empty body", body: " ", wantErr: ErrBadRequest},
+		{name: "not json", body: "action=pay", wantErr: ErrBadRequest},
+		{name: "empty batch", body: "[]", wantErr: ErrBadRequest},
+		{name: "batch too large", body: "[" + strings.TrimSuffix(strings.Repeat(`{"action":"pay"},`, maxBatchSize+1), ",") + "]", wantErr: ErrBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeKds := &fakeKinesis{throttle: map[string]bool{}}
+			for _, action := range tt.throttle {
+				fakeKds.throttle[action] = true
+			}
+			result, err := newTestCollector(fakeKds).Collect(context.Background(), []byte(tt.body))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Collect() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if result.Accepted != tt.wantAccepted || len(fakeKds.events) != tt.wantAccepted || len(result.EventIds) != tt.wantAccepted {
+				t.Errorf("Collect() accepted %d put %d, want %d", result.Accepted, len(fakeKds.events), tt.wantAccepted)
+			}
+			rejected := []int{}
+			for _, rejection := range result.Rejected {
+				rejected = append(rejected, rejection.Index)
+			}
+			if fmt.Sprint(rejected) != fmt.Sprint(append([]int{}, tt.wantRejected...)) {
+				t.Errorf("Collect() rejected %v, want %v", result.Rejected, tt.wantRejected)
+			}
+		})
+	}
+}
+
+func TestCollectorFillsEvent(t *testing.T) {
+	fakeKds := &fakeKinesis{}
+	result, err := newTestCollector(fakeKds).Collect(context.Background(), []byte(`{"action":"pay","userId":"u1","errorMsg":"[error] boom"}`))
+	if err != nil || result.Accepted != 1 {
+		t.Fatalf("Collect() = %+v, %v", result, err)
+	}
+	event := fakeKds.events[0]
+	if len(event.EventId) != 36 || event.EventId != result.EventIds[0] {
+		t.Errorf("Collect() eventId = %s, want a uuid", event.EventId)
+	}
+	if event.CreatedAt != "2022-11-11 11:11:11.123456" {
+		t.Errorf("Collect() createdAt = %s", event.CreatedAt)
+	}
+	if event.ErrorMsg != "[error] boom" {
+		t.Errorf("Collect() errorMsg = %s", event.ErrorMsg)
+	}
+}
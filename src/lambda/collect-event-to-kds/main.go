@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	awslambda "github.com/aws/aws-sdk-go-v2/service/lambda"
+)
+
+// DynamoDBUpdateItemAPI is the DynamoDB client api used to count hits, *dynamodb.Client implements it
+type DynamoDBUpdateItemAPI interface {
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+}
+
+// LambdaInvokeAPI is the Lambda client api used to call the downstream function, *lambda.Client implements it
+type LambdaInvokeAPI interface {
+	Invoke(ctx context.Context, params *awslambda.InvokeInput, optFns ...func(*awslambda.Options)) (*awslambda.InvokeOutput, error)
+}
+
+// CollectHandler is the drop-in Go replacement of the hitcounter function behind API Gateway:
+// it counts hits per path, collects POST /event into the kinesis data stream
+// and proxies the other requests to the downstream function.
+type CollectHandler struct {
+	collector *Collector
+
+	hitsClient    DynamoDBUpdateItemAPI
+	hitsTableName string
+
+	lambdaClient   LambdaInvokeAPI
+	downstreamName string
+}
+
+func NewCollectHandler(collector *Collector) *CollectHandler {
+	return &CollectHandler{collector: collector}
+}
+
+// WithHits counts the hits of every path in the table
+func (h *CollectHandler) WithHits(client DynamoDBUpdateItemAPI, tableName string) *CollectHandler {
+	h.hitsClient, h.hitsTableName = client, tableName
+	return h
+}
+
+// WithDownstream proxies the requests which aren't POST /event to the function
+func (h *CollectHandler) WithDownstream(client LambdaInvokeAPI, functionName string) *CollectHandler {
+	h.lambdaClient, h.downstreamName = client, functionName
+	return h
+}
+
+// same env as hitcounter.js: HITS_STREAM_NAME is required, HITS_TABLE_NAME and DOWNSTREAM_FUNCTION_NAME are optional
+func Init() *CollectHandler {
+	streamName := os.Getenv("HITS_STREAM_NAME")
+	if len(streamName) == 0 {
+		log.Fatalf("env HITS_STREAM_NAME is empty")
+	}
+	tableName, downstreamName := os.Getenv("HITS_TABLE_NAME"), os.Getenv("DOWNSTREAM_FUNCTION_NAME")
+	log.Printf("env HITS_STREAM_NAME:%s HITS_TABLE_NAME:%s DOWNSTREAM_FUNCTION_NAME:%s", streamName, tableName, downstreamName)
+
+	optFns := []func(*config.LoadOptions) error{}
+	if region := os.Getenv("REGION"); len(region) > 0 {
+		optFns = append(optFns, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(context.TODO(), optFns...)
+	if err != nil {
+		log.Fatalf("unable to load SDK config, %v", err)
+	}
+
+	h := NewCollectHandler(NewCollector(kinesis.NewFromConfig(cfg), streamName))
+	if len(tableName) > 0 {
+		h.WithHits(dynamodb.NewFromConfig(cfg), tableName)
+	}
+	if len(downstreamName) > 0 {
+		h.WithDownstream(awslambda.NewFromConfig(cfg), downstreamName)
+	}
+	return h
+}
+
+func (h *CollectHandler) Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if h.hitsClient != nil {
+		// a failed hit count doesn't fail the request
+		if err := h.hit(ctx, request.Path); err != nil {
+			log.Printf("[WARNING] path %s can't count hit err:%s \n", request.Path, err.Error())
+		}
+	}
+
+	if request.HTTPMethod == http.MethodPost && request.Path == "/event" {
+		return h.collect(ctx, request)
+	}
+	if h.lambdaClient != nil {
+		return h.downstream(ctx, request)
+	}
+
+	return jsonResponse(http.StatusNotFound, map[string]string{"error": "only POST /event is supported"})
+}
+
+// collect responds 200 when any event is accepted, 400 when the request or all events are invalid,
+// 503 when none is accepted and some can be retried, 502 when the events can't be put into the stream
+func (h *CollectHandler) collect(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	body := []byte(request.Body)
+	if request.IsBase64Encoded {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "base64 encoded body isn't supported"})
+	}
+
+	result, err := h.collector.Collect(ctx, body)
+	if errors.Is(err, ErrBadRequest) {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		log.Printf("[ERROR] put events err:%s \n", err.Error())
+		return jsonResponse(http.StatusBadGateway, map[string]string{"error": "can't put events into the stream"})
+	}
+	log.Printf("[INFO] accepted %d events, rejected %d \n", result.Accepted, len(result.Rejected))
+
+	statusCode := http.StatusOK
+	if result.Accepted == 0 {
+		statusCode = http.StatusBadRequest
+		for _, rejection := range result.Rejected {
+			if rejection.Retryable {
+				statusCode = http.StatusServiceUnavailable
+				break
+			}
+		}
+	}
+	return jsonResponse(statusCode, result)
+}
+
+func (h *CollectHandler) hit(ctx context.Context, path string) error {
+	_, err := h.hitsClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(h.hitsTableName),
+		Key:              map[string]dynamodbtypes.AttributeValue{"path": &dynamodbtypes.AttributeValueMemberS{Value: path}},
+		UpdateExpression: aws.String("ADD hits :incr"),
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":incr": &dynamodbtypes.AttributeValueMemberN{Value: "1"},
+		},
+	})
+	return err
+}
+
+// downstream invokes the downstream function with the request and returns its response
+func (h *CollectHandler) downstream(ctx context.Context, request events.APIGatewayProxyRequest) (response events.APIGatewayProxyResponse, err error) {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return
+	}
+	output, err := h.lambdaClient.Invoke(ctx, &awslambda.InvokeInput{
+		FunctionName: aws.String(h.downstreamName),
+		Payload:      payload,
+	})
+	if err != nil {
+		return
+	}
+	if output.FunctionError != nil {
+		log.Printf("[ERROR] downstream %s error:%s payload:%s \n", h.downstreamName, aws.ToString(output.FunctionError), output.Payload)
+		return jsonResponse(http.StatusBadGateway, map[string]string{"error": "downstream function error"})
+	}
+	err = json.Unmarshal(output.Payload, &response)
+
+	return
+}
+
+func jsonResponse(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(data),
+	}, nil
+}
+
+func main() {
+	lambda.Start(Init().Handler)
+}
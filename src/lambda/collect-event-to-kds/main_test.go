@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	awslambda "github.com/aws/aws-sdk-go-v2/service/lambda"
+)
+
+// fakeHits counts hits per path
+type fakeHits struct {
+	hits map[string]int
+}
+
+func (f *fakeHits) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	f.hits[params.Key["path"].(*dynamodbtypes.AttributeValueMemberS).Value]++
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+// fakeDownstream is the hello function
+type fakeDownstream struct {
+	invoked int
+}
+
+func (f *fakeDownstream) Invoke(ctx context.Context, params *awslambda.InvokeInput, optFns ...func(*awslambda.Options)) (*awslambda.InvokeOutput, error) {
+	f.invoked++
+	request := events.APIGatewayProxyRequest{}
+	json.Unmarshal(params.Payload, &request)
+	payload, _ := json.Marshal(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: "hello " + request.Path})
+	return &awslambda.InvokeOutput{StatusCode: 200, Payload: payload}, nil
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		request        events.APIGatewayProxyRequest
+		kinesisErr     error
+		throttle       []string
+		wantStatusCode int
+		wantBody       string
+		wantInvoked    int
+	}{
+		{
+			name:           "collect events",
+			request:        events.APIGatewayProxyRequest{HTTPMethod: "POST", Path: "/event", Body: `[{"eventId":"e1","action":"pay","userId":"u1"},{"action":"pay"}]`},
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"accepted":1,"eventIds":["e1"],"rejected":[{"index":1,"error":"userId is required"}]}`,
+		},
+		{
+			name:           "all events invalid",
+			request:        events.APIGatewayProxyRequest{HTTPMethod: "POST", Path: "/event", Body: `{"eventId":"e1","userId":"u1"}`},
+			wantStatusCode: http.StatusBadRequest,
+			wantBody:       `{"accepted":0,"eventIds":[],"rejected":[{"index":0,"eventId":"e1","error":"action is required"}]}`,
+		},
+		{
+			name:           "all events throttled",
+			request:        events.APIGatewayProxyRequest{HTTPMethod: "POST", Path: "/event", Body: `{"eventId":"e1","action":"pay","userId":"u1"}`},
+			throttle:       []string{"pay"},
+			wantStatusCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:           "bad request",
+			request:        events.APIGatewayProxyRequest{HTTPMethod: "POST", Path: "/event", Body: `pay`},
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "stream error",
+			request:        events.APIGatewayProxyRequest{HTTPMethod: "POST", Path: "/event", Body: `{"action":"pay","userId":"u1"}`},
+			kinesisErr:     errors.New("fake kinesis error"),
+			wantStatusCode: http.StatusBadGateway,
+		},
+		{
+			name:           "other path goes downstream",
+			request:        events.APIGatewayProxyRequest{HTTPMethod: "GET", Path: "/hello"},
+			wantStatusCode: http.StatusOK,
+			wantBody:       "hello /hello",
+			wantInvoked:    1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeKds := &fakeKinesis{err: tt.kinesisErr, throttle: map[string]bool{}}
+			for _, action := range tt.throttle {
+				fakeKds.throttle[action] = true
+			}
+			hits, downstream := &fakeHits{hits: map[string]int{}}, &fakeDownstream{}
+			h := NewCollectHandler(newTestCollector(fakeKds)).WithHits(hits, "hits").WithDownstream(downstream, "hello")
+
+			got, err := h.Handler(context.Background(), tt.request)
+			if err != nil {
+				t.Fatalf("Handler() error = %v", err)
+			}
+			if got.StatusCode != tt.wantStatusCode {
+				t.Errorf("Handler() status = %d, want %d body %s", got.StatusCode, tt.wantStatusCode, got.Body)
+			}
+			if len(tt.wantBody) > 0 && got.Body != tt.wantBody {
+				t.Errorf("Handler() body = %s, want %s", got.Body, tt.wantBody)
+			}
+			if downstream.invoked != tt.wantInvoked {
+				t.Errorf("Handler() invoked downstream %d, want %d", downstream.invoked, tt.wantInvoked)
+			}
+			if hits.hits[tt.request.Path] != 1 {
+				t.Errorf("Handler() hits of %s = %d, want 1", tt.request.Path, hits.hits[tt.request.Path])
+			}
+		})
+	}
+
+	// without downstream
+	h := NewCollectHandler(newTestCollector(&fakeKinesis{}))
+	if got, _ := h.Handler(context.Background(), events.APIGatewayProxyRequest{HTTPMethod: "GET", Path: "/"}); got.StatusCode != http.StatusNotFound {
+		t.Errorf("Handler() without downstream status = %d, want 404", got.StatusCode)
+	}
+}
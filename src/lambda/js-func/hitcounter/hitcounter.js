@@ -22,7 +22,7 @@ exports.handler = async function(event) {
   if (event.httpMethod == "POST"
     && event.path == "/event"
     && process.env.HITS_STREAM_NAME.length>0) {
-    putRecordToKDS(event.body);
+    await putRecordToKDS(event.body);
   }
 
   // call downstream function and capture response
@@ -47,7 +47,7 @@ async function putRecordToKDS(bodyStr){
     objectId: bodyObj.objectId?bodyObj.objectId:"",
     bizId: bodyObj.bizId?bodyObj.bizId:"",
     errorMsg: bodyObj.errorMsg?bodyObj.errorMsg:"",
-    createdTime: new Date()
+    createdAt: bodyObj.createdAt?bodyObj.createdAt:formatCreatedAt(new Date())
   };
   console.log('put KDS recordData:', JSON.stringify(recordData, undefined, 2));
   const putRes = await kinesis.putRecord({
@@ -58,3 +58,10 @@ async function putRecordToKDS(bodyStr){
   console.log('KDS result:', JSON.stringify(putRes, undefined, 2));
 }
 
+// createdAt layout of the schema, same as the python producers str(datetime.now()): 2022-11-11 11:11:11.000000
+function formatCreatedAt(date){
+  const pad = (n, width) => String(n).padStart(width, '0');
+  return date.getFullYear() + '-' + pad(date.getMonth() + 1, 2) + '-' + pad(date.getDate(), 2) + ' ' +
+    pad(date.getHours(), 2) + ':' + pad(date.getMinutes(), 2) + ':' + pad(date.getSeconds(), 2) + '.' +
+    pad(date.getMilliseconds(), 3) + '000';
+}
@@ -3,23 +3,24 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/sagemakerruntime"
 	"github.com/aws/aws-sdk-go-v2/service/sns"
 )
 
-var eventDynamodbTable string
-var eventSNSTopicArn string
-var ddbClient *dynamodb.Client
-var snsClient *sns.Client
-
 type EventItem struct {
 	EventId   string `dynamodbav:"eventId" json:"eventId"`
 	Action    string `dynamodbav:"action" json:"action"`
@@ -28,61 +29,195 @@ type EventItem struct {
 	ObjectId  string `dynamodbav:"objectId" json:"objectId"`
 	BizId     string `dynamodbav:"bizId" json:"bizId"`
 	ErrorMsg  string `dynamodbav:"errorMsg" json:"errorMsg"`
+	// Severity is derived from ErrorMsg by the SeverityClassifier: panic/error/warning/info
+	Severity string `dynamodbav:"severity,omitempty" json:"severity,omitempty"`
+	// AnomalyScore is from the AnomalyScorer, nil without a scorer or when the scoring failed
+	AnomalyScore *float64 `dynamodbav:"anomalyScore,omitempty" json:"anomalyScore,omitempty"`
 }
 
-type TableBasics struct {
-	DynamoDbClient *dynamodb.Client
-	TableName      string
+// Field returns the value of the json field name, empty for unknown field
+func (m *EventItem) Field(name string) string {
+	switch name {
+	case "eventId":
+		return m.EventId
+	case "action":
+		return m.Action
+	case "userId":
+		return m.UserId
+	case "createdAt":
+		return m.CreatedAt
+	case "objectId":
+		return m.ObjectId
+	case "bizId":
+		return m.BizId
+	case "errorMsg":
+		return m.ErrorMsg
+	case "severity":
+		return m.Severity
+	}
+	return ""
 }
 
-// ensure idempotency with a condition expression
-func (m TableBasics) putItem(eventItem *EventItem) (err error) {
-	item, err := attributevalue.MarshalMap(eventItem)
-	if err != nil {
-		return
+// AlertHandler saves abnormal events from kinesis analytics output and alerts them
+type AlertHandler struct {
+	store      EventStore
+	publisher  AlertPublisher
+	suppressor AlertSuppressor
+	classifier *SeverityClassifier
+	scorer     AnomalyScorer
+	// anomalyThreshold raises the severity of an event scored at least it, 0 only saves and alerts the score
+	anomalyThreshold float64
+}
+
+func NewAlertHandler(store EventStore, publisher AlertPublisher) *AlertHandler {
+	classifier, _ := NewSeverityClassifier(DefaultSeverityRules)
+	return &AlertHandler{store: store, publisher: publisher, classifier: classifier}
+}
+
+// WithClassifier replaces the DefaultSeverityRules classifier
+func (h *AlertHandler) WithClassifier(classifier *SeverityClassifier) *AlertHandler {
+	h.classifier = classifier
+	return h
+}
+
+// WithSuppressor rate limits alerts by the suppressor, nil sends every alert
+func (h *AlertHandler) WithSuppressor(suppressor AlertSuppressor) *AlertHandler {
+	h.suppressor = suppressor
+	return h
+}
+
+// WithScorer scores the events before they are saved, nil doesn't score,
+// an event scored at least threshold (> 0) is raised to the anomalySeverity whatever its errorMsg tag
+func (h *AlertHandler) WithScorer(scorer AnomalyScorer, threshold float64) *AlertHandler {
+	h.scorer = scorer
+	h.anomalyThreshold = threshold
+	return h
+}
+
+// NewAlertHandlerFromConfig wires the DynamoDB table store and SNS topic publisher with real clients,
+// severityTopicArns routes alerts of a severity to another topic
+func NewAlertHandlerFromConfig(cfg aws.Config, tableName, topicArn string, severityTopicArns map[string]string, tmpl *template.Template) *AlertHandler {
+	return NewAlertHandler(
+		TableBasics{DynamoDbClient: dynamodb.NewFromConfig(cfg), TableName: tableName},
+		SnsPublisher{SnsClient: sns.NewFromConfig(cfg), TopicArn: topicArn, SeverityTopicArns: severityTopicArns, Template: tmpl},
+	)
+}
+
+// loadConfig loads the default SDK config, region is from env REGION or the lambda runtime AWS_REGION.
+// env ENDPOINT_URL overrides all service endpoints, DYNAMODB_ENDPOINT_URL/SNS_ENDPOINT_URL/SAGEMAKER_RUNTIME_ENDPOINT_URL
+// override one service, e.g. DynamoDB Local and local SNS and endpoint stand-ins for integration tests.
+func loadConfig(ctx context.Context) (aws.Config, error) {
+	optFns := []func(*config.LoadOptions) error{}
+	if region := os.Getenv("REGION"); len(region) > 0 {
+		optFns = append(optFns, config.WithRegion(region))
 	}
-	_, err = m.DynamoDbClient.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName:           aws.String(m.TableName),
-		Item:                item,
-		ConditionExpression: aws.String("attribute_not_exists(inspectedAt)"),
-	})
-	if err != nil {
-		log.Printf("[ERROR] Couldn't add item to table. Here's why: %v\n", err)
+
+	endpoints := map[string]string{}
+	for serviceID, env := range map[string]string{
+		dynamodb.ServiceID:         "DYNAMODB_ENDPOINT_URL",
+		sns.ServiceID:              "SNS_ENDPOINT_URL",
+		sagemakerruntime.ServiceID: "SAGEMAKER_RUNTIME_ENDPOINT_URL",
+	} {
+		if url := os.Getenv(env); len(url) > 0 {
+			endpoints[serviceID] = url
+		} else if url := os.Getenv("ENDPOINT_URL"); len(url) > 0 {
+			endpoints[serviceID] = url
+		}
 	}
+	if len(endpoints) > 0 {
+		log.Printf("override service endpoints: %v", endpoints)
+		optFns = append(optFns, config.WithEndpointResolverWithOptions(endpointResolver(endpoints)))
+	}
+
+	return config.LoadDefaultConfig(ctx, optFns...)
+}
 
-	return
+// endpointResolver resolves serviceID -> url, other services use the default endpoint
+func endpointResolver(endpoints map[string]string) aws.EndpointResolverWithOptions {
+	return aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+		if url, ok := endpoints[service]; ok {
+			return aws.Endpoint{URL: url, SigningRegion: region, Source: aws.EndpointSourceCustom}, nil
+		}
+		return aws.Endpoint{}, &aws.EndpointNotFoundError{}
+	})
 }
 
 // more example: https://github.com/awsdocs/aws-doc-sdk-examples/tree/main/gov2
-func Init() {
-	eventDynamodbTable = os.Getenv("TABLE_NAME")
-	eventSNSTopicArn = os.Getenv("TOPIC_ARN")
+func Init() *AlertHandler {
+	eventDynamodbTable := os.Getenv("TABLE_NAME")
+	eventSNSTopicArn := os.Getenv("TOPIC_ARN")
 	if len(eventDynamodbTable) == 0 || len(eventSNSTopicArn) == 0 {
 		log.Fatalf("env TABLE_NAME:%s TOPIC_ARN:%s is empty", eventDynamodbTable, eventSNSTopicArn)
 	}
+	log.Printf("env TABLE_NAME:%s TOPIC_ARN:%s", eventDynamodbTable, eventSNSTopicArn)
 
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("us-east-1"))
+	cfg, err := loadConfig(context.TODO())
 	if err != nil {
 		log.Fatalf("unable to load SDK config, %v", err)
 	}
+	log.Printf("SDK config region:%s", cfg.Region)
+
+	// ALERT_TEMPLATE_FILE overrides the bundled templates/alert.tmpl
+	tmpl, err := LoadAlertTemplate(os.Getenv("ALERT_TEMPLATE_FILE"))
+	if err != nil {
+		log.Fatalf("unable to load alert template, %v", err)
+	}
+
+	// panics page through the high priority topic, the others only go to the alert topic
+	severityTopicArns := map[string]string{}
+	if highPriorityTopicArn := os.Getenv("HIGH_PRIORITY_TOPIC_ARN"); len(highPriorityTopicArn) > 0 {
+		severityTopicArns["panic"] = highPriorityTopicArn
+		log.Printf("env HIGH_PRIORITY_TOPIC_ARN:%s", highPriorityTopicArn)
+	}
+
+	// SEVERITY_RULES is a json list of {"severity","pattern"}, default DefaultSeverityRules
+	classifier, err := ParseSeverityRules(os.Getenv("SEVERITY_RULES"))
+	if err != nil {
+		log.Fatalf("unable to parse SEVERITY_RULES, %v", err)
+	}
+
+	h := NewAlertHandlerFromConfig(cfg, eventDynamodbTable, eventSNSTopicArn, severityTopicArns, tmpl).WithClassifier(classifier)
+
+	// optional suppression window, SUPPRESS_GROUP_KEYS is a comma separated list of event json field names
+	suppressTable := os.Getenv("SUPPRESS_TABLE_NAME")
+	suppressWindow, _ := strconv.Atoi(os.Getenv("SUPPRESS_WINDOW_SECONDS"))
+	if len(suppressTable) > 0 && suppressWindow > 0 {
+		groupKeys := []string{}
+		for _, key := range strings.Split(os.Getenv("SUPPRESS_GROUP_KEYS"), ",") {
+			if key = strings.TrimSpace(key); len(key) > 0 {
+				groupKeys = append(groupKeys, key)
+			}
+		}
+		suppressor := NewDynamoSuppressor(dynamodb.NewFromConfig(cfg), suppressTable, time.Duration(suppressWindow)*time.Second, groupKeys)
+		log.Printf("env SUPPRESS_TABLE_NAME:%s window:%ds group keys:%v", suppressTable, suppressWindow, suppressor.GroupKeys)
+		h.WithSuppressor(suppressor)
+	}
 
-	// Using the Config value, create the DynamoDB,SNS client
-	ddbClient = dynamodb.NewFromConfig(cfg)
-	snsClient = sns.NewFromConfig(cfg)
+	// optional anomaly model endpoint of the sagemaker stack, ANOMALY_SCORE_THRESHOLD raises the high scores to anomalySeverity
+	if endpointName := os.Getenv("ANOMALY_ENDPOINT_NAME"); len(endpointName) > 0 {
+		threshold, _ := strconv.ParseFloat(os.Getenv("ANOMALY_SCORE_THRESHOLD"), 64)
+		log.Printf("env ANOMALY_ENDPOINT_NAME:%s ANOMALY_SCORE_THRESHOLD:%v", endpointName, threshold)
+		h.WithScorer(&SageMakerScorer{Client: sagemakerruntime.NewFromConfig(cfg), EndpointName: endpointName}, threshold)
+	}
+
+	return h
 }
 
 // detail: https://docs.aws.amazon.com/zh_cn/lambda/latest/dg/with-kinesis.html
 // input and output data: https://docs.aws.amazon.com/zh_cn/kinesisanalytics/latest/dev/how-it-works-output-lambda.html
 // notice:
 // Best effort, Kinesis Analytics Output is "at least once" delivery, meaning this lambda function can be invoked multiple times with the same item
-// need Idempotent operation
+// need Idempotent operation, the store rejects a saved event with ErrDuplicateEvent and no alert is sent again
+// every record gets its own result, only failed records are redelivered by KDA,
+// the invocation returns an error only when none of the decoded records could be persisted.
 // @TODO tracing https://docs.aws.amazon.com/zh_cn/lambda/latest/dg/golang-tracing.html
-func Handler(ctx context.Context, kinesisAnalyticsEvent events.KinesisAnalyticsOutputDeliveryEvent) (responses events.KinesisAnalyticsOutputDeliveryResponse, err error) {
+func (h *AlertHandler) Handler(ctx context.Context, kinesisAnalyticsEvent events.KinesisAnalyticsOutputDeliveryEvent) (responses events.KinesisAnalyticsOutputDeliveryResponse, err error) {
 	responses = events.KinesisAnalyticsOutputDeliveryResponse{
 		Records: make([]events.KinesisAnalyticsOutputDeliveryResponseRecord, len(kinesisAnalyticsEvent.Records)),
 	}
 
-	log.Printf("env TABLE_NAME:%s TOPIC_ARN:%s", eventDynamodbTable, eventSNSTopicArn)
+	eventItems := make([]*EventItem, 0, len(kinesisAnalyticsEvent.Records))
+	recordIdxs := make([]int, 0, len(kinesisAnalyticsEvent.Records))
 	for i, record := range kinesisAnalyticsEvent.Records {
 		responses.Records[i] = events.KinesisAnalyticsOutputDeliveryResponseRecord{
 			RecordID: record.RecordID,
@@ -94,41 +229,150 @@ func Handler(ctx context.Context, kinesisAnalyticsEvent events.KinesisAnalyticsO
 		log.Printf("%s Data = %s \n", record.RecordID, dataBytes)
 
 		eventItem := &EventItem{}
-		err = json.Unmarshal(dataBytes, eventItem)
-		if err != nil {
+		if err := json.Unmarshal(dataBytes, eventItem); err != nil {
 			log.Printf("[WARNING] %s Data = %s can't decode by json error:%s \n", record.RecordID, dataBytes, err.Error())
-			err = nil
 			continue
 		}
-		tb := TableBasics{
-			DynamoDbClient: ddbClient,
-			TableName:      eventDynamodbTable,
+		eventItem.Severity = h.classifier.Classify(eventItem.ErrorMsg)
+		eventItems = append(eventItems, eventItem)
+		recordIdxs = append(recordIdxs, i)
+	}
+
+	h.score(ctx, eventItems)
+
+	saveErrs := h.store.SaveEvents(ctx, eventItems)
+	persisted := 0
+	var lastErr error
+	alerts := make([]*EventItem, 0, len(eventItems))
+	alertData := map[*EventItem][]byte{}
+	for j, eventItem := range eventItems {
+		record := kinesisAnalyticsEvent.Records[recordIdxs[j]]
+		dataBytes := record.Data
+		if errors.Is(saveErrs[j], ErrDuplicateEvent) {
+			// redelivered by KDA, already alerted
+			log.Printf("[INFO] %s Data = %s is duplicate, skip alert \n", record.RecordID, dataBytes)
+			persisted++
+			continue
+		}
+		if saveErrs[j] != nil {
+			log.Printf("[ERROR] %s Data = %s save event: %v error:%s \n", record.RecordID, dataBytes, eventItem, saveErrs[j].Error())
+			responses.Records[recordIdxs[j]].Result = events.KinesisAnalyticsOutputDeliveryFailed
+			lastErr = saveErrs[j]
+			continue
 		}
-		err = tb.putItem(eventItem)
-		if err != nil {
-			log.Printf("[ERROR] %s Data = %s dynamoDb putItem: %v error:%s \n", record.RecordID, dataBytes, eventItem, err.Error())
-			responses.Records[i].Result = events.KinesisAnalyticsOutputDeliveryFailed
-			return responses, err
+		persisted++
+		alerts = append(alerts, eventItem)
+		// alert the saved item with its severity
+		if data, err := json.Marshal(eventItem); err == nil {
+			dataBytes = data
+		}
+		alertData[eventItem] = dataBytes
+	}
+
+	for _, eventItem := range h.suppress(ctx, alerts) {
+		if pubErr := h.publisher.Publish(ctx, eventItem, alertData[eventItem]); pubErr != nil {
+			log.Printf("[WARNING] Data = %s can't send alert err:%s \n", alertData[eventItem], pubErr.Error())
+		}
+	}
+
+	if len(eventItems) > 0 && persisted == 0 {
+		err = fmt.Errorf("none of %d records persisted, last error: %w", len(eventItems), lastErr)
+	}
+
+	return responses, err
+}
+
+// score sets the AnomalyScore of the events and raises the severity of the scores over the threshold,
+// a scoring error only logs, the events are saved and alerted without it
+func (h *AlertHandler) score(ctx context.Context, eventItems []*EventItem) {
+	if h.scorer == nil || len(eventItems) == 0 {
+		return
+	}
+	scores, err := h.scorer.Score(ctx, eventItems)
+	if err != nil {
+		log.Printf("[WARNING] can't score %d events err:%s \n", len(eventItems), err.Error())
+		return
+	}
+	for i, eventItem := range eventItems {
+		score := scores[i]
+		eventItem.AnomalyScore = &score
+		if h.anomalyThreshold > 0 && score >= h.anomalyThreshold && eventItem.Severity != anomalySeverity {
+			log.Printf("[INFO] %s anomaly score %.2f raises severity %s to %s \n", eventItem.EventId, score, eventItem.Severity, anomalySeverity)
+			eventItem.Severity = anomalySeverity
 		}
+	}
+}
+
+// suppress returns the alerts to send now, the others are counted into the suppression window digest.
+// one suppression check per group, a check error sends the first alert of the group.
+func (h *AlertHandler) suppress(ctx context.Context, alerts []*EventItem) []*EventItem {
+	if h.suppressor == nil {
+		return alerts
+	}
 
-		//go func() {
-		input := &sns.PublishInput{
-			Message:  aws.String(string(dataBytes)),
-			TopicArn: aws.String(eventSNSTopicArn),
+	groupKeys := []string{}
+	groups := map[string][]*EventItem{}
+	for _, eventItem := range alerts {
+		groupKey := h.suppressor.GroupKey(eventItem)
+		if _, ok := groups[groupKey]; !ok {
+			groupKeys = append(groupKeys, groupKey)
 		}
-		res, err := snsClient.Publish(context.TODO(), input)
+		groups[groupKey] = append(groups[groupKey], eventItem)
+	}
+
+	sends := []*EventItem{}
+	for _, groupKey := range groupKeys {
+		group := groups[groupKey]
+		allowed, err := h.suppressor.Check(ctx, groupKey, group)
 		if err != nil {
-			log.Printf("[WARNING] Data = %s can't send SNS err:%s \n", dataBytes, err.Error())
-		} else {
-			log.Printf("[INFO] Data = %s send SNS ok msgID:%s \n", dataBytes, *res.MessageId)
+			log.Printf("[WARNING] group %s suppression check err:%s \n", groupKey, err.Error())
+			allowed = true
+		}
+		if allowed {
+			sends = append(sends, group[0])
+			group = group[1:]
+		}
+		if len(group) > 0 {
+			log.Printf("[INFO] group %s suppressed %d alerts \n", groupKey, len(group))
 		}
-		//}()
 	}
 
-	return responses, err
+	return sends
+}
+
+// DigestHandler is invoked by a schedule rule, it sends the digest of every finished suppression window
+func (h *AlertHandler) DigestHandler(ctx context.Context, event events.CloudWatchEvent) error {
+	if h.suppressor == nil {
+		return nil
+	}
+	digests, err := h.suppressor.Digests(ctx)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, digest := range digests {
+		if err := h.publisher.PublishDigest(ctx, digest); err != nil {
+			log.Printf("[ERROR] group %s can't send digest err:%s \n", digest.GroupKey, err.Error())
+			lastErr = err
+			continue
+		}
+		if err := h.suppressor.Reset(ctx, digest); err != nil {
+			log.Printf("[ERROR] group %s can't reset digest err:%s \n", digest.GroupKey, err.Error())
+			lastErr = err
+		}
+	}
+	log.Printf("[INFO] sent %d digests \n", len(digests))
+
+	return lastErr
 }
 
 func main() {
-	Init()
-	lambda.Start(Handler)
+	h := Init()
+	// the same function code is deployed as the scheduled digest function with env HANDLER=digest
+	if os.Getenv("HANDLER") == "digest" {
+		lambda.Start(h.DigestHandler)
+		return
+	}
+	lambda.Start(h.Handler)
 }
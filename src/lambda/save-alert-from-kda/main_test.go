@@ -2,21 +2,143 @@ package main
 
 import (
 	"context"
-	"os"
+	"errors"
+	"fmt"
 	"reflect"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/sagemakerruntime"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
 )
 
-// Tips: env params need to set(TOPIC_ARN, TABLE_NAME) before run test if need env params
-func TestMain(m *testing.M) {
-	os.Setenv("TABLE_NAME", "test")
-	os.Setenv("TOPIC_ARN", "test")
-	Init()
+// memStore is an in-memory EventStore, events with an eventId in fail can't be saved
+type memStore struct {
+	items map[string]*EventItem
+	fail  map[string]bool
+}
+
+func newMemStore(failEventIds ...string) *memStore {
+	m := &memStore{items: map[string]*EventItem{}, fail: map[string]bool{}}
+	for _, eventId := range failEventIds {
+		m.fail[eventId] = true
+	}
+	return m
+}
+
+func (m *memStore) SaveEvents(ctx context.Context, eventItems []*EventItem) []error {
+	errs := make([]error, len(eventItems))
+	for i, eventItem := range eventItems {
+		if m.fail[eventItem.EventId] {
+			errs[i] = errors.New("mem store save error")
+			continue
+		}
+		key := eventItem.EventId + "|" + eventItem.CreatedAt
+		if _, ok := m.items[key]; ok {
+			errs[i] = ErrDuplicateEvent
+			continue
+		}
+		m.items[key] = eventItem
+	}
+	return errs
+}
+
+// memPublisher is an in-memory AlertPublisher which records published events and digests
+type memPublisher struct {
+	published []*EventItem
+	digests   []*Digest
+	err       error
+}
+
+func (m *memPublisher) Publish(ctx context.Context, eventItem *EventItem, data []byte) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.published = append(m.published, eventItem)
+	return nil
+}
+
+func (m *memPublisher) PublishDigest(ctx context.Context, digest *Digest) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.digests = append(m.digests, digest)
+	return nil
+}
+
+// memSuppressor is the in-memory suppression window of DynamoSuppressor with its group keys and window,
+// its now is moved by the tests and the simulated ROWTIME
+type memSuppressor struct {
+	*DynamoSuppressor
+	windows map[string]*Digest
+}
+
+func newMemSuppressor(window time.Duration, groupKeys []string) *memSuppressor {
+	start := time.Unix(1668135071, 0)
+	m := &memSuppressor{DynamoSuppressor: NewDynamoSuppressor(nil, "", window, groupKeys), windows: map[string]*Digest{}}
+	m.now = func() time.Time { return start }
+	return m
+}
+
+func (m *memSuppressor) Check(ctx context.Context, groupKey string, eventItems []*EventItem) (bool, error) {
+	if len(eventItems) == 0 {
+		return false, nil
+	}
+	now := m.now()
+	w, ok := m.windows[groupKey]
+	if !ok || (w.WindowEnd <= now.Unix() && w.Suppressed == 0) {
+		m.windows[groupKey] = &Digest{
+			GroupKey:    groupKey,
+			WindowStart: now.Unix(),
+			WindowEnd:   now.Add(m.Window).Unix(),
+			Suppressed:  len(eventItems) - 1,
+			LastEvent:   eventItems[len(eventItems)-1],
+		}
+		return true, nil
+	}
+	w.Suppressed += len(eventItems)
+	w.LastEvent = eventItems[len(eventItems)-1]
+	return false, nil
+}
+
+func (m *memSuppressor) Digests(ctx context.Context) ([]*Digest, error) {
+	digests := []*Digest{}
+	for _, w := range m.windows {
+		if w.Suppressed > 0 && w.WindowEnd <= m.now().Unix() {
+			d := *w
+			digests = append(digests, &d)
+		}
+	}
+	sort.Slice(digests, func(i, j int) bool { return digests[i].GroupKey < digests[j].GroupKey })
+	return digests, nil
+}
+
+func (m *memSuppressor) Reset(ctx context.Context, digest *Digest) error {
+	m.windows[digest.GroupKey].Suppressed -= digest.Suppressed
+	return nil
+}
+
+func record(id, eventId string) events.KinesisAnalyticsOutputDeliveryEventRecord {
+	return actionRecord(id, eventId, "click")
+}
+
+func actionRecord(id, eventId, action string) events.KinesisAnalyticsOutputDeliveryEventRecord {
+	return events.KinesisAnalyticsOutputDeliveryEventRecord{
+		RecordID: id,
+		Data:     []byte(fmt.Sprintf(`{"eventId":"%s","action":"%s","userId":"u1","objectId":"o1","bizId":"b1","errorMsg":"[error] boom","createdAt":"2022-11-11 11:11:11"}`, eventId, action)),
+	}
+}
+
+func result(id, result string) events.KinesisAnalyticsOutputDeliveryResponseRecord {
+	return events.KinesisAnalyticsOutputDeliveryResponseRecord{RecordID: id, Result: result}
 }
 
 func TestHandler(t *testing.T) {
+	ok, failed := events.KinesisAnalyticsOutputDeliveryOK, events.KinesisAnalyticsOutputDeliveryFailed
+
 	type args struct {
 		ctx                   context.Context
 		kinesisAnalyticsEvent events.KinesisAnalyticsOutputDeliveryEvent
@@ -24,14 +146,123 @@ func TestHandler(t *testing.T) {
 	tests := []struct {
 		name          string
 		args          args
+		store         *memStore
+		publisher     *memPublisher
+		suppressor    *memSuppressor
 		wantResponses events.KinesisAnalyticsOutputDeliveryResponse
 		wantErr       bool
+		wantSaved     int
+		wantPublished int
 	}{
-		// TODO: Add test data from lambda test case.
+		{
+			name:      "empty",
+			args:      args{context.Background(), events.KinesisAnalyticsOutputDeliveryEvent{}},
+			store:     newMemStore(),
+			publisher: &memPublisher{},
+			wantResponses: events.KinesisAnalyticsOutputDeliveryResponse{
+				Records: []events.KinesisAnalyticsOutputDeliveryResponseRecord{},
+			},
+		},
+		{
+			name: "all ok",
+			args: args{context.Background(), events.KinesisAnalyticsOutputDeliveryEvent{
+				Records: []events.KinesisAnalyticsOutputDeliveryEventRecord{record("r1", "e1"), record("r2", "e2")},
+			}},
+			store:     newMemStore(),
+			publisher: &memPublisher{},
+			wantResponses: events.KinesisAnalyticsOutputDeliveryResponse{
+				Records: []events.KinesisAnalyticsOutputDeliveryResponseRecord{result("r1", ok), result("r2", ok)},
+			},
+			wantSaved:     2,
+			wantPublished: 2,
+		},
+		{
+			name: "undecodable record is dropped",
+			args: args{context.Background(), events.KinesisAnalyticsOutputDeliveryEvent{
+				Records: []events.KinesisAnalyticsOutputDeliveryEventRecord{{RecordID: "r1", Data: []byte("not json")}, record("r2", "e2")},
+			}},
+			store:     newMemStore(),
+			publisher: &memPublisher{},
+			wantResponses: events.KinesisAnalyticsOutputDeliveryResponse{
+				Records: []events.KinesisAnalyticsOutputDeliveryResponseRecord{result("r1", ok), result("r2", ok)},
+			},
+			wantSaved:     1,
+			wantPublished: 1,
+		},
+		{
+			name: "mixed success and failure",
+			args: args{context.Background(), events.KinesisAnalyticsOutputDeliveryEvent{
+				Records: []events.KinesisAnalyticsOutputDeliveryEventRecord{record("r1", "e1"), record("r2", "e2"), record("r3", "e3")},
+			}},
+			store:     newMemStore("e2"),
+			publisher: &memPublisher{},
+			wantResponses: events.KinesisAnalyticsOutputDeliveryResponse{
+				Records: []events.KinesisAnalyticsOutputDeliveryResponseRecord{result("r1", ok), result("r2", failed), result("r3", ok)},
+			},
+			wantSaved:     2,
+			wantPublished: 2,
+		},
+		{
+			name: "redelivered record doesn't alert again",
+			args: args{context.Background(), events.KinesisAnalyticsOutputDeliveryEvent{
+				Records: []events.KinesisAnalyticsOutputDeliveryEventRecord{record("r1", "e1"), record("r2", "e2"), record("r3", "e1")},
+			}},
+			store:     newMemStore(),
+			publisher: &memPublisher{},
+			wantResponses: events.KinesisAnalyticsOutputDeliveryResponse{
+				Records: []events.KinesisAnalyticsOutputDeliveryResponseRecord{result("r1", ok), result("r2", ok), result("r3", ok)},
+			},
+			wantSaved:     2,
+			wantPublished: 2,
+		},
+		{
+			name: "publish error doesn't fail the record",
+			args: args{context.Background(), events.KinesisAnalyticsOutputDeliveryEvent{
+				Records: []events.KinesisAnalyticsOutputDeliveryEventRecord{record("r1", "e1")},
+			}},
+			store:     newMemStore(),
+			publisher: &memPublisher{err: errors.New("mem publish error")},
+			wantResponses: events.KinesisAnalyticsOutputDeliveryResponse{
+				Records: []events.KinesisAnalyticsOutputDeliveryResponseRecord{result("r1", ok)},
+			},
+			wantSaved: 1,
+		},
+		{
+			name: "alerts of the same action and bizId are suppressed",
+			args: args{context.Background(), events.KinesisAnalyticsOutputDeliveryEvent{
+				Records: []events.KinesisAnalyticsOutputDeliveryEventRecord{
+					actionRecord("r1", "e1", "pay"), actionRecord("r2", "e2", "pay"), actionRecord("r3", "e3", "login"), actionRecord("r4", "e4", "pay"),
+				},
+			}},
+			store:      newMemStore(),
+			publisher:  &memPublisher{},
+			suppressor: newMemSuppressor(time.Minute, nil),
+			wantResponses: events.KinesisAnalyticsOutputDeliveryResponse{
+				Records: []events.KinesisAnalyticsOutputDeliveryResponseRecord{result("r1", ok), result("r2", ok), result("r3", ok), result("r4", ok)},
+			},
+			wantSaved:     4,
+			wantPublished: 2,
+		},
+		{
+			name: "nothing persisted",
+			args: args{context.Background(), events.KinesisAnalyticsOutputDeliveryEvent{
+				Records: []events.KinesisAnalyticsOutputDeliveryEventRecord{record("r1", "e1"), record("r2", "e2")},
+			}},
+			store:     newMemStore("e1", "e2"),
+			publisher: &memPublisher{},
+			wantResponses: events.KinesisAnalyticsOutputDeliveryResponse{
+				Records: []events.KinesisAnalyticsOutputDeliveryResponseRecord{result("r1", failed), result("r2", failed)},
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotResponses, err := Handler(tt.args.ctx, tt.args.kinesisAnalyticsEvent)
+			h := NewAlertHandler(tt.store, tt.publisher)
+			if tt.suppressor != nil {
+				h.WithSuppressor(tt.suppressor)
+			}
+			gotResponses, err := h.Handler(tt.args.ctx, tt.args.kinesisAnalyticsEvent)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Handler() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -39,6 +270,113 @@ func TestHandler(t *testing.T) {
 			if !reflect.DeepEqual(gotResponses, tt.wantResponses) {
 				t.Errorf("Handler() = %v, want %v", gotResponses, tt.wantResponses)
 			}
+			if len(tt.store.items) != tt.wantSaved {
+				t.Errorf("Handler() saved %d, want %d", len(tt.store.items), tt.wantSaved)
+			}
+			if len(tt.publisher.published) != tt.wantPublished {
+				t.Errorf("Handler() published %d, want %d", len(tt.publisher.published), tt.wantPublished)
+			}
 		})
 	}
 }
+
+func TestHandlerSeverity(t *testing.T) {
+	store, publisher := newMemStore(), &memPublisher{}
+	classifier, _ := ParseSeverityRules(`[{"severity":"panic","pattern":"(?i)\\[panic\\]"}]`)
+	h := NewAlertHandler(store, publisher).WithClassifier(classifier)
+
+	panicRecord := events.KinesisAnalyticsOutputDeliveryEventRecord{
+		RecordID: "r2",
+		Data:     []byte(`{"eventId":"e2","action":"pay","bizId":"b1","errorMsg":"[PANIC] nil pointer","createdAt":"2022-11-11 11:11:11"}`),
+	}
+	if _, err := h.Handler(context.Background(), events.KinesisAnalyticsOutputDeliveryEvent{
+		Records: []events.KinesisAnalyticsOutputDeliveryEventRecord{record("r1", "e1"), panicRecord},
+	}); err != nil {
+		t.Fatalf("Handler() error = %v", err)
+	}
+
+	want := map[string]string{"e1": SeverityInfo, "e2": "panic"}
+	for _, eventItem := range store.items {
+		if eventItem.Severity != want[eventItem.EventId] {
+			t.Errorf("Handler() saved %s severity = %s, want %s", eventItem.EventId, eventItem.Severity, want[eventItem.EventId])
+		}
+	}
+	for _, eventItem := range publisher.published {
+		if eventItem.Severity != want[eventItem.EventId] {
+			t.Errorf("Handler() published %s severity = %s, want %s", eventItem.EventId, eventItem.Severity, want[eventItem.EventId])
+		}
+	}
+}
+
+func TestDigestHandler(t *testing.T) {
+	store, publisher, suppressor := newMemStore(), &memPublisher{}, newMemSuppressor(time.Minute, nil)
+	now := suppressor.now()
+	suppressor.now = func() time.Time { return now }
+	h := NewAlertHandler(store, publisher).WithSuppressor(suppressor)
+	send := func(records ...events.KinesisAnalyticsOutputDeliveryEventRecord) {
+		if _, err := h.Handler(context.Background(), events.KinesisAnalyticsOutputDeliveryEvent{Records: records}); err != nil {
+			t.Fatalf("Handler() error = %v", err)
+		}
+	}
+
+	send(actionRecord("r1", "e1", "pay"), actionRecord("r2", "e2", "pay"))
+	send(actionRecord("r3", "e3", "pay"))
+	if len(publisher.published) != 1 {
+		t.Fatalf("published %d alerts in window, want 1", len(publisher.published))
+	}
+
+	// window isn't finished, no digest
+	if err := h.DigestHandler(context.Background(), events.CloudWatchEvent{}); err != nil || len(publisher.digests) != 0 {
+		t.Fatalf("DigestHandler() error = %v digests %d, want 0", err, len(publisher.digests))
+	}
+
+	now = now.Add(time.Minute)
+	if err := h.DigestHandler(context.Background(), events.CloudWatchEvent{}); err != nil {
+		t.Fatalf("DigestHandler() error = %v", err)
+	}
+	if len(publisher.digests) != 1 || publisher.digests[0].Suppressed != 2 || publisher.digests[0].LastEvent.EventId != "e3" {
+		t.Fatalf("DigestHandler() digests = %+v, want 1 digest of 2 suppressed", publisher.digests)
+	}
+
+	// digest is sent, the next alert opens a new window
+	send(actionRecord("r4", "e4", "pay"))
+	if len(publisher.published) != 2 {
+		t.Errorf("published %d alerts after window, want 2", len(publisher.published))
+	}
+	if err := h.DigestHandler(context.Background(), events.CloudWatchEvent{}); err != nil || len(publisher.digests) != 1 {
+		t.Errorf("DigestHandler() error = %v digests %d, want no new digest", err, len(publisher.digests))
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("REGION", "ap-northeast-1")
+	t.Setenv("ENDPOINT_URL", "http://localhost:4566")
+	t.Setenv("DYNAMODB_ENDPOINT_URL", "http://localhost:8000")
+	t.Setenv("SAGEMAKER_RUNTIME_ENDPOINT_URL", "http://localhost:8080")
+
+	cfg, err := loadConfig(context.Background())
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	if cfg.Region != "ap-northeast-1" {
+		t.Errorf("loadConfig() region = %s, want ap-northeast-1", cfg.Region)
+	}
+
+	for service, wantURL := range map[string]string{
+		dynamodb.ServiceID:         "http://localhost:8000",
+		sns.ServiceID:              "http://localhost:4566",
+		sagemakerruntime.ServiceID: "http://localhost:8080",
+	} {
+		endpoint, err := cfg.EndpointResolverWithOptions.ResolveEndpoint(service, cfg.Region)
+		if err != nil {
+			t.Errorf("ResolveEndpoint(%s) error = %v", service, err)
+			continue
+		}
+		if endpoint.URL != wantURL {
+			t.Errorf("ResolveEndpoint(%s) = %s, want %s", service, endpoint.URL, wantURL)
+		}
+	}
+	if _, err := cfg.EndpointResolverWithOptions.ResolveEndpoint("S3", cfg.Region); err == nil {
+		t.Errorf("ResolveEndpoint(S3) should fallback to the default endpoint")
+	}
+}
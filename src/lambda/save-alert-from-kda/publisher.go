@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"log"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sns/types"
+)
+
+// SNSPublishAPI is the SNS client api used to send alerts, *sns.Client implements it
+type SNSPublishAPI interface {
+	Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error)
+}
+
+// AlertPublisher sends the alert of a persisted abnormal event
+type AlertPublisher interface {
+	Publish(ctx context.Context, eventItem *EventItem, data []byte) error
+	// PublishDigest sends the rollup of suppressed alerts
+	PublishDigest(ctx context.Context, digest *Digest) error
+}
+
+// SnsPublisher is the SNS topic AlertPublisher, messages are rendered by Template per protocol
+// with the message attributes action, bizId and severity for subscription filter policies.
+type SnsPublisher struct {
+	SnsClient SNSPublishAPI
+	TopicArn  string
+	// SeverityTopicArns routes alerts and digests by event severity, e.g. panic -> the high priority topic,
+	// other severities go to TopicArn
+	SeverityTopicArns map[string]string
+	// Template default is DefaultAlertTemplate
+	Template *template.Template
+}
+
+// topicArn of the severity
+func (m SnsPublisher) topicArn(severity string) string {
+	if arn, ok := m.SeverityTopicArns[severity]; ok && len(arn) > 0 {
+		return arn
+	}
+	return m.TopicArn
+}
+
+func (m SnsPublisher) Publish(ctx context.Context, eventItem *EventItem, data []byte) error {
+	return m.publish(ctx, m.topicArn(eventItem.Severity), &AlertData{Event: eventItem, Raw: string(data)})
+}
+
+func (m SnsPublisher) PublishDigest(ctx context.Context, digest *Digest) error {
+	data, err := digest.Message()
+	if err != nil {
+		return err
+	}
+	// the digest of a group has the severity of its events
+	severity := ""
+	if digest.LastEvent != nil {
+		severity = digest.LastEvent.Severity
+	}
+	return m.publish(ctx, m.topicArn(severity), &AlertData{Event: digest.LastEvent, Digest: digest, Raw: string(data)})
+}
+
+func (m SnsPublisher) publish(ctx context.Context, topicArn string, alert *AlertData) error {
+	tmpl := m.Template
+	if tmpl == nil {
+		tmpl = DefaultAlertTemplate
+	}
+	msg, err := RenderAlert(tmpl, alert)
+	if err != nil {
+		return err
+	}
+	structure, err := msg.Structure()
+	if err != nil {
+		return err
+	}
+
+	res, err := m.SnsClient.Publish(ctx, &sns.PublishInput{
+		Message:           aws.String(structure),
+		MessageStructure:  aws.String("json"),
+		Subject:           aws.String(msg.Subject),
+		MessageAttributes: messageAttributes(alert),
+		TopicArn:          aws.String(topicArn),
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] Data = %s send SNS %s ok msgID:%s \n", alert.Raw, topicArn, aws.ToString(res.MessageId))
+
+	return nil
+}
+
+// messageAttributes for filter policies, sns rejects empty attribute values
+func messageAttributes(alert *AlertData) map[string]types.MessageAttributeValue {
+	attrs := map[string]types.MessageAttributeValue{}
+	for name, value := range map[string]string{
+		"action":   alert.Event.Action,
+		"bizId":    alert.Event.BizId,
+		"severity": alert.Severity,
+	} {
+		if len(value) > 0 {
+			attrs[name] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+		}
+	}
+	if alert.Digest != nil {
+		attrs["digest"] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("true")}
+	}
+	return attrs
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+)
+
+// fakeSNS records publish inputs
+type fakeSNS struct {
+	inputs []*sns.PublishInput
+}
+
+func (f *fakeSNS) Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error) {
+	f.inputs = append(f.inputs, params)
+	return &sns.PublishOutput{MessageId: aws.String("msg-1")}, nil
+}
+
+func TestSnsPublisherPublish(t *testing.T) {
+	fakeSns := &fakeSNS{}
+	p := SnsPublisher{SnsClient: fakeSns, TopicArn: "alert", SeverityTopicArns: map[string]string{"panic": "page"}}
+	eventItem := &EventItem{EventId: "e1", Action: "pay", BizId: "b1", UserId: "u1", ErrorMsg: "[PANIC] nil pointer 空指针", CreatedAt: "2022-11-11 11:11:11", Severity: "panic"}
+	data, _ := json.Marshal(eventItem)
+
+	if err := p.Publish(context.Background(), eventItem, data); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	input := fakeSns.inputs[0]
+	if aws.ToString(input.TopicArn) != "page" {
+		t.Errorf("Publish() TopicArn = %s, want the panic topic", aws.ToString(input.TopicArn))
+	}
+	if aws.ToString(input.MessageStructure) != "json" {
+		t.Errorf("Publish() MessageStructure = %v", aws.ToString(input.MessageStructure))
+	}
+	if got := aws.ToString(input.Subject); got != "[panic] user behavior abnormal event of pay bizId b1" {
+		t.Errorf("Publish() Subject = %s", got)
+	}
+	for name, want := range map[string]string{"action": "pay", "bizId": "b1", "severity": "panic"} {
+		if got := aws.ToString(input.MessageAttributes[name].StringValue); got != want {
+			t.Errorf("Publish() attribute %s = %s, want %s", name, got, want)
+		}
+	}
+
+	msgs := map[string]string{}
+	if err := json.Unmarshal([]byte(aws.ToString(input.Message)), &msgs); err != nil {
+		t.Fatalf("Publish() Message isn't json: %v", err)
+	}
+	if msgs["default"] != string(data) || msgs["https"] != string(data) {
+		t.Errorf("Publish() default/https = %s / %s, want event json", msgs["default"], msgs["https"])
+	}
+	if !strings.Contains(msgs["email"], "severity:  panic") || !strings.Contains(msgs["email"], "errorMsg:\n[PANIC] nil pointer 空指针") || !strings.Contains(msgs["email"], "userId:    u1") {
+		t.Errorf("Publish() email = %s", msgs["email"])
+	}
+	if msgs["sms"] != "[panic] pay/b1: [PANIC] nil pointer 空指针" {
+		t.Errorf("Publish() sms = %s", msgs["sms"])
+	}
+}
+
+func TestSnsPublisherPublishDigest(t *testing.T) {
+	fakeSns := &fakeSNS{}
+	p := SnsPublisher{SnsClient: fakeSns, TopicArn: "alert", SeverityTopicArns: map[string]string{"error": "page"}}
+	digest := &Digest{
+		GroupKey: "action=pay#bizId=b1", WindowStart: 1668135071, WindowEnd: 1668135371, Suppressed: 12,
+		LastEvent: &EventItem{EventId: "e9", Action: "pay", BizId: "b1", ErrorMsg: "[error] timeout", Severity: "error"},
+	}
+
+	if err := p.PublishDigest(context.Background(), digest); err != nil {
+		t.Fatalf("PublishDigest() error = %v", err)
+	}
+	input := fakeSns.inputs[0]
+	if aws.ToString(input.TopicArn) != "page" {
+		t.Errorf("PublishDigest() TopicArn = %s, want the error digest routed to page", aws.ToString(input.TopicArn))
+	}
+	if got := aws.ToString(input.Subject); got != "[error] 12 more alerts of pay bizId b1 suppressed" {
+		t.Errorf("PublishDigest() Subject = %s", got)
+	}
+	if aws.ToString(input.MessageAttributes["digest"].StringValue) != "true" {
+		t.Errorf("PublishDigest() attributes = %v", input.MessageAttributes)
+	}
+	msgs := map[string]string{}
+	json.Unmarshal([]byte(aws.ToString(input.Message)), &msgs)
+	if !strings.HasPrefix(msgs["email"], "12 more alerts of action=pay#bizId=b1 are suppressed\nfrom 2022-11-11T02:51:11Z to 2022-11-11T02:56:11Z") {
+		t.Errorf("PublishDigest() email = %s", msgs["email"])
+	}
+}
+
+func TestLoadAlertTemplate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "alert.tmpl")
+	os.WriteFile(file, []byte(`{{define "subject"}}ALERT {{.Event.Action}}
+second line{{end}}{{define "email"}}e{{end}}{{define "sms"}}s{{end}}{{define "https"}}h{{end}}`), 0o644)
+
+	tmpl, err := LoadAlertTemplate(file)
+	if err != nil {
+		t.Fatalf("LoadAlertTemplate() error = %v", err)
+	}
+	msg, err := RenderAlert(tmpl, &AlertData{Event: &EventItem{Action: strings.Repeat("x", 120)}})
+	if err != nil {
+		t.Fatalf("RenderAlert() error = %v", err)
+	}
+	if len(msg.Subject) != maxSubjectLen-1 || strings.Contains(msg.Subject, "\n") || msg.Email != "e" || msg.HTTPS != "h" {
+		t.Errorf("RenderAlert() = %+v", msg)
+	}
+
+	if _, err := LoadAlertTemplate(filepath.Join(t.TempDir(), "missing.tmpl")); err == nil {
+		t.Errorf("LoadAlertTemplate() missing file should fail")
+	}
+
+	// every protocol template is required at load time
+	os.WriteFile(file, []byte(`{{define "subject"}}s{{end}}{{define "email"}}e{{end}}{{define "https"}}h{{end}}`), 0o644)
+	if _, err := LoadAlertTemplate(file); err == nil || !strings.Contains(err.Error(), `"sms"`) {
+		t.Errorf("LoadAlertTemplate() without sms error = %v, want the missing sms template", err)
+	}
+}
+
+func TestSubjectLength(t *testing.T) {
+	tests := []struct {
+		subject string
+		want    string
+	}{
+		{strings.Repeat("x", maxSubjectLen-1), strings.Repeat("x", maxSubjectLen-1)},
+		{strings.Repeat("x", maxSubjectLen), strings.Repeat("x", maxSubjectLen-4) + "..."},
+		{strings.Repeat("x", maxSubjectLen+1), strings.Repeat("x", maxSubjectLen-4) + "..."},
+	}
+	for _, tt := range tests {
+		if got := subject(tt.subject); got != tt.want || len(got) >= maxSubjectLen {
+			t.Errorf("subject(%d chars) = %d chars %q, want %d chars", len(tt.subject), len(got), got, len(tt.want))
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sagemakerruntime"
+)
+
+const (
+	anomalyBuckets           = 100
+	anomalyMaxErrorMsgLength = 1024
+	// anomalySeverity is the severity of an event scored over the threshold, it pages like a [panic]
+	anomalySeverity = "panic"
+)
+
+// anomalyLevels are the level tags of the feature row, the same as src/sagemaker-studio/pipeline/features.py
+var anomalyLevels = []struct {
+	level   int
+	pattern *regexp.Regexp
+}{
+	{3, regexp.MustCompile(`(?i)\[panic\]`)},
+	{2, regexp.MustCompile(`(?i)\[error\]`)},
+	{1, regexp.MustCompile(`(?i)\[warn(n)?(ing)?\]`)},
+}
+
+// AnomalyFeatures is the feature row of the anomaly model trained by the sagemaker pipeline:
+// hour of createdAt, crc32 bucket of action, crc32 bucket of bizId, errorMsg length, level tag
+func AnomalyFeatures(eventItem *EventItem) []int {
+	hour := 0
+	createdAt := strings.Replace(eventItem.CreatedAt, "T", " ", 1)
+	if len(createdAt) >= 19 {
+		if t, err := time.Parse("2006-01-02 15:04:05", createdAt[:19]); err == nil {
+			hour = t.Hour()
+		}
+	}
+	errorMsgLength := len([]rune(eventItem.ErrorMsg))
+	if errorMsgLength > anomalyMaxErrorMsgLength {
+		errorMsgLength = anomalyMaxErrorMsgLength
+	}
+	level := 0
+	for _, l := range anomalyLevels {
+		if l.pattern.MatchString(eventItem.ErrorMsg) {
+			level = l.level
+			break
+		}
+	}
+	return []int{
+		hour,
+		int(crc32.ChecksumIEEE([]byte(eventItem.Action)) % anomalyBuckets),
+		int(crc32.ChecksumIEEE([]byte(eventItem.BizId)) % anomalyBuckets),
+		errorMsgLength,
+		level,
+	}
+}
+
+// AnomalyScorer scores the events, a higher score is more abnormal
+type AnomalyScorer interface {
+	Score(ctx context.Context, eventItems []*EventItem) ([]float64, error)
+}
+
+// SageMakerRuntimeAPI is the sagemaker runtime api used to score events, *sagemakerruntime.Client implements it
+type SageMakerRuntimeAPI interface {
+	InvokeEndpoint(ctx context.Context, params *sagemakerruntime.InvokeEndpointInput, optFns ...func(*sagemakerruntime.Options)) (*sagemakerruntime.InvokeEndpointOutput, error)
+}
+
+// SageMakerScorer invokes the random cut forest endpoint with the csv feature rows
+type SageMakerScorer struct {
+	Client       SageMakerRuntimeAPI
+	EndpointName string
+}
+
+// Score returns one score per event in order
+func (s *SageMakerScorer) Score(ctx context.Context, eventItems []*EventItem) ([]float64, error) {
+	if len(eventItems) == 0 {
+		return nil, nil
+	}
+	body := &bytes.Buffer{}
+	for _, eventItem := range eventItems {
+		features := AnomalyFeatures(eventItem)
+		values := make([]string, len(features))
+		for i, v := range features {
+			values[i] = strconv.Itoa(v)
+		}
+		body.WriteString(strings.Join(values, ",") + "\n")
+	}
+
+	res, err := s.Client.InvokeEndpoint(ctx, &sagemakerruntime.InvokeEndpointInput{
+		EndpointName: aws.String(s.EndpointName),
+		Body:         body.Bytes(),
+		ContentType:  aws.String("text/csv"),
+		Accept:       aws.String("application/json"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// random cut forest response: {"scores":[{"score":1.2},...]}
+	result := struct {
+		Scores []struct {
+			Score float64 `json:"score"`
+		} `json:"scores"`
+	}{}
+	if err := json.Unmarshal(res.Body, &result); err != nil {
+		return nil, fmt.Errorf("invoke endpoint response %s: %w", res.Body, err)
+	}
+	if len(result.Scores) != len(eventItems) {
+		return nil, fmt.Errorf("invoke endpoint got %d scores of %d events", len(result.Scores), len(eventItems))
+	}
+	scores := make([]float64, len(result.Scores))
+	for i, score := range result.Scores {
+		scores[i] = score.Score
+	}
+	return scores, nil
+}
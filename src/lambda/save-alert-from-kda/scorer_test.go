@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sagemakerruntime"
+)
+
+// scorerFunc is an AnomalyScorer stub
+type scorerFunc func(ctx context.Context, eventItems []*EventItem) ([]float64, error)
+
+func (f scorerFunc) Score(ctx context.Context, eventItems []*EventItem) ([]float64, error) {
+	return f(ctx, eventItems)
+}
+
+func TestAnomalyFeatures(t *testing.T) {
+	// the same rows as src/sagemaker-studio/pipeline/features.py
+	tests := []struct {
+		eventItem *EventItem
+		want      []int
+	}{
+		{&EventItem{Action: "pay", BizId: "b1", ErrorMsg: "[error] timeout", CreatedAt: "2022-11-11 11:11:11.000000"}, []int{11, 76, 16, 15, 2}},
+		{&EventItem{Action: "click", CreatedAt: "2022-11-11T08:00:00.000Z"}, []int{8, 28, 0, 0, 0}},
+		{&EventItem{ErrorMsg: "[WARNING] " + strings.Repeat("x", 2000), CreatedAt: "bad"}, []int{0, 0, 0, 1024, 1}},
+	}
+	for _, tt := range tests {
+		if got := AnomalyFeatures(tt.eventItem); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("AnomalyFeatures(%+v) = %v, want %v", tt.eventItem, got, tt.want)
+		}
+	}
+}
+
+// fakeSageMakerRuntime records the InvokeEndpoint input and answers body
+type fakeSageMakerRuntime struct {
+	input *sagemakerruntime.InvokeEndpointInput
+	body  string
+}
+
+func (f *fakeSageMakerRuntime) InvokeEndpoint(ctx context.Context, params *sagemakerruntime.InvokeEndpointInput, optFns ...func(*sagemakerruntime.Options)) (*sagemakerruntime.InvokeEndpointOutput, error) {
+	f.input = params
+	return &sagemakerruntime.InvokeEndpointOutput{Body: []byte(f.body)}, nil
+}
+
+func TestSageMakerScorer(t *testing.T) {
+	client := &fakeSageMakerRuntime{body: `{"scores":[{"score":0.8},{"score":3.5}]}`}
+	scorer := &SageMakerScorer{Client: client, EndpointName: "user-behavior-anomaly"}
+
+	scores, err := scorer.Score(context.Background(), []*EventItem{
+		{Action: "pay", BizId: "b1", ErrorMsg: "[error] timeout", CreatedAt: "2022-11-11 11:11:11.000000"},
+		{Action: "click", CreatedAt: "2022-11-11T08:00:00.000Z"},
+	})
+	if err != nil || !reflect.DeepEqual(scores, []float64{0.8, 3.5}) {
+		t.Errorf("Score() = %v, %v, want [0.8 3.5]", scores, err)
+	}
+	if body := string(client.input.Body); body != "11,76,16,15,2\n8,28,0,0,0\n" {
+		t.Errorf("Score() body = %q", body)
+	}
+	if aws.ToString(client.input.EndpointName) != "user-behavior-anomaly" || aws.ToString(client.input.ContentType) != "text/csv" {
+		t.Errorf("Score() input = %+v", client.input)
+	}
+
+	if _, err := scorer.Score(context.Background(), []*EventItem{{Action: "pay"}}); err == nil {
+		t.Error("Score() of 2 scores for 1 event error = nil")
+	}
+}
+
+func TestHandlerScore(t *testing.T) {
+	store, publisher := newMemStore(), &memPublisher{}
+	h := NewAlertHandler(store, publisher).WithScorer(scorerFunc(func(ctx context.Context, eventItems []*EventItem) ([]float64, error) {
+		return []float64{2.5}, nil
+	}), 0)
+	if _, err := h.Handler(context.Background(), events.KinesisAnalyticsOutputDeliveryEvent{
+		Records: []events.KinesisAnalyticsOutputDeliveryEventRecord{record("r1", "e1")},
+	}); err != nil {
+		t.Fatalf("Handler() error = %v", err)
+	}
+	if len(publisher.published) != 1 || publisher.published[0].AnomalyScore == nil || *publisher.published[0].AnomalyScore != 2.5 {
+		t.Fatalf("Handler() published %+v, want anomaly score 2.5", publisher.published)
+	}
+	message, err := RenderAlert(DefaultAlertTemplate, &AlertData{Event: publisher.published[0], Severity: "error"})
+	if err != nil || !strings.Contains(message.Email, "anomaly:   2.50") {
+		t.Errorf("RenderAlert() email = %v, %v, want the anomaly score", message, err)
+	}
+
+	// a scoring error doesn't drop the event
+	store, publisher = newMemStore(), &memPublisher{}
+	h = NewAlertHandler(store, publisher).WithScorer(scorerFunc(func(ctx context.Context, eventItems []*EventItem) ([]float64, error) {
+		return nil, errors.New("endpoint not found")
+	}), 0)
+	if _, err := h.Handler(context.Background(), events.KinesisAnalyticsOutputDeliveryEvent{
+		Records: []events.KinesisAnalyticsOutputDeliveryEventRecord{record("r1", "e1")},
+	}); err != nil {
+		t.Fatalf("Handler() error = %v", err)
+	}
+	if len(publisher.published) != 1 || publisher.published[0].AnomalyScore != nil {
+		t.Errorf("Handler() published %+v, want the event without a score", publisher.published)
+	}
+
+	// a score at least the threshold pages the event whatever its errorMsg, a lower one keeps its severity
+	store, publisher = newMemStore(), &memPublisher{}
+	h = NewAlertHandler(store, publisher).WithScorer(scorerFunc(func(ctx context.Context, eventItems []*EventItem) ([]float64, error) {
+		return []float64{3.5, 0.8}, nil
+	}), 3)
+	if _, err := h.Handler(context.Background(), events.KinesisAnalyticsOutputDeliveryEvent{
+		Records: []events.KinesisAnalyticsOutputDeliveryEventRecord{record("r1", "e1"), record("r2", "e2")},
+	}); err != nil {
+		t.Fatalf("Handler() error = %v", err)
+	}
+	want := map[string]string{"e1": anomalySeverity, "e2": "error"}
+	for _, eventItem := range publisher.published {
+		if eventItem.Severity != want[eventItem.EventId] {
+			t.Errorf("Handler() published %s severity = %s, want %s", eventItem.EventId, eventItem.Severity, want[eventItem.EventId])
+		}
+	}
+}
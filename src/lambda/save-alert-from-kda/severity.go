@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// SeverityInfo is the severity of an errorMsg which matches no rule
+const SeverityInfo = "info"
+
+// DefaultSeverityRules are the level tags in errorMsg, same as the kinesis analytics filter
+var DefaultSeverityRules = []SeverityRule{
+	{Severity: "panic", Pattern: `(?i)\[panic\]`},
+	{Severity: "error", Pattern: `(?i)\[error\]`},
+	{Severity: "warning", Pattern: `(?i)\[warn(n)?(ing)?\]`},
+}
+
+// SeverityRule tags an errorMsg which matches the regexp Pattern with Severity
+type SeverityRule struct {
+	Severity string `json:"severity"`
+	Pattern  string `json:"pattern"`
+}
+
+// SeverityClassifier derives the event severity from errorMsg, rules are matched in order and the first match wins
+type SeverityClassifier struct {
+	rules    []SeverityRule
+	patterns []*regexp.Regexp
+}
+
+func NewSeverityClassifier(rules []SeverityRule) (*SeverityClassifier, error) {
+	if len(rules) == 0 {
+		rules = DefaultSeverityRules
+	}
+	c := &SeverityClassifier{rules: rules, patterns: make([]*regexp.Regexp, len(rules))}
+	for i, rule := range rules {
+		if len(rule.Severity) == 0 {
+			return nil, fmt.Errorf("severity rule %d: empty severity", i)
+		}
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("severity rule %d: %w", i, err)
+		}
+		c.patterns[i] = pattern
+	}
+	return c, nil
+}
+
+// ParseSeverityRules parses the json rule list, e.g. [{"severity":"panic","pattern":"(?i)\\[panic\\]|fatal"}],
+// empty is DefaultSeverityRules
+func ParseSeverityRules(rulesJson string) (*SeverityClassifier, error) {
+	rules := []SeverityRule{}
+	if len(rulesJson) > 0 {
+		if err := json.Unmarshal([]byte(rulesJson), &rules); err != nil {
+			return nil, err
+		}
+	}
+	return NewSeverityClassifier(rules)
+}
+
+// Classify returns the severity of the first matched rule, SeverityInfo if none matches
+func (m *SeverityClassifier) Classify(errorMsg string) string {
+	for i, pattern := range m.patterns {
+		if pattern.MatchString(errorMsg) {
+			return m.rules[i].Severity
+		}
+	}
+	return SeverityInfo
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestSeverityClassifier(t *testing.T) {
+	defaultClassifier, _ := ParseSeverityRules("")
+	customClassifier, err := ParseSeverityRules(`[{"severity":"panic","pattern":"(?i)\\[panic\\]|fatal"},{"severity":"error","pattern":"(?i)\\[error\\]|timeout"}]`)
+	if err != nil {
+		t.Fatalf("ParseSeverityRules() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		classifier *SeverityClassifier
+		errorMsg   string
+		want       string
+	}{
+		{"panic", defaultClassifier, "[PANIC] runtime error: nil pointer", "panic"},
+		{"first rule wins", defaultClassifier, "[error] recovered from [panic]", "panic"},
+		{"error", defaultClassifier, "[error] db timeout", "error"},
+		{"warning", defaultClassifier, "[Warnning] slow query", "warning"},
+		{"no tag", defaultClassifier, "user canceled", SeverityInfo},
+		{"custom panic", customClassifier, "fatal error: concurrent map writes", "panic"},
+		{"custom error", customClassifier, "rpc timeout", "error"},
+		{"custom has no warning", customClassifier, "[warning] slow query", SeverityInfo},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.classifier.Classify(tt.errorMsg); got != tt.want {
+				t.Errorf("Classify(%q) = %s, want %s", tt.errorMsg, got, tt.want)
+			}
+		})
+	}
+
+	for _, rules := range []string{`not json`, `[{"severity":"panic","pattern":"(["}]`, `[{"pattern":"x"}]`} {
+		if _, err := ParseSeverityRules(rules); err == nil {
+			t.Errorf("ParseSeverityRules(%s) should fail", rules)
+		}
+	}
+}
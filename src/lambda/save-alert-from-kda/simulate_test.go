@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the report of testdata/simulate-events.ndjson, regenerate it with go test -run 'TestSimulate$' -update
+const simulateGolden = "testdata/simulate-report.golden.json"
+
+// the simulate flags check other events offline, e.g.
+// go test -run TestSimulateEvents -args -events events.ndjson -suppress-window 5m -out report.json
+var (
+	simulateEvents         = flag.String("events", "", "NDJSON events file of TestSimulateEvents")
+	simulateRules          = flag.String("rules", "", "SEVERITY_RULES json, default the bundled rules")
+	simulateTemplate       = flag.String("template", "", "ALERT_TEMPLATE_FILE, default the bundled templates/alert.tmpl")
+	simulateSuppressWindow = flag.Duration("suppress-window", 0, "alert suppression window, 0 sends every alert")
+	simulateGroupKeys      = flag.String("group-keys", strings.Join(DefaultSuppressGroupKeys, ","), "SUPPRESS_GROUP_KEYS")
+	simulateThreshold      = flag.Int64("warn-threshold", 10, "WARN_COUNT_THRESHOLD of save-warn-count-from-kda")
+	simulateBatch          = flag.Int("batch", 100, "max records of one KDA output delivery")
+	simulateOut            = flag.String("out", "", "report json file, default stdout")
+	update                 = flag.Bool("update", false, "rewrite the golden report of TestSimulate")
+)
+
+func TestSimulate(t *testing.T) {
+	f, err := os.Open("testdata/simulate-events.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	report, err := Simulate(context.Background(), f, SimulateOptions{SuppressWindow: time.Minute, WarnCountThreshold: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// [Error] isn't matched by the case sensitive LIKE, the redelivered e2 is a duplicate
+	if report.Events != 11 || report.Abnormal != 5 {
+		t.Errorf("events %d abnormal %d", report.Events, report.Abnormal)
+	}
+	rows := []string{}
+	for _, row := range report.Rows {
+		rows = append(rows, row.EventId+"/"+row.Severity)
+	}
+	if want := []string{"e2/error", "e3/error", "e4/panic", "e10/panic"}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows %v, want %v", rows, want)
+	}
+
+	alerts := []string{}
+	for _, alert := range report.Alerts {
+		alerts = append(alerts, alert.Topic+" "+alert.Subject)
+	}
+	wantAlerts := []string{
+		"alert [error] user behavior abnormal event of pay bizId b1",
+		"high-priority [panic] user behavior abnormal event of pay bizId b1",
+		"high-priority [panic] user behavior abnormal event of view bizId b2",
+		"alert [error] 1 more alerts of pay bizId b1 suppressed",
+	}
+	if !reflect.DeepEqual(alerts, wantAlerts) {
+		t.Errorf("alerts %q, want %q", alerts, wantAlerts)
+	}
+
+	wantCounts := []SimulatedWarnCount{
+		{Action: "cart", WindowStart: "2022-11-11 11:11:00.000", WarnCount: 3, OverThreshold: true},
+		{Action: "cart", WindowStart: "2022-11-11 11:12:00.000", WarnCount: 1},
+	}
+	if !reflect.DeepEqual(report.WarnCounts, wantCounts) {
+		t.Errorf("warn counts %+v, want %+v", report.WarnCounts, wantCounts)
+	}
+
+	out, _ := json.MarshalIndent(report, "", "  ")
+	out = append(out, '\n')
+	if *update {
+		if err := os.WriteFile(simulateGolden, out, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(simulateGolden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, want) {
+		t.Errorf("report differs from %s, rerun with -update if the change is expected", simulateGolden)
+	}
+}
+
+// TestSimulateEvents runs the -events file through the simulated pipeline configured by the flags like the function env
+func TestSimulateEvents(t *testing.T) {
+	if len(*simulateEvents) == 0 {
+		t.Skip("no -events file")
+	}
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+	classifier, err := ParseSeverityRules(*simulateRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := LoadAlertTemplate(*simulateTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, key := range strings.Split(*simulateGroupKeys, ",") {
+		if key = strings.TrimSpace(key); len(key) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	f, err := os.Open(*simulateEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	report, err := Simulate(context.Background(), f, SimulateOptions{
+		Classifier:         classifier,
+		Template:           tmpl,
+		SuppressWindow:     *simulateSuppressWindow,
+		SuppressGroupKeys:  keys,
+		WarnCountThreshold: *simulateThreshold,
+		Batch:              *simulateBatch,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = append(out, '\n')
+	if len(*simulateOut) > 0 {
+		err = os.WriteFile(*simulateOut, out, 0644)
+	} else {
+		_, err = os.Stdout.Write(out)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSimulateFilters(t *testing.T) {
+	tests := []struct {
+		errorMsg     string
+		wantAbnormal bool
+		wantWarn     bool
+	}{
+		{"", false, false},
+		{"[panic] nil pointer", true, false},
+		{"retry [ERROR] timeout", true, false},
+		{"[Error] mixed case", false, false},
+		{"[WARNING] slow", false, true},
+		{"[warn] slow", false, true},
+		{"warning without tag", false, false},
+	}
+	for _, tt := range tests {
+		if got := IsAbnormalEvent(tt.errorMsg); got != tt.wantAbnormal {
+			t.Errorf("IsAbnormalEvent(%q) %v", tt.errorMsg, got)
+		}
+		if got := IsWarnEvent(tt.errorMsg); got != tt.wantWarn {
+			t.Errorf("IsWarnEvent(%q) %v", tt.errorMsg, got)
+		}
+	}
+}
+
+// the simulated filters must follow the LIKE patterns of the deployed sql
+func TestSimulateFiltersMatchSql(t *testing.T) {
+	likePattern := regexp.MustCompile(`LIKE '%([^%']+)%'`)
+	for file, tags := range map[string][]string{
+		"../../kinesis-analytics-sql/filter-abnormality-event.sql":        abnormalTags,
+		"../../kinesis-analytics-sql/filter-abnormality-window-event.sql": warnTags,
+	} {
+		sql, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, match := range likePattern.FindAllStringSubmatch(string(sql), -1) {
+			got = append(got, match[1])
+		}
+		want := append([]string{}, tags...)
+		sort.Strings(got)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s LIKE patterns %s, simulated %s", file, strings.Join(got, " "), strings.Join(want, " "))
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+)
+
+// abnormalTags are the errorMsg LIKE patterns of filter-abnormality-event.sql, case sensitive
+var abnormalTags = []string{"[PANIC]", "[panic]", "[ERROR]", "[error]"}
+
+// warnTags are the LOWER("errorMsg") LIKE patterns of filter-abnormality-window-event.sql
+var warnTags = []string{"[warn]", "[warning]", "[warnning]"}
+
+// the tumbling window of filter-abnormality-window-event.sql
+const warnCountWindow = 60 * time.Second
+
+// KDA delivers the output records to lambda about every second
+const deliveryInterval = time.Second
+
+// windowStart layout of the KDA TIMESTAMP output, e.g. 2022-11-11 11:11:00.000
+const windowStartLayout = "2006-01-02 15:04:05.000"
+
+// createdAt layouts of the producers, python str(datetime.now()) and js toISOString()
+var createdAtLayouts = []string{"2006-01-02 15:04:05.999999999", time.RFC3339Nano}
+
+// the topics of the simulated sns publisher
+const (
+	simTopic             = "alert"
+	simHighPriorityTopic = "high-priority"
+)
+
+// SimulateOptions configures the simulated pipeline the same way as the function env
+type SimulateOptions struct {
+	// Classifier default DefaultSeverityRules
+	Classifier *SeverityClassifier
+	// Template default DefaultAlertTemplate
+	Template *template.Template
+	// SuppressWindow 0 sends every alert
+	SuppressWindow time.Duration
+	// SuppressGroupKeys default DefaultSuppressGroupKeys
+	SuppressGroupKeys []string
+	// WarnCountThreshold of save-warn-count-from-kda, default 10
+	WarnCountThreshold int64
+	// Batch is the max records of one KDA lambda output delivery, default 100,
+	// a delivery also has no records one deliveryInterval after its first one
+	Batch int
+}
+
+// SimulatedAlert is one sns publish of the simulated publisher
+type SimulatedAlert struct {
+	Topic      string            `json:"topic"`
+	Subject    string            `json:"subject"`
+	Attributes map[string]string `json:"attributes"`
+	// Messages per protocol of MessageStructure json
+	Messages map[string]string `json:"messages"`
+}
+
+// SimulatedWarnCount is one tumbling window row of the warn count detector
+type SimulatedWarnCount struct {
+	Action      string `json:"action"`
+	WindowStart string `json:"windowStart"`
+	WarnCount   int64  `json:"warnCount"`
+	// OverThreshold the count is alerted by save-warn-count-from-kda
+	OverThreshold bool `json:"overThreshold"`
+}
+
+// SimulationReport is the result of the simulated pipeline
+type SimulationReport struct {
+	Events   int `json:"events"`
+	Abnormal int `json:"abnormal"`
+	// Rows of the abnormal event table in save order
+	Rows       []*EventItem         `json:"rows"`
+	Alerts     []SimulatedAlert     `json:"alerts"`
+	WarnCounts []SimulatedWarnCount `json:"warnCounts"`
+}
+
+// IsAbnormalEvent is the WHERE clause of filter-abnormality-event.sql
+func IsAbnormalEvent(errorMsg string) bool {
+	for _, tag := range abnormalTags {
+		if strings.Contains(errorMsg, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsWarnEvent is the WHERE clause of filter-abnormality-window-event.sql
+func IsWarnEvent(errorMsg string) bool {
+	errorMsg = strings.ToLower(errorMsg)
+	for _, tag := range warnTags {
+		if strings.Contains(errorMsg, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Simulate runs the NDJSON events of r through the KDA filters and the function Handler in-process,
+// the table, topics and suppression window are in memory. the KDA ROWTIME is the event createdAt,
+// an event without a valid createdAt takes the time of the previous event.
+func Simulate(ctx context.Context, r io.Reader, opts SimulateOptions) (*SimulationReport, error) {
+	if opts.Classifier == nil {
+		opts.Classifier, _ = NewSeverityClassifier(DefaultSeverityRules)
+	}
+	if opts.WarnCountThreshold <= 0 {
+		opts.WarnCountThreshold = 10
+	}
+	if opts.Batch <= 0 {
+		opts.Batch = 100
+	}
+
+	store := &simStore{keys: map[string]bool{}, rows: []*EventItem{}}
+	snsClient := &simSNS{alerts: []SimulatedAlert{}}
+	publisher := SnsPublisher{
+		SnsClient:         snsClient,
+		TopicArn:          simTopic,
+		SeverityTopicArns: map[string]string{"panic": simHighPriorityTopic},
+		Template:          opts.Template,
+	}
+	h := NewAlertHandler(store, publisher).WithClassifier(opts.Classifier)
+	// now of the function is the ROWTIME of the last delivered record
+	rowTime, now := time.Unix(0, 0).UTC(), time.Unix(0, 0).UTC()
+	var suppressor *memSuppressor
+	if opts.SuppressWindow > 0 {
+		suppressor = newMemSuppressor(opts.SuppressWindow, opts.SuppressGroupKeys)
+		suppressor.now = func() time.Time { return now }
+		h.WithSuppressor(suppressor)
+	}
+
+	report := &SimulationReport{Rows: []*EventItem{}, WarnCounts: []SimulatedWarnCount{}}
+	warnCounts := map[[2]string]int64{}
+	batch := []events.KinesisAnalyticsOutputDeliveryEventRecord{}
+	var batchStart, batchEnd time.Time
+	deliver := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		now = batchEnd
+		if _, err := h.Handler(ctx, events.KinesisAnalyticsOutputDeliveryEvent{Records: batch}); err != nil {
+			return err
+		}
+		batch = batch[:0]
+		return h.DigestHandler(ctx, events.CloudWatchEvent{})
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		eventItem := &EventItem{}
+		if err := json.Unmarshal(data, eventItem); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		report.Events++
+		if t, ok := parseCreatedAt(eventItem.CreatedAt); ok {
+			rowTime = t
+		}
+		if len(batch) > 0 && rowTime.Sub(batchStart) >= deliveryInterval {
+			if err := deliver(); err != nil {
+				return nil, err
+			}
+		}
+
+		if IsWarnEvent(eventItem.ErrorMsg) {
+			windowStart := rowTime.Truncate(warnCountWindow).Format(windowStartLayout)
+			warnCounts[[2]string{eventItem.Action, windowStart}]++
+		}
+		if !IsAbnormalEvent(eventItem.ErrorMsg) {
+			continue
+		}
+
+		// the destination stream columns, without the fields the sql doesn't select
+		eventItem.Severity = ""
+		record, err := json.Marshal(eventItem)
+		if err != nil {
+			return nil, err
+		}
+		report.Abnormal++
+		if len(batch) == 0 {
+			batchStart = rowTime
+		}
+		batchEnd = rowTime
+		batch = append(batch, events.KinesisAnalyticsOutputDeliveryEventRecord{RecordID: fmt.Sprintf("sim-%d", line), Data: record})
+		if len(batch) >= opts.Batch {
+			if err := deliver(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := deliver(); err != nil {
+		return nil, err
+	}
+	// the digests of the windows still open at the end
+	if suppressor != nil {
+		now = rowTime.Add(opts.SuppressWindow)
+		if err := h.DigestHandler(ctx, events.CloudWatchEvent{}); err != nil {
+			return nil, err
+		}
+	}
+
+	report.Rows = store.rows
+	report.Alerts = snsClient.alerts
+	for key, count := range warnCounts {
+		report.WarnCounts = append(report.WarnCounts, SimulatedWarnCount{
+			Action:        key[0],
+			WindowStart:   key[1],
+			WarnCount:     count,
+			OverThreshold: count >= opts.WarnCountThreshold,
+		})
+	}
+	sort.Slice(report.WarnCounts, func(i, j int) bool {
+		a, b := report.WarnCounts[i], report.WarnCounts[j]
+		if a.WindowStart != b.WindowStart {
+			return a.WindowStart < b.WindowStart
+		}
+		return a.Action < b.Action
+	})
+
+	return report, nil
+}
+
+func parseCreatedAt(createdAt string) (time.Time, bool) {
+	for _, layout := range createdAtLayouts {
+		if t, err := time.Parse(layout, createdAt); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// simStore is the in-memory abnormal event table, keyed by (eventId, createdAt)
+type simStore struct {
+	keys map[string]bool
+	rows []*EventItem
+}
+
+func (m *simStore) SaveEvents(ctx context.Context, eventItems []*EventItem) []error {
+	errs := make([]error, len(eventItems))
+	for i, eventItem := range eventItems {
+		key := eventItem.EventId + "|" + eventItem.CreatedAt
+		if m.keys[key] {
+			errs[i] = ErrDuplicateEvent
+			continue
+		}
+		m.keys[key] = true
+		m.rows = append(m.rows, eventItem)
+	}
+	return errs
+}
+
+// simSNS records the messages published by SnsPublisher
+type simSNS struct {
+	alerts []SimulatedAlert
+}
+
+func (m *simSNS) Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error) {
+	alert := SimulatedAlert{
+		Topic:      aws.ToString(params.TopicArn),
+		Subject:    aws.ToString(params.Subject),
+		Attributes: map[string]string{},
+		Messages:   map[string]string{},
+	}
+	for name, value := range params.MessageAttributes {
+		alert.Attributes[name] = aws.ToString(value.StringValue)
+	}
+	if err := json.Unmarshal([]byte(aws.ToString(params.Message)), &alert.Messages); err != nil {
+		return nil, err
+	}
+	m.alerts = append(m.alerts, alert)
+	return &sns.PublishOutput{MessageId: aws.String(fmt.Sprintf("sim-%d", len(m.alerts)))}, nil
+}
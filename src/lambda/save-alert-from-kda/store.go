@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// at most 25 PutItem requests in flight per invocation, same as one BatchWriteItem call,
+// throttled requests are retried with backoff by the sdk standard retryer, the UnprocessedItems retry of BatchWriteItem
+const putItemConcurrency = 25
+
+// ErrDuplicateEvent means the event is already saved by a previous delivery
+var ErrDuplicateEvent = errors.New("duplicate event")
+
+// DynamoDBPutItemAPI is the DynamoDB client api used to save events, *dynamodb.Client implements it
+type DynamoDBPutItemAPI interface {
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+}
+
+// EventStore persists abnormal events
+type EventStore interface {
+	// SaveEvents returns one error per eventItem (same index), nil means the item is persisted,
+	// ErrDuplicateEvent means the item was persisted before.
+	SaveEvents(ctx context.Context, eventItems []*EventItem) []error
+}
+
+// TableBasics is the DynamoDB EventStore
+type TableBasics struct {
+	DynamoDbClient DynamoDBPutItemAPI
+	TableName      string
+}
+
+// ensure idempotency with a condition expression on the table key (eventId, createdAt),
+// a redelivered event fails the condition check and returns ErrDuplicateEvent
+func (m TableBasics) putItem(ctx context.Context, eventItem *EventItem) (err error) {
+	item, err := attributevalue.MarshalMap(eventItem)
+	if err != nil {
+		return
+	}
+	_, err = m.DynamoDbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(m.TableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(eventId)"),
+	})
+	var conditionalCheckFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionalCheckFailed) {
+		return ErrDuplicateEvent
+	}
+	if err != nil {
+		log.Printf("[ERROR] Couldn't add item to table. Here's why: %v\n", err)
+	}
+
+	return
+}
+
+// SaveEvents writes eventItems with conditional PutItem, putItemConcurrency requests at a time.
+// BatchWriteItem doesn't support condition expressions, so it can't tell a redelivered event from a new one.
+func (m TableBasics) SaveEvents(ctx context.Context, eventItems []*EventItem) (errs []error) {
+	errs = make([]error, len(eventItems))
+
+	sem := make(chan struct{}, putItemConcurrency)
+	wg := sync.WaitGroup{}
+	for i, eventItem := range eventItems {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, eventItem *EventItem) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = m.putItem(ctx, eventItem)
+		}(i, eventItem)
+	}
+	wg.Wait()
+
+	return
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeDynamoDB is an in-memory DynamoDBPutItemAPI which checks attribute_not_exists on the item key,
+// a PutItem with an eventId in fail returns an error.
+type fakeDynamoDB struct {
+	mu    sync.Mutex
+	items map[string]map[string]types.AttributeValue
+	fail  map[string]bool
+}
+
+func newFakeDynamoDB() *fakeDynamoDB {
+	return &fakeDynamoDB{
+		items: map[string]map[string]types.AttributeValue{},
+		fail:  map[string]bool{},
+	}
+}
+
+func (f *fakeDynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	eventId := params.Item["eventId"].(*types.AttributeValueMemberS).Value
+	createdAt := params.Item["createdAt"].(*types.AttributeValueMemberS).Value
+	if f.fail[eventId] {
+		return nil, errors.New("fake PutItem error")
+	}
+	key := eventId + "|" + createdAt
+	if _, ok := f.items[key]; ok && params.ConditionExpression != nil {
+		return nil, fmt.Errorf("operation error DynamoDB: PutItem, %w", &types.ConditionalCheckFailedException{})
+	}
+	f.items[key] = params.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func eventItems(eventIds ...string) []*EventItem {
+	items := make([]*EventItem, len(eventIds))
+	for i, eventId := range eventIds {
+		items[i] = &EventItem{EventId: eventId, CreatedAt: "2022-11-11 11:11:11"}
+	}
+	return items
+}
+
+func TestTableBasicsSaveEvents(t *testing.T) {
+	manyIds := []string{}
+	manyWant := []error{}
+	for i := 0; i < 60; i++ {
+		manyIds = append(manyIds, fmt.Sprintf("e%d", i))
+		manyWant = append(manyWant, nil)
+	}
+
+	tests := []struct {
+		name      string
+		saved     []string
+		fail      []string
+		eventIds  []string
+		wantErrs  []error
+		wantSaved int
+	}{
+		{
+			name:      "all saved",
+			eventIds:  []string{"e1", "e2"},
+			wantErrs:  []error{nil, nil},
+			wantSaved: 2,
+		},
+		{
+			name:      "redelivered event is duplicate",
+			saved:     []string{"e1"},
+			eventIds:  []string{"e1", "e2"},
+			wantErrs:  []error{ErrDuplicateEvent, nil},
+			wantSaved: 2,
+		},
+		{
+			name:      "put error",
+			fail:      []string{"e2"},
+			eventIds:  []string{"e1", "e2", "e3"},
+			wantErrs:  []error{nil, errors.New("fake PutItem error"), nil},
+			wantSaved: 2,
+		},
+		{
+			name:      "many events",
+			eventIds:  manyIds,
+			wantErrs:  manyWant,
+			wantSaved: len(manyIds),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeDdb := newFakeDynamoDB()
+			tb := TableBasics{DynamoDbClient: fakeDdb, TableName: "test"}
+			tb.SaveEvents(context.Background(), eventItems(tt.saved...))
+			for _, eventId := range tt.fail {
+				fakeDdb.fail[eventId] = true
+			}
+
+			errs := tb.SaveEvents(context.Background(), eventItems(tt.eventIds...))
+			for i, err := range errs {
+				switch {
+				case tt.wantErrs[i] == nil && err != nil,
+					tt.wantErrs[i] != nil && err == nil,
+					errors.Is(tt.wantErrs[i], ErrDuplicateEvent) && !errors.Is(err, ErrDuplicateEvent):
+					t.Errorf("SaveEvents() %s error = %v, want %v", tt.eventIds[i], err, tt.wantErrs[i])
+				}
+			}
+			if len(fakeDdb.items) != tt.wantSaved {
+				t.Errorf("SaveEvents() saved %d, want %d", len(fakeDdb.items), tt.wantSaved)
+			}
+		})
+	}
+}
+
+// TestTableBasicsSaveEventsThrottled runs the sdk client against a DynamoDB stub which throttles some PutItem calls,
+// the standard retryer retries them, an item still throttled after the max attempts fails alone
+func TestTableBasicsSaveEventsThrottled(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Item map[string]struct{ S string }
+		}
+		json.NewDecoder(r.Body).Decode(&input)
+		eventId := input.Item["eventId"].S
+		mu.Lock()
+		calls[eventId]++
+		n := calls[eventId]
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		// e2 is throttled twice, e3 always
+		if (eventId == "e2" && n <= 2) || eventId == "e3" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"com.amazonaws.dynamodb.v20120810#ProvisionedThroughputExceededException","message":"throttled"}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	client := dynamodb.New(dynamodb.Options{
+		Region:           "us-east-1",
+		Credentials:      aws.AnonymousCredentials{},
+		EndpointResolver: dynamodb.EndpointResolverFromURL(server.URL),
+		Retryer: retry.NewStandard(func(o *retry.StandardOptions) {
+			o.Backoff = retry.BackoffDelayerFunc(func(attempt int, err error) (time.Duration, error) { return 0, nil })
+		}),
+	})
+	tb := TableBasics{DynamoDbClient: client, TableName: "test"}
+
+	errs := tb.SaveEvents(context.Background(), eventItems("e1", "e2", "e3"))
+	if errs[0] != nil || errs[1] != nil {
+		t.Errorf("SaveEvents() errors = %v, want e1 and e2 saved", errs)
+	}
+	var throttled *types.ProvisionedThroughputExceededException
+	if !errors.As(errs[2], &throttled) {
+		t.Errorf("SaveEvents() e3 error = %v, want ProvisionedThroughputExceededException", errs[2])
+	}
+	want := map[string]int{"e1": 1, "e2": 3, "e3": retry.DefaultMaxAttempts}
+	for eventId, n := range want {
+		if calls[eventId] != n {
+			t.Errorf("PutItem %s calls = %d, want %d", eventId, calls[eventId], n)
+		}
+	}
+}
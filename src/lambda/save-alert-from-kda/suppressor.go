@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// suppression items expire one day after the window end, a digest not sent by then is dropped
+const suppressItemTTL = 24 * time.Hour
+
+// DefaultSuppressGroupKeys groups alerts by action, bizId and severity, a panic is never folded into an error window
+var DefaultSuppressGroupKeys = []string{"action", "bizId", "severity"}
+
+// DynamoDBSuppressAPI is the DynamoDB client api used by the suppression window, *dynamodb.Client implements it
+type DynamoDBSuppressAPI interface {
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+}
+
+// AlertSuppressor rate limits alerts of the same group(e.g. action+bizId) to one per window,
+// the other occurrences in the window are rolled up into a digest.
+type AlertSuppressor interface {
+	GroupKey(eventItem *EventItem) string
+	// Check records the occurrences of one group, returns true when they open a new window
+	// and the first one should be alerted now, the rest are counted into the window digest.
+	Check(ctx context.Context, groupKey string, eventItems []*EventItem) (bool, error)
+	// Digests returns the finished windows which have suppressed occurrences
+	Digests(ctx context.Context) ([]*Digest, error)
+	// Reset removes the digest counts after it is sent
+	Reset(ctx context.Context, digest *Digest) error
+}
+
+// Digest is the rollup of the suppressed occurrences in one window
+type Digest struct {
+	GroupKey    string     `dynamodbav:"groupKey" json:"groupKey"`
+	WindowStart int64      `dynamodbav:"windowStart" json:"windowStart"`
+	WindowEnd   int64      `dynamodbav:"windowEnd" json:"windowEnd"`
+	Suppressed  int        `dynamodbav:"suppressed" json:"suppressed"`
+	LastEvent   *EventItem `dynamodbav:"lastEvent" json:"lastEvent"`
+}
+
+// DynamoSuppressor keeps one item per group in the suppression table
+// {groupKey, windowStart, windowEnd, suppressed, lastEvent, expiresAt(TTL)}
+type DynamoSuppressor struct {
+	DynamoDbClient DynamoDBSuppressAPI
+	TableName      string
+	Window         time.Duration
+	// event json field names, default DefaultSuppressGroupKeys
+	GroupKeys []string
+
+	now func() time.Time
+}
+
+func NewDynamoSuppressor(client DynamoDBSuppressAPI, tableName string, window time.Duration, groupKeys []string) *DynamoSuppressor {
+	if len(groupKeys) == 0 {
+		groupKeys = DefaultSuppressGroupKeys
+	}
+	return &DynamoSuppressor{
+		DynamoDbClient: client,
+		TableName:      tableName,
+		Window:         window,
+		GroupKeys:      groupKeys,
+		now:            time.Now,
+	}
+}
+
+// GroupKey joins the group field values, e.g. action=pay#bizId=b1
+func (m *DynamoSuppressor) GroupKey(eventItem *EventItem) string {
+	parts := make([]string, 0, len(m.GroupKeys))
+	for _, key := range m.GroupKeys {
+		parts = append(parts, key+"="+eventItem.Field(key))
+	}
+	return strings.Join(parts, "#")
+}
+
+func (m *DynamoSuppressor) Check(ctx context.Context, groupKey string, eventItems []*EventItem) (bool, error) {
+	if len(eventItems) == 0 {
+		return false, nil
+	}
+	lastEvent, err := attributevalue.Marshal(eventItems[len(eventItems)-1])
+	if err != nil {
+		return false, err
+	}
+	now := m.now()
+	windowEnd := now.Add(m.Window)
+
+	// open a new window when there is none or the last one is finished and its digest is sent
+	_, err = m.DynamoDbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(m.TableName),
+		Key:                 map[string]types.AttributeValue{"groupKey": &types.AttributeValueMemberS{Value: groupKey}},
+		UpdateExpression:    aws.String("SET windowStart = :now, windowEnd = :end, suppressed = :rest, lastEvent = :event, expiresAt = :ttl"),
+		ConditionExpression: aws.String("attribute_not_exists(groupKey) OR (windowEnd <= :now AND suppressed = :zero)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now":   unixValue(now),
+			":end":   unixValue(windowEnd),
+			":rest":  intValue(len(eventItems) - 1),
+			":event": lastEvent,
+			":ttl":   unixValue(windowEnd.Add(suppressItemTTL)),
+			":zero":  intValue(0),
+		},
+	})
+	if err == nil {
+		return true, nil
+	}
+	var conditionalCheckFailed *types.ConditionalCheckFailedException
+	if !errors.As(err, &conditionalCheckFailed) {
+		return false, err
+	}
+
+	// in window, count into the digest
+	_, err = m.DynamoDbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(m.TableName),
+		Key:              map[string]types.AttributeValue{"groupKey": &types.AttributeValueMemberS{Value: groupKey}},
+		UpdateExpression: aws.String("SET lastEvent = :event ADD suppressed :n"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":event": lastEvent,
+			":n":     intValue(len(eventItems)),
+		},
+	})
+
+	return false, err
+}
+
+func (m *DynamoSuppressor) Digests(ctx context.Context) (digests []*Digest, err error) {
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String(m.TableName),
+		FilterExpression: aws.String("suppressed > :zero AND windowEnd <= :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":zero": intValue(0),
+			":now":  unixValue(m.now()),
+		},
+	}
+	for {
+		output, err := m.DynamoDbClient.Scan(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		page := []*Digest{}
+		if err = attributevalue.UnmarshalListOfMaps(output.Items, &page); err != nil {
+			return nil, err
+		}
+		digests = append(digests, page...)
+		if len(output.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+
+	return
+}
+
+// Reset subtracts the sent count, occurrences added by a concurrent Check are kept for the next digest
+func (m *DynamoSuppressor) Reset(ctx context.Context, digest *Digest) error {
+	_, err := m.DynamoDbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(m.TableName),
+		Key:              map[string]types.AttributeValue{"groupKey": &types.AttributeValueMemberS{Value: digest.GroupKey}},
+		UpdateExpression: aws.String("ADD suppressed :n"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":n": intValue(-digest.Suppressed),
+		},
+	})
+	return err
+}
+
+// Message is the digest alert, it keeps the EventItem json fields of the last event
+// so the alert subscribers can read it as an event
+func (m *Digest) Message() ([]byte, error) {
+	msg := map[string]interface{}{}
+	if m.LastEvent != nil {
+		data, err := json.Marshal(m.LastEvent)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, &msg); err != nil {
+			return nil, err
+		}
+	}
+	window := time.Duration(m.WindowEnd-m.WindowStart) * time.Second
+	msg["errorMsg"] = fmt.Sprintf("[digest] %d more alerts of %s suppressed in %s, last errorMsg: %v", m.Suppressed, m.GroupKey, window, msg["errorMsg"])
+	msg["digest"] = true
+	msg["groupKey"] = m.GroupKey
+	msg["suppressed"] = m.Suppressed
+	msg["windowStart"] = time.Unix(m.WindowStart, 0).UTC().Format(time.RFC3339)
+	msg["windowEnd"] = time.Unix(m.WindowEnd, 0).UTC().Format(time.RFC3339)
+
+	return json.Marshal(msg)
+}
+
+func unixValue(t time.Time) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(t.Unix(), 10)}
+}
+
+func intValue(n int) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.Itoa(n)}
+}
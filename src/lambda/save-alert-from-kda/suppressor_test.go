@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeSuppressDynamoDB records UpdateItem requests, the first openFails of them fail the condition check,
+// Scan returns pages in order
+type fakeSuppressDynamoDB struct {
+	updates   []*dynamodb.UpdateItemInput
+	openFails int
+	pages     []*dynamodb.ScanOutput
+	scans     int
+}
+
+func (f *fakeSuppressDynamoDB) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	f.updates = append(f.updates, params)
+	if params.ConditionExpression != nil && f.openFails > 0 {
+		f.openFails--
+		return nil, &types.ConditionalCheckFailedException{}
+	}
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (f *fakeSuppressDynamoDB) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	f.scans++
+	return f.pages[f.scans-1], nil
+}
+
+func TestDynamoSuppressorCheck(t *testing.T) {
+	fakeDdb := &fakeSuppressDynamoDB{openFails: 1}
+	s := NewDynamoSuppressor(fakeDdb, "suppress", time.Minute, nil)
+	s.now = func() time.Time { return time.Unix(1668135071, 0) }
+	items := []*EventItem{{EventId: "e1", Action: "pay", BizId: "b1", Severity: "error"}, {EventId: "e2", Action: "pay", BizId: "b1", Severity: "error"}}
+
+	groupKey := s.GroupKey(items[0])
+	if groupKey != "action=pay#bizId=b1#severity=error" {
+		t.Errorf("GroupKey() = %s", groupKey)
+	}
+
+	// window is open, counted into digest
+	allowed, err := s.Check(context.Background(), groupKey, items)
+	if err != nil || allowed {
+		t.Fatalf("Check() = %v, %v, want suppressed", allowed, err)
+	}
+	if len(fakeDdb.updates) != 2 || aws.ToString(fakeDdb.updates[1].UpdateExpression) != "SET lastEvent = :event ADD suppressed :n" {
+		t.Fatalf("Check() updates = %d, want open window then add", len(fakeDdb.updates))
+	}
+	if n := fakeDdb.updates[1].ExpressionAttributeValues[":n"].(*types.AttributeValueMemberN).Value; n != "2" {
+		t.Errorf("Check() add suppressed %s, want 2", n)
+	}
+
+	// new window, the rest of the group are counted
+	allowed, err = s.Check(context.Background(), groupKey, items)
+	if err != nil || !allowed {
+		t.Fatalf("Check() = %v, %v, want allowed", allowed, err)
+	}
+	open := fakeDdb.updates[2].ExpressionAttributeValues
+	if open[":rest"].(*types.AttributeValueMemberN).Value != "1" || open[":end"].(*types.AttributeValueMemberN).Value != "1668135131" {
+		t.Errorf("Check() open window values %v", open)
+	}
+}
+
+func TestDynamoSuppressorDigests(t *testing.T) {
+	item := func(groupKey string, suppressed int) map[string]types.AttributeValue {
+		av, _ := attributevalue.MarshalMap(&Digest{
+			GroupKey: groupKey, WindowStart: 1668135071, WindowEnd: 1668135131, Suppressed: suppressed,
+			LastEvent: &EventItem{EventId: "e9", Action: "pay", BizId: "b1", ErrorMsg: "[error] boom"},
+		})
+		return av
+	}
+	fakeDdb := &fakeSuppressDynamoDB{pages: []*dynamodb.ScanOutput{
+		{Items: []map[string]types.AttributeValue{item("g1", 3)}, LastEvaluatedKey: map[string]types.AttributeValue{"groupKey": &types.AttributeValueMemberS{Value: "g1"}}},
+		{Items: []map[string]types.AttributeValue{item("g2", 5)}},
+	}}
+	s := NewDynamoSuppressor(fakeDdb, "suppress", time.Minute, []string{"action"})
+
+	digests, err := s.Digests(context.Background())
+	if err != nil || len(digests) != 2 || fakeDdb.scans != 2 {
+		t.Fatalf("Digests() = %d, %v after %d scans, want 2 digests of 2 pages", len(digests), err, fakeDdb.scans)
+	}
+	if digests[1].GroupKey != "g2" || digests[1].Suppressed != 5 || digests[1].LastEvent.EventId != "e9" {
+		t.Errorf("Digests() [1] = %+v", digests[1])
+	}
+
+	data, err := digests[0].Message()
+	if err != nil {
+		t.Fatalf("Message() error = %v", err)
+	}
+	msg := map[string]interface{}{}
+	json.Unmarshal(data, &msg)
+	if msg["action"] != "pay" || msg["suppressed"] != float64(3) || msg["errorMsg"] != "[digest] 3 more alerts of g1 suppressed in 1m0s, last errorMsg: [error] boom" {
+		t.Errorf("Message() = %s", data)
+	}
+
+	if err := s.Reset(context.Background(), digests[0]); err != nil {
+		t.Fatalf("Reset() error = %v", err)
+	}
+	if n := fakeDdb.updates[0].ExpressionAttributeValues[":n"].(*types.AttributeValueMemberN).Value; n != "-3" {
+		t.Errorf("Reset() add %s, want -3", n)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+// sns Subject must be ascii printable and shorter than 100 chars
+const maxSubjectLen = 100
+
+// alertTemplateNames are the templates every alert template file defines
+var alertTemplateNames = []string{"subject", "email", "sms", "https"}
+
+//go:embed templates/alert.tmpl
+var defaultAlertTemplateText string
+
+// DefaultAlertTemplate is the template bundled with the function, see templates/alert.tmpl
+var DefaultAlertTemplate = template.Must(newAlertTemplate().Parse(defaultAlertTemplateText))
+
+// AlertData is the template data of one alert
+type AlertData struct {
+	Event    *EventItem
+	Severity string
+	// Digest is nil for a single alert
+	Digest *Digest
+	// Raw is the event json sent to lambda/sqs subscriptions
+	Raw string
+}
+
+// AlertMessage is the rendered sns message of one alert, every protocol has its own message
+type AlertMessage struct {
+	Subject string
+	Default string
+	Email   string
+	SMS     string
+	HTTPS   string
+}
+
+func newAlertTemplate() *template.Template {
+	return template.New("alert").Funcs(template.FuncMap{
+		"unixTime": func(sec int64) string {
+			return time.Unix(sec, 0).UTC().Format(time.RFC3339)
+		},
+		"score": func(score *float64) string {
+			return strconv.FormatFloat(*score, 'f', 2, 64)
+		},
+		"truncate": func(n int, s string) string {
+			if r := []rune(s); len(r) > n {
+				return string(r[:n]) + "..."
+			}
+			return s
+		},
+	})
+}
+
+// LoadAlertTemplate parses the template file which overrides the bundled templates,
+// it must define subject, email, sms and https templates. empty file is DefaultAlertTemplate.
+func LoadAlertTemplate(file string) (*template.Template, error) {
+	if len(file) == 0 {
+		return DefaultAlertTemplate, nil
+	}
+	text, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := newAlertTemplate().Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+	// a missing template would fail every publish, not the function init
+	for _, name := range alertTemplateNames {
+		if tmpl.Lookup(name) == nil {
+			return nil, fmt.Errorf("alert template %s doesn't define %q", file, name)
+		}
+	}
+	return tmpl, nil
+}
+
+// RenderAlert renders every protocol message of the alert
+func RenderAlert(tmpl *template.Template, data *AlertData) (*AlertMessage, error) {
+	if data.Event == nil {
+		data.Event = &EventItem{}
+	}
+	if len(data.Severity) == 0 {
+		data.Severity = data.Event.Severity
+	}
+	if len(data.Severity) == 0 {
+		data.Severity = SeverityInfo
+	}
+
+	msg := &AlertMessage{Default: data.Raw}
+	for name, out := range map[string]*string{"subject": &msg.Subject, "email": &msg.Email, "sms": &msg.SMS, "https": &msg.HTTPS} {
+		buf := bytes.Buffer{}
+		if err := tmpl.ExecuteTemplate(&buf, name, data); err != nil {
+			return nil, err
+		}
+		*out = buf.String()
+	}
+	msg.Subject = subject(msg.Subject)
+
+	return msg, nil
+}
+
+// Structure is the sns Message with MessageStructure json
+func (m *AlertMessage) Structure() (string, error) {
+	data, err := json.Marshal(map[string]string{
+		"default": m.Default,
+		"email":   m.Email,
+		"sms":     m.SMS,
+		"https":   m.HTTPS,
+		"http":    m.HTTPS,
+	})
+	return string(data), err
+}
+
+// subject keeps ascii printable chars in one line
+func subject(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\r' || r == '\t' {
+			return ' '
+		}
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, s)
+	s = strings.TrimSpace(s)
+	if len(s) >= maxSubjectLen {
+		s = s[:maxSubjectLen-4] + "..."
+	}
+	return s
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sns/types"
+)
+
+// alert when an action has at least 10 warnings in one window by default
+const defaultWarnCountThreshold = 10
+
+// sns Subject is less than 100 chars, same as save-alert-from-kda
+const maxSubjectLen = 100
+
+// WarnCountItem is one row of the windowed kinesis analytics output, see filter-abnormality-window-event.sql
+type WarnCountItem struct {
+	Action string `dynamodbav:"action" json:"action"`
+	// WindowStart is the tumbling window start of ROWTIME, e.g. 2022-11-11 11:11:00.000
+	WindowStart string `dynamodbav:"windowStart" json:"windowStart"`
+	WarnCount   int64  `dynamodbav:"warnCount" json:"warnCount"`
+}
+
+// SNSPublishAPI is the SNS client api used to send alerts, *sns.Client implements it
+type SNSPublishAPI interface {
+	Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error)
+}
+
+// WarnCountHandler saves the per action warn counts and alerts the counts over threshold
+type WarnCountHandler struct {
+	store     CountStore
+	snsClient SNSPublishAPI
+	topicArn  string
+	threshold int64
+}
+
+func NewWarnCountHandler(store CountStore, snsClient SNSPublishAPI, topicArn string, threshold int64) *WarnCountHandler {
+	if threshold <= 0 {
+		threshold = defaultWarnCountThreshold
+	}
+	return &WarnCountHandler{store: store, snsClient: snsClient, topicArn: topicArn, threshold: threshold}
+}
+
+func Init() *WarnCountHandler {
+	countDynamodbTable := os.Getenv("TABLE_NAME")
+	alertSNSTopicArn := os.Getenv("TOPIC_ARN")
+	if len(countDynamodbTable) == 0 || len(alertSNSTopicArn) == 0 {
+		log.Fatalf("env TABLE_NAME:%s TOPIC_ARN:%s is empty", countDynamodbTable, alertSNSTopicArn)
+	}
+	threshold, _ := strconv.ParseInt(os.Getenv("WARN_COUNT_THRESHOLD"), 10, 64)
+	log.Printf("env TABLE_NAME:%s TOPIC_ARN:%s WARN_COUNT_THRESHOLD:%d", countDynamodbTable, alertSNSTopicArn, threshold)
+
+	optFns := []func(*config.LoadOptions) error{}
+	if region := os.Getenv("REGION"); len(region) > 0 {
+		optFns = append(optFns, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(context.TODO(), optFns...)
+	if err != nil {
+		log.Fatalf("unable to load SDK config, %v", err)
+	}
+
+	return NewWarnCountHandler(NewCountTable(dynamodb.NewFromConfig(cfg), countDynamodbTable), sns.NewFromConfig(cfg), alertSNSTopicArn, threshold)
+}
+
+// Handler receives the windowed warn counts from kinesis analytics output,
+// same delivery contract as save-alert-from-kda: a redelivered window count is saved once and alerted once,
+// only failed records are redelivered, the invocation fails when none of the decoded records could be persisted.
+func (h *WarnCountHandler) Handler(ctx context.Context, kinesisAnalyticsEvent events.KinesisAnalyticsOutputDeliveryEvent) (responses events.KinesisAnalyticsOutputDeliveryResponse, err error) {
+	responses = events.KinesisAnalyticsOutputDeliveryResponse{
+		Records: make([]events.KinesisAnalyticsOutputDeliveryResponseRecord, len(kinesisAnalyticsEvent.Records)),
+	}
+
+	decoded, persisted := 0, 0
+	var lastErr error
+	for i, record := range kinesisAnalyticsEvent.Records {
+		responses.Records[i] = events.KinesisAnalyticsOutputDeliveryResponseRecord{
+			RecordID: record.RecordID,
+			Result:   events.KinesisAnalyticsOutputDeliveryOK,
+		}
+		log.Printf("%s Data = %s \n", record.RecordID, record.Data)
+
+		item := &WarnCountItem{}
+		if err := json.Unmarshal(record.Data, item); err != nil || len(item.Action) == 0 {
+			log.Printf("[WARNING] %s Data = %s can't decode by json error:%v \n", record.RecordID, record.Data, err)
+			continue
+		}
+		decoded++
+
+		saveErr := h.store.SaveCount(ctx, item)
+		if errors.Is(saveErr, ErrDuplicateCount) {
+			log.Printf("[INFO] %s Data = %s is duplicate, skip alert \n", record.RecordID, record.Data)
+			persisted++
+			continue
+		}
+		if saveErr != nil {
+			log.Printf("[ERROR] %s Data = %s save warn count error:%s \n", record.RecordID, record.Data, saveErr.Error())
+			responses.Records[i].Result = events.KinesisAnalyticsOutputDeliveryFailed
+			lastErr = saveErr
+			continue
+		}
+		persisted++
+
+		if item.WarnCount < h.threshold {
+			continue
+		}
+		if pubErr := h.alert(ctx, item); pubErr != nil {
+			log.Printf("[WARNING] Data = %s can't send alert err:%s \n", record.Data, pubErr.Error())
+		}
+	}
+
+	if decoded > 0 && persisted == 0 {
+		err = fmt.Errorf("none of %d records persisted, last error: %w", decoded, lastErr)
+	}
+
+	return responses, err
+}
+
+// alert keeps the abnormal event json fields, so the alert topic subscribers(e.g. send-alert-to-webhook) read it as an event
+func (h *WarnCountHandler) alert(ctx context.Context, item *WarnCountItem) error {
+	errorMsg := fmt.Sprintf("[warning] %d warnings of action %s in the window from %s, threshold %d", item.WarnCount, item.Action, item.WindowStart, h.threshold)
+	data, err := json.Marshal(map[string]interface{}{
+		"eventId":     fmt.Sprintf("warn-count#%s#%s", item.Action, item.WindowStart),
+		"action":      item.Action,
+		"createdAt":   item.WindowStart,
+		"errorMsg":    errorMsg,
+		"severity":    "warning",
+		"warnCount":   item.WarnCount,
+		"windowStart": item.WindowStart,
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := h.snsClient.Publish(ctx, &sns.PublishInput{
+		Message:           aws.String(string(data)),
+		Subject:           aws.String(subject(fmt.Sprintf("[warning] %s warn count %d over threshold %d", item.Action, item.WarnCount, h.threshold))),
+		TopicArn:          aws.String(h.topicArn),
+		MessageAttributes: messageAttributes(item),
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] Data = %s send SNS ok msgID:%s \n", data, aws.ToString(res.MessageId))
+
+	return nil
+}
+
+// messageAttributes are the action and severity attributes of save-alert-from-kda for subscription filter policies
+func messageAttributes(item *WarnCountItem) map[string]types.MessageAttributeValue {
+	return map[string]types.MessageAttributeValue{
+		"action":   {DataType: aws.String("String"), StringValue: aws.String(item.Action)},
+		"severity": {DataType: aws.String("String"), StringValue: aws.String("warning")},
+	}
+}
+
+// subject keeps ascii printable chars in one line, same as save-alert-from-kda
+func subject(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\r' || r == '\t' {
+			return ' '
+		}
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, s)
+	s = strings.TrimSpace(s)
+	if len(s) >= maxSubjectLen {
+		s = s[:maxSubjectLen-4] + "..."
+	}
+	return s
+}
+
+func main() {
+	lambda.Start(Init().Handler)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+)
+
+// memStore is an in-memory CountStore, counts of an action in fail can't be saved
+type memStore struct {
+	items map[string]*WarnCountItem
+	fail  map[string]bool
+}
+
+func newMemStore(failActions ...string) *memStore {
+	m := &memStore{items: map[string]*WarnCountItem{}, fail: map[string]bool{}}
+	for _, action := range failActions {
+		m.fail[action] = true
+	}
+	return m
+}
+
+func (m *memStore) SaveCount(ctx context.Context, item *WarnCountItem) error {
+	if m.fail[item.Action] {
+		return errors.New("mem store save error")
+	}
+	key := item.Action + "|" + item.WindowStart
+	if _, ok := m.items[key]; ok {
+		return ErrDuplicateCount
+	}
+	m.items[key] = item
+	return nil
+}
+
+// fakeSNS records publish inputs
+type fakeSNS struct {
+	inputs []*sns.PublishInput
+}
+
+func (f *fakeSNS) Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error) {
+	f.inputs = append(f.inputs, params)
+	return &sns.PublishOutput{MessageId: aws.String("msg-1")}, nil
+}
+
+func record(id, action string, warnCount int) events.KinesisAnalyticsOutputDeliveryEventRecord {
+	return events.KinesisAnalyticsOutputDeliveryEventRecord{
+		RecordID: id,
+		Data:     []byte(fmt.Sprintf(`{"action":"%s","windowStart":"2022-11-11 11:11:00.000","warnCount":%d}`, action, warnCount)),
+	}
+}
+
+func result(id, result string) events.KinesisAnalyticsOutputDeliveryResponseRecord {
+	return events.KinesisAnalyticsOutputDeliveryResponseRecord{RecordID: id, Result: result}
+}
+
+func TestHandler(t *testing.T) {
+	ok, failed := events.KinesisAnalyticsOutputDeliveryOK, events.KinesisAnalyticsOutputDeliveryFailed
+
+	tests := []struct {
+		name        string
+		records     []events.KinesisAnalyticsOutputDeliveryEventRecord
+		store       *memStore
+		wantResults []events.KinesisAnalyticsOutputDeliveryResponseRecord
+		wantErr     bool
+		wantSaved   int
+		wantAlerts  int
+	}{
+		{
+			name:        "under threshold isn't alerted",
+			records:     []events.KinesisAnalyticsOutputDeliveryEventRecord{record("r1", "pay", 3), record("r2", "login", 10)},
+			store:       newMemStore(),
+			wantResults: []events.KinesisAnalyticsOutputDeliveryResponseRecord{result("r1", ok), result("r2", ok)},
+			wantSaved:   2,
+			wantAlerts:  1,
+		},
+		{
+			name:        "undecodable record is dropped",
+			records:     []events.KinesisAnalyticsOutputDeliveryEventRecord{{RecordID: "r1", Data: []byte("not json")}, record("r2", "pay", 12)},
+			store:       newMemStore(),
+			wantResults: []events.KinesisAnalyticsOutputDeliveryResponseRecord{result("r1", ok), result("r2", ok)},
+			wantSaved:   1,
+			wantAlerts:  1,
+		},
+		{
+			name:        "redelivered window count doesn't alert again",
+			records:     []events.KinesisAnalyticsOutputDeliveryEventRecord{record("r1", "pay", 12), record("r2", "pay", 12)},
+			store:       newMemStore(),
+			wantResults: []events.KinesisAnalyticsOutputDeliveryResponseRecord{result("r1", ok), result("r2", ok)},
+			wantSaved:   1,
+			wantAlerts:  1,
+		},
+		{
+			name:        "save error fails the record",
+			records:     []events.KinesisAnalyticsOutputDeliveryEventRecord{record("r1", "pay", 12), record("r2", "login", 12)},
+			store:       newMemStore("pay"),
+			wantResults: []events.KinesisAnalyticsOutputDeliveryResponseRecord{result("r1", failed), result("r2", ok)},
+			wantSaved:   1,
+			wantAlerts:  1,
+		},
+		{
+			name:        "nothing persisted",
+			records:     []events.KinesisAnalyticsOutputDeliveryEventRecord{record("r1", "pay", 12)},
+			store:       newMemStore("pay"),
+			wantResults: []events.KinesisAnalyticsOutputDeliveryResponseRecord{result("r1", failed)},
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeSns := &fakeSNS{}
+			h := NewWarnCountHandler(tt.store, fakeSns, "alert", 0)
+			got, err := h.Handler(context.Background(), events.KinesisAnalyticsOutputDeliveryEvent{Records: tt.records})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Handler() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got.Records, tt.wantResults) {
+				t.Errorf("Handler() = %v, want %v", got.Records, tt.wantResults)
+			}
+			if len(tt.store.items) != tt.wantSaved {
+				t.Errorf("Handler() saved %d, want %d", len(tt.store.items), tt.wantSaved)
+			}
+			if len(fakeSns.inputs) != tt.wantAlerts {
+				t.Errorf("Handler() alerted %d, want %d", len(fakeSns.inputs), tt.wantAlerts)
+			}
+		})
+	}
+}
+
+func TestHandlerAlertMessage(t *testing.T) {
+	fakeSns := &fakeSNS{}
+	h := NewWarnCountHandler(newMemStore(), fakeSns, "alert", 5)
+	if _, err := h.Handler(context.Background(), events.KinesisAnalyticsOutputDeliveryEvent{
+		Records: []events.KinesisAnalyticsOutputDeliveryEventRecord{record("r1", "pay", 7)},
+	}); err != nil {
+		t.Fatalf("Handler() error = %v", err)
+	}
+
+	input := fakeSns.inputs[0]
+	if got := aws.ToString(input.Subject); got != "[warning] pay warn count 7 over threshold 5" {
+		t.Errorf("alert Subject = %s", got)
+	}
+	for name, want := range map[string]string{"action": "pay", "severity": "warning"} {
+		if got := aws.ToString(input.MessageAttributes[name].StringValue); got != want {
+			t.Errorf("alert MessageAttributes %s = %s, want %s", name, got, want)
+		}
+	}
+	msg := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(aws.ToString(input.Message)), &msg); err != nil {
+		t.Fatalf("alert Message isn't json: %v", err)
+	}
+	for field, want := range map[string]interface{}{
+		"eventId":   "warn-count#pay#2022-11-11 11:11:00.000",
+		"action":    "pay",
+		"createdAt": "2022-11-11 11:11:00.000",
+		"severity":  "warning",
+		"warnCount": float64(7),
+	} {
+		if msg[field] != want {
+			t.Errorf("alert Message %s = %v, want %v", field, msg[field], want)
+		}
+	}
+}
+
+// sns rejects a Subject of 100 chars or more, the limits are spelled out so a changed maxSubjectLen fails
+func TestSubject(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want string
+	}{
+		{" [warning] pay\nwarn \u00e9count ", "[warning] pay warn count"},
+		{strings.Repeat("a", 99), strings.Repeat("a", 99)},
+		{strings.Repeat("a", 100), strings.Repeat("a", 96) + "..."},
+		{strings.Repeat("a", 101), strings.Repeat("a", 96) + "..."},
+		{strings.Repeat("\u652f\u4ed8", 60) + strings.Repeat("a", 120), strings.Repeat("a", 96) + "..."},
+	} {
+		if got := subject(tt.in); got != tt.want || len(got) >= 100 {
+			t.Errorf("subject(%q) = %q (%d chars), want %q", tt.in, got, len(got), tt.want)
+		}
+	}
+
+	// a long action still publishes a valid Subject
+	fakeSns := &fakeSNS{}
+	h := NewWarnCountHandler(newMemStore(), fakeSns, "alert", 5)
+	if _, err := h.Handler(context.Background(), events.KinesisAnalyticsOutputDeliveryEvent{
+		Records: []events.KinesisAnalyticsOutputDeliveryEventRecord{record("r1", strings.Repeat("pay", 50), 7)},
+	}); err != nil {
+		t.Fatalf("Handler() error = %v", err)
+	}
+	if got := aws.ToString(fakeSns.inputs[0].Subject); len(got) >= 100 || !strings.HasPrefix(got, "[warning] paypay") {
+		t.Errorf("alert Subject = %q (%d chars), want a [warning] subject under 100 chars", got, len(got))
+	}
+}
+
+// subject is a copy of save-alert-from-kda, the lambdas are separate modules, the copy must not drift
+func TestSubjectSameAsSaveAlert(t *testing.T) {
+	funcSrc := func(file string) (string, string) {
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			t.Fatalf("parse %s: %v", file, err)
+		}
+		var body, maxLen bytes.Buffer
+		for _, decl := range f.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				if decl.Name.Name == "subject" {
+					printer.Fprint(&body, fset, decl.Body)
+				}
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					if value, ok := spec.(*ast.ValueSpec); ok && value.Names[0].Name == "maxSubjectLen" {
+						printer.Fprint(&maxLen, fset, value.Values[0])
+					}
+				}
+			}
+		}
+		return body.String(), maxLen.String()
+	}
+
+	body, maxLen := funcSrc("main.go")
+	wantBody, wantMaxLen := funcSrc("../save-alert-from-kda/template.go")
+	if len(wantBody) == 0 || body != wantBody {
+		t.Errorf("subject() =\n%s\nwant save-alert-from-kda subject()\n%s", body, wantBody)
+	}
+	if maxLen != wantMaxLen || maxLen != "100" {
+		t.Errorf("maxSubjectLen = %s, want save-alert-from-kda %s", maxLen, wantMaxLen)
+	}
+}
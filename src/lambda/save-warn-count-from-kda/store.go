@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// warn counts expire after 30 days by the table TTL attribute expiresAt
+const countItemTTL = 30 * 24 * time.Hour
+
+// ErrDuplicateCount means the window count is already saved by a previous delivery
+var ErrDuplicateCount = errors.New("duplicate warn count")
+
+// DynamoDBPutItemAPI is the DynamoDB client api used to save counts, *dynamodb.Client implements it
+type DynamoDBPutItemAPI interface {
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+}
+
+// CountStore persists the per action warn count of every window
+type CountStore interface {
+	// SaveCount returns ErrDuplicateCount when the window count was saved before
+	SaveCount(ctx context.Context, item *WarnCountItem) error
+}
+
+// CountTable is the time series DynamoDB CountStore, key is (action, windowStart)
+type CountTable struct {
+	DynamoDbClient DynamoDBPutItemAPI
+	TableName      string
+
+	now func() time.Time
+}
+
+func NewCountTable(client DynamoDBPutItemAPI, tableName string) *CountTable {
+	return &CountTable{DynamoDbClient: client, TableName: tableName, now: time.Now}
+}
+
+func (m *CountTable) SaveCount(ctx context.Context, item *WarnCountItem) error {
+	av, err := attributevalue.MarshalMap(item)
+	if err != nil {
+		return err
+	}
+	av["expiresAt"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(m.now().Add(countItemTTL).Unix(), 10)}
+	_, err = m.DynamoDbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(m.TableName),
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(#action)"),
+		// action is a dynamodb reserved word
+		ExpressionAttributeNames: map[string]string{"#action": "action"},
+	})
+	var conditionalCheckFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionalCheckFailed) {
+		return ErrDuplicateCount
+	}
+	if err != nil {
+		log.Printf("[ERROR] Couldn't add item to table. Here's why: %v\n", err)
+	}
+
+	return err
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeDynamoDB is an in-memory DynamoDBPutItemAPI which checks attribute_not_exists on the item key
+type fakeDynamoDB struct {
+	items map[string]map[string]types.AttributeValue
+}
+
+func (f *fakeDynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	key := params.Item["action"].(*types.AttributeValueMemberS).Value + "|" + params.Item["windowStart"].(*types.AttributeValueMemberS).Value
+	if _, ok := f.items[key]; ok && params.ConditionExpression != nil {
+		return nil, fmt.Errorf("operation error DynamoDB: PutItem, %w", &types.ConditionalCheckFailedException{})
+	}
+	f.items[key] = params.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func TestCountTableSaveCount(t *testing.T) {
+	fakeDdb := &fakeDynamoDB{items: map[string]map[string]types.AttributeValue{}}
+	table := NewCountTable(fakeDdb, "test")
+	table.now = func() time.Time { return time.Unix(1668135060, 0) }
+	item := &WarnCountItem{Action: "pay", WindowStart: "2022-11-11 11:11:00.000", WarnCount: 12}
+
+	if err := table.SaveCount(context.Background(), item); err != nil {
+		t.Fatalf("SaveCount() error = %v", err)
+	}
+	saved := fakeDdb.items["pay|2022-11-11 11:11:00.000"]
+	if got := saved["warnCount"].(*types.AttributeValueMemberN).Value; got != "12" {
+		t.Errorf("SaveCount() warnCount = %s, want 12", got)
+	}
+	if got := saved["expiresAt"].(*types.AttributeValueMemberN).Value; got != "1670727060" {
+		t.Errorf("SaveCount() expiresAt = %s, want 30 days later", got)
+	}
+
+	if err := table.SaveCount(context.Background(), item); err != ErrDuplicateCount {
+		t.Errorf("SaveCount() redelivered error = %v, want ErrDuplicateCount", err)
+	}
+}
@@ -0,0 +1,5 @@
+module send-alert-to-webhook
+
+go 1.18
+
+require github.com/aws/aws-lambda-go v1.34.1
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+type EventItem struct {
+	EventId   string `json:"eventId"`
+	Action    string `json:"action"`
+	UserId    string `json:"userId"`
+	CreatedAt string `json:"createdAt"`
+	ObjectId  string `json:"objectId"`
+	BizId     string `json:"bizId"`
+	ErrorMsg  string `json:"errorMsg"`
+	Severity  string `json:"severity"`
+}
+
+// WebhookHandler sends abnormal event alerts from the sns topic to all webhook channels
+type WebhookHandler struct {
+	notifiers []Notifier
+}
+
+func NewWebhookHandler(notifiers ...Notifier) *WebhookHandler {
+	return &WebhookHandler{notifiers: notifiers}
+}
+
+// Init creates notifiers from env WEBHOOKS, a json list of WebhookConfig
+func Init() *WebhookHandler {
+	webhooks := []WebhookConfig{}
+	if err := json.Unmarshal([]byte(os.Getenv("WEBHOOKS")), &webhooks); err != nil {
+		log.Fatalf("env WEBHOOKS can't decode by json error:%s", err.Error())
+	}
+
+	notifiers := make([]Notifier, 0, len(webhooks))
+	for _, conf := range webhooks {
+		notifier, err := NewNotifier(conf)
+		if err != nil {
+			log.Fatalf("new notifier error:%s", err.Error())
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	log.Printf("%d webhook notifiers", len(notifiers))
+
+	return NewWebhookHandler(notifiers...)
+}
+
+// detail: https://docs.aws.amazon.com/zh_cn/lambda/latest/dg/with-sns.html
+// sns invokes lambda asynchronously and retries on error, so the invocation only fails
+// when a message can't be sent to any channel, otherwise a retry would alert the sent channels again.
+func (h *WebhookHandler) Handler(ctx context.Context, snsEvent events.SNSEvent) (err error) {
+	for _, record := range snsEvent.Records {
+		msg := record.SNS.Message
+		log.Printf("%s Message = %s \n", record.SNS.MessageID, msg)
+
+		eventItem := &EventItem{}
+		if err := json.Unmarshal([]byte(msg), eventItem); err != nil {
+			log.Printf("[WARNING] %s Message = %s can't decode by json error:%s \n", record.SNS.MessageID, msg, err.Error())
+			continue
+		}
+
+		alert := &Alert{Subject: record.SNS.Subject, Event: eventItem}
+		sent := 0
+		for _, notifier := range h.notifiers {
+			if notifyErr := notifier.Notify(ctx, alert); notifyErr != nil {
+				log.Printf("[ERROR] %s send to %s error:%s \n", record.SNS.MessageID, notifier.Name(), notifyErr.Error())
+				continue
+			}
+			sent++
+		}
+		if len(h.notifiers) > 0 && sent == 0 {
+			err = fmt.Errorf("message %s can't send to any of %d webhooks", record.SNS.MessageID, len(h.notifiers))
+		}
+	}
+
+	return
+}
+
+func main() {
+	h := Init()
+	lambda.Start(h.Handler)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// webhookServer is the webhook stand-in, it records request bodies and replies with resp
+type webhookServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	bodies   []map[string]interface{}
+	queries  []url.Values
+	status   int
+	respBody string
+}
+
+func newWebhookServer(t *testing.T, status int, respBody string) *webhookServer {
+	s := &webhookServer{status: status, respBody: respBody}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		body := map[string]interface{}{}
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Errorf("webhook body %s isn't json: %v", data, err)
+		}
+		s.mu.Lock()
+		s.bodies = append(s.bodies, body)
+		s.queries = append(s.queries, r.URL.Query())
+		s.mu.Unlock()
+		w.WriteHeader(s.status)
+		io.WriteString(w, s.respBody)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func snsEvent(messages ...string) events.SNSEvent {
+	e := events.SNSEvent{}
+	for i, msg := range messages {
+		e.Records = append(e.Records, events.SNSEventRecord{SNS: events.SNSEntity{
+			MessageID: string(rune('a' + i)),
+			Subject:   "abnormal event",
+			Message:   msg,
+		}})
+	}
+	return e
+}
+
+const eventMsg = `{"eventId":"e1","action":"pay","userId":"u1","objectId":"o1","bizId":"b1","errorMsg":"[error] boom","createdAt":"2022-11-11 11:11:11"}`
+
+func TestNotifiers(t *testing.T) {
+	now = func() time.Time { return time.Unix(1668135071, 0) }
+	defer func() { now = time.Now }()
+
+	tests := []struct {
+		name     string
+		conf     WebhookConfig
+		status   int
+		respBody string
+		wantErr  bool
+		check    func(t *testing.T, body map[string]interface{}, query url.Values)
+	}{
+		{
+			name:     "feishu signed card",
+			conf:     WebhookConfig{Type: WebhookTypeFeishu, Secret: "sec"},
+			status:   http.StatusOK,
+			respBody: `{"code":0,"msg":"success"}`,
+			check: func(t *testing.T, body map[string]interface{}, query url.Values) {
+				if body["msg_type"] != "interactive" {
+					t.Errorf("feishu msg_type = %v", body["msg_type"])
+				}
+				if body["timestamp"] != "1668135071" || body["sign"] != hmacSha256Base64("1668135071\nsec", "") {
+					t.Errorf("feishu timestamp = %v sign = %v", body["timestamp"], body["sign"])
+				}
+				card, _ := json.Marshal(body["card"])
+				if !strings.Contains(string(card), "[error] boom") {
+					t.Errorf("feishu card %s has no errorMsg", card)
+				}
+			},
+		},
+		{
+			name:     "feishu error code",
+			conf:     WebhookConfig{Type: WebhookTypeFeishu},
+			status:   http.StatusOK,
+			respBody: `{"code":19021,"msg":"sign match fail"}`,
+			wantErr:  true,
+		},
+		{
+			name:     "dingtalk signed markdown",
+			conf:     WebhookConfig{Type: WebhookTypeDingTalk, Secret: "sec"},
+			status:   http.StatusOK,
+			respBody: `{"errcode":0,"errmsg":"ok"}`,
+			check: func(t *testing.T, body map[string]interface{}, query url.Values) {
+				if body["msgtype"] != "markdown" {
+					t.Errorf("dingtalk msgtype = %v", body["msgtype"])
+				}
+				if query.Get("timestamp") != "1668135071000" || query.Get("sign") != hmacSha256Base64("sec", "1668135071000\nsec") {
+					t.Errorf("dingtalk query = %v", query)
+				}
+			},
+		},
+		{
+			name:     "dingtalk error code",
+			conf:     WebhookConfig{Type: WebhookTypeDingTalk},
+			status:   http.StatusOK,
+			respBody: `{"errcode":310000,"errmsg":"sign not match"}`,
+			wantErr:  true,
+		},
+		{
+			name:     "slack blocks",
+			conf:     WebhookConfig{Type: WebhookTypeSlack},
+			status:   http.StatusOK,
+			respBody: `ok`,
+			check: func(t *testing.T, body map[string]interface{}, query url.Values) {
+				if body["text"] != "abnormal event" {
+					t.Errorf("slack text = %v", body["text"])
+				}
+				if blocks, _ := body["blocks"].([]interface{}); len(blocks) != 2 {
+					t.Errorf("slack blocks = %v", body["blocks"])
+				}
+			},
+		},
+		{
+			name:     "generic webhook",
+			conf:     WebhookConfig{Type: WebhookTypeGeneric},
+			status:   http.StatusOK,
+			respBody: `{}`,
+			check: func(t *testing.T, body map[string]interface{}, query url.Values) {
+				event, _ := body["event"].(map[string]interface{})
+				if event["eventId"] != "e1" || event["bizId"] != "b1" {
+					t.Errorf("generic event = %v", body["event"])
+				}
+			},
+		},
+		{
+			name:     "http error",
+			conf:     WebhookConfig{Type: WebhookTypeGeneric},
+			status:   http.StatusInternalServerError,
+			respBody: `{}`,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newWebhookServer(t, tt.status, tt.respBody)
+			tt.conf.URL = server.URL + "/hook"
+			notifier, err := NewNotifier(tt.conf)
+			if err != nil {
+				t.Fatalf("NewNotifier() error = %v", err)
+			}
+
+			err = NewWebhookHandler(notifier).Handler(context.Background(), snsEvent(eventMsg))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Handler() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(server.bodies) != 1 {
+				t.Fatalf("webhook got %d requests, want 1", len(server.bodies))
+			}
+			if tt.check != nil {
+				tt.check(t, server.bodies[0], server.queries[0])
+			}
+		})
+	}
+}
+
+func TestSlackHeaderLength(t *testing.T) {
+	server := newWebhookServer(t, http.StatusOK, `ok`)
+	notifier, err := NewNotifier(WebhookConfig{Type: WebhookTypeSlack, URL: server.URL})
+	if err != nil {
+		t.Fatalf("NewNotifier() error = %v", err)
+	}
+	// no sns subject, the title is the action
+	action := strings.Repeat("支付", 100)
+	if err := notifier.Notify(context.Background(), &Alert{Event: &EventItem{EventId: "e1", Action: action}}); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+
+	body := server.bodies[0]
+	title := "User behavior abnormal event: " + action
+	if body["text"] != title {
+		t.Errorf("slack text = %v, want the full title", body["text"])
+	}
+	header := body["blocks"].([]interface{})[0].(map[string]interface{})["text"].(map[string]interface{})["text"].(string)
+	if n := utf8.RuneCountInString(header); n != slackHeaderMaxLength || !strings.HasPrefix(title, strings.TrimSuffix(header, "…")) {
+		t.Errorf("slack header = %s (%d runes), want the title cut to %d runes", header, n, slackHeaderMaxLength)
+	}
+}
+
+func TestHandlerPartialFailure(t *testing.T) {
+	ok := newWebhookServer(t, http.StatusOK, `{}`)
+	down := newWebhookServer(t, http.StatusBadGateway, `{}`)
+	okNotifier, _ := NewNotifier(WebhookConfig{Name: "ok", URL: ok.URL})
+	downNotifier, _ := NewNotifier(WebhookConfig{Name: "down", URL: down.URL})
+
+	// one channel sent, no retry
+	err := NewWebhookHandler(okNotifier, downNotifier).Handler(context.Background(), snsEvent(eventMsg, "not json"))
+	if err != nil {
+		t.Errorf("Handler() error = %v, want nil", err)
+	}
+	if len(ok.bodies) != 1 || len(down.bodies) != 1 {
+		t.Errorf("webhook requests ok:%d down:%d, want 1 1", len(ok.bodies), len(down.bodies))
+	}
+
+	// no channel sent, retry
+	if err := NewWebhookHandler(downNotifier).Handler(context.Background(), snsEvent(eventMsg)); err == nil {
+		t.Errorf("Handler() error = nil, want error")
+	}
+}
+
+func TestNewNotifier(t *testing.T) {
+	if _, err := NewNotifier(WebhookConfig{Type: WebhookTypeSlack}); err == nil {
+		t.Errorf("NewNotifier() without url should fail")
+	}
+	if _, err := NewNotifier(WebhookConfig{Type: "wechat", URL: "http://localhost"}); err == nil {
+		t.Errorf("NewNotifier() with unsupported type should fail")
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	WebhookTypeFeishu   = "feishu"
+	WebhookTypeDingTalk = "dingtalk"
+	WebhookTypeSlack    = "slack"
+	WebhookTypeGeneric  = "webhook"
+)
+
+// WebhookConfig is one alert channel from env WEBHOOKS (cdk context alertWebhooks)
+type WebhookConfig struct {
+	Name string `json:"name"`
+	// feishu, dingtalk, slack or webhook
+	Type string `json:"type"`
+	URL  string `json:"url"`
+	// signature secret of feishu/dingtalk custom bot, optional
+	Secret string `json:"secret"`
+}
+
+// Notifier sends an abnormal event alert to one channel
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, alert *Alert) error
+}
+
+// Alert is the abnormal event with the sns message subject
+type Alert struct {
+	Subject string
+	Event   *EventItem
+}
+
+var httpClient = &http.Client{Timeout: 5 * time.Second}
+
+// now is replaced in tests for a stable signature
+var now = time.Now
+
+func NewNotifier(conf WebhookConfig) (Notifier, error) {
+	if len(conf.URL) == 0 {
+		return nil, fmt.Errorf("webhook %s url is empty", conf.Name)
+	}
+	if len(conf.Name) == 0 {
+		conf.Name = conf.Type
+	}
+
+	switch strings.ToLower(conf.Type) {
+	case WebhookTypeFeishu:
+		return &feishuNotifier{conf}, nil
+	case WebhookTypeDingTalk:
+		return &dingTalkNotifier{conf}, nil
+	case WebhookTypeSlack:
+		return &slackNotifier{conf}, nil
+	case WebhookTypeGeneric, "":
+		return &genericNotifier{conf}, nil
+	}
+
+	return nil, fmt.Errorf("webhook %s unsupported type %s", conf.Name, conf.Type)
+}
+
+// lines is the alert content shared by all card messages
+func (a *Alert) lines() [][2]string {
+	return [][2]string{
+		{"severity", a.Event.Severity},
+		{"action", a.Event.Action},
+		{"bizId", a.Event.BizId},
+		{"userId", a.Event.UserId},
+		{"objectId", a.Event.ObjectId},
+		{"eventId", a.Event.EventId},
+		{"createdAt", a.Event.CreatedAt},
+		{"errorMsg", a.Event.ErrorMsg},
+	}
+}
+
+func (a *Alert) title() string {
+	if len(a.Subject) > 0 {
+		return a.Subject
+	}
+	return fmt.Sprintf("User behavior abnormal event: %s", a.Event.Action)
+}
+
+func (a *Alert) markdown() string {
+	b := strings.Builder{}
+	for _, line := range a.lines() {
+		fmt.Fprintf(&b, "**%s**: %s\n", line[0], line[1])
+	}
+	return b.String()
+}
+
+// postJSON posts body to url and returns the response body when http status is 2xx
+func postJSON(ctx context.Context, url string, body interface{}) ([]byte, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("http status %d body %s", resp.StatusCode, respBody)
+	}
+
+	return respBody, nil
+}
+
+func hmacSha256Base64(key, message string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte(message))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// feishu custom bot: https://open.feishu.cn/document/ukTMukTMukTM/ucTM5YjL3ETO24yNxkjN
+type feishuNotifier struct {
+	conf WebhookConfig
+}
+
+func (m *feishuNotifier) Name() string {
+	return m.conf.Name
+}
+
+func (m *feishuNotifier) Notify(ctx context.Context, alert *Alert) error {
+	body := map[string]interface{}{
+		"msg_type": "interactive",
+		"card": map[string]interface{}{
+			"header": map[string]interface{}{
+				"title":    map[string]interface{}{"tag": "plain_text", "content": alert.title()},
+				"template": "red",
+			},
+			"elements": []interface{}{
+				map[string]interface{}{
+					"tag":  "div",
+					"text": map[string]interface{}{"tag": "lark_md", "content": alert.markdown()},
+				},
+			},
+		},
+	}
+	// sign: base64(hmac_sha256(key=timestamp+"\n"+secret, message=""))
+	if len(m.conf.Secret) > 0 {
+		timestamp := strconv.FormatInt(now().Unix(), 10)
+		body["timestamp"] = timestamp
+		body["sign"] = hmacSha256Base64(timestamp+"\n"+m.conf.Secret, "")
+	}
+
+	respBody, err := postJSON(ctx, m.conf.URL, body)
+	if err != nil {
+		return err
+	}
+	res := struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	}{}
+	if err = json.Unmarshal(respBody, &res); err != nil {
+		return err
+	}
+	if res.Code != 0 {
+		return fmt.Errorf("feishu code %d msg %s", res.Code, res.Msg)
+	}
+
+	return nil
+}
+
+// dingtalk custom robot: https://open.dingtalk.com/document/robots/custom-robot-access
+type dingTalkNotifier struct {
+	conf WebhookConfig
+}
+
+func (m *dingTalkNotifier) Name() string {
+	return m.conf.Name
+}
+
+// signURL appends timestamp(ms) and sign=urlencode(base64(hmac_sha256(key=secret, message=timestamp+"\n"+secret)))
+func (m *dingTalkNotifier) signURL() (string, error) {
+	if len(m.conf.Secret) == 0 {
+		return m.conf.URL, nil
+	}
+	u, err := url.Parse(m.conf.URL)
+	if err != nil {
+		return "", err
+	}
+	timestamp := strconv.FormatInt(now().UnixNano()/int64(time.Millisecond), 10)
+	query := u.Query()
+	query.Set("timestamp", timestamp)
+	query.Set("sign", hmacSha256Base64(m.conf.Secret, timestamp+"\n"+m.conf.Secret))
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+func (m *dingTalkNotifier) Notify(ctx context.Context, alert *Alert) error {
+	signedURL, err := m.signURL()
+	if err != nil {
+		return err
+	}
+	title := alert.title()
+	body := map[string]interface{}{
+		"msgtype": "markdown",
+		"markdown": map[string]interface{}{
+			"title": title,
+			"text":  fmt.Sprintf("### %s\n%s", title, strings.ReplaceAll(alert.markdown(), "\n", "\n\n")),
+		},
+	}
+
+	respBody, err := postJSON(ctx, signedURL, body)
+	if err != nil {
+		return err
+	}
+	res := struct {
+		ErrCode int    `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+	}{}
+	if err = json.Unmarshal(respBody, &res); err != nil {
+		return err
+	}
+	if res.ErrCode != 0 {
+		return fmt.Errorf("dingtalk errcode %d errmsg %s", res.ErrCode, res.ErrMsg)
+	}
+
+	return nil
+}
+
+// slackHeaderMaxLength is the plain_text limit of a slack header block, a longer one rejects the whole message
+const slackHeaderMaxLength = 150
+
+// slack incoming webhook: https://api.slack.com/messaging/webhooks
+type slackNotifier struct {
+	conf WebhookConfig
+}
+
+func (m *slackNotifier) Name() string {
+	return m.conf.Name
+}
+
+func (m *slackNotifier) Notify(ctx context.Context, alert *Alert) error {
+	fields := []interface{}{}
+	for _, line := range alert.lines() {
+		fields = append(fields, map[string]interface{}{"type": "mrkdwn", "text": fmt.Sprintf("*%s*\n%s", line[0], line[1])})
+	}
+	// the notification text keeps the full title, the header is truncated
+	title := alert.title()
+	body := map[string]interface{}{
+		"text": title,
+		"blocks": []interface{}{
+			map[string]interface{}{
+				"type": "header",
+				"text": map[string]interface{}{"type": "plain_text", "text": truncateRunes(title, slackHeaderMaxLength)},
+			},
+			map[string]interface{}{
+				"type":   "section",
+				"fields": fields,
+			},
+		},
+	}
+
+	// slack returns plain text "ok" with http 200
+	_, err := postJSON(ctx, m.conf.URL, body)
+	return err
+}
+
+// truncateRunes cuts s to at most n runes, a cut string ends with an ellipsis
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+// genericNotifier posts {"subject": ..., "event": EventItem} to the url
+type genericNotifier struct {
+	conf WebhookConfig
+}
+
+func (m *genericNotifier) Name() string {
+	return m.conf.Name
+}
+
+func (m *genericNotifier) Notify(ctx context.Context, alert *Alert) error {
+	_, err := postJSON(ctx, m.conf.URL, map[string]interface{}{
+		"subject": alert.title(),
+		"event":   alert.Event,
+	})
+	return err
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// Properties are the custom resource properties, every value is a json document by name
+type Properties struct {
+	// Endpoint is the domain endpoint, e.g. https://vpc-xxx.us-east-1.es.amazonaws.com
+	Endpoint       string            `json:"Endpoint"`
+	IndexTemplates map[string]string `json:"IndexTemplates"`
+	// Roles are fine-grained access control roles, RolesMapping maps them to the backend roles e.g. IAM role arns
+	Roles        map[string]string `json:"Roles"`
+	RolesMapping map[string]string `json:"RolesMapping"`
+}
+
+// Event is the custom resource provider framework onEvent request
+type Event struct {
+	RequestType        string     `json:"RequestType"`
+	PhysicalResourceId string     `json:"PhysicalResourceId"`
+	ResourceProperties Properties `json:"ResourceProperties"`
+}
+
+// Response is the custom resource provider framework onEvent response
+type Response struct {
+	PhysicalResourceId string `json:"PhysicalResourceId"`
+}
+
+// SetupHandler puts the index templates and the security roles into the domain with SigV4 requests,
+// the handler role is the domain master user
+type SetupHandler struct {
+	client      *http.Client
+	signer      *v4.Signer
+	credentials aws.CredentialsProvider
+	region      string
+}
+
+func NewSetupHandler(client *http.Client, credentials aws.CredentialsProvider, region string) *SetupHandler {
+	return &SetupHandler{client: client, signer: v4.NewSigner(), credentials: credentials, region: region}
+}
+
+func Init() *SetupHandler {
+	optFns := []func(*config.LoadOptions) error{}
+	if region := os.Getenv("REGION"); len(region) > 0 {
+		optFns = append(optFns, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(context.TODO(), optFns...)
+	if err != nil {
+		log.Fatalf("unable to load SDK config, %v", err)
+	}
+	log.Printf("region:%s", cfg.Region)
+
+	return NewSetupHandler(&http.Client{Timeout: 30 * time.Second}, cfg.Credentials, cfg.Region)
+}
+
+// Handler puts the documents on create and update, the roles before their mappings;
+// delete keeps them, they leave with the domain
+func (h *SetupHandler) Handler(ctx context.Context, event Event) (*Response, error) {
+	props := event.ResourceProperties
+	log.Printf("%s %s", event.RequestType, props.Endpoint)
+	if len(props.Endpoint) == 0 {
+		return nil, fmt.Errorf("Endpoint is empty")
+	}
+	response := &Response{PhysicalResourceId: props.Endpoint}
+	if event.RequestType == "Delete" {
+		response.PhysicalResourceId = event.PhysicalResourceId
+		return response, nil
+	}
+
+	for _, docs := range []struct {
+		path string
+		docs map[string]string
+	}{
+		{"/_index_template/", props.IndexTemplates},
+		{"/_plugins/_security/api/roles/", props.Roles},
+		{"/_plugins/_security/api/rolesmapping/", props.RolesMapping},
+	} {
+		names := make([]string, 0, len(docs.docs))
+		for name := range docs.docs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := h.put(ctx, strings.TrimSuffix(props.Endpoint, "/")+docs.path+name, docs.docs[name]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return response, nil
+}
+
+func (h *SetupHandler) put(ctx context.Context, url, body string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader([]byte(body)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	credentials, err := h.credentials.Retrieve(ctx)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(body))
+	if err := h.signer.SignHTTP(ctx, credentials, req, hex.EncodeToString(hash[:]), "es", h.region, time.Now()); err != nil {
+		return err
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+	log.Printf("PUT %s %d %s", req.URL.Path, resp.StatusCode, respBody)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("PUT %s status %d: %s", req.URL.Path, resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+func main() {
+	lambda.Start(Init().Handler)
+}
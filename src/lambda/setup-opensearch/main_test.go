@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+type request struct {
+	method, path, body string
+	signed             bool
+}
+
+// newDomain records the requests, a path in fail is answered 403
+func newDomain(t *testing.T, fail string) (*httptest.Server, *[]request) {
+	t.Helper()
+	requests := &[]request{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		*requests = append(*requests, request{
+			method: r.Method,
+			path:   r.URL.Path,
+			body:   string(body),
+			signed: strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") && strings.Contains(r.Header.Get("Authorization"), "/us-east-1/es/aws4_request"),
+		})
+		if r.URL.Path == fail {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error":"no permissions"}`))
+			return
+		}
+		w.Write([]byte(`{"acknowledged":true}`))
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func newHandler(server *httptest.Server) *SetupHandler {
+	credentials := aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "SECRET"}, nil
+	})
+	return NewSetupHandler(server.Client(), credentials, "us-east-1")
+}
+
+func event(requestType, endpoint string) Event {
+	return Event{
+		RequestType: requestType,
+		ResourceProperties: Properties{
+			Endpoint:       endpoint,
+			IndexTemplates: map[string]string{"cdc": `{"index_patterns":["cdc-*"]}`, "user-behavior-event": `{"index_patterns":["user-behavior-event*"]}`},
+			Roles:          map[string]string{"user_behavior_writer": `{"cluster_permissions":["indices:data/write/bulk"]}`},
+			RolesMapping:   map[string]string{"user_behavior_writer": `{"backend_roles":["arn:aws:iam::123456789012:role/flink"]}`},
+		},
+	}
+}
+
+func TestHandlerCreate(t *testing.T) {
+	server, requests := newDomain(t, "")
+	resp, err := newHandler(server).Handler(context.Background(), event("Create", server.URL+"/"))
+	if err != nil {
+		t.Fatalf("Handler() error = %v", err)
+	}
+	if resp.PhysicalResourceId != server.URL+"/" {
+		t.Errorf("PhysicalResourceId = %s", resp.PhysicalResourceId)
+	}
+
+	paths := []string{}
+	for _, r := range *requests {
+		if r.method != http.MethodPut || !r.signed {
+			t.Errorf("%s %s signed = %v, want a signed PUT", r.method, r.path, r.signed)
+		}
+		paths = append(paths, r.path)
+	}
+	want := []string{
+		"/_index_template/cdc",
+		"/_index_template/user-behavior-event",
+		"/_plugins/_security/api/roles/user_behavior_writer",
+		"/_plugins/_security/api/rolesmapping/user_behavior_writer",
+	}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("paths = %v, want %v", paths, want)
+	}
+	if (*requests)[3].body != `{"backend_roles":["arn:aws:iam::123456789012:role/flink"]}` {
+		t.Errorf("rolesmapping body = %s", (*requests)[3].body)
+	}
+}
+
+func TestHandlerError(t *testing.T) {
+	server, requests := newDomain(t, "/_plugins/_security/api/roles/user_behavior_writer")
+	_, err := newHandler(server).Handler(context.Background(), event("Update", server.URL))
+	if err == nil || !strings.Contains(err.Error(), "status 403") {
+		t.Errorf("Handler() error = %v, want status 403", err)
+	}
+	// the mapping of a role which failed isn't put
+	if len(*requests) != 3 {
+		t.Errorf("requests = %d, want 3", len(*requests))
+	}
+}
+
+func TestHandlerDelete(t *testing.T) {
+	server, requests := newDomain(t, "")
+	e := event("Delete", server.URL)
+	e.PhysicalResourceId = "old"
+	resp, err := newHandler(server).Handler(context.Background(), e)
+	if err != nil || resp.PhysicalResourceId != "old" || len(*requests) != 0 {
+		t.Errorf("Handler() = %+v, %v, requests %d, want no request", resp, err, len(*requests))
+	}
+
+	if _, err := newHandler(server).Handler(context.Background(), Event{RequestType: "Create"}); err == nil {
+		t.Error("Handler() without Endpoint error = nil")
+	}
+}
@@ -0,0 +1,103 @@
+"""
+the Features processing step of the UserBehaviorAnomalyPipeline,
+reads the user behavior events archived by firehose under raw/ and writes the random cut forest train csv.
+
+the feature row of an event, same as the AnomalyFeatures of src/lambda/save-alert-from-kda/scorer.go:
+    hour, action bucket, bizId bucket, errorMsg length, level
+hour is of createdAt, a bucket is crc32(value) % 100, errorMsg length is at most 1024,
+level is 3 [panic], 2 [error], 1 [warning], 0 without a level tag
+"""
+
+import argparse
+import gzip
+import itertools
+import json
+import logging
+import os
+import re
+import zlib
+from datetime import datetime
+
+logger = logging.getLogger()
+logger.setLevel(logging.INFO)
+logger.addHandler(logging.StreamHandler())
+
+BUCKETS = 100
+MAX_ERROR_MSG_LENGTH = 1024
+LEVELS = [
+    (3, re.compile(r"(?i)\[panic\]")),
+    (2, re.compile(r"(?i)\[error\]")),
+    (1, re.compile(r"(?i)\[warn(n)?(ing)?\]")),
+]
+
+
+def bucket(value):
+    return zlib.crc32(value.encode("utf-8")) % BUCKETS
+
+
+def hour(created_at):
+    # 2022-11-11 11:11:11.000000 of the producer or the js 2022-11-11T11:11:11.000Z
+    try:
+        return datetime.strptime(created_at[:19].replace("T", " "), "%Y-%m-%d %H:%M:%S").hour
+    except ValueError:
+        return 0
+
+
+def level(error_msg):
+    for lvl, pattern in LEVELS:
+        if pattern.search(error_msg):
+            return lvl
+    return 0
+
+
+def features(event):
+    error_msg = event.get("errorMsg") or ""
+    return [
+        hour(event.get("createdAt") or ""),
+        bucket(event.get("action") or ""),
+        bucket(event.get("bizId") or ""),
+        min(len(error_msg), MAX_ERROR_MSG_LENGTH),
+        level(error_msg),
+    ]
+
+
+def events(path):
+    # the default archive concatenates the json records without a delimiter, the partitioned one is newline delimited
+    opener = gzip.open if path.endswith(".gz") else open
+    with opener(path, "rt", encoding="utf-8") as f:
+        data = f.read()
+    decoder = json.JSONDecoder()
+    pos = 0
+    while pos < len(data):
+        while pos < len(data) and data[pos].isspace():
+            pos += 1
+        if pos >= len(data):
+            break
+        try:
+            event, pos = decoder.raw_decode(data, pos)
+        except json.JSONDecodeError:
+            logger.warning("skip the undecodable rest of %s at %d", path, pos)
+            break
+        # cdc records of a shared stream aren't user behavior events
+        if isinstance(event, dict) and "metadata" not in event:
+            yield event
+
+
+if __name__ == "__main__":
+    parser = argparse.ArgumentParser()
+    parser.add_argument("--input", type=str, default="/opt/ml/processing/raw")
+    parser.add_argument("--output", type=str, default="/opt/ml/processing/train")
+    parser.add_argument("--max-events", type=int, default=1000000)
+    args, _ = parser.parse_known_args()
+    logger.info("Received arguments %s", args)
+
+    os.makedirs(args.output, exist_ok=True)
+    paths = sorted(os.path.join(root, name) for root, _, files in os.walk(args.input) for name in files)
+    count = 0
+    with open(os.path.join(args.output, "train.csv"), "w", encoding="utf-8") as out:
+        for event in itertools.islice((e for path in paths for e in events(path)), args.max_events):
+            out.write(",".join(str(v) for v in features(event)) + "\n")
+            count += 1
+    if count == 0:
+        raise SystemExit("no user behavior event under " + args.input)
+    logger.info("wrote %d feature rows", count)
@@ -1,16 +1,32 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"user-behavior-analytics-cdk/infra"
 	"user-behavior-analytics-cdk/infra/lib"
 
 	"github.com/aws/aws-cdk-go/awscdk/v2"
 	"github.com/aws/aws-cdk-go/awscdk/v2/assertions"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsdynamodb"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskinesis"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
 	"github.com/aws/jsii-runtime-go"
 	"github.com/google/go-cmp/cmp"
 )
 
+// asset and sql file paths are relative to the cdk app dir, same as cdk synth
+func TestMain(m *testing.M) {
+	if err := os.Chdir(".."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
 func TestHitCounterConstruct(t *testing.T) {
 	defer jsii.Close()
 
@@ -24,7 +40,9 @@ func TestHitCounterConstruct(t *testing.T) {
 		Handler: jsii.String("hello.handler"),
 	})
 	lib.NewHitCounter(stack, "MyTestConstruct", &lib.HitCounterProps{
-		Downstream: testFn,
+		Downstream:   testFn,
+		ReadCapacity: 10,
+		EventStream:  awskinesis.NewStream(stack, jsii.String("TestStream"), nil),
 	})
 
 	// THEN
@@ -42,7 +60,9 @@ func TestLambdaFunction(t *testing.T) {
 		Handler: jsii.String("hello.handler"),
 	})
 	lib.NewHitCounter(stack, "MyTestConstruct", &lib.HitCounterProps{
-		Downstream: testFn,
+		Downstream:   testFn,
+		ReadCapacity: 10,
+		EventStream:  awskinesis.NewStream(stack, jsii.String("TestStream"), nil),
 	})
 
 	// THEN
@@ -60,6 +80,9 @@ func TestLambdaFunction(t *testing.T) {
 			"HITS_TABLE_NAME": map[string]any{
 				"Ref": "MyTestConstructHits24A357F0",
 			},
+			"HITS_STREAM_NAME": map[string]any{
+				"Ref": "TestStreamE6F40222",
+			},
 		},
 	}
 	if !cmp.Equal(envCapture.AsObject(), expectedEnv) {
@@ -67,6 +90,40 @@ func TestLambdaFunction(t *testing.T) {
 	}
 }
 
+func TestHitCounterUseGoCollector(t *testing.T) {
+	defer jsii.Close()
+
+	// GIVEN
+	stack := awscdk.NewStack(nil, nil, nil)
+
+	// WHEN
+	testFn := awslambda.NewFunction(stack, jsii.String("TestFunction"), &awslambda.FunctionProps{
+		Code:    awslambda.Code_FromAsset(jsii.String("src/lambda/js-func/hello"), nil),
+		Runtime: awslambda.Runtime_NODEJS_16_X(),
+		Handler: jsii.String("hello.handler"),
+	})
+	lib.NewHitCounter(stack, "MyTestConstruct", &lib.HitCounterProps{
+		Downstream:     testFn,
+		ReadCapacity:   10,
+		EventStream:    awskinesis.NewStream(stack, jsii.String("TestStream"), nil),
+		UseGoCollector: true,
+	})
+
+	// THEN
+	template := assertions.Template_FromStack(stack, nil)
+	template.ResourceCountIs(jsii.String("AWS::Lambda::Function"), jsii.Number(2))
+	template.HasResourceProperties(jsii.String("AWS::Lambda::Function"), &map[string]any{
+		"Runtime": "provided.al2",
+		"Environment": map[string]any{
+			"Variables": map[string]any{
+				"DOWNSTREAM_FUNCTION_NAME": map[string]any{"Ref": "TestFunction22AD90FC"},
+				"HITS_TABLE_NAME":          map[string]any{"Ref": "MyTestConstructHits24A357F0"},
+				"HITS_STREAM_NAME":         map[string]any{"Ref": "TestStreamE6F40222"},
+			},
+		},
+	})
+}
+
 func TestTableCreatedWithEncryption(t *testing.T) {
 	defer jsii.Close()
 
@@ -82,6 +139,7 @@ func TestTableCreatedWithEncryption(t *testing.T) {
 	lib.NewHitCounter(stack, "MyTestConstruct", &lib.HitCounterProps{
 		Downstream:   testFn,
 		ReadCapacity: 10,
+		EventStream:  awskinesis.NewStream(stack, jsii.String("TestStream"), nil),
 	})
 
 	// THEN
@@ -133,3 +191,777 @@ func TestCantPassStream(t *testing.T) {
 		EventStream:  nil,
 	})
 }
+
+func TestKdaSqlAppConstruct(t *testing.T) {
+	defer jsii.Close()
+
+	// GIVEN
+	stack := awscdk.NewStack(nil, nil, nil)
+	stream := awskinesis.NewStream(stack, jsii.String("TestStream"), nil)
+	testFn := awslambda.NewFunction(stack, jsii.String("TestFunction"), &awslambda.FunctionProps{
+		Code:    awslambda.Code_FromAsset(jsii.String("src/lambda/js-func/hello"), nil),
+		Runtime: awslambda.Runtime_NODEJS_16_X(),
+		Handler: jsii.String("hello.handler"),
+	})
+
+	// WHEN
+	lib.NewKdaSqlAppConstruct(stack, "MyTestConstruct", &lib.KdaSqlAppProps{
+		ApplicationName: "test-app",
+		SqlFile:         "src/kinesis-analytics-sql/filter-abnormality-event.sql",
+		InputStream:     stream,
+		Schema: &lib.KdaSqlSchema{Columns: []lib.KdaSqlColumn{
+			{Name: "eventId", SqlType: "VARCHAR(64)"},
+			{Name: "createdAt", SqlType: "VARCHAR(32)", Mapping: "$.createdTime"},
+		}},
+		Outputs: []lib.KdaSqlOutput{{Lambda: testFn}},
+	})
+
+	// THEN
+	template := assertions.Template_FromStack(stack, nil)
+	template.HasResourceProperties(jsii.String("AWS::KinesisAnalytics::Application"), &map[string]any{
+		"ApplicationName": "test-app",
+		"Inputs": []any{map[string]any{
+			"NamePrefix": "SOURCE_SQL_STREAM",
+			"InputSchema": assertions.Match_ObjectLike(&map[string]any{
+				"RecordColumns": []any{
+					map[string]any{"Name": "eventId", "SqlType": "VARCHAR(64)", "Mapping": "$.eventId"},
+					map[string]any{"Name": "createdAt", "SqlType": "VARCHAR(32)", "Mapping": "$.createdTime"},
+				},
+			}),
+		}},
+	})
+	template.HasResourceProperties(jsii.String("AWS::KinesisAnalytics::ApplicationOutput"), &map[string]any{
+		"Output": assertions.Match_ObjectLike(&map[string]any{
+			"Name": "DESTINATION_SQL_STREAM",
+			"LambdaOutput": assertions.Match_ObjectLike(&map[string]any{
+				"ResourceARN": map[string]any{"Fn::GetAtt": []any{"TestFunction22AD90FC", "Arn"}},
+			}),
+		}),
+	})
+}
+
+func TestKdaSqlAppConstructNeedsOutputTarget(t *testing.T) {
+	defer jsii.Close()
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Did not throw output error")
+		} else {
+			t.Logf("%+v\n", r)
+		}
+	}()
+
+	// GIVEN
+	stack := awscdk.NewStack(nil, nil, nil)
+
+	// THEN
+	lib.NewKdaSqlAppConstruct(stack, "MyTestConstruct", &lib.KdaSqlAppProps{
+		ApplicationName: "test-app",
+		SqlFile:         "src/kinesis-analytics-sql/filter-abnormality-event.sql",
+		InputStream:     awskinesis.NewStream(stack, jsii.String("TestStream"), nil),
+		Schema:          &lib.KdaSqlSchema{Columns: []lib.KdaSqlColumn{{Name: "eventId", SqlType: "VARCHAR(64)"}}},
+		Outputs:         []lib.KdaSqlOutput{{}},
+	})
+}
+
+func TestKdsFirehoseS3ConstructPartitionedParquet(t *testing.T) {
+	defer jsii.Close()
+
+	// GIVEN
+	stack := awscdk.NewStack(nil, nil, nil)
+
+	// WHEN
+	construct := lib.NewKdsFirehoseS3Construct(stack, "MyTestConstruct", &lib.KdsFirehoseS3Props{
+		StreamName:          "TestStream",
+		CompressionFormat:   "GZIP",
+		DynamicPartitioning: true,
+		RecordFormat:        "parquet",
+		Columns: []lib.GlueColumn{
+			{Name: "eventId", Type: "string"},
+			{Name: "bizId", Type: "string"},
+			{Name: "createdAt", Type: "string"},
+		},
+	})
+
+	// THEN
+	if diff := cmp.Diff([]string{"dt", "hour", "bizId"}, construct.PartitionKeys()); diff != "" {
+		t.Errorf("PartitionKeys() mismatch (-want +got):\n%s", diff)
+	}
+	template := assertions.Template_FromStack(stack, nil)
+	template.HasResourceProperties(jsii.String("AWS::KinesisFirehose::DeliveryStream"), &map[string]any{
+		"ExtendedS3DestinationConfiguration": assertions.Match_ObjectLike(&map[string]any{
+			"CompressionFormat":                "UNCOMPRESSED",
+			"Prefix":                           "parquet/dt=!{partitionKeyFromQuery:dt}/hour=!{partitionKeyFromQuery:hour}/bizId=!{partitionKeyFromQuery:bizId}/",
+			"ErrorOutputPrefix":                "errors/!{firehose:error-output-type}/!{timestamp:yyyy/MM/dd}/",
+			"DynamicPartitioningConfiguration": assertions.Match_ObjectLike(&map[string]any{"Enabled": true}),
+			"DataFormatConversionConfiguration": assertions.Match_ObjectLike(&map[string]any{
+				"OutputFormatConfiguration": map[string]any{
+					"Serializer": map[string]any{"ParquetSerDe": map[string]any{"Compression": "SNAPPY"}},
+				},
+			}),
+		}),
+	})
+	template.HasResourceProperties(jsii.String("AWS::Glue::Table"), &map[string]any{
+		"TableInput": assertions.Match_ObjectLike(&map[string]any{
+			"Name": "user_behavior_event",
+			"PartitionKeys": []any{
+				map[string]any{"Name": "dt", "Type": "string"},
+				map[string]any{"Name": "hour", "Type": "string"},
+				map[string]any{"Name": "bizid", "Type": "string"},
+			},
+			"StorageDescriptor": assertions.Match_ObjectLike(&map[string]any{
+				"Columns": []any{
+					map[string]any{"Name": "eventid", "Type": "string"},
+					map[string]any{"Name": "createdat", "Type": "string"},
+				},
+			}),
+		}),
+	})
+}
+
+func TestKdsFirehoseS3ConstructRawJson(t *testing.T) {
+	defer jsii.Close()
+
+	// GIVEN
+	stack := awscdk.NewStack(nil, nil, nil)
+
+	// WHEN
+	lib.NewKdsFirehoseS3Construct(stack, "MyTestConstruct", &lib.KdsFirehoseS3Props{
+		StreamName:        "TestStream",
+		CompressionFormat: "GZIP",
+	})
+
+	// THEN
+	template := assertions.Template_FromStack(stack, nil)
+	template.HasResourceProperties(jsii.String("AWS::KinesisFirehose::DeliveryStream"), &map[string]any{
+		"S3DestinationConfiguration": assertions.Match_ObjectLike(&map[string]any{
+			"CompressionFormat": "GZIP",
+			"Prefix":            "raw/",
+			"ErrorOutputPrefix": "errors/!{firehose:error-output-type}/!{timestamp:yyyy/MM/dd}/",
+		}),
+	})
+	template.ResourceCountIs(jsii.String("AWS::Glue::Table"), jsii.Number(0))
+}
+
+func TestGlueAthenaConstruct(t *testing.T) {
+	defer jsii.Close()
+
+	// GIVEN
+	stack := awscdk.NewStack(nil, nil, nil)
+	firehose := lib.NewKdsFirehoseS3Construct(stack, "Firehose", &lib.KdsFirehoseS3Props{
+		StreamName:          "TestStream",
+		CompressionFormat:   "GZIP",
+		DynamicPartitioning: true,
+	})
+
+	// WHEN
+	lib.NewGlueAthenaConstruct(stack, "MyTestConstruct", &lib.GlueAthenaProps{
+		Firehose:        firehose,
+		Columns:         []lib.GlueColumn{{Name: "eventId", Type: "string"}, {Name: "bizId", Type: "string"}},
+		PartitionValues: map[string][]string{"bizId": {"b1", "unknown"}},
+	})
+
+	// THEN
+	template := assertions.Template_FromStack(stack, nil)
+	template.HasResourceProperties(jsii.String("AWS::Glue::Table"), &map[string]any{
+		"TableInput": assertions.Match_ObjectLike(&map[string]any{
+			"Parameters": assertions.Match_ObjectLike(&map[string]any{
+				"projection.enabled":        "true",
+				"projection.dt.format":      "yyyy-MM-dd",
+				"projection.bizid.type":     "enum",
+				"projection.bizid.values":   "b1,unknown",
+				"storage.location.template": assertions.Match_AnyValue(),
+			}),
+			"StorageDescriptor": assertions.Match_ObjectLike(&map[string]any{
+				"Columns": []any{map[string]any{"Name": "eventid", "Type": "string"}},
+			}),
+		}),
+	})
+	template.HasResourceProperties(jsii.String("AWS::Athena::WorkGroup"), &map[string]any{
+		"Name": "user_behavior_analytics",
+	})
+	template.HasResourceProperties(jsii.String("AWS::Athena::NamedQuery"), &map[string]any{
+		"Name": "error-count-by-action",
+	})
+}
+
+func TestGlueAthenaConstructNeedsDelimitedRecords(t *testing.T) {
+	defer jsii.Close()
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Did not throw raw json error")
+		} else {
+			t.Logf("%+v\n", r)
+		}
+	}()
+
+	// GIVEN
+	stack := awscdk.NewStack(nil, nil, nil)
+	firehose := lib.NewKdsFirehoseS3Construct(stack, "Firehose", &lib.KdsFirehoseS3Props{StreamName: "TestStream", CompressionFormat: "GZIP"})
+
+	// THEN
+	lib.NewGlueAthenaConstruct(stack, "MyTestConstruct", &lib.GlueAthenaProps{
+		Firehose: firehose,
+		Columns:  []lib.GlueColumn{{Name: "eventId", Type: "string"}},
+	})
+}
+
+func TestKdsFirehoseS3ConstructEncryption(t *testing.T) {
+	defer jsii.Close()
+
+	// GIVEN
+	stack := awscdk.NewStack(nil, nil, nil)
+
+	// WHEN
+	construct := lib.NewKdsFirehoseS3Construct(stack, "MyTestConstruct", &lib.KdsFirehoseS3Props{
+		StreamName:        "TestStream",
+		CompressionFormat: "GZIP",
+		Encrypt:           true,
+	})
+
+	// THEN
+	if construct.EncryptionKey() == nil {
+		t.Fatal("EncryptionKey() is nil")
+	}
+	keyArn := stack.Resolve(construct.EncryptionKey().KeyArn())
+	template := assertions.Template_FromStack(stack, nil)
+	template.HasResourceProperties(jsii.String("AWS::KMS::Key"), &map[string]any{
+		"EnableKeyRotation": true,
+	})
+	template.HasResourceProperties(jsii.String("AWS::Kinesis::Stream"), &map[string]any{
+		"StreamEncryption": map[string]any{"EncryptionType": "KMS", "KeyId": keyArn},
+	})
+	template.HasResourceProperties(jsii.String("AWS::S3::Bucket"), &map[string]any{
+		"BucketEncryption": map[string]any{"ServerSideEncryptionConfiguration": []any{map[string]any{
+			"BucketKeyEnabled":              true,
+			"ServerSideEncryptionByDefault": map[string]any{"KMSMasterKeyID": keyArn, "SSEAlgorithm": "aws:kms"},
+		}}},
+	})
+	template.HasResourceProperties(jsii.String("AWS::KinesisFirehose::DeliveryStream"), &map[string]any{
+		"S3DestinationConfiguration": assertions.Match_ObjectLike(&map[string]any{
+			"EncryptionConfiguration": map[string]any{"KMSEncryptionConfig": map[string]any{"AWSKMSKeyARN": keyArn}},
+		}),
+	})
+}
+
+func TestStageProfileProd(t *testing.T) {
+	defer jsii.Close()
+
+	// GIVEN
+	app := awscdk.NewApp(&awscdk.AppProps{Context: &map[string]any{"stage": "prod"}})
+	stack := awscdk.NewStack(app, jsii.String("TestStack"), nil)
+	profile := lib.StageProfileOf(stack)
+
+	// WHEN
+	lib.NewKdsFirehoseS3Construct(stack, "MyTestConstruct", &lib.KdsFirehoseS3Props{
+		StreamName:        "TestStream",
+		CompressionFormat: "GZIP",
+		Profile:           profile,
+	})
+	profile.NewTable(stack, "TestTable", &awsdynamodb.TableProps{
+		PartitionKey: &awsdynamodb.Attribute{Name: jsii.String("id"), Type: awsdynamodb.AttributeType_STRING},
+	})
+
+	// THEN
+	template := assertions.Template_FromStack(stack, nil)
+	template.HasResource(jsii.String("AWS::S3::Bucket"), &map[string]any{
+		"DeletionPolicy": "Retain",
+		"Properties": assertions.Match_ObjectLike(&map[string]any{
+			"VersioningConfiguration": map[string]any{"Status": "Enabled"},
+			"LifecycleConfiguration": map[string]any{"Rules": []any{assertions.Match_ObjectLike(&map[string]any{
+				"Id": "prod-archive",
+				"Transitions": []any{
+					map[string]any{"StorageClass": "STANDARD_IA", "TransitionInDays": 30},
+					map[string]any{"StorageClass": "GLACIER_IR", "TransitionInDays": 90},
+				},
+			})}},
+		}),
+	})
+	template.HasResource(jsii.String("AWS::DynamoDB::Table"), &map[string]any{
+		"DeletionPolicy": "Retain",
+		"Properties": assertions.Match_ObjectLike(&map[string]any{
+			"PointInTimeRecoverySpecification": map[string]any{"PointInTimeRecoveryEnabled": true},
+			"DeletionProtectionEnabled":        true,
+		}),
+	})
+	template.ResourceCountIs(jsii.String("Custom::S3AutoDeleteObjects"), jsii.Number(0))
+}
+
+func TestStageProfileDev(t *testing.T) {
+	defer jsii.Close()
+
+	// GIVEN
+	stack := awscdk.NewStack(nil, nil, nil)
+
+	// WHEN
+	lib.NewKdsFirehoseS3Construct(stack, "MyTestConstruct", &lib.KdsFirehoseS3Props{StreamName: "TestStream", CompressionFormat: "GZIP"})
+
+	// THEN
+	template := assertions.Template_FromStack(stack, nil)
+	template.HasResource(jsii.String("AWS::S3::Bucket"), &map[string]any{
+		"DeletionPolicy": "Delete",
+		"Properties": assertions.Match_ObjectLike(&map[string]any{
+			"LifecycleConfiguration": map[string]any{"Rules": []any{assertions.Match_ObjectLike(&map[string]any{
+				"Id":               "dev-archive",
+				"ExpirationInDays": 30,
+			})}},
+		}),
+	})
+	template.ResourceCountIs(jsii.String("Custom::S3AutoDeleteObjects"), jsii.Number(1))
+}
+
+func TestStageProfileUnknownStage(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Did not throw stage error")
+		}
+	}()
+	lib.NewStageProfile("qa")
+}
+
+func TestRdsMysqlStack(t *testing.T) {
+	defer jsii.Close()
+
+	// GIVEN
+	app := awscdk.NewApp(nil)
+
+	// WHEN
+	stack := infra.NewRdsMysqlStack(app, "TestStack", &infra.RdsMysqlStackProps{})
+
+	// THEN
+	if stack.DatabaseName() != "user_behavior" {
+		t.Errorf("DatabaseName() = %s", stack.DatabaseName())
+	}
+	// the jsii proxy of the stack, not the go struct embedding it
+	template := assertions.Template_FromStack(awscdk.Stack_Of(stack.Instance()), nil)
+	template.HasResourceProperties(jsii.String("AWS::RDS::DBParameterGroup"), &map[string]any{
+		"Parameters": map[string]any{"binlog_format": "ROW", "binlog_row_image": "FULL", "binlog_checksum": "NONE"},
+	})
+	template.HasResourceProperties(jsii.String("AWS::RDS::DBInstance"), &map[string]any{
+		"Engine":                "mysql",
+		"DBName":                "user_behavior",
+		"BackupRetentionPeriod": 1,
+		"StorageEncrypted":      true,
+		"PubliclyAccessible":    false,
+	})
+	template.HasResourceProperties(jsii.String("AWS::SecretsManager::Secret"), &map[string]any{
+		"Name": "UserBehaviorMysqlSecret",
+	})
+	template.HasResourceProperties(jsii.String("AWS::EC2::SecurityGroup"), &map[string]any{
+		"SecurityGroupIngress": []any{assertions.Match_ObjectLike(&map[string]any{"FromPort": 3306, "ToPort": 3306})},
+	})
+}
+
+func TestRdsMysqlStackVpcLookup(t *testing.T) {
+	defer jsii.Close()
+
+	// GIVEN
+	app := awscdk.NewApp(nil)
+	env := &awscdk.Environment{Account: jsii.String("123456789012"), Region: jsii.String("ap-northeast-1")}
+
+	// WHEN
+	source := infra.NewRdsMysqlStack(app, "SourceStack", &infra.RdsMysqlStackProps{
+		StackProps: awscdk.StackProps{Env: env},
+		VpcId:      "vpc-12345",
+	})
+	stack := infra.NewDmsKdsStack(app, "TestStack", &infra.DmsKdsStackProps{
+		StackProps: awscdk.StackProps{Env: env},
+		Source:     source,
+	})
+
+	// THEN the looked up vpc isn't created, the dms stack of the same env references it
+	template := assertions.Template_FromStack(awscdk.Stack_Of(source.Instance()), nil)
+	template.ResourceCountIs(jsii.String("AWS::EC2::VPC"), jsii.Number(0))
+	template.ResourceCountIs(jsii.String("AWS::RDS::DBInstance"), jsii.Number(1))
+	assertions.Template_FromStack(awscdk.Stack_Of(stack.ReplicationInstance()), nil).ResourceCountIs(jsii.String("AWS::DMS::ReplicationInstance"), jsii.Number(1))
+}
+
+func TestRdsMysqlStackVpcLookupNeedsEnv(t *testing.T) {
+	defer jsii.Close()
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Did not throw VpcId env error")
+		} else {
+			t.Logf("%+v\n", r)
+		}
+	}()
+
+	// GIVEN
+	app := awscdk.NewApp(nil)
+
+	// THEN
+	infra.NewRdsMysqlStack(app, "TestStack", &infra.RdsMysqlStackProps{VpcId: "vpc-12345"})
+}
+
+func TestDmsKdsStack(t *testing.T) {
+	defer jsii.Close()
+
+	// GIVEN
+	app := awscdk.NewApp(nil)
+	source := infra.NewRdsMysqlStack(app, "SourceStack", &infra.RdsMysqlStackProps{})
+
+	// WHEN
+	stack := infra.NewDmsKdsStack(app, "TestStack", &infra.DmsKdsStackProps{
+		Source: source,
+		TableRules: []lib.DmsTableRule{
+			{Schema: "user_behavior", Table: "%"},
+			{Schema: "user_behavior", Table: "tmp_%", Exclude: true},
+		},
+	})
+
+	// THEN
+	template := assertions.Template_FromStack(awscdk.Stack_Of(stack.ReplicationTask()), nil)
+	template.ResourceCountIs(jsii.String("AWS::Kinesis::Stream"), jsii.Number(1))
+	template.ResourceCountIs(jsii.String("AWS::EC2::VPCEndpoint"), jsii.Number(2))
+	template.HasResourceProperties(jsii.String("AWS::DMS::ReplicationInstance"), &map[string]any{
+		"ReplicationInstanceClass": "dms.t3.micro",
+		"PubliclyAccessible":       false,
+	})
+	template.HasResourceProperties(jsii.String("AWS::DMS::Endpoint"), &map[string]any{
+		"EndpointType": "source",
+		"EngineName":   "mysql",
+		"MySqlSettings": map[string]any{
+			"SecretsManagerSecretId":      assertions.Match_AnyValue(),
+			"SecretsManagerAccessRoleArn": assertions.Match_AnyValue(),
+		},
+	})
+	template.HasResourceProperties(jsii.String("AWS::DMS::Endpoint"), &map[string]any{
+		"EndpointType": "target",
+		"EngineName":   "kinesis",
+		"KinesisSettings": assertions.Match_ObjectLike(&map[string]any{
+			"MessageFormat":               "json-unformatted",
+			"IncludeTransactionDetails":   true,
+			"PartitionIncludeSchemaTable": true,
+		}),
+	})
+	template.HasResourceProperties(jsii.String("AWS::DMS::ReplicationTask"), &map[string]any{
+		"MigrationType": "full-load-and-cdc",
+		"TableMappings": `{"rules":[` +
+			`{"rule-type":"selection","rule-id":"1","rule-name":"1","object-locator":{"schema-name":"user_behavior","table-name":"%"},"rule-action":"include"},` +
+			`{"rule-type":"selection","rule-id":"2","rule-name":"2","object-locator":{"schema-name":"user_behavior","table-name":"tmp_%"},"rule-action":"exclude"}]}`,
+	})
+}
+
+func TestFlinkCdcOpenSearchStack(t *testing.T) {
+	defer jsii.Close()
+
+	// GIVEN
+	app := awscdk.NewApp(nil)
+	source := infra.NewRdsMysqlStack(app, "SourceStack", &infra.RdsMysqlStackProps{})
+	eventStack := awscdk.NewStack(app, jsii.String("EventStack"), nil)
+	eventStream := awskinesis.NewStream(eventStack, jsii.String("EventStream"), nil)
+
+	// WHEN
+	stack := infra.NewFlinkCdcOpenSearchStack(app, "TestStack", &infra.FlinkCdcOpenSearchStackProps{
+		Source:         source,
+		EventStream:    eventStream,
+		CodePath:       "src/kinesis-analytics-pyflink",
+		SearchRoleArns: []string{"arn:aws:iam::123456789012:role/support"},
+	})
+
+	// THEN
+	template := assertions.Template_FromStack(awscdk.Stack_Of(stack.Domain()), nil)
+	template.HasResourceProperties(jsii.String("AWS::OpenSearchService::Domain"), &map[string]any{
+		"AdvancedSecurityOptions": map[string]any{
+			"Enabled":                     true,
+			"InternalUserDatabaseEnabled": false,
+			"MasterUserOptions":           map[string]any{"MasterUserARN": assertions.Match_AnyValue()},
+		},
+		"EncryptionAtRestOptions":     map[string]any{"Enabled": true},
+		"NodeToNodeEncryptionOptions": map[string]any{"Enabled": true},
+		"VPCOptions":                  assertions.Match_AnyValue(),
+	})
+	template.HasResourceProperties(jsii.String("AWS::KinesisAnalyticsV2::Application"), &map[string]any{
+		"RuntimeEnvironment": "FLINK-1_15",
+		"ApplicationConfiguration": assertions.Match_ObjectLike(&map[string]any{
+			"EnvironmentProperties": map[string]any{
+				"PropertyGroups": []any{
+					assertions.Match_ObjectLike(&map[string]any{"PropertyGroupId": "EventSource"}),
+					map[string]any{
+						"PropertyGroupId": "MySqlCdcSource",
+						"PropertyMap": assertions.Match_ObjectLike(&map[string]any{
+							"database.name": "user_behavior",
+							"table.list":    "user_behavior.*",
+						}),
+					},
+					map[string]any{
+						"PropertyGroupId": "OpenSearchSink",
+						"PropertyMap": assertions.Match_ObjectLike(&map[string]any{
+							"event.index":      "user-behavior-event",
+							"cdc.index.prefix": "cdc-",
+						}),
+					},
+				},
+			},
+			"VpcConfigurations": assertions.Match_AnyValue(),
+		}),
+	})
+	template.ResourceCountIs(jsii.String("AWS::KinesisAnalyticsV2::ApplicationCloudWatchLoggingOption"), jsii.Number(1))
+	template.HasResourceProperties(jsii.String("AWS::CloudFormation::CustomResource"), &map[string]any{
+		"IndexTemplates": map[string]any{"user-behavior-event": assertions.Match_AnyValue(), "cdc": assertions.Match_AnyValue()},
+		"Roles":          map[string]any{"user_behavior_writer": assertions.Match_AnyValue(), "user_behavior_reader": assertions.Match_AnyValue()},
+		"RolesMapping": map[string]any{
+			"user_behavior_writer": assertions.Match_AnyValue(),
+			"user_behavior_reader": `{"backend_roles":["arn:aws:iam::123456789012:role/support"]}`,
+		},
+	})
+}
+
+func TestSageMakerStack(t *testing.T) {
+	defer jsii.Close()
+
+	// GIVEN
+	app := awscdk.NewApp(nil)
+	rawStack := awscdk.NewStack(app, jsii.String("RawStack"), nil)
+	rawBucket := awss3.NewBucket(rawStack, jsii.String("RawBucket"), nil)
+
+	// WHEN
+	stack := infra.NewSageMakerStack(app, "TestStack", &infra.SageMakerStackProps{
+		RawBucket:               rawBucket,
+		EndpointModelPackageArn: "arn:aws:sagemaker:us-east-1:123456789012:model-package/user-behavior-anomaly/1",
+	})
+
+	// THEN
+	template := assertions.Template_FromStack(awscdk.Stack_Of(stack.Domain()), nil)
+	template.HasResourceProperties(jsii.String("AWS::SageMaker::Domain"), &map[string]any{
+		"AuthMode":            "IAM",
+		"DefaultUserSettings": assertions.Match_ObjectLike(&map[string]any{"ExecutionRole": assertions.Match_AnyValue()}),
+	})
+	template.ResourceCountIs(jsii.String("AWS::SageMaker::UserProfile"), jsii.Number(1))
+	template.HasResourceProperties(jsii.String("AWS::SageMaker::ModelPackageGroup"), &map[string]any{
+		"ModelPackageGroupName": infra.AnomalyModelPackageGroupName,
+	})
+	template.HasResourceProperties(jsii.String("AWS::SageMaker::Pipeline"), &map[string]any{
+		"PipelineName":       infra.AnomalyPipelineName,
+		"PipelineDefinition": map[string]any{"PipelineDefinitionBody": assertions.Match_AnyValue()},
+	})
+	template.HasResourceProperties(jsii.String("AWS::SageMaker::Model"), &map[string]any{
+		"Containers": []any{map[string]any{"ModelPackageName": "arn:aws:sagemaker:us-east-1:123456789012:model-package/user-behavior-anomaly/1"}},
+	})
+	template.HasResourceProperties(jsii.String("AWS::SageMaker::Endpoint"), &map[string]any{
+		"EndpointName": infra.AnomalyEndpointName,
+	})
+	template.HasOutput(jsii.String("AnomalyEndpointName"), &map[string]any{})
+}
+
+func TestPyFlinkAppConstruct(t *testing.T) {
+	defer jsii.Close()
+
+	// GIVEN
+	stack := awscdk.NewStack(nil, nil, nil)
+	codePath := pyflinkCodePath(t, "lib/flink-sql-connector-kinesis_2.12-1.13.2.jar")
+
+	// WHEN
+	lib.NewPyFlinkAppConstruct(stack, "MyTestConstruct", &lib.PyFlinkAppProps{
+		ApplicationName:    "test-app",
+		CodePath:           codePath,
+		JarFile:            "lib/flink-sql-connector-kinesis_2.12-1.13.2.jar",
+		InputStream:        awskinesis.NewStream(stack, jsii.String("TestStream"), nil),
+		InitialPosition:    "TRIM_HORIZON",
+		OutputBucket:       awss3.NewBucket(stack, jsii.String("TestBucket"), nil),
+		PropertyGroups:     map[string]map[string]string{"sink.config.0": {"output.format": "csv"}},
+		Parallelism:        2,
+		CheckpointInterval: awscdk.Duration_Seconds(jsii.Number(30)),
+	})
+
+	// THEN
+	template := assertions.Template_FromStack(stack, nil)
+	template.HasResourceProperties(jsii.String("AWS::KinesisAnalyticsV2::Application"), &map[string]any{
+		"ApplicationName":    "test-app",
+		"RuntimeEnvironment": "FLINK-1_13",
+		"ApplicationConfiguration": assertions.Match_ObjectLike(&map[string]any{
+			"ApplicationCodeConfiguration": assertions.Match_ObjectLike(&map[string]any{"CodeContentType": "ZIPFILE"}),
+			"EnvironmentProperties": map[string]any{
+				"PropertyGroups": []any{
+					map[string]any{
+						"PropertyGroupId": "consumer.config.0",
+						"PropertyMap": assertions.Match_ObjectLike(&map[string]any{
+							"input.stream.name":    assertions.Match_AnyValue(),
+							"flink.stream.initpos": "TRIM_HORIZON",
+						}),
+					},
+					map[string]any{
+						"PropertyGroupId": "kinesis.analytics.flink.run.options",
+						"PropertyMap": map[string]any{
+							"python":  "kda-pyflink-demo.py",
+							"jarfile": "lib/flink-sql-connector-kinesis_2.12-1.13.2.jar",
+						},
+					},
+					map[string]any{
+						"PropertyGroupId": "sink.config.0",
+						"PropertyMap":     map[string]any{"output.bucket.name": assertions.Match_AnyValue(), "output.format": "csv"},
+					},
+				},
+			},
+			"FlinkApplicationConfiguration": assertions.Match_ObjectLike(&map[string]any{
+				"CheckpointConfiguration":  map[string]any{"ConfigurationType": "CUSTOM", "CheckpointingEnabled": true, "CheckpointInterval": 30000},
+				"ParallelismConfiguration": assertions.Match_ObjectLike(&map[string]any{"Parallelism": 2}),
+			}),
+		}),
+	})
+	template.ResourceCountIs(jsii.String("AWS::KinesisAnalyticsV2::ApplicationCloudWatchLoggingOption"), jsii.Number(1))
+}
+
+// pyflinkCodePath is a copy of the pyflink script dir with the empty jars, the connector jar isn't in git
+func pyflinkCodePath(t *testing.T, jarFiles ...string) string {
+	dir := t.TempDir()
+	script, err := os.ReadFile("src/kinesis-analytics-pyflink/kda-pyflink-demo.py")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "kda-pyflink-demo.py"), script, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, jarFile := range jarFiles {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, jarFile)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, jarFile), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestPyFlinkAppConstructNeedsJarFile(t *testing.T) {
+	defer jsii.Close()
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "flink-sql-connector-kinesis") {
+			t.Errorf("got %v, want the missing jar error", r)
+		}
+	}()
+
+	// GIVEN
+	stack := awscdk.NewStack(nil, nil, nil)
+	codePath := pyflinkCodePath(t)
+
+	// THEN
+	lib.NewPyFlinkAppConstruct(stack, "MyTestConstruct", &lib.PyFlinkAppProps{
+		ApplicationName: "test-app",
+		CodePath:        codePath,
+		JarFile:         "lib/flink-sql-connector-kinesis_2.12-1.13.2.jar",
+		InputStream:     awskinesis.NewStream(stack, jsii.String("TestStream"), nil),
+		OutputBucket:    awss3.NewBucket(stack, jsii.String("TestBucket"), nil),
+	})
+}
+
+func TestPyFlinkAppConstructNeedsOutputBucket(t *testing.T) {
+	defer jsii.Close()
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Did not throw output bucket error")
+		} else {
+			t.Logf("%+v\n", r)
+		}
+	}()
+
+	// GIVEN
+	stack := awscdk.NewStack(nil, nil, nil)
+
+	// THEN
+	lib.NewPyFlinkAppConstruct(stack, "MyTestConstruct", &lib.PyFlinkAppProps{
+		ApplicationName: "test-app",
+		CodePath:        "src/kinesis-analytics-pyflink",
+		InputStream:     awskinesis.NewStream(stack, jsii.String("TestStream"), nil),
+	})
+}
+
+func TestCantPassAlertSuppressWindowOfSeconds(t *testing.T) {
+	defer jsii.Close()
+	for _, window := range []awscdk.Duration{awscdk.Duration_Seconds(jsii.Number(30)), awscdk.Duration_Seconds(jsii.Number(90))} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "AlertSuppressWindow") {
+					t.Errorf("%s window got %v, want the AlertSuppressWindow error", *window.ToHumanString(), r)
+				}
+			}()
+
+			// GIVEN
+			app := awscdk.NewApp(nil)
+
+			// THEN
+			infra.NewKdsSqlKdaLambdaDynamoDBStack(app, "TestStack", &infra.KdsSqlKdaLambdaDynamoDBStackProps{
+				StreamName:          "TestStream",
+				AlertSuppressWindow: window,
+			})
+		}()
+	}
+}
+
+func TestKdsSqlKdaDigestFunctionPagesPanics(t *testing.T) {
+	defer jsii.Close()
+
+	// GIVEN
+	app := awscdk.NewApp(&awscdk.AppProps{Context: &map[string]interface{}{"snsSendEmail": "alert@example.com"}})
+
+	// WHEN
+	stack := infra.NewKdsSqlKdaLambdaDynamoDBStack(app, "TestStack", &infra.KdsSqlKdaLambdaDynamoDBStackProps{
+		StreamName:          "TestStream",
+		AlertSuppressWindow: awscdk.Duration_Minutes(jsii.Number(5)),
+		AlertGroupKeys:      []string{"action", "bizId", "severity"},
+	})
+
+	// THEN
+	template := assertions.Template_FromStack(stack, nil)
+	functions := template.FindResources(jsii.String("AWS::Lambda::Function"), &map[string]any{
+		"Properties": map[string]any{"FunctionName": "UserBehaviorAnalytics-SendAlertDigestFunc"},
+	})
+	if len(*functions) != 1 {
+		t.Fatalf("found %d digest functions, want 1", len(*functions))
+	}
+	var digestRole any
+	for _, function := range *functions {
+		props := (*function)["Properties"].(map[string]any)
+		env := props["Environment"].(map[string]any)["Variables"].(map[string]any)
+		if env["HANDLER"] != "digest" || env["HIGH_PRIORITY_TOPIC_ARN"] == nil || env["TOPIC_ARN"] == nil {
+			t.Errorf("digest function env %v, want HANDLER digest with TOPIC_ARN and HIGH_PRIORITY_TOPIC_ARN", env)
+		}
+		digestRole = props["Role"].(map[string]any)["Fn::GetAtt"].([]any)[0]
+	}
+
+	// the digest role publishes to both topics
+	for topicId := range *template.FindResources(jsii.String("AWS::SNS::Topic"), nil) {
+		template.HasResourceProperties(jsii.String("AWS::IAM::Policy"), &map[string]any{
+			"PolicyDocument": map[string]any{
+				"Statement": assertions.Match_ArrayWith(&[]any{map[string]any{
+					"Action":   "sns:Publish",
+					"Effect":   "Allow",
+					"Resource": map[string]any{"Ref": topicId},
+				}}),
+			},
+			"Roles": []any{map[string]any{"Ref": digestRole}},
+		})
+	}
+}
+
+func TestKdsSqlKdaAnomalyScoreThreshold(t *testing.T) {
+	defer jsii.Close()
+
+	// GIVEN
+	app := awscdk.NewApp(&awscdk.AppProps{Context: &map[string]interface{}{"snsSendEmail": "alert@example.com"}})
+
+	// WHEN
+	stack := infra.NewKdsSqlKdaLambdaDynamoDBStack(app, "TestStack", &infra.KdsSqlKdaLambdaDynamoDBStackProps{
+		StreamName:            "TestStream",
+		AnomalyEndpointName:   infra.AnomalyEndpointName,
+		AnomalyScoreThreshold: 2.5,
+	})
+
+	// THEN
+	template := assertions.Template_FromStack(stack, nil)
+	template.HasResourceProperties(jsii.String("AWS::Lambda::Function"), &map[string]any{
+		"FunctionName": "UserBehaviorAnalytics-SaveAlertFunc",
+		"Environment": map[string]any{
+			"Variables": assertions.Match_ObjectLike(&map[string]any{
+				"ANOMALY_ENDPOINT_NAME":   infra.AnomalyEndpointName,
+				"ANOMALY_SCORE_THRESHOLD": "2.5",
+			}),
+		},
+	})
+	template.HasResourceProperties(jsii.String("AWS::IAM::Policy"), &map[string]any{
+		"PolicyDocument": map[string]any{
+			"Statement": assertions.Match_ArrayWith(&[]any{assertions.Match_ObjectLike(&map[string]any{
+				"Action": "sagemaker:InvokeEndpoint",
+			})}),
+		},
+	})
+}